@@ -0,0 +1,177 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---------------------- Admin Server ----------------------
+// Start binds -admin along with the listeners and closes it once the LB has
+// drained. The endpoints:
+//
+//	GET  /live              200 while the process can serve HTTP at all
+//	                        (restart me if this fails)
+//	GET  /ready             200 only while at least one backend is healthy
+//	                        (stop sending me traffic if this fails)
+//	GET  /stats             the `list` command as JSON
+//	GET  /ring?key=K        the `ring` dump
+//	GET  /metrics           the Prometheus exposition
+//	POST /backends/{addr}/disable, POST /backends/{addr}/enable
+//	                        the CLI commands of that name
+//	PUT  /groups/{name}/strategy
+//	                        switch a group's strategy (body: strategy name)
+//	GET  /drr/quantum       drr's quantum, as the quantum command shows it
+//	PUT  /drr/quantum       set it (body: a number)
+//
+// The routes that change state are as powerful as the console, so -admin
+// binds loopback by default. Exposing it (-admin :9091, e.g. for kubelet
+// probes) should come with -admin-token, which every request other than a
+// GET or HEAD must then carry as a bearer token; the probes, /stats and
+// /metrics stay open.
+
+// adminReadHeaderTimeout bounds how long a client may take to send its
+// request headers, so idle connections can't pile up on the admin port.
+const adminReadHeaderTimeout = 5 * time.Second
+
+// serveAdmin serves the admin endpoints on l until admin is closed.
+func (lb *LB) serveAdmin(admin *http.Server, l net.Listener) {
+	log.Printf("admin listening on %s ...", l.Addr())
+	if a, ok := l.Addr().(*net.TCPAddr); ok && !a.IP.IsLoopback() && lb.cfg.AdminToken == "" {
+		log.Printf("warning: admin on %s without -admin-token; anyone who can reach it can disable backends", l.Addr())
+	}
+	if err := admin.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("admin server stopped: %s", err)
+	}
+}
+
+// adminServer builds the admin HTTP server.
+func (lb *LB) adminServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/live", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		if lb.healthyCount() == 0 {
+			http.Error(w, "no healthy backends", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ready\n"))
+	})
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(lb.stats())
+	})
+	mux.HandleFunc("GET /metrics", lb.serveMetrics)
+	mux.HandleFunc("GET /ring", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		var buf bytes.Buffer
+		if err := lb.writeRing(&buf, r.URL.Query().Get("key")); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		_, _ = buf.WriteTo(w)
+	})
+	mux.HandleFunc("POST /backends/{addr}/{action}", func(w http.ResponseWriter, r *http.Request) {
+		action := r.PathValue("action")
+		if action != "disable" && action != "enable" {
+			http.NotFound(w, r)
+			return
+		}
+		b, err := ParseBackendAddr(r.PathValue("addr"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = lb.Request(Event{EventName: CMD_BackendAdmin, Data: AdminState{Addr: b.String(), Disabled: action == "disable"}})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("PUT /groups/{name}/strategy", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 256))
+		name := strings.TrimSpace(string(body))
+		if err != nil || name == "" {
+			http.Error(w, "body must be a strategy name", http.StatusBadRequest)
+			return
+		}
+		if _, err := canonicalStrategy(name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = lb.Request(Event{EventName: CMD_GroupStrategy, Data: GroupStrategy{Group: r.PathValue("name"), Strategy: name}})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /drr/quantum", func(w http.ResponseWriter, r *http.Request) {
+		lb.mu.Lock()
+		q := lb.drrQuantum
+		lb.mu.Unlock()
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "%d\n", q)
+	})
+	mux.HandleFunc("PUT /drr/quantum", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 64))
+		q, perr := strconv.Atoi(strings.TrimSpace(string(body)))
+		if err != nil || perr != nil {
+			http.Error(w, "body must be a number", http.StatusBadRequest)
+			return
+		}
+		if err := lb.Request(Event{EventName: CMD_DRRQuantum, Data: q}); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return &http.Server{Handler: lb.requireAdminToken(mux), ReadHeaderTimeout: adminReadHeaderTimeout}
+}
+
+// requireAdminToken lets GET and HEAD requests through to next and, when
+// -admin-token is set, only those of the rest that carry it.
+func (lb *LB) requireAdminToken(next http.Handler) http.Handler {
+	token := lb.cfg.AdminToken
+	if token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "admin token required", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// healthyCount reports how many backends, in the main pool or a group, are
+// currently eligible for traffic.
+func (lb *LB) healthyCount() int {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	n := 0
+	for _, b := range lb.allBackendsLocked() {
+		if b.Available() {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,85 @@
+package loadbalancer
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadyCountsGroupBackends(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Mode = ModeHTTP
+	cfg.Groups = []GroupConfig{{
+		Name:     "api",
+		Prefix:   "/api",
+		Backends: []BackendConfig{{Host: "127.0.0.1", Port: 8081, Weight: 1}},
+	}}
+	lb := newTestLB(t, cfg)
+	admin := lb.adminServer().Handler
+
+	ready := func() int {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		return rec.Code
+	}
+	if code := ready(); code != http.StatusOK {
+		t.Fatalf("/ready with a healthy group backend: %d, want 200", code)
+	}
+	lb.mu.Lock()
+	lb.groups[0].backends[0].IsHealthy = false
+	lb.mu.Unlock()
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Fatalf("/ready with no healthy backend: %d, want 503", code)
+	}
+}
+
+func TestAdminRejectsBadPort(t *testing.T) {
+	lb := newTestLB(t, testConfig(t))
+	admin := lb.adminServer().Handler
+	for _, addr := range []string{"app:0", "app:65536", "app:-1"} {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/backends/"+addr+"/disable", nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("disable %s: %d, want 400", addr, rec.Code)
+		}
+	}
+}
+
+func TestAdminTokenGuardsChanges(t *testing.T) {
+	cfg := testConfig(t, BackendConfig{Host: "10.0.0.1", Port: 80, Weight: 1})
+	cfg.AdminToken = "s3cret"
+	lb := newTestLB(t, cfg)
+	startLB(t, lb)
+	srv := lb.adminServer()
+	if srv.ReadHeaderTimeout <= 0 {
+		t.Fatal("admin server without a ReadHeaderTimeout")
+	}
+	do := func(method, path, auth string) int {
+		req := httptest.NewRequest(method, path, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	for _, auth := range []string{"", "Bearer wrong", "s3cret"} {
+		if code := do(http.MethodPost, "/backends/10.0.0.1:80/disable", auth); code != http.StatusUnauthorized {
+			t.Errorf("disable with Authorization %q: %d, want 401", auth, code)
+		}
+	}
+	if code := do(http.MethodGet, "/ready", ""); code != http.StatusOK {
+		t.Errorf("/ready without a token: %d, want 200", code)
+	}
+	if code := do(http.MethodPost, "/backends/10.0.0.1:80/disable", "Bearer s3cret"); code != http.StatusNoContent {
+		t.Errorf("disable with the token: %d, want 204", code)
+	}
+}
+
+func TestAdminDefaultsToLoopback(t *testing.T) {
+	host, _, err := net.SplitHostPort(DefaultConfig().AdminAddr)
+	if err != nil || !net.ParseIP(host).IsLoopback() {
+		t.Fatalf("default admin address %q is not loopback", DefaultConfig().AdminAddr)
+	}
+}
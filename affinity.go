@@ -0,0 +1,165 @@
+package loadbalancer
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// ---------------------- Session Affinity ----------------------
+// a key that was routed once keeps going to the same backend until its entry
+// expires (idle for longer than AffinityTTL) or the backend turns unhealthy or
+// is removed; then the strategy picks again and the entry is refreshed. The
+// table sits in front of the strategy, so pins survive strategy changes and
+// pool changes that would move the key. With AffinityMaxEntries the least
+// recently used entry is evicted to make room for a new key. The `sessions`
+// command lists the table and flushes it.
+
+type session struct {
+	key      string
+	backend  *Backend
+	lastSeen time.Time
+	elem     *list.Element // in lb.sessionLRU
+}
+
+// sessionListLimit caps how many entries the sessions command prints.
+const sessionListLimit = 50
+
+// pickBackend is the single entry point for data-plane selection; failures
+// are counted per reason. Callers must hold lb.mu.
+func (lb *LB) pickBackend(req IncomingReq) (*Backend, error) {
+	b, err := lb.pickAffine(req)
+	if err != nil {
+		lb.selectErrors[err.Error()]++
+	}
+	return b, err
+}
+
+func (lb *LB) pickAffine(req IncomingReq) (*Backend, error) {
+	if !lb.cfg.Affinity {
+		return lb.selectBackend(req)
+	}
+	now := lb.clock.Now()
+	s, ok := lb.sessions[req.key]
+	if ok && !lb.sessionExpired(s, now) && s.backend.Available() {
+		s.lastSeen = now
+		lb.sessionLRU.MoveToFront(s.elem)
+		return s.backend, nil
+	}
+	if ok {
+		lb.deleteSessionLocked(s)
+	}
+	b, err := lb.selectBackend(req)
+	if err == nil {
+		s = &session{key: req.key, backend: b, lastSeen: now}
+		s.elem = lb.sessionLRU.PushFront(s)
+		lb.sessions[req.key] = s
+		if limit := lb.cfg.AffinityMaxEntries; limit > 0 && len(lb.sessions) > limit {
+			lb.deleteSessionLocked(lb.sessionLRU.Back().Value.(*session))
+			lb.sessionEvictions.Add(1)
+		}
+	}
+	return b, err
+}
+
+// deleteSessionLocked removes s from the table. Callers must hold lb.mu.
+func (lb *LB) deleteSessionLocked(s *session) {
+	delete(lb.sessions, s.key)
+	lb.sessionLRU.Remove(s.elem)
+}
+
+func (lb *LB) sessionExpired(s *session, now time.Time) bool {
+	return lb.cfg.AffinityTTL > 0 && now.Sub(s.lastSeen) > lb.cfg.AffinityTTL
+}
+
+// dropSessionsLocked forgets every session pinned to b. Callers must hold lb.mu.
+func (lb *LB) dropSessionsLocked(b *Backend) {
+	for _, s := range lb.sessions {
+		if s.backend == b {
+			lb.deleteSessionLocked(s)
+		}
+	}
+}
+
+// flushSessions drops the entry for key, or every entry when key is empty,
+// and returns how many went.
+func (lb *LB) flushSessions(key string) int {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if key != "" {
+		s, ok := lb.sessions[key]
+		if !ok {
+			return 0
+		}
+		lb.deleteSessionLocked(s)
+		return 1
+	}
+	n := len(lb.sessions)
+	clear(lb.sessions)
+	lb.sessionLRU.Init()
+	return n
+}
+
+// writeSessions lists the table, most recently used first, up to
+// sessionListLimit entries.
+func (lb *LB) writeSessions(w io.Writer) {
+	if !lb.cfg.Affinity {
+		fmt.Fprintln(w, "affinity is off; start with -affinity to keep a session table")
+		return
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	now := lb.clock.Now()
+	limit := "unlimited"
+	if lb.cfg.AffinityMaxEntries > 0 {
+		limit = fmt.Sprint(lb.cfg.AffinityMaxEntries)
+	}
+	fmt.Fprintf(w, "=== SESSIONS %d (max %s, ttl %s, evicted %d) ===\n",
+		len(lb.sessions), limit, lb.cfg.AffinityTTL, lb.sessionEvictions.Load())
+	n := 0
+	for e := lb.sessionLRU.Front(); e != nil; e = e.Next() {
+		if n == sessionListLimit {
+			fmt.Fprintf(w, "... %d more\n", len(lb.sessions)-n)
+			break
+		}
+		s := e.Value.(*session)
+		state := ""
+		if lb.sessionExpired(s, now) {
+			state = " expired"
+		} else if !s.backend.Available() {
+			state = " backend unavailable"
+		}
+		fmt.Fprintf(w, "%-24s -> %-20s idle %s%s\n", s.key, s.backend, now.Sub(s.lastSeen).Round(time.Millisecond), state)
+		n++
+	}
+}
+
+// sweepSessions periodically removes expired entries so the table doesn't
+// grow with every key ever seen.
+func (lb *LB) sweepSessions() {
+	interval := max(lb.cfg.AffinityTTL/2, time.Second)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lb.stopping:
+			return
+		case <-ticker.C:
+		}
+		now := lb.clock.Now()
+		lb.mu.Lock()
+		swept := 0
+		for _, s := range lb.sessions {
+			if lb.sessionExpired(s, now) {
+				lb.deleteSessionLocked(s)
+				swept++
+			}
+		}
+		lb.mu.Unlock()
+		if swept > 0 {
+			log.Printf("affinity: swept %d expired sessions", swept)
+		}
+	}
+}
@@ -1,22 +1,62 @@
 package main
 
 import (
+	"encoding/binary"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 )
 
 func main() {
 	port := flag.Int("port", 8081, "port to listen on")
+	serving := flag.Bool("serving", true, "answer SERVING to gRPC health checks (false = NOT_SERVING)")
 	flag.Parse()
 
 	mux := http.NewServeMux()
+	// for the LB's -hc-mode http checks, whose default path this is
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "ok :%d\n", *port)
+	})
+	// for the LB's -hc-mode grpc checks; h2c only, like real gRPC servers
+	mux.HandleFunc("/grpc.health.v1.Health/Check", func(w http.ResponseWriter, r *http.Request) {
+		grpcHealth(w, r, *serving)
+	})
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "Hello from backend :%d (path=%s)\n", *port, r.URL.Path)
 	})
 
-	addr := fmt.Sprintf(":%d", *port)
-	log.Printf("backend listening on %s", addr)
-	log.Fatal(http.ListenAndServe(addr, mux))
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", *port), Handler: mux, Protocols: protocols}
+	log.Printf("backend listening on %s", srv.Addr)
+	log.Fatal(srv.ListenAndServe())
+}
+
+// grpcHealth answers grpc.health.v1.Health/Check for the whole server ("")
+// and for the service "backend"; any other service is NOT_FOUND, as the
+// standard implementation does.
+func grpcHealth(w http.ResponseWriter, r *http.Request, serving bool) {
+	body, _ := io.ReadAll(io.LimitReader(r.Body, 1<<10))
+	service := ""
+	if len(body) > 5 && body[5] == 1<<3|2 { // field 1, length-delimited
+		if n, k := binary.Uvarint(body[6:]); k > 0 && 6+k+int(n) <= len(body) {
+			service = string(body[6+k : 6+k+int(n)])
+		}
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	if service != "" && service != "backend" {
+		w.Header().Set("Grpc-Status", "5") // trailers-only response
+		w.Header().Set("Grpc-Message", "unknown service "+service)
+		return
+	}
+	status := byte(1) // SERVING
+	if !serving {
+		status = 2 // NOT_SERVING
+	}
+	w.Header().Set("Trailer", "Grpc-Status")
+	w.Write([]byte{0, 0, 0, 0, 2, 1 << 3, status})
+	w.Header().Set("Grpc-Status", "0")
 }
@@ -0,0 +1,130 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// ---------------------- Backend TLS ----------------------
+// -backend-tls makes the LB speak TLS to the main pool's backends, whatever
+// the client side speaks: the certificate is verified against -backend-ca (the
+// system roots when unset) and the name -backend-server-name, or the
+// backend's host. -backend-cert/-backend-key add a client certificate for
+// mutual TLS. A group in the config file can set its own `tls:` block, and so
+// can a single backend; one without it follows its pool, and a reload may
+// change a backend's block (new connections use it, open ones are kept).
+// -backend-insecure (insecure_skip_verify) skips verification altogether, for
+// test setups with self-signed certificates. The handshake is part of the dial, so a
+// certificate that fails verification is a dial failure like a refused
+// connection: it is retried, and counts against the backend's health. Under
+// TLS 1.3 a backend rejecting the LB's client certificate only says so after
+// the handshake, so that failure surfaces on the first request instead.
+
+// backendTLSHandshakeTimeout bounds the handshake with a backend.
+const backendTLSHandshakeTimeout = 10 * time.Second
+
+type BackendTLSConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	CAFile  string `yaml:"ca,omitempty"`
+
+	// CertFile and KeyFile are the client certificate for mutual TLS.
+	CertFile string `yaml:"cert,omitempty"`
+	KeyFile  string `yaml:"key,omitempty"`
+
+	// ServerName replaces the backend's host for SNI and verification; Unix
+	// socket backends need it.
+	ServerName string `yaml:"server_name,omitempty"`
+
+	// InsecureSkipVerify accepts any backend certificate.
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify,omitempty"`
+}
+
+func (c BackendTLSConfig) check() error {
+	if !c.Enabled {
+		if c.CAFile != "" || c.CertFile != "" || c.KeyFile != "" || c.ServerName != "" || c.InsecureSkipVerify {
+			return fmt.Errorf("backend TLS options given without enabling it")
+		}
+		return nil
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("backend TLS client cert and key go together")
+	}
+	return nil
+}
+
+// build loads c's files into a client tls.Config, nil when c is disabled.
+func (c BackendTLSConfig) build() (*tls.Config, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+	cfg := &tls.Config{
+		ServerName:         c.ServerName,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no PEM certificates", c.CAFile)
+		}
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// sameBackendTLS reports whether two tls blocks configure the same thing.
+func sameBackendTLS(a, b *BackendTLSConfig) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// backendTLSFor is the client TLS config of the backend bc describes in a
+// pool dialing with pool: its own tls block's when it has one, the pool's
+// otherwise.
+func backendTLSFor(bc BackendConfig, pool *tls.Config) (*tls.Config, error) {
+	if bc.TLS == nil {
+		return pool, nil
+	}
+	cfg, err := bc.TLS.build()
+	if err != nil {
+		return nil, fmt.Errorf("backend %s: tls: %w", bc.addr(), err)
+	}
+	return cfg, nil
+}
+
+// handshakeBackend runs the TLS client handshake with b over conn using cfg,
+// closing conn when it fails.
+func handshakeBackend(conn net.Conn, b *Backend, cfg *tls.Config) (net.Conn, error) {
+	if cfg.ServerName == "" && b.Path == "" {
+		cfg = cfg.Clone()
+		cfg.ServerName = b.Host
+		if b.Name != "" {
+			cfg.ServerName = b.Name
+		}
+	}
+	tc := tls.Client(conn, cfg)
+	ctx, cancel := context.WithTimeout(context.Background(), backendTLSHandshakeTimeout)
+	defer cancel()
+	if err := tc.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("tls handshake with %s: %w", b, err)
+	}
+	return tc, nil
+}
@@ -0,0 +1,111 @@
+package loadbalancer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"testing"
+)
+
+// tlsEchoBackend starts a TLS echo server with the certificate in
+// certFile/keyFile, requiring client certificates signed by clientCAs when
+// that is set, and returns its config.
+func tlsEchoBackend(t *testing.T, certFile, keyFile string, clientCAs *x509.CertPool) BackendConfig {
+	t.Helper()
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if clientCAs != nil {
+		cfg.ClientCAs, cfg.ClientAuth = clientCAs, tls.RequireAndVerifyClientCert
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	return backendAt(t, l.Addr().String())
+}
+
+func TestBackendTLSVerifiesAgainstCA(t *testing.T) {
+	certFile, keyFile := testCert(t)
+	otherCA, _ := testCert(t)
+	be := tlsEchoBackend(t, certFile, keyFile, nil)
+
+	for name, tc := range map[string]struct {
+		tls BackendTLSConfig
+		ok  bool
+	}{
+		"trusted CA":           {BackendTLSConfig{Enabled: true, CAFile: certFile}, true},
+		"server name":          {BackendTLSConfig{Enabled: true, CAFile: certFile, ServerName: "localhost"}, true},
+		"untrusted CA":         {BackendTLSConfig{Enabled: true, CAFile: otherCA}, false},
+		"wrong server name":    {BackendTLSConfig{Enabled: true, CAFile: certFile, ServerName: "other.example"}, false},
+		"insecure, unverified": {BackendTLSConfig{Enabled: true, CAFile: otherCA, InsecureSkipVerify: true}, true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := testConfig(t, be)
+			cfg.BackendTLS = tc.tls
+			lb := newTestLB(t, cfg)
+			startLB(t, lb)
+			b := lb.backends[0]
+
+			if got := echoes(dialLB(t, lb), "ping"); got != tc.ok {
+				t.Fatalf("proxied over backend TLS: %v, want %v", got, tc.ok)
+			}
+			conn, err := lb.dialBackend(b)
+			if tc.ok {
+				if err != nil {
+					t.Fatalf("dial: %v", err)
+				}
+				_ = conn.Close()
+				return
+			}
+			var verr *tls.CertificateVerificationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("dial with a bad certificate: %v, want a verification error", err)
+			}
+			lb.mu.Lock()
+			defer lb.mu.Unlock()
+			if b.failures == 0 {
+				t.Fatal("failed handshake not counted against the backend")
+			}
+		})
+	}
+}
+
+func TestBackendMutualTLS(t *testing.T) {
+	certFile, keyFile := testCert(t)
+	be := tlsEchoBackend(t, certFile, keyFile, certPool(t, certFile))
+
+	cfg := testConfig(t, be)
+	cfg.BackendTLS = BackendTLSConfig{Enabled: true, CAFile: certFile, CertFile: certFile, KeyFile: keyFile}
+	lb := newTestLB(t, cfg)
+	startLB(t, lb)
+	if !echoes(dialLB(t, lb), "ping") {
+		t.Fatal("not proxied to a backend requiring a client certificate")
+	}
+
+	// without the client certificate the backend refuses; under TLS 1.3 that
+	// shows on the first read
+	cfg = testConfig(t, be)
+	cfg.BackendTLS = BackendTLSConfig{Enabled: true, CAFile: certFile}
+	lb = newTestLB(t, cfg)
+	startLB(t, lb)
+	if echoes(dialLB(t, lb), "ping") {
+		t.Fatal("proxied to a backend requiring a client certificate without one")
+	}
+}
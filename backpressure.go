@@ -0,0 +1,45 @@
+package loadbalancer
+
+import (
+	"log"
+	"time"
+)
+
+// ---------------------- Accept Backpressure ----------------------
+// when -max-conns is reached, accepting only to reject again wastes CPU and
+// turns clients away that could have waited a moment. Instead the accept loops
+// stop calling Accept, so new clients queue in the kernel's listen backlog,
+// until a connection ends or a jittered, doubling backoff (capped at
+// -accept-backoff) expires. A connection accepted right as another listener
+// took the last slot is still rejected the old way.
+
+// acceptBackoffStart is the first pause; it doubles up to -accept-backoff.
+const acceptBackoffStart = 5 * time.Millisecond
+
+// awaitCapacity blocks while every -max-conns slot is taken. It returns false
+// once shutdown has begun.
+func (lb *LB) awaitCapacity() bool {
+	if lb.connSlots == nil || lb.cfg.AcceptBackoff <= 0 || len(lb.connSlots) < cap(lb.connSlots) {
+		return true
+	}
+	start := time.Now()
+	defer func() { lb.backpressureNanos.Add(int64(time.Since(start))) }()
+	log.Printf("max-conns %d reached, pausing accept", lb.cfg.MaxConns)
+
+	backoff := acceptBackoffStart
+	for len(lb.connSlots) >= cap(lb.connSlots) {
+		// jitter in [backoff/2, backoff) keeps several listeners from
+		// waking in lockstep
+		t := time.NewTimer(backoff/2 + time.Duration(lb.rng.Float64()*float64(backoff/2)))
+		select {
+		case <-lb.slotFreed:
+		case <-t.C:
+		case <-lb.stopping:
+			t.Stop()
+			return false
+		}
+		t.Stop()
+		backoff = min(2*backoff, lb.cfg.AcceptBackoff)
+	}
+	return true
+}
@@ -0,0 +1,165 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+)
+
+// ---------------------- Strategy Bench ----------------------
+// `bench <n>` compares every registered strategy on the current pool without touching
+// the live one: each is built fresh over copies of the backends and routes n
+// fixed keys. The table shows each backend's share, the coefficient of
+// variation of the available backends' shares (0 = perfectly even; weighted
+// strategies are uneven on purpose when weights differ) and the fraction of
+// keys that move when the last backend is removed. Random picks come from a
+// Rand seeded with -seed, so a fixed seed reproduces the table exactly.
+
+type BenchResult struct {
+	Strategy string
+	Counts   []int // per backend, in pool order
+	CV       float64
+	Moved    float64 // fraction of keys; -1 with fewer than two backends
+}
+
+// bench runs n keys (capped like simulate) through every strategy and
+// returns the pool it ran on alongside the results. No sockets are opened.
+func (lb *LB) bench(n int) ([]*Backend, []BenchResult) {
+	n = min(n, MaxSimulateRequests)
+	lb.mu.Lock()
+	pool := make([]*Backend, len(lb.backends))
+	for i, b := range lb.backends {
+		c := *b
+		c.ActiveConns, c.NumRequests = 0, 0
+		pool[i] = &c
+	}
+	lb.mu.Unlock()
+
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("bench-%d", i)
+	}
+
+	index := make(map[string]int, len(pool))
+	for i, b := range pool {
+		index[b.String()] = i
+	}
+
+	names := StrategyNames()
+	results := make([]BenchResult, 0, len(names))
+	for _, name := range names {
+		res := BenchResult{Strategy: name, Counts: make([]int, len(pool)), Moved: -1}
+		full := lb.benchRoute(name, pool, keys)
+		for _, addr := range full {
+			if i, ok := index[addr]; ok {
+				res.Counts[i]++
+			}
+		}
+		res.CV = benchCV(pool, res.Counts)
+
+		if len(pool) > 1 {
+			less := lb.benchRoute(name, pool[:len(pool)-1], keys)
+			moved := 0
+			for i := range keys {
+				if full[i] != less[i] {
+					moved++
+				}
+			}
+			res.Moved = float64(moved) / float64(n)
+		}
+		results = append(results, res)
+	}
+	return pool, results
+}
+
+// benchRoute maps keys through a fresh strategy called name over backends,
+// returning the picked address per key ("<nil>" on a selection error).
+func (lb *LB) benchRoute(name string, backends []*Backend, keys []string) []string {
+	out := make([]string, len(keys))
+	cfg := lb.strategyConfig()
+	cfg.Rand, cfg.Spills, cfg.State = NewRand(lb.cfg.Seed), nil, nil
+	s, err := NewStrategy(name, backends, cfg)
+	if err != nil {
+		for i := range out {
+			out[i] = "<nil>"
+		}
+		return out
+	}
+	for i, k := range keys {
+		out[i] = "<nil>"
+		if b, err := s.GetNextBackend(lookupReq(k)); err == nil {
+			out[i] = b.String()
+		}
+	}
+	return out
+}
+
+// benchCV is the coefficient of variation of counts over the available
+// backends.
+func benchCV(pool []*Backend, counts []int) float64 {
+	var vals []float64
+	for i, b := range pool {
+		if b.Available() {
+			vals = append(vals, float64(counts[i]))
+		}
+	}
+	if len(vals) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, v := range vals {
+		sum += v
+	}
+	mean := sum / float64(len(vals))
+	if mean == 0 {
+		return 0
+	}
+	var sq float64
+	for _, v := range vals {
+		sq += (v - mean) * (v - mean)
+	}
+	return math.Sqrt(sq/float64(len(vals))) / mean
+}
+
+func (lb *LB) printBench(n int, pool []*Backend, results []BenchResult) {
+	n = min(n, MaxSimulateRequests)
+	log.Printf("=== BENCH n=%d ===", n)
+	if len(pool) == 0 {
+		log.Printf("no backends in pool")
+		return
+	}
+	for i, b := range pool {
+		state := ""
+		if !b.Available() {
+			state = "  (unavailable)"
+		}
+		log.Printf("b%-3d = %s%s", i+1, b.String(), state)
+	}
+	if len(pool) > 1 {
+		log.Printf("moved = keys remapped when b%d is removed", len(pool))
+	}
+
+	var head strings.Builder
+	fmt.Fprintf(&head, "%-8s", "strategy")
+	for i := range pool {
+		fmt.Fprintf(&head, " %8s", fmt.Sprintf("b%d", i+1))
+	}
+	fmt.Fprintf(&head, " %7s %8s", "cv", "moved")
+	log.Print(head.String())
+
+	for _, r := range results {
+		var row strings.Builder
+		fmt.Fprintf(&row, "%-8s", r.Strategy)
+		for _, c := range r.Counts {
+			fmt.Fprintf(&row, " %7.2f%%", 100*float64(c)/float64(n))
+		}
+		fmt.Fprintf(&row, " %7.3f", r.CV)
+		if r.Moved < 0 {
+			fmt.Fprintf(&row, " %8s", "-")
+		} else {
+			fmt.Fprintf(&row, " %7.2f%%", 100*r.Moved)
+		}
+		log.Print(row.String())
+	}
+}
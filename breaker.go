@@ -0,0 +1,214 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// ---------------------- Circuit Breakers ----------------------
+// every backend has a circuit breaker fed by the same results as passive
+// health: failed dials, 5xx responses, and successes. It opens after
+// Failures consecutive failures, or when at least MinRequests results within
+// Window fail at ErrorRate or worse. An open circuit takes the backend out
+// of rotation, without marking it unhealthy, for Cooldown; it then turns
+// half-open and admits Probes requests. If they all succeed the circuit
+// closes; any failure opens it again for another Cooldown. A half-open
+// circuit whose probes are all out and still unanswered a Cooldown later
+// gets fresh ones, so it can't stay stuck. Health checks and passive health work independently,
+// and a backend must pass both to take traffic.
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (c circuitState) String() string {
+	switch c {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+type BreakerConfig struct {
+	Failures    int           // consecutive failures that open; 0 = no limit
+	ErrorRate   float64       // failed share of a window that opens; 0 = no limit
+	MinRequests int           // results a window needs before ErrorRate applies
+	Window      time.Duration // ErrorRate's window
+	Cooldown    time.Duration // open time before going half-open
+	Probes      int           // requests admitted half-open, all of which must succeed
+}
+
+func DefaultBreakerConfig() BreakerConfig {
+	return BreakerConfig{
+		MinRequests: 20,
+		Window:      10 * time.Second,
+		Cooldown:    30 * time.Second,
+		Probes:      3,
+	}
+}
+
+// enabled reports whether either trip condition is set.
+func (bc BreakerConfig) enabled() bool { return bc.Failures > 0 || bc.ErrorRate > 0 }
+
+func (bc BreakerConfig) Validate() error {
+	if bc.Failures < 0 {
+		return fmt.Errorf("-cb-failures must be >= 0")
+	}
+	if bc.ErrorRate < 0 || bc.ErrorRate > 1 {
+		return fmt.Errorf("-cb-error-rate must be between 0 and 1")
+	}
+	if !bc.enabled() {
+		return nil
+	}
+	if bc.ErrorRate > 0 && (bc.MinRequests < 1 || bc.Window <= 0) {
+		return fmt.Errorf("-cb-error-rate needs -cb-min-requests >= 1 and -cb-window > 0")
+	}
+	if bc.Cooldown <= 0 {
+		return fmt.Errorf("-cb-cooldown must be > 0")
+	}
+	if bc.Probes < 1 {
+		return fmt.Errorf("-cb-probes must be >= 1")
+	}
+	return nil
+}
+
+func (bc BreakerConfig) String() string {
+	if !bc.enabled() {
+		return "off"
+	}
+	desc := ""
+	if bc.Failures > 0 {
+		desc = fmt.Sprintf("open after %d failures in a row", bc.Failures)
+	}
+	if bc.ErrorRate > 0 {
+		if desc != "" {
+			desc += " or "
+		} else {
+			desc = "open "
+		}
+		desc += fmt.Sprintf("at %.0f%% errors of %d+ results in %s", 100*bc.ErrorRate, bc.MinRequests, bc.Window)
+	}
+	return fmt.Sprintf("%s, cooldown %s, %d probes", desc, bc.Cooldown, bc.Probes)
+}
+
+// breaker is one backend's circuit, guarded by lb.mu.
+type breaker struct {
+	state       circuitState
+	consecutive int       // failures since the last success
+	windowStart time.Time // of the current ErrorRate window
+	results     int       // in the window
+	failures    int       // in the window
+	probesLeft  int       // half-open: requests still to admit
+	passed      int       // half-open: probes that succeeded
+	trips       int       // times opened, to match cooldown timers
+	rounds      int       // probe sets handed out, to match cooldown timers
+}
+
+// admits reports whether the circuit lets a request through.
+func (br *breaker) admits() bool {
+	switch br.state {
+	case circuitOpen:
+		return false
+	case circuitHalfOpen:
+		return br.probesLeft > 0
+	}
+	return true
+}
+
+// breakerResultLocked feeds one result for b into its circuit. Callers must
+// hold lb.mu.
+func (lb *LB) breakerResultLocked(b *Backend, ok bool, reason string) {
+	bc := lb.cfg.Breaker
+	if !bc.enabled() {
+		return
+	}
+	br := &b.breaker
+	switch br.state {
+	case circuitOpen:
+		return // a straggler from before it opened
+	case circuitHalfOpen:
+		if !ok {
+			lb.openCircuitLocked(b, "probe failed: "+reason)
+			return
+		}
+		if br.passed++; br.passed >= bc.Probes {
+			*br = breaker{trips: br.trips, rounds: br.rounds}
+			log.Printf("circuit %s: closed after %d probes", b.Label(), bc.Probes)
+			lb.publishBackend(StateCircuitClosed, b, "")
+		}
+		return
+	}
+
+	now := lb.clock.Now()
+	if bc.ErrorRate > 0 && now.Sub(br.windowStart) > bc.Window {
+		br.windowStart, br.results, br.failures = now, 0, 0
+	}
+	br.results++
+	if ok {
+		br.consecutive = 0
+		return
+	}
+	br.consecutive++
+	br.failures++
+	switch {
+	case bc.Failures > 0 && br.consecutive >= bc.Failures:
+		lb.openCircuitLocked(b, fmt.Sprintf("%d failures in a row (last: %s)", br.consecutive, reason))
+	case bc.ErrorRate > 0 && br.results >= bc.MinRequests && float64(br.failures) >= bc.ErrorRate*float64(br.results):
+		lb.openCircuitLocked(b, fmt.Sprintf("%d of %d failed in %s (last: %s)", br.failures, br.results, bc.Window, reason))
+	}
+}
+
+// openCircuitLocked opens b's circuit and arms the cooldown that makes it
+// half-open. Callers must hold lb.mu.
+func (lb *LB) openCircuitLocked(b *Backend, why string) {
+	br := &b.breaker
+	br.state = circuitOpen
+	br.trips++
+	lb.breakerTrips.Add(1)
+	log.Printf("circuit %s: open for %s: %s", b.Label(), lb.cfg.Breaker.Cooldown, why)
+	lb.publishBackend(StateCircuitOpen, b, why)
+	lb.armHalfOpenLocked(b)
+}
+
+// armHalfOpenLocked hands b's circuit a fresh set of probes, half-open, after
+// a cooldown, unless it opened again, closed or got probes meanwhile. Callers
+// must hold lb.mu.
+func (lb *LB) armHalfOpenLocked(b *Backend) {
+	trip, round := b.breaker.trips, b.breaker.rounds
+	time.AfterFunc(lb.cfg.Breaker.Cooldown, func() {
+		lb.mu.Lock()
+		defer lb.mu.Unlock()
+		br := &b.breaker
+		if br.trips != trip || br.rounds != round || br.state == circuitClosed ||
+			!containsBackend(lb.allBackendsLocked(), b) {
+			return
+		}
+		if br.state == circuitHalfOpen {
+			log.Printf("circuit %s: probes unanswered for %s, admitting %d more", b.Label(), lb.cfg.Breaker.Cooldown, lb.cfg.Breaker.Probes)
+		} else {
+			log.Printf("circuit %s: half-open, admitting %d probes", b.Label(), lb.cfg.Breaker.Probes)
+		}
+		br.state, br.probesLeft, br.passed = circuitHalfOpen, lb.cfg.Breaker.Probes, 0
+		br.rounds++
+	})
+}
+
+// breakerDispatchLocked spends a half-open probe on a request sent to b; once
+// the last is out, a cooldown timer guards against them never reporting back.
+// Callers must hold lb.mu.
+func (lb *LB) breakerDispatchLocked(b *Backend) {
+	br := &b.breaker
+	if br.state != circuitHalfOpen || br.probesLeft == 0 {
+		return
+	}
+	if br.probesLeft--; br.probesLeft == 0 {
+		lb.armHalfOpenLocked(b)
+	}
+}
@@ -0,0 +1,139 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// ---------------------- Strategy Chains ----------------------
+// `strat chain ch,lc` composes strategies: every request asks the first one,
+// and moves on to the next when it has no backend or picked one at capacity
+// (-spill-at active connections), so "sticky by hash, but least-loaded when
+// the key's home is full" is ch then lc. The links run without -spill-at of
+// their own; the chain applies it. When every link's pick is at capacity the
+// first pick wins, like ch's spill. The canonical name is "chain:ch,lc",
+// which is also accepted by LB_STRATEGY and the config file.
+
+// chainPrefix starts the canonical name of a chain.
+const chainPrefix = "chain:"
+
+// canonicalChain normalizes the link list of "chain ch,lc" or "chain:ch,lc";
+// ok is false when name isn't a chain at all.
+func canonicalChain(name string) (canonical string, ok bool, err error) {
+	rest, found := strings.CutPrefix(name, "chain")
+	if !found || (rest != "" && rest[0] != ':' && rest[0] != ' ') {
+		return "", false, nil
+	}
+	var links []string
+	for _, l := range strings.Split(strings.TrimSpace(rest[min(1, len(rest)):]), ",") {
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+		if strings.HasPrefix(l, "chain") {
+			return "", true, fmt.Errorf("chains don't nest")
+		}
+		c, err := canonicalStrategy(l)
+		if err != nil {
+			return "", true, err
+		}
+		links = append(links, c)
+	}
+	if len(links) < 2 {
+		return "", true, fmt.Errorf("a chain needs at least two strategies, e.g. chain ch,lc")
+	}
+	return chainPrefix + strings.Join(links, ","), true, nil
+}
+
+// chainLinks returns the link names of a canonical strategy name, nil when
+// it isn't a chain.
+func chainLinks(canonical string) []string {
+	rest, ok := strings.CutPrefix(canonical, chainPrefix)
+	if !ok {
+		return nil
+	}
+	return strings.Split(rest, ",")
+}
+
+// usesStrategy reports whether the canonical strategy name is want or a chain
+// through it.
+func usesStrategy(canonical, want string) bool {
+	return canonical == want || slices.Contains(chainLinks(canonical), want)
+}
+
+type ChainStrategy struct {
+	Backends []*Backend
+	names    []string
+	links    []BalancingStrategy
+
+	spillAt int           // see StrategyConfig.SpillAt
+	spills  *atomic.Int64 // may be nil
+}
+
+// NewChainStrategy builds the links named by names (canonical) over
+// backends, each from cfg without its SpillAt.
+func NewChainStrategy(names []string, backends []*Backend, cfg StrategyConfig) (*ChainStrategy, error) {
+	s := &ChainStrategy{Backends: backends, names: names, spillAt: cfg.SpillAt, spills: cfg.Spills}
+	linkCfg := cfg
+	linkCfg.SpillAt, linkCfg.Spills = 0, nil
+	for _, name := range names {
+		l, err := NewStrategy(name, backends, linkCfg)
+		if err != nil {
+			return nil, err
+		}
+		s.links = append(s.links, l)
+	}
+	return s, nil
+}
+
+func (s *ChainStrategy) Init(backends []*Backend) {
+	s.Backends = backends
+	for _, l := range s.links {
+		l.Init(backends)
+	}
+}
+
+func (s *ChainStrategy) RegisterBackend(backend *Backend) {
+	s.Backends = append(s.Backends, backend)
+	for _, l := range s.links {
+		l.RegisterBackend(backend)
+	}
+}
+
+func (s *ChainStrategy) GetNextBackend(req IncomingReq) (*Backend, error) {
+	if len(s.Backends) == 0 {
+		return nil, ErrNoBackends
+	}
+	var first *Backend // first pick at capacity
+	for _, l := range s.links {
+		b, err := l.GetNextBackend(req)
+		if err != nil || !b.Available() {
+			continue
+		}
+		if s.spillAt > 0 && b.ActiveConns >= s.spillAt {
+			if first == nil {
+				first = b
+			}
+			continue
+		}
+		if first != nil && s.spills != nil && !req.lookup {
+			s.spills.Add(1)
+		}
+		return b, nil
+	}
+	if first != nil {
+		return first, nil
+	}
+	return nil, ErrAllUnhealthy
+}
+
+// PrintTopology prints every link's topology in chain order.
+func (s *ChainStrategy) PrintTopology() {
+	fmt.Printf("chain %s\n", strings.Join(s.names, " -> "))
+	for i, l := range s.links {
+		fmt.Printf("--- %d: %s ---\n", i+1, s.names[i])
+		l.PrintTopology()
+	}
+}
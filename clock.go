@@ -0,0 +1,19 @@
+package loadbalancer
+
+import "time"
+
+// ---------------------- Clock ----------------------
+// time-dependent bookkeeping (passive health windows, circuit breaker error
+// windows, slow start, outlier ejection, peak-EWMA, affinity sessions,
+// resolve cache expiry) reads the time through lb.clock, so tests can drive
+// it with a fake clock (Config.clock) instead of real sleeps. Socket
+// deadlines and timers stay on the wall clock: the kernel and runtime
+// enforce those.
+
+type clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
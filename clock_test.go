@@ -0,0 +1,89 @@
+package loadbalancer
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when Advance is called.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock { return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)} }
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func TestFakeClockExpiresSessions(t *testing.T) {
+	clk := newFakeClock()
+	cfg := testConfig(t,
+		BackendConfig{Host: "10.0.0.1", Port: 80, Weight: 1},
+		BackendConfig{Host: "10.0.0.2", Port: 80, Weight: 1},
+	)
+	cfg.Strategy = "rr"
+	cfg.Affinity = true
+	cfg.AffinityTTL = time.Minute
+	cfg.clock = clk
+	lb := newTestLB(t, cfg)
+
+	pick := func() *Backend {
+		lb.mu.Lock()
+		defer lb.mu.Unlock()
+		b, err := lb.pickBackend(IncomingReq{key: "client"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	first := pick()
+	clk.Advance(59 * time.Second)
+	if b := pick(); b != first {
+		t.Fatalf("session moved to %s before its TTL", b)
+	}
+	clk.Advance(time.Minute + time.Second)
+	if b := pick(); b == first {
+		t.Fatalf("session stayed on %s past its TTL", b)
+	}
+}
+
+func TestFakeClockDrivesBreakerWindow(t *testing.T) {
+	clk := newFakeClock()
+	cfg := testConfig(t, BackendConfig{Host: "10.0.0.1", Port: 80, Weight: 1})
+	cfg.PassiveFailThreshold = 0
+	cfg.Breaker = BreakerConfig{ErrorRate: 0.5, MinRequests: 4, Window: 10 * time.Second, Cooldown: time.Hour, Probes: 1}
+	cfg.clock = clk
+	lb := newTestLB(t, cfg)
+	b := lb.backends[0]
+	state := func() circuitState {
+		lb.mu.Lock()
+		defer lb.mu.Unlock()
+		return b.breaker.state
+	}
+
+	for range 3 {
+		lb.recordFailure(b, "boom")
+	}
+	clk.Advance(11 * time.Second) // the three fall out of the window
+	lb.recordFailure(b, "boom")
+	if s := state(); s != circuitClosed {
+		t.Fatalf("circuit %s after one failure in a fresh window", s)
+	}
+	for range 3 {
+		lb.recordFailure(b, "boom")
+	}
+	if s := state(); s != circuitOpen {
+		t.Fatalf("circuit %s after 4 of 4 failed in one window", s)
+	}
+}
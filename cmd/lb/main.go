@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"loadbalancer"
+)
+
+func main() {
+	cfg := loadbalancer.DefaultConfig()
+	cfg.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := cfg.LoadFile(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := cfg.LoadEnv(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := cfg.CheckPool(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	lb, err := loadbalancer.New(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// first SIGTERM/SIGINT drains, a second one exits right away
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigs
+		log.Printf("received %s, draining (send again to exit now)", sig)
+		go func() {
+			<-sigs
+			log.Println("second signal, exiting without drain")
+			os.Exit(1)
+		}()
+		lb.Send(loadbalancer.Event{EventName: loadbalancer.CMD_Exit})
+	}()
+
+	// SIGHUP re-reads -config
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	go func() {
+		for range hups {
+			log.Println("received SIGHUP, reloading config")
+			lb.Send(loadbalancer.Event{EventName: loadbalancer.CMD_Reload})
+		}
+	}()
+
+	go func() {
+		sc := bufio.NewScanner(os.Stdin)
+		help := func() {
+			fmt.Printf(`commands:
+  show                             -> print key->backend mapping for demo keys
+  list                             -> print backends with health, live connections and request counts
+  health                           -> print each backend's last check, failure counts and what keeps it out of rotation
+  topo [-v]                        -> print the strategy's topology (-v: every ring position)
+  ring [key]                       -> dump the consistent-hash ring; with a key, show where it lands
+  vnodes <n>                       -> rebuild consistent-hash rings with n positions per unit of weight (until restart)
+  quantum <n>                      -> set drr's quantum, the connections in a row its heaviest backend takes (until restart)
+  sessions [flush [key]]           -> list the -affinity session table, or flush it (one key or all)
+  key <extractor>                  -> what hashing strategies key new connections by: random, ip, ipport, payload or sni (-key)
+  keys <k1,k2,...>                 -> replace the demo key set
+  simulate <n> [k1,k2,...]         -> route n synthetic requests (random or given keys) and print distribution
+  bench <n>                        -> route n keys through every strategy on a copy of the pool and compare balance and churn
+  strat <name>                     -> change strategy: %s; chain <a>,<b>... tries them in order
+  add <port>|<host:port> [w] [p]   -> add backend with weight w (default 1) and priority tier p (default 0; host defaults to localhost, IPv6 as [::1]:8085, unix:/path for a socket)
+  prio <port>|<host:port> <p>      -> move backend to priority tier p (0 takes traffic first)
+  zone <port>|<host:port> <zone>   -> label backend with a zone for the zone strategy (- clears it)
+  rm <port>|<host:port>            -> remove backend
+  disable <port>|<host:port>       -> take backend out of rotation, whatever its health
+  enable <port>|<host:port>        -> put a disabled backend back
+  exit                             -> stop LB
+`, strings.Join(loadbalancer.StrategyNames(), ", "))
+		}
+		help()
+		for {
+			fmt.Print("> ")
+			if !sc.Scan() {
+				return
+			}
+			line := strings.TrimSpace(sc.Text())
+			if line == "" {
+				continue
+			}
+			parts := strings.Fields(line)
+			cmd := strings.ToLower(parts[0])
+
+			switch cmd {
+			case "show":
+				lb.Send(loadbalancer.Event{EventName: loadbalancer.CMD_ShowMapping})
+
+			case "topo", "topology":
+				verbose := len(parts) > 1 && parts[1] == "-v"
+				lb.Send(loadbalancer.Event{EventName: loadbalancer.CMD_ShowTopology, Data: verbose})
+
+			case "list", "ls":
+				lb.Send(loadbalancer.Event{EventName: loadbalancer.CMD_ListBackends})
+
+			case "health":
+				lb.Send(loadbalancer.Event{EventName: loadbalancer.CMD_ShowHealth})
+
+			case "sessions":
+				switch {
+				case len(parts) == 1:
+					lb.Send(loadbalancer.Event{EventName: loadbalancer.CMD_ShowSessions})
+				case parts[1] == "flush" && len(parts) <= 3:
+					key := ""
+					if len(parts) == 3 {
+						key = parts[2]
+					}
+					if err := lb.Request(loadbalancer.Event{EventName: loadbalancer.CMD_FlushSessions, Data: key}); err != nil {
+						fmt.Println(err)
+					}
+				default:
+					fmt.Println("usage: sessions [flush [key]]")
+				}
+
+			case "key":
+				if len(parts) != 2 {
+					fmt.Printf("usage: key %s\n", strings.Join(loadbalancer.KeyExtractorNames, "|"))
+					continue
+				}
+				if err := lb.Request(loadbalancer.Event{EventName: loadbalancer.CMD_KeyExtractor, Data: strings.ToLower(parts[1])}); err != nil {
+					fmt.Println(err)
+				}
+
+			case "keys":
+				if len(parts) < 2 {
+					fmt.Println("usage: keys <k1,k2,...>")
+					continue
+				}
+				keys := splitKeys(parts[1])
+				if len(keys) == 0 {
+					fmt.Println("no keys given")
+					continue
+				}
+				lb.Send(loadbalancer.Event{EventName: loadbalancer.CMD_KeysSet, Data: keys})
+
+			case "simulate", "sim":
+				if len(parts) < 2 {
+					fmt.Println("usage: simulate <n> [k1,k2,...]")
+					continue
+				}
+				n, err := strconv.Atoi(parts[1])
+				if err != nil || n <= 0 {
+					fmt.Println("invalid request count")
+					continue
+				}
+				if n > loadbalancer.MaxSimulateRequests {
+					fmt.Printf("request count capped at %d\n", loadbalancer.MaxSimulateRequests)
+					n = loadbalancer.MaxSimulateRequests
+				}
+				sim := loadbalancer.Simulation{N: n}
+				if len(parts) > 2 {
+					sim.Keys = splitKeys(parts[2])
+				}
+				lb.Send(loadbalancer.Event{EventName: loadbalancer.CMD_Simulate, Data: sim})
+
+			case "bench":
+				if len(parts) < 2 {
+					fmt.Println("usage: bench <n>")
+					continue
+				}
+				n, err := strconv.Atoi(parts[1])
+				if err != nil || n <= 0 {
+					fmt.Println("invalid key count")
+					continue
+				}
+				if n > loadbalancer.MaxSimulateRequests {
+					fmt.Printf("key count capped at %d\n", loadbalancer.MaxSimulateRequests)
+					n = loadbalancer.MaxSimulateRequests
+				}
+				lb.Send(loadbalancer.Event{EventName: loadbalancer.CMD_Bench, Data: n})
+
+			case "ring":
+				probe := ""
+				if len(parts) > 1 {
+					probe = parts[1]
+				}
+				lb.Send(loadbalancer.Event{EventName: loadbalancer.CMD_ShowRing, Data: probe})
+
+			case "vnodes":
+				if len(parts) != 2 {
+					fmt.Println("usage: vnodes <n>")
+					continue
+				}
+				n, err := strconv.Atoi(parts[1])
+				if err != nil {
+					fmt.Println("invalid vnode count")
+					continue
+				}
+				if err := lb.Request(loadbalancer.Event{EventName: loadbalancer.CMD_VNodes, Data: n}); err != nil {
+					fmt.Println(err)
+				}
+
+			case "quantum":
+				if len(parts) != 2 {
+					fmt.Println("usage: quantum <n>")
+					continue
+				}
+				q, err := strconv.Atoi(parts[1])
+				if err != nil {
+					fmt.Println("invalid quantum")
+					continue
+				}
+				if err := lb.Request(loadbalancer.Event{EventName: loadbalancer.CMD_DRRQuantum, Data: q}); err != nil {
+					fmt.Println(err)
+				}
+
+			case "strat", "strategy":
+				if len(parts) < 2 {
+					fmt.Printf("usage: strat %s|chain <a>,<b>...\n", strings.Join(loadbalancer.StrategyNames(), "|"))
+					continue
+				}
+				name := strings.Join(parts[1:], " ") // chain ch,lc
+				if err := lb.Request(loadbalancer.Event{EventName: loadbalancer.CMD_StrategyChange, Data: name}); err != nil {
+					fmt.Println(err)
+				}
+
+			case "add":
+				if len(parts) < 2 {
+					fmt.Println("usage: add <port>|<host:port>|unix:<path> [weight] [priority]")
+					continue
+				}
+				backend, err := loadbalancer.ParseBackendAddr(parts[1])
+				if err != nil {
+					fmt.Println(err)
+					continue
+				}
+				w := 1
+				if len(parts) > 2 {
+					if w, err = strconv.Atoi(parts[2]); err != nil || w < 0 {
+						fmt.Println("invalid weight")
+						continue
+					}
+				}
+				p := 0
+				if len(parts) > 3 {
+					if p, err = strconv.Atoi(parts[3]); err != nil || p < 0 {
+						fmt.Println("invalid priority")
+						continue
+					}
+				}
+				b, err := loadbalancer.NewBackend(loadbalancer.BackendConfig{Host: backend.Host, Port: backend.Port, Path: backend.Path, Weight: w, Priority: p})
+				if err == nil {
+					err = lb.Request(loadbalancer.Event{EventName: loadbalancer.CMD_BackendAdd, Data: *b})
+				}
+				if err != nil {
+					fmt.Println(err)
+				}
+
+			case "rm", "remove":
+				if len(parts) < 2 {
+					fmt.Println("usage: rm <port>|<host:port>|unix:<path>")
+					continue
+				}
+				backend, err := loadbalancer.ParseBackendAddr(parts[1])
+				if err != nil {
+					fmt.Println(err)
+					continue
+				}
+				if err := lb.Request(loadbalancer.Event{EventName: loadbalancer.CMD_BackendRemove, Data: backend}); err != nil {
+					fmt.Println(err)
+				}
+
+			case "prio", "priority":
+				if len(parts) != 3 {
+					fmt.Println("usage: prio <port>|<host:port>|unix:<path> <priority>")
+					continue
+				}
+				backend, err := loadbalancer.ParseBackendAddr(parts[1])
+				if err != nil {
+					fmt.Println(err)
+					continue
+				}
+				p, err := strconv.Atoi(parts[2])
+				if err != nil || p < 0 {
+					fmt.Println("invalid priority")
+					continue
+				}
+				err = lb.Request(loadbalancer.Event{
+					EventName: loadbalancer.CMD_BackendTier,
+					Data:      loadbalancer.BackendPriority{Addr: backend.String(), Priority: p},
+				})
+				if err != nil {
+					fmt.Println(err)
+				}
+
+			case "zone":
+				if len(parts) != 3 {
+					fmt.Println("usage: zone <port>|<host:port>|unix:<path> <zone>|-")
+					continue
+				}
+				backend, err := loadbalancer.ParseBackendAddr(parts[1])
+				if err != nil {
+					fmt.Println(err)
+					continue
+				}
+				zone := parts[2]
+				if zone == "-" {
+					zone = ""
+				}
+				err = lb.Request(loadbalancer.Event{
+					EventName: loadbalancer.CMD_BackendZone,
+					Data:      loadbalancer.BackendZone{Addr: backend.String(), Zone: zone},
+				})
+				if err != nil {
+					fmt.Println(err)
+				}
+
+			case "disable", "enable":
+				if len(parts) != 2 {
+					fmt.Printf("usage: %s <port>|<host:port>|unix:<path>\n", parts[0])
+					continue
+				}
+				backend, err := loadbalancer.ParseBackendAddr(parts[1])
+				if err == nil {
+					err = lb.Request(loadbalancer.Event{
+						EventName: loadbalancer.CMD_BackendAdmin,
+						Data:      loadbalancer.AdminState{Addr: backend.String(), Disabled: parts[0] == "disable"},
+					})
+				}
+				if err != nil {
+					fmt.Println(err)
+				}
+
+			case "exit", "quit":
+				lb.Send(loadbalancer.Event{EventName: loadbalancer.CMD_Exit})
+				return
+
+			case "help", "h", "?":
+				help()
+
+			default:
+				fmt.Println("unknown command; type 'help'")
+			}
+		}
+	}()
+
+	// start the data plane and serve until exit
+	if err := lb.Start(context.Background()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	<-lb.Done()
+}
+
+// splitKeys parses a comma separated key list, dropping empty entries.
+func splitKeys(s string) []string {
+	var keys []string
+	for _, k := range strings.Split(s, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,648 @@
+package loadbalancer
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxy modes
+const (
+	ModeTCP  = "tcp"
+	ModeHTTP = "http"
+	ModeGRPC = "grpc"
+	ModeAuto = "auto"
+)
+
+// Config holds the startup options of the LB.
+type Config struct {
+	// Mode is ModeTCP (raw byte splicing), ModeHTTP (requests are parsed
+	// and balanced one by one, response status feeds passive health) or
+	// ModeGRPC (h2c terminated, every stream balanced on its own); ModeAuto
+	// picks HTTP or TCP per connection from its first bytes.
+	Mode string
+
+	// ConfigFile is the YAML file the pool and strategy were loaded from;
+	// Persist writes runtime changes back to it.
+	ConfigFile string
+	Persist    bool
+
+	// Backends and Strategy are the initial pool and strategy; empty means
+	// the built-in demo pool and consistent hashing.
+	Backends []BackendConfig
+	Strategy string
+
+	// Groups are pools routed by path (HTTP mode) or TLS server name (TCP
+	// mode), from the config file.
+	Groups []GroupConfig
+
+	// Key names the key extractor hashing strategies route connections by
+	// (see KeyExtractorNames); KeyBytes is how much the payload one reads.
+	Key      string
+	KeyBytes int
+
+	// AllowEmpty lets the LB start without any backend, for pools that are
+	// only ever filled at runtime with `add`.
+	AllowEmpty bool
+
+	// WarnLowPorts logs a warning for every backend added on a port below
+	// 1024, which is more often a typo (808 for 8080) than a real service.
+	WarnLowPorts bool
+
+	// Listeners are the addresses the LB accepts client connections on; they
+	// all feed the same backend pool.
+	Listeners []ListenerConfig
+
+	// UDPListen is an address to balance UDP datagrams on, over the main
+	// pool; empty = off. UDPKey (UDPKeySrc, UDPKeyIP or UDPKeyPayload) is
+	// what sessions are keyed by, and UDPIdleTimeout ends idle ones. See
+	// udp.go.
+	UDPListen      string
+	UDPKey         string
+	UDPIdleTimeout time.Duration
+
+	// Hash overrides the hash function of the hashing strategies (HashFNV or
+	// HashSHA256); empty keeps each strategy's default.
+	Hash string
+
+	// MaxConns caps concurrently proxied client connections; 0 = unlimited.
+	MaxConns int
+
+	// Acceptors is how many SO_REUSEPORT listeners, each with its own accept
+	// loop, every TCP listen address gets (Linux only; elsewhere 1).
+	Acceptors int
+
+	// MaxConnsPerIP caps concurrent connections from one client IP; 0 =
+	// unlimited.
+	MaxConnsPerIP int
+
+	// AcceptBackoff is the longest the accept loops pause while MaxConns is
+	// reached, leaving new clients in the listen backlog; 0 rejects them.
+	AcceptBackoff time.Duration
+
+	// ReadTimeout / WriteTimeout close a proxied connection once a single
+	// read or write on either side stalls for that long. They are idle limits
+	// refreshed on every transfer, not absolute lifetimes; 0 = off.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// LatencyBuckets are the upper bounds, in seconds, of the per-backend
+	// duration histograms; Validate parses them into latencyBounds.
+	LatencyBuckets string
+	latencyBounds  []float64
+
+	// SpillAt makes consistent hashing pass a key to the next ring node while
+	// its owner has this many active connections, and the zone strategy go
+	// to other zones while every local backend has; 0 = strict affinity.
+	SpillAt int
+
+	// Zone is the LB's own zone, which the zone strategy keeps traffic in.
+	Zone string
+
+	// EWMADecay is how fast a backend's peak-EWMA latency (p2c) forgets old
+	// samples: their weight falls by 1/e every EWMADecay.
+	EWMADecay time.Duration
+
+	// MaglevTableSize is the maglev strategy's lookup table size, a prime.
+	MaglevTableSize int
+
+	// VNodes is how many ring positions consistent hashing gives each
+	// backend per unit of weight; the vnodes command changes it at runtime.
+	VNodes int
+
+	// DRRQuantum is how many connections in a row deficit round robin gives
+	// the heaviest backend per visit; the quantum command and PUT
+	// /drr/quantum change it at runtime.
+	DRRQuantum int
+
+	// Retries is how many other backends a request may be re-dialed on when
+	// its backend refuses the connection; RetryBudget is the share of the
+	// request rate those retries may add, across all requests.
+	Retries     int
+	RetryBudget float64
+
+	// HedgeDelay re-sends an unanswered GET/HEAD to a second backend after
+	// this long in HTTP mode; 0 = off.
+	HedgeDelay time.Duration
+
+	// HappyEyeballs dials every resolved address of a backend hostname in a
+	// staggered race; lookups are cached for ResolveTTL.
+	HappyEyeballs bool
+	ResolveTTL    time.Duration
+
+	// DNSRefresh turns each hostname backend of the main pool into one
+	// backend per address it resolves to, re-resolved this often; 0 = off.
+	DNSRefresh time.Duration
+
+	// Mirror is a backend address (host:port or unix:/path) that gets a copy
+	// of MirrorPercent percent of HTTP requests; its responses are dropped.
+	Mirror        string
+	MirrorPercent float64
+
+	// DialSource is the local IP backend TCP connections (and health probes)
+	// originate from; empty lets the kernel choose.
+	DialSource string
+
+	// BackendTLS dials the main pool's backends over TLS; see backendtls.go.
+	BackendTLS BackendTLSConfig
+
+	// ProxyProtocol is the PROXY protocol version (ProxyProtocolV1 or V2)
+	// whose header starts every backend connection made for a client; empty
+	// = off. See proxyproto.go.
+	ProxyProtocol string
+
+	// RequestTimeout is an absolute limit measured from the backend connect.
+	// In HTTP mode it bounds the whole proxied exchange; in TCP mode, where
+	// the LB can't see request boundaries, it caps the connection lifetime
+	// even while bytes are flowing. 0 = off.
+	RequestTimeout time.Duration
+
+	// ShutdownGrace is how long in-flight connections may keep running after
+	// exit or SIGTERM before they are closed.
+	ShutdownGrace time.Duration
+
+	// RemapSample is how many synthetic keys every topology change is
+	// measured on, beyond the demo keys; 0 = demo keys only.
+	RemapSample int
+
+	// Seed seeds the LB's random source; 0 picks one from the clock.
+	Seed int64
+
+	// RequestIDHeader is set on every request forwarded in HTTP mode and
+	// echoed on its response; empty disables it. An id sent by the client is
+	// kept unless RequestIDOverwrite.
+	RequestIDHeader    string
+	RequestIDOverwrite bool
+
+	// BackendHeader names the response header that tells an HTTP-mode client
+	// which backend served it: the backend's address, or its ID with
+	// BackendHeaderID. Empty disables it.
+	BackendHeader   string
+	BackendHeaderID bool
+
+	// AllowBackendOverride lets an HTTP request pick its backend with
+	// BackendOverrideHeader, proving BackendOverrideSecret when set; see
+	// override.go.
+	AllowBackendOverride  bool
+	BackendOverrideHeader string
+	BackendOverrideSecret string
+
+	// AdminAddr is where the admin endpoints (probes, stats, metrics and the
+	// routes that change state) are served; empty disables it. AdminToken,
+	// when set, must be sent as "Authorization: Bearer <token>" on every
+	// request that isn't a GET or HEAD. See admin.go.
+	AdminAddr  string
+	AdminToken string
+
+	// SlowStart ramps a backend added at runtime from no traffic to its full
+	// share over this long; 0 = full share at once.
+	SlowStart time.Duration
+
+	// Affinity pins each key to the backend it was first routed to;
+	// AffinityTTL expires idle pins (0 = never) and AffinityMaxEntries bounds
+	// the table, evicting the least recently used pin (0 = unbounded).
+	Affinity           bool
+	AffinityTTL        time.Duration
+	AffinityMaxEntries int
+
+	// HealthCheck configures active probing of the pool.
+	HealthCheck HealthCheckConfig
+
+	// PassiveFailThreshold 5xx responses within PassiveFailWindow mark a
+	// backend unhealthy; 0 disables passive health.
+	PassiveFailThreshold int
+	PassiveFailWindow    time.Duration
+
+	// PassiveProbation is how long a backend marked unhealthy by passive
+	// health sits out before it gets traffic again on probation; 0 keeps
+	// it out until an active check passes. Unused with active checks on.
+	PassiveProbation time.Duration
+
+	// HealthWebhook is a URL that gets a POST for every backend health
+	// change; empty = off.
+	HealthWebhook string
+
+	// Breaker configures the per-backend circuit breakers.
+	Breaker BreakerConfig
+
+	// Outlier configures outlier detection.
+	Outlier OutlierConfig
+
+	// clock is what the LB reads the time from (see clock.go); nil is the
+	// wall clock. Tests set a fake one.
+	clock clock
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Mode:                  ModeTCP,
+		Listeners:             []ListenerConfig{{Addr: ":9090"}},
+		UDPKey:                UDPKeySrc,
+		UDPIdleTimeout:        30 * time.Second,
+		AdminAddr:             "127.0.0.1:9091",
+		RequestIDHeader:       "X-Request-ID",
+		BackendOverrideHeader: "X-LB-Backend",
+		ResolveTTL:            30 * time.Second,
+		ShutdownGrace:         25 * time.Second,
+		AcceptBackoff:         time.Second,
+		RemapSample:           10000,
+		LatencyBuckets:        defaultLatencyBuckets,
+		MaglevTableSize:       DefaultMaglevTableSize,
+		Key:                   "random",
+		KeyBytes:              DefaultKeyBytes,
+		VNodes:                DefaultVNodes,
+		DRRQuantum:            DefaultDRRQuantum,
+		EWMADecay:             DefaultEWMADecay,
+		Acceptors:             1,
+		MirrorPercent:         100,
+		RetryBudget:           0.1,
+		HealthCheck:           DefaultHealthCheckConfig(),
+		PassiveFailThreshold:  5,
+		PassiveFailWindow:     30 * time.Second,
+		PassiveProbation:      10 * time.Second,
+		Breaker:               DefaultBreakerConfig(),
+		Outlier:               DefaultOutlierConfig(),
+	}
+}
+
+// LoadFile fills Backends and Strategy from ConfigFile, if one is set.
+func (c *Config) LoadFile() error {
+	if c.ConfigFile == "" {
+		return nil
+	}
+	fc, err := LoadFileConfig(c.ConfigFile)
+	if err != nil {
+		return err
+	}
+	c.Backends, c.Strategy, c.Groups = fc.Backends, fc.Strategy, fc.Groups
+	return nil
+}
+
+// LoadEnv fills Backends and Strategy from LB_BACKENDS and LB_STRATEGY when no
+// config file is given, for deployments where mounting one is awkward:
+//
+//	LB_BACKENDS="app1:8081:3,app2:8081,[::1]:8082"   host:port[:weight]
+//	LB_STRATEGY=wrand
+//
+// Precedence is flags > config file > environment > built-in pool.
+func (c *Config) LoadEnv() error {
+	if c.ConfigFile != "" {
+		return nil
+	}
+	if v := os.Getenv("LB_BACKENDS"); v != "" {
+		backends, err := parseEnvBackends(v)
+		if err != nil {
+			return fmt.Errorf("LB_BACKENDS: %w", err)
+		}
+		c.Backends = backends
+	}
+	if v := os.Getenv("LB_STRATEGY"); v != "" {
+		if _, err := canonicalStrategy(v); err != nil {
+			return fmt.Errorf("LB_STRATEGY: %w", err)
+		}
+		c.Strategy = v
+	}
+	return nil
+}
+
+// parseEnvBackends parses a comma separated host:port[:weight] list. The
+// weight is split off only when what precedes it is a complete host:port, so
+// "app:8081" and "[::1]:8081" keep their meaning; unix:/path entries get
+// weight 1.
+func parseEnvBackends(s string) ([]BackendConfig, error) {
+	var bcs []BackendConfig
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		addr, weight := entry, 1
+		if i := strings.LastIndex(entry, ":"); i >= 0 {
+			if _, _, err := net.SplitHostPort(entry[:i]); err == nil {
+				w, err := strconv.Atoi(entry[i+1:])
+				if err != nil {
+					return nil, fmt.Errorf("%q: invalid weight %q", entry, entry[i+1:])
+				}
+				addr, weight = entry[:i], w
+			}
+		}
+		b, err := ParseBackendAddr(addr)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", entry, err)
+		}
+		bcs = append(bcs, BackendConfig{Host: b.Host, Port: b.Port, Path: b.Path, Weight: weight})
+	}
+	if len(bcs) == 0 {
+		return nil, fmt.Errorf("no backends in %q", s)
+	}
+	if err := checkBackends(bcs); err != nil {
+		return nil, err
+	}
+	return bcs, nil
+}
+
+// demoBackends is the pool used when nothing names one: the four local demo
+// servers.
+var demoBackends = []BackendConfig{
+	{Host: "localhost", Port: 8081, Weight: 1},
+	{Host: "localhost", Port: 8082, Weight: 1},
+	{Host: "localhost", Port: 8083, Weight: 1},
+	{Host: "localhost", Port: 8084, Weight: 1},
+}
+
+// CheckPool runs after LoadFile and LoadEnv. With no pool from either it
+// falls back to demoBackends; a config file that names no backend at all is
+// an error unless AllowEmpty, since every request would otherwise fail with
+// "no backend available" and nothing saying why.
+func (c *Config) CheckPool() error {
+	n := len(c.Backends)
+	for _, g := range c.Groups {
+		n += len(g.Backends)
+	}
+	switch {
+	case n > 0 || c.AllowEmpty:
+		return nil
+	case c.ConfigFile != "":
+		return fmt.Errorf("%s: no backends configured; add some, or pass -allow-empty to start empty and `add` them at runtime", c.ConfigFile)
+	}
+	c.Backends = slices.Clone(demoBackends)
+	return nil
+}
+
+// RegisterFlags binds the config fields to command-line flags.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Mode, "mode", c.Mode, "proxy mode: tcp|http|grpc|auto (auto: http or tcp per connection, by its first bytes)")
+	fs.StringVar(&c.Key, "key", c.Key, "what hashing strategies route a connection by: random|ip|ipport|payload|sni, or each http/grpc request by header:<name>")
+	fs.IntVar(&c.KeyBytes, "key-bytes", c.KeyBytes, "-key payload: how many leading bytes of the client's data make the key")
+	fs.StringVar(&c.ConfigFile, "config", c.ConfigFile, "YAML file with the backend pool and strategy")
+	fs.BoolVar(&c.Persist, "persist", c.Persist, "write runtime backend/strategy changes back to -config")
+	fs.BoolVar(&c.AllowEmpty, "allow-empty", c.AllowEmpty, "start without backends (instead of the demo pool or failing) and wait for `add`")
+	fs.BoolVar(&c.WarnLowPorts, "warn-low-ports", c.WarnLowPorts, "log a warning for backends on ports below 1024")
+	fs.Var(&listenFlag{l: &c.Listeners}, "listen", "listen address, repeatable; append ,cert=FILE,key=FILE to terminate TLS, ,proxy to read PROXY protocol headers, ,mode=0660 to set a unix: socket's permissions, ,h3 to also serve HTTP/3 on a TLS listener in http mode")
+	fs.StringVar(&c.UDPListen, "udp-listen", c.UDPListen, "also balance UDP datagrams received on this address over the main pool (empty = off)")
+	fs.StringVar(&c.UDPKey, "udp-key", c.UDPKey, "what udp sessions are keyed by: src (client address and port)|ip|payload (first -key-bytes bytes of each datagram)")
+	fs.DurationVar(&c.UDPIdleTimeout, "udp-idle-timeout", c.UDPIdleTimeout, "close a udp session after this long without datagrams either way")
+	fs.StringVar(&c.Hash, "hash", c.Hash, "hash function for simple/consistent hashing: fnv|sha256 (default per strategy)")
+	fs.IntVar(&c.MaxConns, "max-conns", c.MaxConns, "max concurrent client connections; when reached, accepting pauses (see -accept-backoff) (0 = unlimited)")
+	fs.IntVar(&c.Acceptors, "acceptors", c.Acceptors, "SO_REUSEPORT listeners (and accept loops) per listen address, for high connection rates (Linux)")
+	fs.IntVar(&c.MaxConnsPerIP, "max-conns-per-ip", c.MaxConnsPerIP, "max concurrent connections from one client IP; more are rejected (0 = unlimited)")
+	fs.DurationVar(&c.AcceptBackoff, "accept-backoff", c.AcceptBackoff, "longest accept pause while -max-conns is reached (0 = accept and reject at once)")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", c.ReadTimeout, "close a connection when a read waits this long without data, refreshed on progress (0 = off)")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "close a connection when a write blocks this long, refreshed on progress (0 = off)")
+	fs.DurationVar(&c.RequestTimeout, "request-timeout", c.RequestTimeout, "absolute limit from backend connect to close; in tcp mode a connection lifetime cap (0 = off)")
+	fs.StringVar(&c.LatencyBuckets, "latency-buckets", c.LatencyBuckets, "upper bounds in seconds of the per-backend duration histograms in /metrics")
+	fs.IntVar(&c.MaglevTableSize, "maglev-table", c.MaglevTableSize, "maglev: lookup table size, a prime well above the backend count (larger spreads more evenly)")
+	fs.IntVar(&c.VNodes, "vnodes", c.VNodes, "ch: ring positions per backend and unit of weight (more spreads keys more evenly)")
+	fs.IntVar(&c.DRRQuantum, "drr-quantum", c.DRRQuantum, "drr: connections in a row the heaviest backend takes per visit, lighter ones proportionally fewer")
+	fs.IntVar(&c.SpillAt, "spill-at", c.SpillAt, "ch: send a key to the next ring node while its backend has this many active connections; zone: go remote while every local backend has (0 = off)")
+	fs.StringVar(&c.Zone, "zone", c.Zone, "zone: this LB's zone; the zone strategy prefers backends labeled with it")
+	fs.DurationVar(&c.EWMADecay, "ewma-decay", c.EWMADecay, "p2c: time for a backend's peak-EWMA latency to forget 1/e of its past samples")
+	fs.IntVar(&c.Retries, "retries", c.Retries, "other backends to try when a backend refuses the connection (0 = off)")
+	fs.Float64Var(&c.RetryBudget, "retry-budget", c.RetryBudget, "retries allowed as a fraction of requests, e.g. 0.1 = at most 10% extra dials")
+	fs.DurationVar(&c.HedgeDelay, "hedge-delay", c.HedgeDelay, "http mode: hedge a GET/HEAD to another backend when unanswered after this long (0 = off)")
+	fs.BoolVar(&c.HappyEyeballs, "happy-eyeballs", c.HappyEyeballs, "race all resolved addresses of a backend hostname, first to connect wins")
+	fs.StringVar(&c.Mirror, "mirror", c.Mirror, "http mode: also send requests to this backend (host:port or unix:/path) and discard its responses (empty = off)")
+	fs.Float64Var(&c.MirrorPercent, "mirror-percent", c.MirrorPercent, "percentage of requests -mirror gets a copy of")
+	fs.StringVar(&c.DialSource, "dial-source", c.DialSource, "local IP to dial backends from on multi-homed hosts (empty = kernel's choice)")
+	fs.BoolVar(&c.BackendTLS.Enabled, "backend-tls", c.BackendTLS.Enabled, "connect to backends over TLS")
+	fs.StringVar(&c.BackendTLS.CAFile, "backend-ca", c.BackendTLS.CAFile, "PEM CA bundle backend certificates are verified against (empty = system roots)")
+	fs.StringVar(&c.BackendTLS.CertFile, "backend-cert", c.BackendTLS.CertFile, "client certificate presented to backends, for mutual TLS")
+	fs.StringVar(&c.BackendTLS.KeyFile, "backend-key", c.BackendTLS.KeyFile, "key for -backend-cert")
+	fs.StringVar(&c.BackendTLS.ServerName, "backend-server-name", c.BackendTLS.ServerName, "name backend certificates are verified against and sent as SNI (empty = the backend's host)")
+	fs.BoolVar(&c.BackendTLS.InsecureSkipVerify, "backend-insecure", c.BackendTLS.InsecureSkipVerify, "accept any backend certificate, for testing with self-signed ones")
+	fs.StringVar(&c.ProxyProtocol, "proxy-protocol", c.ProxyProtocol, "send backends a PROXY protocol header with the client's address: v1|v2 (empty = off)")
+	fs.DurationVar(&c.ResolveTTL, "resolve-ttl", c.ResolveTTL, "how long backend name lookups are cached for -happy-eyeballs")
+	fs.DurationVar(&c.DNSRefresh, "dns-refresh", c.DNSRefresh, "expand hostname backends into one backend per resolved address, re-resolved this often (0 = off)")
+	fs.DurationVar(&c.ShutdownGrace, "shutdown-grace", c.ShutdownGrace, "time in-flight connections get to finish on exit/SIGTERM")
+	fs.IntVar(&c.RemapSample, "remap-sample", c.RemapSample, "synthetic keys to measure churn on at every add/remove/strategy change (0 = demo keys only)")
+	fs.Int64Var(&c.Seed, "seed", c.Seed, "random seed for reproducible random selection and simulate runs (0 = time based)")
+	fs.StringVar(&c.RequestIDHeader, "request-id-header", c.RequestIDHeader, "header carrying the request id in http mode (empty = off)")
+	fs.BoolVar(&c.RequestIDOverwrite, "request-id-overwrite", c.RequestIDOverwrite, "replace a request id the client already sent")
+	fs.StringVar(&c.BackendHeader, "backend-header", c.BackendHeader, "http mode: response header naming the backend that served it, e.g. X-Backend (empty = off)")
+	fs.BoolVar(&c.BackendHeaderID, "backend-header-id", c.BackendHeaderID, "put the backend ID instead of its address in -backend-header")
+	fs.BoolVar(&c.AllowBackendOverride, "allow-backend-override", c.AllowBackendOverride, "http mode: let a request pick its backend with -backend-override-header")
+	fs.StringVar(&c.BackendOverrideHeader, "backend-override-header", c.BackendOverrideHeader, "request header naming the backend (address or ID) to pin the request to")
+	fs.StringVar(&c.BackendOverrideSecret, "backend-override-secret", c.BackendOverrideSecret, "value requests must send in X-LB-Override-Secret for an override to apply (empty = none needed)")
+	fs.StringVar(&c.AdminAddr, "admin", c.AdminAddr, "admin listen address for probes, /stats, /metrics and the admin routes (empty = off; :9091 for all interfaces)")
+	fs.StringVar(&c.AdminToken, "admin-token", c.AdminToken, "bearer token the admin routes that change state require (empty = none needed)")
+	fs.BoolVar(&c.Affinity, "affinity", c.Affinity, "pin each key to its first backend until the session expires")
+	fs.DurationVar(&c.AffinityTTL, "affinity-ttl", c.AffinityTTL, "idle time after which an affinity session expires (0 = never)")
+	fs.DurationVar(&c.SlowStart, "slow-start", c.SlowStart, "ramp a backend added at runtime up to its full share over this long (0 = off)")
+	fs.IntVar(&c.AffinityMaxEntries, "affinity-max", c.AffinityMaxEntries, "most affinity sessions kept; the least recently used is evicted beyond it (0 = unbounded)")
+	fs.StringVar(&c.HealthCheck.Mode, "hc-mode", c.HealthCheck.Mode, "active health check: off|tcp|http|grpc")
+	fs.StringVar(&c.HealthCheck.Path, "hc-path", c.HealthCheck.Path, "http health check path")
+	fs.StringVar(&c.HealthCheck.Method, "hc-method", c.HealthCheck.Method, "http health check method")
+	fs.StringVar(&c.HealthCheck.Expect, "hc-expect", c.HealthCheck.Expect, "http statuses counted as healthy, e.g. 200,204 or 200-399")
+	fs.StringVar(&c.HealthCheck.Body, "hc-body", c.HealthCheck.Body, "text the http check response body must contain (empty = any body)")
+	fs.StringVar(&c.HealthCheck.GRPCService, "hc-grpc-service", c.HealthCheck.GRPCService, "service the grpc health check asks about (empty = the whole server)")
+	fs.DurationVar(&c.HealthCheck.Timeout, "hc-timeout", c.HealthCheck.Timeout, "health check timeout")
+	fs.DurationVar(&c.HealthCheck.Interval, "hc-interval", c.HealthCheck.Interval, "time between health check rounds")
+	fs.IntVar(&c.HealthCheck.Healthy, "hc-healthy", c.HealthCheck.Healthy, "consecutive passes that mark a backend up")
+	fs.IntVar(&c.HealthCheck.Unhealthy, "hc-unhealthy", c.HealthCheck.Unhealthy, "consecutive failures that mark a backend down")
+	fs.StringVar(&c.HealthCheck.WeightHeader, "hc-weight-header", c.HealthCheck.WeightHeader, "http check response header a backend reports its weight in, e.g. X-LB-Weight (empty = off)")
+	fs.IntVar(&c.PassiveFailThreshold, "fail-threshold", c.PassiveFailThreshold, "failed dials (and 5xx responses in http mode, 5xx and failing grpc-status in grpc mode) within -fail-window that mark a backend unhealthy (0 = off)")
+	fs.DurationVar(&c.PassiveFailWindow, "fail-window", c.PassiveFailWindow, "window for counting backend failures")
+	fs.DurationVar(&c.PassiveProbation, "fail-probation", c.PassiveProbation, "time a backend marked unhealthy by -fail-threshold sits out before it is tried again, without active checks (0 = until an active check passes)")
+	fs.StringVar(&c.HealthWebhook, "health-webhook", c.HealthWebhook, "URL to POST a JSON event to whenever a backend turns healthy or unhealthy (empty = off)")
+	fs.IntVar(&c.Breaker.Failures, "cb-failures", c.Breaker.Failures, "consecutive failures that open a backend's circuit (0 = off)")
+	fs.Float64Var(&c.Breaker.ErrorRate, "cb-error-rate", c.Breaker.ErrorRate, "share of failed results within -cb-window that opens a backend's circuit, e.g. 0.5 (0 = off)")
+	fs.IntVar(&c.Breaker.MinRequests, "cb-min-requests", c.Breaker.MinRequests, "results a -cb-window needs before -cb-error-rate applies")
+	fs.DurationVar(&c.Breaker.Window, "cb-window", c.Breaker.Window, "window for -cb-error-rate")
+	fs.DurationVar(&c.Breaker.Cooldown, "cb-cooldown", c.Breaker.Cooldown, "time an open circuit stays open before going half-open")
+	fs.IntVar(&c.Breaker.Probes, "cb-probes", c.Breaker.Probes, "requests a half-open circuit admits; all must succeed to close it")
+	fs.DurationVar(&c.Outlier.Interval, "outlier-interval", c.Outlier.Interval, "time between outlier detection rounds, e.g. 10s (0 = off)")
+	fs.DurationVar(&c.Outlier.BaseEjection, "outlier-ejection", c.Outlier.BaseEjection, "how long an outlier is ejected, times the number of its ejections")
+	fs.DurationVar(&c.Outlier.MaxEjection, "outlier-max-ejection", c.Outlier.MaxEjection, "longest an outlier is ejected")
+	fs.IntVar(&c.Outlier.MaxEjectionPercent, "outlier-max-percent", c.Outlier.MaxEjectionPercent, "most of a pool, in percent, ejected at once (at least one backend, never all)")
+	fs.IntVar(&c.Outlier.MinRequests, "outlier-min-requests", c.Outlier.MinRequests, "results, and connects for latency, a backend needs in a round to be compared")
+	fs.IntVar(&c.Outlier.MinHosts, "outlier-min-hosts", c.Outlier.MinHosts, "backends a pool needs with enough results for a comparison")
+	fs.Float64Var(&c.Outlier.StdevFactor, "outlier-stdev-factor", c.Outlier.StdevFactor, "standard deviations from the pool mean success rate or p99 connect time that make an outlier")
+}
+
+func (c *Config) Validate() error {
+	switch c.Mode {
+	case ModeTCP, ModeHTTP, ModeGRPC, ModeAuto:
+	default:
+		return fmt.Errorf("invalid mode %q (want tcp, http, grpc or auto)", c.Mode)
+	}
+	if _, err := NewKeyExtractor(c.Key, c.KeyBytes, 0); err != nil {
+		return fmt.Errorf("-key: %w", err)
+	}
+	if c.Persist && c.ConfigFile == "" {
+		return fmt.Errorf("-persist requires -config")
+	}
+	if len(c.Listeners) == 0 {
+		return fmt.Errorf("at least one -listen address is required")
+	}
+	if c.UDPListen != "" {
+		if _, _, err := net.SplitHostPort(c.UDPListen); err != nil {
+			return fmt.Errorf("-udp-listen: %w", err)
+		}
+		switch c.UDPKey {
+		case UDPKeySrc, UDPKeyIP, UDPKeyPayload:
+		default:
+			return fmt.Errorf("invalid -udp-key %q (want src, ip or payload)", c.UDPKey)
+		}
+		if c.UDPIdleTimeout <= 0 {
+			return fmt.Errorf("-udp-idle-timeout must be > 0")
+		}
+	}
+	if _, err := NewHasher(c.Hash); err != nil {
+		return err
+	}
+	if err := checkBackends(c.Backends); err != nil {
+		return err
+	}
+	for _, g := range c.Groups {
+		if err := checkBackends(g.Backends); err != nil {
+			return fmt.Errorf("group %s: %w", g.Name, err)
+		}
+		if len(g.SNI) > 0 && (c.Mode == ModeHTTP || c.Mode == ModeGRPC) {
+			return fmt.Errorf("group %s: sni routing needs -mode tcp or auto", g.Name)
+		}
+	}
+	if c.Acceptors < 1 {
+		return fmt.Errorf("-acceptors must be >= 1")
+	}
+	if c.MaxConnsPerIP < 0 {
+		return fmt.Errorf("-max-conns-per-ip must be >= 0")
+	}
+	if c.MaxConns < 0 {
+		return fmt.Errorf("-max-conns must be >= 0")
+	}
+	if c.RemapSample < 0 || c.RemapSample > MaxSimulateRequests {
+		return fmt.Errorf("-remap-sample must be between 0 and %d", MaxSimulateRequests)
+	}
+	if c.AcceptBackoff < 0 {
+		return fmt.Errorf("-accept-backoff must be >= 0")
+	}
+	if c.ReadTimeout < 0 || c.WriteTimeout < 0 {
+		return fmt.Errorf("-read-timeout and -write-timeout must be >= 0")
+	}
+	if c.RequestTimeout < 0 {
+		return fmt.Errorf("-request-timeout must be >= 0")
+	}
+	if c.ShutdownGrace < 0 {
+		return fmt.Errorf("-shutdown-grace must be >= 0")
+	}
+	bounds, err := parseBuckets(c.LatencyBuckets)
+	if err != nil {
+		return fmt.Errorf("-latency-buckets: %w", err)
+	}
+	c.latencyBounds = bounds
+	if c.SpillAt < 0 {
+		return fmt.Errorf("-spill-at must be >= 0")
+	}
+	if c.EWMADecay <= 0 {
+		return fmt.Errorf("-ewma-decay must be > 0")
+	}
+	if err := checkVNodes(c.VNodes); err != nil {
+		return fmt.Errorf("-vnodes: %w", err)
+	}
+	if err := checkDRRQuantum(c.DRRQuantum); err != nil {
+		return fmt.Errorf("-drr-quantum: %w", err)
+	}
+	if !isPrime(c.MaglevTableSize) {
+		return fmt.Errorf("-maglev-table must be a prime, got %d", c.MaglevTableSize)
+	}
+	if c.Retries < 0 {
+		return fmt.Errorf("-retries must be >= 0")
+	}
+	if c.RetryBudget < 0 {
+		return fmt.Errorf("-retry-budget must be >= 0")
+	}
+	if c.HedgeDelay < 0 {
+		return fmt.Errorf("-hedge-delay must be >= 0")
+	}
+	if c.HappyEyeballs && c.ResolveTTL <= 0 {
+		return fmt.Errorf("-resolve-ttl must be > 0")
+	}
+	if c.DNSRefresh < 0 {
+		return fmt.Errorf("-dns-refresh must be >= 0")
+	}
+	if c.Mirror != "" {
+		if _, err := ParseBackendAddr(c.Mirror); err != nil {
+			return fmt.Errorf("-mirror: %w", err)
+		}
+	}
+	if c.MirrorPercent < 0 || c.MirrorPercent > 100 {
+		return fmt.Errorf("-mirror-percent must be between 0 and 100")
+	}
+	if err := c.BackendTLS.check(); err != nil {
+		return err
+	}
+	if c.Mode == ModeGRPC && c.BackendTLS.Enabled {
+		return fmt.Errorf("-backend-tls is not supported in grpc mode")
+	}
+	for _, bc := range c.Backends {
+		if c.Mode == ModeGRPC && bc.TLS != nil && bc.TLS.Enabled {
+			return fmt.Errorf("backend %s: backend TLS is not supported in grpc mode", bc.addr())
+		}
+	}
+	for _, g := range c.Groups {
+		if g.TLS != nil {
+			if err := g.TLS.check(); err != nil {
+				return fmt.Errorf("group %s: %w", g.Name, err)
+			}
+		}
+	}
+	switch c.ProxyProtocol {
+	case "", ProxyProtocolV1, ProxyProtocolV2:
+	default:
+		return fmt.Errorf("invalid -proxy-protocol %q (want v1 or v2)", c.ProxyProtocol)
+	}
+	if c.Mode == ModeGRPC && c.ProxyProtocol != "" {
+		return fmt.Errorf("-proxy-protocol is not supported in grpc mode")
+	}
+	for _, lc := range c.Listeners {
+		if lc.HTTP3 && c.Mode != ModeHTTP {
+			return fmt.Errorf("listener %s: h3 needs -mode http", lc.Addr)
+		}
+	}
+	if c.DialSource != "" {
+		if err := checkDialSource(c.DialSource); err != nil {
+			return fmt.Errorf("-dial-source: %w", err)
+		}
+	}
+	if c.AllowBackendOverride && c.BackendOverrideHeader == "" {
+		return fmt.Errorf("-allow-backend-override needs a -backend-override-header")
+	}
+	if c.AffinityTTL < 0 {
+		return fmt.Errorf("-affinity-ttl must be >= 0")
+	}
+	if c.SlowStart < 0 {
+		return fmt.Errorf("-slow-start must be >= 0")
+	}
+	if c.AffinityMaxEntries < 0 {
+		return fmt.Errorf("-affinity-max must be >= 0")
+	}
+	if err := c.HealthCheck.Validate(); err != nil {
+		return err
+	}
+	if c.HealthWebhook != "" {
+		if err := checkWebhookURL(c.HealthWebhook); err != nil {
+			return err
+		}
+	}
+	if err := c.Breaker.Validate(); err != nil {
+		return err
+	}
+	if err := c.Outlier.Validate(); err != nil {
+		return err
+	}
+	if c.PassiveFailThreshold < 0 {
+		return fmt.Errorf("-fail-threshold must be >= 0")
+	}
+	if c.PassiveProbation < 0 {
+		return fmt.Errorf("-fail-probation must be >= 0")
+	}
+	if c.PassiveFailThreshold > 0 && c.PassiveFailWindow <= 0 {
+		return fmt.Errorf("-fail-window must be > 0")
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package loadbalancer
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseEnvBackends(t *testing.T) {
+	for in, want := range map[string][]BackendConfig{
+		"app:8081":                {{Host: "app", Port: 8081, Weight: 1}},
+		"app:8081:3, db:8082":     {{Host: "app", Port: 8081, Weight: 3}, {Host: "db", Port: 8082, Weight: 1}},
+		"[::1]:8081":              {{Host: "::1", Port: 8081, Weight: 1}},
+		"[::1]:8081:2":            {{Host: "::1", Port: 8081, Weight: 2}},
+		"app:8081:0,":             {{Host: "app", Port: 8081, Weight: 0}},
+		"unix:/run/app.sock":      {{Path: "/run/app.sock", Weight: 1}},
+		"10.0.0.1:80,unix:/a.sck": {{Host: "10.0.0.1", Port: 80, Weight: 1}, {Path: "/a.sck", Weight: 1}},
+	} {
+		got, err := parseEnvBackends(in)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("parseEnvBackends(%q) = %v, %v, want %v", in, got, err, want)
+		}
+	}
+}
+
+func TestParseEnvBackendsMalformed(t *testing.T) {
+	for _, in := range []string{
+		"",
+		" , ",
+		"app",              // no port
+		"app:",             // empty port
+		"app:http",         // named port
+		"app:8081:x",       // weight not a number
+		"app:8081:-1",      // negative weight
+		"app:8081:1001",    // weight over maxWeight
+		"app:8081:1:2",     // too many fields
+		"app:0",            // port out of range
+		"app:65536",        // port out of range
+		"::1:8081",         // IPv6 without brackets
+		"unix:",            // empty socket path
+		"app:8081,db:port", // one bad entry spoils the list
+	} {
+		if got, err := parseEnvBackends(in); err == nil {
+			t.Errorf("parseEnvBackends(%q) = %v, want an error", in, got)
+		}
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	t.Setenv("LB_BACKENDS", "app:8081:2")
+	t.Setenv("LB_STRATEGY", "round-robin")
+	cfg := DefaultConfig()
+	if err := cfg.LoadEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []BackendConfig{{Host: "app", Port: 8081, Weight: 2}}; !reflect.DeepEqual(cfg.Backends, want) || cfg.Strategy != "round-robin" {
+		t.Fatalf("from the environment: %v, %q", cfg.Backends, cfg.Strategy)
+	}
+
+	// a config file takes precedence over the environment
+	cfg = DefaultConfig()
+	cfg.ConfigFile = "lb.yaml"
+	before := cfg.Backends
+	if err := cfg.LoadEnv(); err != nil || !reflect.DeepEqual(cfg.Backends, before) {
+		t.Fatalf("with a config file: %v, %v", cfg.Backends, err)
+	}
+
+	for env, val := range map[string]string{"LB_BACKENDS": "app:8081:x", "LB_STRATEGY": "bogus"} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv(env, val)
+			cfg := DefaultConfig()
+			if err := cfg.LoadEnv(); err == nil || !strings.HasPrefix(err.Error(), env+": ") {
+				t.Fatalf("%s=%s: %v, want an error naming %s", env, val, err, env)
+			}
+		})
+	}
+}
+
+func TestCheckPool(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Backends = nil
+	cfg.ConfigFile = "lb.yaml"
+	if err := cfg.CheckPool(); err == nil || !strings.Contains(err.Error(), "-allow-empty") {
+		t.Fatalf("empty config file: %v, want an error pointing at -allow-empty", err)
+	}
+
+	cfg.AllowEmpty = true
+	if err := cfg.CheckPool(); err != nil || len(cfg.Backends) != 0 {
+		t.Fatalf("-allow-empty: %v, %v, want an empty pool", cfg.Backends, err)
+	}
+
+	cfg.AllowEmpty = false
+	cfg.Groups = []GroupConfig{{Name: "api", Prefix: "/api", Backends: []BackendConfig{{Host: "app", Port: 8081, Weight: 1}}}}
+	if err := cfg.CheckPool(); err != nil || len(cfg.Backends) != 0 {
+		t.Fatalf("backends only in a group: %v, %v", cfg.Backends, err)
+	}
+
+	// with nothing configured anywhere, the demo pool
+	cfg = DefaultConfig()
+	cfg.Backends = nil
+	if err := cfg.CheckPool(); err != nil || !reflect.DeepEqual(cfg.Backends, demoBackends) {
+		t.Fatalf("nothing configured: %v, %v, want the demo pool", cfg.Backends, err)
+	}
+}
@@ -0,0 +1,259 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ---------------------- Config File ----------------------
+// -config points at a YAML file holding the pool and strategy, plus optional
+// groups routed by path prefix in HTTP mode or by TLS server name (sni:) in
+// TCP mode:
+//
+//	strategy: ch
+//	backends:
+//	  - host: localhost
+//	    port: 8081
+//	groups:
+//	  - name: static
+//	    prefix: /static
+//	    strategy: rr
+//	    backends:
+//	      - port: 8091
+//
+// With -persist the LB writes its live pool and strategy back to the same file
+// after every applied change, so a restart picks up where it left off.
+
+type FileConfig struct {
+	Strategy string          `yaml:"strategy,omitempty"`
+	Backends []BackendConfig `yaml:"backends"`
+	Groups   []GroupConfig   `yaml:"groups,omitempty"`
+}
+
+type BackendConfig struct {
+	ID     string `yaml:"id,omitempty"`
+	Host   string `yaml:"host,omitempty"`
+	Port   int    `yaml:"port,omitempty"`
+	Path   string `yaml:"path,omitempty"` // Unix socket; replaces host/port
+	Weight int    `yaml:"weight"`
+
+	// Priority is the tier for the priority strategy, 0 first.
+	Priority int `yaml:"priority,omitempty"`
+
+	// Zone is the locality label the zone strategy matches against -zone.
+	Zone string `yaml:"zone,omitempty"`
+
+	// Disabled keeps an operator's `disable` across restarts.
+	Disabled bool `yaml:"disabled,omitempty"`
+
+	// Drain takes the backend out of rotation while its connections finish.
+	Drain bool `yaml:"drain,omitempty"`
+
+	// HealthCheck overrides the http check's path, statuses or body, or the
+	// grpc check's service.
+	HealthCheck *BackendHealthCheck `yaml:"health_check,omitempty"`
+
+	// TLS replaces the pool's backend TLS settings for this backend.
+	TLS *BackendTLSConfig `yaml:"tls,omitempty"`
+}
+
+// addr is the String() of the backend bc describes.
+func (bc BackendConfig) addr() string {
+	return (&Backend{Host: bc.Host, Port: bc.Port, Path: bc.Path}).String()
+}
+
+// UnmarshalYAML defaults a missing weight to 1 while keeping an explicit 0.
+func (b *BackendConfig) UnmarshalYAML(n *yaml.Node) error {
+	type plain BackendConfig
+	p := plain{Weight: 1}
+	if err := n.Decode(&p); err != nil {
+		return err
+	}
+	*b = BackendConfig(p)
+	return nil
+}
+
+func LoadFileConfig(path string) (FileConfig, error) {
+	var fc FileConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fc, err
+	}
+	if err := yaml.Unmarshal(data, &fc); err != nil {
+		return fc, fmt.Errorf("%s: %w", path, err)
+	}
+	if _, err := canonicalStrategy(fc.Strategy); err != nil {
+		return fc, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := checkBackends(fc.Backends); err != nil {
+		return fc, fmt.Errorf("%s: %w", path, err)
+	}
+	names := make(map[string]bool)
+	serverNames := make(map[string]string) // to the group claiming it
+	for i := range fc.Groups {
+		g := &fc.Groups[i]
+		if g.Name == "" || names[g.Name] {
+			return fc, fmt.Errorf("%s: group %d: missing or duplicate name %q", path, i, g.Name)
+		}
+		names[g.Name] = true
+		if g.Prefix == "" && len(g.SNI) == 0 {
+			return fc, fmt.Errorf("%s: group %s: needs a prefix or sni names to route by", path, g.Name)
+		}
+		if g.Prefix != "" && !strings.HasPrefix(g.Prefix, "/") {
+			return fc, fmt.Errorf("%s: group %s: prefix must start with /", path, g.Name)
+		}
+		for j, s := range g.SNI {
+			s = strings.ToLower(s)
+			if err := checkServerName(s); err != nil {
+				return fc, fmt.Errorf("%s: group %s: %w", path, g.Name, err)
+			}
+			if other, dup := serverNames[s]; dup {
+				return fc, fmt.Errorf("%s: group %s: sni %s is already group %s's", path, g.Name, s, other)
+			}
+			serverNames[s] = g.Name
+			g.SNI[j] = s
+		}
+		if _, err := canonicalStrategy(g.Strategy); err != nil {
+			return fc, fmt.Errorf("%s: group %s: %w", path, g.Name, err)
+		}
+		if err := checkBackends(g.Backends); err != nil {
+			return fc, fmt.Errorf("%s: group %s: %w", path, g.Name, err)
+		}
+		if g.TLS != nil {
+			if err := g.TLS.check(); err != nil {
+				return fc, fmt.Errorf("%s: group %s: %w", path, g.Name, err)
+			}
+		}
+	}
+	return fc, nil
+}
+
+// checkBackends validates bcs in place, defaulting the host to localhost.
+func checkBackends(bcs []BackendConfig) error {
+	for i := range bcs {
+		if err := bcs[i].check(); err != nil {
+			return fmt.Errorf("backend %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// maxWeight caps a backend's weight, configured or reported by its health
+// check; the ring strategies give a backend positions per unit of it.
+const maxWeight = 1000
+
+// check validates bc, defaulting the host to localhost.
+func (bc *BackendConfig) check() error {
+	if bc.Path != "" {
+		if bc.Host != "" || bc.Port != 0 {
+			return fmt.Errorf("path excludes host and port")
+		}
+	} else {
+		if bc.Host == "" {
+			bc.Host = "localhost"
+		}
+		if err := checkPort(bc.Port); err != nil {
+			return err
+		}
+	}
+	if bc.Weight < 0 {
+		return fmt.Errorf("negative weight %d", bc.Weight)
+	}
+	if bc.Weight > maxWeight {
+		return fmt.Errorf("weight %d over the maximum of %d", bc.Weight, maxWeight)
+	}
+	if bc.Priority < 0 {
+		return fmt.Errorf("negative priority %d", bc.Priority)
+	}
+	if bc.TLS != nil {
+		if err := bc.TLS.check(); err != nil {
+			return fmt.Errorf("tls: %w", err)
+		}
+	}
+	if bc.HealthCheck != nil {
+		return bc.HealthCheck.check()
+	}
+	return nil
+}
+
+// persistMu serializes writers so two quick mutations can't interleave their
+// temp files.
+var persistMu sync.Mutex
+
+// WriteFileConfig replaces path atomically: the YAML goes to a temp file in
+// the same directory which is then renamed over the original.
+func WriteFileConfig(path string, fc FileConfig) error {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(fc); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+
+	persistMu.Lock()
+	defer persistMu.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// fileConfigLocked captures the live pool and strategy in the file schema.
+// Callers must hold lb.mu.
+func (lb *LB) fileConfigLocked() FileConfig {
+	fc := FileConfig{Strategy: lb.strategyName, Backends: lb.poolConfigsLocked()}
+	for _, g := range lb.groups {
+		fc.Groups = append(fc.Groups, GroupConfig{
+			Name:     g.Name,
+			Prefix:   g.Prefix,
+			SNI:      g.SNI,
+			Strategy: g.strategyName,
+			Backends: backendConfigs(g.backends),
+			TLS:      g.tlsConfig,
+		})
+	}
+	return fc
+}
+
+func backendConfigs(backends []*Backend) []BackendConfig {
+	out := make([]BackendConfig, 0, len(backends))
+	for _, b := range backends {
+		out = append(out, BackendConfig{ID: b.ID, Host: b.Host, Port: b.Port, Path: b.Path, Weight: b.Weight, Priority: b.Priority, Zone: b.Zone, Disabled: b.AdminDisabled, Drain: b.Draining, HealthCheck: b.healthCheck, TLS: b.tlsConfig})
+	}
+	return out
+}
+
+// persist writes the current state back to -config when -persist is on.
+func (lb *LB) persist() {
+	if !lb.cfg.Persist || lb.cfg.ConfigFile == "" {
+		return
+	}
+	lb.mu.Lock()
+	fc := lb.fileConfigLocked()
+	lb.mu.Unlock()
+	if err := WriteFileConfig(lb.cfg.ConfigFile, fc); err != nil {
+		log.Printf("persist %s: %s", lb.cfg.ConfigFile, err)
+	}
+}
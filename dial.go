@@ -0,0 +1,266 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ---------------------- Backend Dialing ----------------------
+// every TCP backend connection goes through lb.dialer, so -dial-source pins
+// its local address. With -happy-eyeballs a backend hostname is resolved to
+// all of its addresses (cached for -resolve-ttl) and they are dialed in a
+// staggered race; the first to connect wins, so one dead address or address
+// family costs at most a stagger step instead of a full connect timeout. The
+// race alternates IPv6 and IPv4 addresses, starting with the resolver's
+// preferred family, so a whole family being unreachable costs one step too.
+
+// happyEyeballsStagger is the delay before starting the next attempt
+// (RFC 8305 "Connection Attempt Delay").
+const happyEyeballsStagger = 250 * time.Millisecond
+
+type resolved struct {
+	addrs   []string
+	expires time.Time
+}
+
+type resolveCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	clock   clock
+	entries map[string]resolved
+}
+
+func newResolveCache(ttl time.Duration, clock clock) *resolveCache {
+	return &resolveCache{ttl: ttl, clock: clock, entries: make(map[string]resolved)}
+}
+
+func (c *resolveCache) lookup(ctx context.Context, host string) ([]string, error) {
+	now := c.clock.Now()
+	c.mu.Lock()
+	e, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.addrs, nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.entries[host] = resolved{addrs: addrs, expires: now.Add(c.ttl)}
+	c.mu.Unlock()
+	return addrs, nil
+}
+
+// forget drops host's cached addresses; a backend still using host resolves
+// it again on its next dial.
+func (c *resolveCache) forget(host string) {
+	c.mu.Lock()
+	delete(c.entries, host)
+	c.mu.Unlock()
+}
+
+// dialBackend opens a connection to b, with the TLS handshake done when b's
+// pool has backend TLS on.
+func (lb *LB) dialBackend(b *Backend) (net.Conn, error) {
+	return lb.dialBackendFor(nil, b)
+}
+
+// dialBackendFor is dialBackend for a connection that carries client's
+// traffic: with -proxy-protocol it starts with the header describing client.
+func (lb *LB) dialBackendFor(client net.Conn, b *Backend) (net.Conn, error) {
+	lb.mu.Lock()
+	cfg := b.tls // a reload may replace it
+	lb.mu.Unlock()
+	conn, err := lb.dialBackendRaw(b)
+	if err != nil {
+		return nil, err
+	}
+	if client != nil && lb.cfg.ProxyProtocol != "" {
+		if _, err := conn.Write(proxyHeader(lb.cfg.ProxyProtocol, client)); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("sending proxy protocol header to %s: %w", b, err)
+		}
+	}
+	if cfg == nil {
+		return conn, nil
+	}
+	return handshakeBackend(conn, b, cfg)
+}
+
+// dialBackendRaw connects to b, racing its resolved addresses when happy
+// eyeballs is on and the host is a name rather than an IP literal.
+func (lb *LB) dialBackendRaw(b *Backend) (net.Conn, error) {
+	d := lb.dialerFor(b)
+	if lb.resolver == nil || b.Path != "" || net.ParseIP(b.Host) != nil {
+		network, address := b.network()
+		return d.Dial(network, address)
+	}
+	ctx := context.Background()
+	addrs, err := lb.resolver.lookup(ctx, b.Host)
+	if err != nil {
+		return nil, err
+	}
+	if src, ok := d.LocalAddr.(*net.TCPAddr); ok {
+		// a bound source can only reach addresses of its own family
+		if addrs = sameFamily(addrs, src.IP); len(addrs) == 0 {
+			return nil, fmt.Errorf("%s has no address reachable from -dial-source %s", b.Host, src.IP)
+		}
+	}
+	addrs = interleaveFamilies(addrs)
+	port := strconv.Itoa(b.Port)
+	targets := make([]string, len(addrs))
+	for i, a := range addrs {
+		targets[i] = net.JoinHostPort(a, port)
+	}
+	return raceDial(ctx, d, targets, happyEyeballsStagger)
+}
+
+// dialerFor is the dialer for b: the LB's for TCP backends, a plain one for
+// Unix sockets, which a TCP source address can't be bound to.
+func (lb *LB) dialerFor(b *Backend) net.Dialer {
+	if b.Path != "" {
+		return net.Dialer{}
+	}
+	return lb.dialer
+}
+
+// sameFamily keeps the addresses of the same IP family as ip.
+func sameFamily(addrs []string, ip net.IP) []string {
+	v4 := ip.To4() != nil
+	var out []string
+	for _, a := range addrs {
+		if p := net.ParseIP(a); p != nil && (p.To4() != nil) == v4 {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// interleaveFamilies reorders addrs to alternate address families, starting
+// with the family of the first (RFC 8305 section 4), keeping each family's
+// own order.
+func interleaveFamilies(addrs []string) []string {
+	var v4, v6 []string
+	for _, a := range addrs {
+		if net.ParseIP(a).To4() != nil {
+			v4 = append(v4, a)
+		} else {
+			v6 = append(v6, a)
+		}
+	}
+	first, second := v6, v4
+	if len(addrs) > 0 && net.ParseIP(addrs[0]).To4() != nil {
+		first, second = v4, v6
+	}
+	out := make([]string, 0, len(addrs))
+	for i := range max(len(first), len(second)) {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
+
+// checkDialSource verifies ip is an address of this host by binding it.
+func checkDialSource(ip string) error {
+	if net.ParseIP(ip) == nil {
+		return fmt.Errorf("%q is not an IP address", ip)
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(ip, "0"))
+	if err != nil {
+		return err
+	}
+	return l.Close()
+}
+
+// backendKey carries the *Backend an HTTP request is meant for in its
+// context, so dialContext can reach it whatever the URL says.
+type backendKey struct{}
+
+// dialContext is the DialContext of the LB's HTTP transports: a request tagged
+// with backendKey dials that backend through dialBackend, which is how Unix
+// socket backends (and happy eyeballs) work behind an http.Client.
+func (lb *LB) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if b, ok := ctx.Value(backendKey{}).(*Backend); ok {
+		return lb.dialBackend(b)
+	}
+	d := lb.dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+// urlHost is the host part of URLs aimed at b. A socket path can't be a URL
+// host, so Unix backends get a name derived from it, distinct per path since
+// transports pool connections by host; dialContext does the routing.
+func (b *Backend) urlHost() string {
+	if b.Path != "" {
+		return fmt.Sprintf("unix-%08x", FNVHasher{}.Sum32(b.Path))
+	}
+	return b.String()
+}
+
+// raceDial starts a dial with d to targets[i] after i*stagger (or as soon as
+// the previous attempt failed) and returns the first connection established.
+func raceDial(ctx context.Context, d net.Dialer, targets []string, stagger time.Duration) (net.Conn, error) {
+	if len(targets) == 1 {
+		return d.DialContext(ctx, "tcp", targets[0])
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(targets))
+	failed := make(chan struct{}, len(targets))
+	go func() {
+		for i, t := range targets {
+			if i > 0 {
+				select {
+				case <-time.After(stagger):
+				case <-failed:
+				case <-ctx.Done():
+					// still report it so the drain below sees every target
+					results <- result{err: ctx.Err()}
+					continue
+				}
+			}
+			go func() {
+				c, err := d.DialContext(ctx, "tcp", t)
+				if err != nil {
+					failed <- struct{}{}
+				}
+				results <- result{c, err}
+			}()
+		}
+	}()
+
+	var errs []error
+	for range targets {
+		r := <-results
+		if r.err == nil {
+			// losers still in flight are cancelled; any that connected anyway
+			// are closed as they arrive
+			go func(pending int) {
+				for ; pending > 0; pending-- {
+					if late := <-results; late.conn != nil {
+						_ = late.conn.Close()
+					}
+				}
+			}(len(targets) - len(errs) - 1)
+			return r.conn, nil
+		}
+		errs = append(errs, r.err)
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,129 @@
+package loadbalancer
+
+import (
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestHappyEyeballsSkipsDeadAddress(t *testing.T) {
+	be := httpBackend(t, "a")
+	cfg := testConfig(t, BackendConfig{Host: "multi.test", Port: be.Port, Weight: 1})
+	cfg.HappyEyeballs = true
+	lb := newTestLB(t, cfg)
+	// TEST-NET-1 never answers; the race must move on to loopback
+	lb.resolver.entries["multi.test"] = resolved{
+		addrs:   []string{"192.0.2.1", "127.0.0.1"},
+		expires: time.Now().Add(time.Hour),
+	}
+	startLB(t, lb)
+
+	start := time.Now()
+	if body, err := get(lb, "/"); err != nil || body != "a" {
+		t.Fatalf("through the LB: %q, %v", body, err)
+	}
+	if took := time.Since(start); took > 3*happyEyeballsStagger {
+		t.Fatalf("dial took %s, more than a couple of stagger steps", took)
+	}
+}
+
+func TestRaceDialFallsThroughRefused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	refused := freeAddr(t)
+	start := time.Now()
+	c, err := raceDial(t.Context(), net.Dialer{}, []string{refused, l.Addr().String()}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Close()
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("a refused attempt held the race up for %s", took)
+	}
+
+	if _, err := raceDial(t.Context(), net.Dialer{}, []string{refused}, time.Hour); err == nil {
+		t.Fatal("dialing only a refused address succeeded")
+	}
+}
+
+func TestResolveCacheExpires(t *testing.T) {
+	clk := newFakeClock()
+	c := newResolveCache(time.Minute, clk)
+	c.entries["multi.test"] = resolved{addrs: []string{"127.0.0.1"}, expires: clk.Now().Add(time.Minute)}
+	addrs, err := c.lookup(t.Context(), "multi.test")
+	if err != nil || !slices.Equal(addrs, []string{"127.0.0.1"}) {
+		t.Fatalf("cached lookup: %v, %v", addrs, err)
+	}
+	clk.Advance(2 * time.Minute)
+	// .test never resolves, so only the cache could answer
+	if addrs, err := c.lookup(t.Context(), "multi.test"); err == nil {
+		t.Fatalf("lookup past the TTL answered %v from the cache", addrs)
+	}
+}
+
+func TestInterleaveFamilies(t *testing.T) {
+	got := interleaveFamilies([]string{"::1", "::2", "10.0.0.1", "10.0.0.2", "10.0.0.3"})
+	want := []string{"::1", "10.0.0.1", "::2", "10.0.0.2", "10.0.0.3"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("interleaved %v, want %v", got, want)
+	}
+}
+
+func TestDialSource(t *testing.T) {
+	if err := checkDialSource("127.0.0.2"); err != nil {
+		t.Skipf("127.0.0.2 not bindable: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	sources := make(chan string, 100)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			sources <- c.RemoteAddr().(*net.TCPAddr).IP.String()
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+
+	cfg := testConfig(t, backendAt(t, l.Addr().String()))
+	cfg.DialSource = "127.0.0.2"
+	cfg.HealthCheck.Mode = HealthCheckTCP
+	cfg.HealthCheck.Interval = 20 * time.Millisecond
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	lb := newTestLB(t, cfg)
+	startLB(t, lb)
+	if !echoes(dialLB(t, lb), "ping") {
+		t.Fatal("connection not proxied")
+	}
+	// the proxied connection and at least one health probe
+	for range 2 {
+		select {
+		case src := <-sources:
+			if src != "127.0.0.2" {
+				t.Fatalf("backend saw a connection from %s, want 127.0.0.2", src)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no connection reached the backend")
+		}
+	}
+
+	cfg.DialSource = "192.0.2.1" // TEST-NET, not an address of this host
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("-dial-source with a foreign address validated")
+	}
+}
@@ -0,0 +1,269 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"time"
+)
+
+// ---------------------- DNS Discovery ----------------------
+// with -dns-refresh set, a main pool backend given by hostname
+// (app.internal:8080) stands for every address the name resolves to: the LB
+// looks it up at start and every -dns-refresh after, and keeps one backend per
+// A/AAAA record, each addressed by its IP and remembering the name it came
+// from. Addresses that appear are added (with slow start), vanished ones
+// removed, and the strategy rebuilt with the remap reported as for any pool
+// change. A failed lookup keeps the name's current backends, so a DNS outage
+// doesn't empty the pool. The name's weight, priority, zone, health check and
+// tls block apply to each of its backends, and backend TLS verifies them
+// against the name. `add` and `rm` take names too, -persist writes back the
+// name rather than its addresses, and a reload adds, drops or updates names
+// like any backend; state set on a single address (disable, prio) lasts until
+// that address leaves. localhost counts as an address, as do IP literals, and
+// groups and -mirror keep resolving on every dial.
+
+// dnsLookupTimeout bounds one name's lookup.
+const dnsLookupTimeout = 5 * time.Second
+
+// dnsName is a hostname backend standing for the addresses it resolves to.
+type dnsName struct {
+	bc  BackendConfig // Host is the name
+	tls *tls.Config   // for its backends, as backendTLSFor built it
+}
+
+// isDNSName reports whether bc names its backend by a hostname to discover.
+func isDNSName(bc BackendConfig) bool {
+	return bc.Path == "" && bc.Host != "localhost" && net.ParseIP(bc.Host) == nil
+}
+
+// discovering reports whether -dns-refresh is on.
+func (lb *LB) discovering() bool { return lb.cfg.DNSRefresh > 0 }
+
+// memberOf reports whether b was resolved from n.
+func (n *dnsName) memberOf(b *Backend) bool {
+	return b.Name == n.bc.Host && b.Port == n.bc.Port
+}
+
+// findNameLocked returns the name backend at addr (name:port), or nil.
+// Callers must hold lb.mu.
+func (lb *LB) findNameLocked(addr string) *dnsName {
+	for _, n := range lb.dnsNames {
+		if n.bc.addr() == addr {
+			return n
+		}
+	}
+	return nil
+}
+
+// runDNSRefresh re-resolves every name each -dns-refresh until shutdown;
+// started by Start after the first round.
+func (lb *LB) runDNSRefresh() {
+	ticker := time.NewTicker(lb.cfg.DNSRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lb.stopping:
+			return
+		case <-ticker.C:
+		}
+		lb.refreshNames()
+	}
+}
+
+func (lb *LB) refreshNames() {
+	lb.mu.Lock()
+	names := slices.Clone(lb.dnsNames)
+	lb.mu.Unlock()
+	for _, n := range names {
+		lb.refreshName(n)
+	}
+}
+
+// refreshName resolves n and brings its backends in line with the answer.
+func (lb *LB) refreshName(n *dnsName) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	addrs, err := net.DefaultResolver.LookupHost(ctx, n.bc.Host)
+	cancel()
+	if err == nil {
+		if src, ok := lb.dialer.LocalAddr.(*net.TCPAddr); ok {
+			// a bound source can only reach addresses of its own family
+			if addrs = sameFamily(addrs, src.IP); len(addrs) == 0 {
+				err = fmt.Errorf("no address reachable from -dial-source %s", src.IP)
+			}
+		}
+	}
+
+	lb.mu.Lock()
+	if !slices.Contains(lb.dnsNames, n) {
+		lb.mu.Unlock() // removed while we looked
+		return
+	}
+	if err != nil {
+		kept := 0
+		for _, b := range lb.backends {
+			if n.memberOf(b) {
+				kept++
+			}
+		}
+		lb.mu.Unlock()
+		log.Printf("dns: %s: %s; keeping its %d backends", n.bc.addr(), err, kept)
+		return
+	}
+	before := lb.remapSnapLocked()
+	changes := lb.syncNameLocked(n, addrs)
+	if len(changes) == 0 {
+		lb.mu.Unlock()
+		return
+	}
+	lb.strategy.Init(lb.backends)
+	after := lb.remapSnapLocked()
+	lb.mu.Unlock()
+
+	for _, c := range changes {
+		log.Printf("dns: %s: %s", n.bc.addr(), c)
+	}
+	lb.reportRemap("DNS "+n.bc.addr(), before, after)
+}
+
+// syncNameLocked adds a backend for each of addrs n has none for and removes
+// those whose address is gone, describing each change. Callers must hold
+// lb.mu.
+func (lb *LB) syncNameLocked(n *dnsName, addrs []string) []string {
+	want := make(map[string]bool, len(addrs))
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip != nil {
+			want[ip.String()] = true
+		}
+	}
+	var changes []string
+	have := make(map[string]bool)
+	keep := make([]*Backend, 0, len(lb.backends)+len(want))
+	for _, b := range lb.backends {
+		if n.memberOf(b) && !want[b.Host] {
+			lb.forgetBackendLocked(b)
+			changes = append(changes, "removed "+b.Label())
+			lb.publishBackend(StateBackendRemoved, b, "")
+			continue
+		}
+		if n.memberOf(b) {
+			have[b.Host] = true
+		}
+		keep = append(keep, b)
+	}
+	ips := make([]string, 0, len(want))
+	for ip := range want {
+		ips = append(ips, ip)
+	}
+	slices.Sort(ips)
+	for _, ip := range ips {
+		if have[ip] {
+			continue
+		}
+		bc := n.bc
+		bc.ID, bc.Host = "", ip
+		if lb.findBackendLocked(bc.addr()) != nil {
+			continue // already in the pool by address
+		}
+		b, _ := lb.newBackend(bc) // n.bc was checked
+		b.Name, b.tls = n.bc.Host, n.tls
+		lb.beginSlowStartLocked(b)
+		keep = append(keep, b)
+		changes = append(changes, "added "+b.Label())
+		lb.publishBackend(StateBackendAdded, b, "")
+	}
+	lb.backends = keep
+	return changes
+}
+
+// removeNameLocked drops the name backend at addr and its backends, which it
+// returns; ok is false when there is no such name. Callers must hold lb.mu.
+func (lb *LB) removeNameLocked(addr string) (removed []*Backend, ok bool) {
+	n := lb.findNameLocked(addr)
+	if n == nil {
+		return nil, false
+	}
+	lb.dnsNames = slices.DeleteFunc(lb.dnsNames, func(m *dnsName) bool { return m == n })
+	lb.backends = slices.DeleteFunc(lb.backends, func(b *Backend) bool {
+		if !n.memberOf(b) {
+			return false
+		}
+		lb.forgetBackendLocked(b)
+		removed = append(removed, b)
+		return true
+	})
+	return removed, true
+}
+
+// setNamesLocked makes lb.dnsNames match bcs on reload: names that vanished
+// go with their backends, changed ones update theirs in place, and new ones
+// are returned for the caller to resolve. ownTLS is as for applyPoolLocked.
+// Callers must hold lb.mu.
+func (lb *LB) setNamesLocked(bcs []BackendConfig, ownTLS map[string]*tls.Config) (changes []string, added []*dnsName) {
+	names := make([]*dnsName, 0, len(bcs))
+	for _, bc := range bcs {
+		bc.ID = ""
+		cfg := lb.backendTLS
+		if bc.TLS != nil {
+			cfg = ownTLS[bc.addr()]
+		}
+		n := lb.findNameLocked(bc.addr())
+		if n == nil {
+			n = &dnsName{bc: bc, tls: cfg}
+			added = append(added, n)
+			changes = append(changes, "added name "+bc.addr())
+		} else if !sameNameConfig(n.bc, bc) {
+			n.bc, n.tls = bc, cfg
+			for _, b := range lb.backends {
+				if n.memberOf(b) {
+					b.Weight, b.Priority, b.Zone = bc.Weight, bc.Priority, bc.Zone
+					b.healthCheck, b.tlsConfig, b.tls = bc.HealthCheck, bc.TLS, cfg
+					b.AdminDisabled, b.Draining = bc.Disabled, bc.Drain
+				}
+			}
+			changes = append(changes, "updated name "+bc.addr())
+		}
+		names = append(names, n)
+	}
+	for _, n := range slices.Clone(lb.dnsNames) {
+		if slices.Contains(names, n) {
+			continue
+		}
+		removed, _ := lb.removeNameLocked(n.bc.addr())
+		changes = append(changes, "removed name "+n.bc.addr())
+		for _, b := range removed {
+			changes = append(changes, "removed "+b.Label())
+			lb.publishBackend(StateBackendRemoved, b, "")
+		}
+	}
+	lb.dnsNames = names
+	return changes, added
+}
+
+// sameNameConfig reports whether a and b give a name's backends the same
+// settings.
+func sameNameConfig(a, b BackendConfig) bool {
+	return a.Weight == b.Weight && a.Priority == b.Priority && a.Zone == b.Zone &&
+		a.Disabled == b.Disabled && a.Drain == b.Drain &&
+		sameHealthCheck(a.HealthCheck, b.HealthCheck) && sameBackendTLS(a.TLS, b.TLS)
+}
+
+// poolConfigsLocked is the main pool in the file schema: backends by
+// address, then names in place of the backends resolved from them. Callers
+// must hold lb.mu.
+func (lb *LB) poolConfigsLocked() []BackendConfig {
+	var own []*Backend
+	for _, b := range lb.backends {
+		if b.Name == "" {
+			own = append(own, b)
+		}
+	}
+	bcs := backendConfigs(own)
+	for _, n := range lb.dnsNames {
+		bcs = append(bcs, n.bc)
+	}
+	return bcs
+}
@@ -0,0 +1,139 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"log"
+	"slices"
+)
+
+// ---------------------- Deficit Round Robin ----------------------
+// backends are visited in turn, and each visit credits the backend
+// quantum x its weight; it then takes connections, each costing the pool's
+// largest weight, for as long as its credit lasts, and keeps the remainder
+// for its next visit. So the heaviest backend takes up to quantum
+// connections per visit and lighter ones proportionally fewer, saving up
+// over several rounds until they can take one. The quantum bounds the
+// bursts: at the default of 1 a backend takes one connection per visit, so a
+// 3:2:1 pool runs a a b a b c rather than a weight-expanded rotation's
+// a a a b b c; larger quanta trade that for runs on one backend. (The light
+// backends still need several rounds to save up, so a 5:1:1 pool runs
+// a a a a a b c; smooth wrr interleaves finer.) Unavailable and weight-0
+// backends are skipped and lose their credit, as an idle flow does in DRR;
+// pool changes keep the credit of the backends that stay, and the credit
+// lives in cfg.State so a rebuilt drr (a quantum change) keeps it too.
+
+// DefaultDRRQuantum is the -drr-quantum default.
+const DefaultDRRQuantum = 1
+
+// maxDRRQuantum caps the quantum; beyond it drr is rr with long bursts.
+const maxDRRQuantum = 1000
+
+// checkDRRQuantum validates a DRR quantum.
+func checkDRRQuantum(q int) error {
+	if q < 1 || q > maxDRRQuantum {
+		return fmt.Errorf("the quantum must be between 1 and %d", maxDRRQuantum)
+	}
+	return nil
+}
+
+type DRRStrategy struct {
+	Backends []*Backend
+	quantum  int
+	deficit  map[*Backend]int // credit, in units of weight
+	pos      int              // backend being visited
+	credited bool             // whether Backends[pos] got this visit's credit
+}
+
+// NewDRRStrategy credits cfg.Quantum per visit, DefaultDRRQuantum when 0.
+func NewDRRStrategy(backends []*Backend, cfg StrategyConfig) *DRRStrategy {
+	q := cfg.Quantum
+	if q <= 0 {
+		q = DefaultDRRQuantum
+	}
+	s := &DRRStrategy{quantum: q, deficit: cfg.State.Counters("drr")}
+	s.Init(backends)
+	return s
+}
+
+// Init adopts the new pool, dropping the credit of backends that left.
+func (s *DRRStrategy) Init(backends []*Backend) {
+	for b := range s.deficit {
+		if !slices.Contains(backends, b) {
+			delete(s.deficit, b)
+		}
+	}
+	s.Backends = backends
+	if s.pos >= len(backends) {
+		s.pos, s.credited = 0, false
+	}
+}
+
+func (s *DRRStrategy) RegisterBackend(backend *Backend) {
+	s.Init(append(s.Backends, backend))
+}
+
+func (s *DRRStrategy) GetNextBackend(_ IncomingReq) (*Backend, error) {
+	n := len(s.Backends)
+	if n == 0 {
+		return nil, ErrNoBackends
+	}
+	cost := 0
+	for _, b := range s.Backends {
+		if b.Available() {
+			cost = max(cost, b.Weight)
+		}
+	}
+	if cost <= 0 {
+		return nil, ErrAllUnhealthy
+	}
+	// the heaviest backend earns a connection on every visit, so one lap
+	// from anywhere finds one
+	for range 2*n + 1 {
+		b := s.Backends[s.pos]
+		if !b.Available() || b.Weight <= 0 {
+			delete(s.deficit, b)
+			s.advance()
+			continue
+		}
+		if !s.credited {
+			s.deficit[b] += s.quantum * b.Weight
+			s.credited = true
+		}
+		if s.deficit[b] >= cost {
+			s.deficit[b] -= cost
+			return b, nil
+		}
+		s.advance()
+	}
+	return nil, ErrAllUnhealthy
+}
+
+func (s *DRRStrategy) advance() {
+	s.pos = (s.pos + 1) % len(s.Backends)
+	s.credited = false
+}
+
+func (s *DRRStrategy) PrintTopology() {
+	fmt.Printf("quantum %d\n", s.quantum)
+	for i, b := range s.Backends {
+		mark := " "
+		if i == s.pos {
+			mark = ">"
+		}
+		fmt.Printf("%s[%d] %-20s w=%-3d deficit=%d\n", mark, i, b, b.Weight, s.deficit[b])
+	}
+}
+
+// setDRRQuantumLocked switches every drr strategy, the main pool's and the
+// groups', to quantum q. Callers must hold lb.mu.
+func (lb *LB) setDRRQuantumLocked(q int) error {
+	if err := checkDRRQuantum(q); err != nil {
+		return err
+	}
+	lb.drrQuantum = q
+	if err := lb.rebuildStrategiesLocked("drr"); err != nil {
+		return err
+	}
+	log.Printf("deficit round robin: quantum %d", q)
+	return nil
+}
@@ -0,0 +1,228 @@
+package loadbalancer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ---------------------- Backend Groups ----------------------
+// in HTTP mode a request whose path starts with a group's prefix goes to that
+// group's pool, balanced by the group's own strategy; everything else goes to
+// the main pool. In TCP mode, and for the TCP connections of auto mode, a
+// connection whose TLS ClientHello asks for one of a group's sni names goes
+// to that group instead, with TLS passed through untouched; an exact name
+// beats a *.domain wildcard, which matches a single label. Affinity and
+// selection hooks apply to the main pool only.
+
+type BackendGroup struct {
+	Name         string
+	Prefix       string   // HTTP routing; empty = none
+	SNI          []string // TCP routing; lower case
+	backends     []*Backend
+	strategy     BalancingStrategy
+	strategyName string
+	state        *StrategyState // see StrategyState; guarded by lb.mu
+
+	// tlsConfig is the group's own backend TLS block, nil when it follows
+	// the main pool; tls is what its backends dial with.
+	tlsConfig *BackendTLSConfig
+	tls       *tls.Config
+}
+
+type GroupConfig struct {
+	Name     string          `yaml:"name"`
+	Prefix   string          `yaml:"prefix,omitempty"`
+	SNI      []string        `yaml:"sni,omitempty"`
+	Strategy string          `yaml:"strategy,omitempty"`
+	Backends []BackendConfig `yaml:"backends"`
+
+	// TLS overrides -backend-tls for this group's backends.
+	TLS *BackendTLSConfig `yaml:"tls,omitempty"`
+}
+
+// GroupStrategy is the CMD_GroupStrategy payload.
+type GroupStrategy struct {
+	Group    string
+	Strategy string
+}
+
+// addGroup builds a group from its (already validated) config; only loading
+// its TLS files can fail.
+func (lb *LB) addGroup(gc GroupConfig) error {
+	g := &BackendGroup{Name: gc.Name, Prefix: gc.Prefix, SNI: gc.SNI, tlsConfig: gc.TLS, tls: lb.backendTLS, state: NewStrategyState()}
+	if gc.TLS != nil {
+		var err error
+		if g.tls, err = gc.TLS.build(); err != nil {
+			return fmt.Errorf("group %s: tls: %w", gc.Name, err)
+		}
+	}
+	for _, bc := range gc.Backends {
+		b, _ := lb.newBackend(bc) // checked by LoadFileConfig
+		var err error
+		if b.tls, err = backendTLSFor(bc, g.tls); err != nil {
+			return fmt.Errorf("group %s: %w", gc.Name, err)
+		}
+		g.backends = append(g.backends, b)
+	}
+	g.strategyName, _ = canonicalStrategy(gc.Strategy)
+	g.strategy, _ = lb.groupStrategyFromName(g, g.strategyName)
+	lb.groups = append(lb.groups, g)
+	sort.SliceStable(lb.groups, func(i, j int) bool { return len(lb.groups[i].Prefix) > len(lb.groups[j].Prefix) })
+	return nil
+}
+
+// routeLocked returns the group serving path, or nil for the main pool.
+// Callers must hold lb.mu.
+func (lb *LB) routeLocked(path string) *BackendGroup {
+	for _, g := range lb.groups {
+		if g.Prefix != "" && strings.HasPrefix(path, g.Prefix) {
+			return g
+		}
+	}
+	return nil
+}
+
+// routeSNILocked returns the group serving the TLS server name, or nil for
+// the main pool. Callers must hold lb.mu.
+func (lb *LB) routeSNILocked(name string) *BackendGroup {
+	if name == "" {
+		return nil
+	}
+	name = strings.ToLower(name)
+	var wild *BackendGroup
+	for _, g := range lb.groups {
+		for _, s := range g.SNI {
+			if s == name {
+				return g
+			}
+			if wild == nil && matchWildcard(s, name) {
+				wild = g
+			}
+		}
+	}
+	return wild
+}
+
+// checkServerName validates an sni entry: a host name, or *. and a domain.
+func checkServerName(s string) error {
+	name := strings.TrimPrefix(s, "*.")
+	if name == "" || strings.ContainsAny(name, "*/:[] ") || strings.HasPrefix(name, ".") ||
+		strings.HasSuffix(name, ".") || strings.Contains(name, "..") {
+		return fmt.Errorf("invalid sni name %q (want a host name or *.domain)", s)
+	}
+	return nil
+}
+
+// matchWildcard reports whether name is one label under a *.domain pattern.
+func matchWildcard(pattern, name string) bool {
+	suffix, ok := strings.CutPrefix(pattern, "*")
+	if !ok {
+		return false
+	}
+	label, ok := strings.CutSuffix(name, suffix)
+	return ok && label != "" && !strings.Contains(label, ".")
+}
+
+// sniRouting reports whether any group routes by server name.
+func (lb *LB) sniRouting() bool {
+	for _, g := range lb.groups {
+		if len(g.SNI) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// pickFor selects a backend for an HTTP request: from the group its path
+// routes to, or from the main pool. Callers must hold lb.mu.
+func (lb *LB) pickFor(req IncomingReq, path string) (*Backend, *BackendGroup, error) {
+	return lb.pickIn(req, lb.routeLocked(path))
+}
+
+// pickForSNI selects a backend for a TCP connection: from the group its TLS
+// server name routes to, or from the main pool. Callers must hold lb.mu.
+func (lb *LB) pickForSNI(req IncomingReq) (*Backend, *BackendGroup, error) {
+	return lb.pickIn(req, lb.routeSNILocked(req.sni))
+}
+
+// pickIn selects a backend from g, or from the main pool when g is nil.
+// Callers must hold lb.mu.
+func (lb *LB) pickIn(req IncomingReq, g *BackendGroup) (*Backend, *BackendGroup, error) {
+	if g == nil {
+		b, err := lb.pickBackend(req)
+		return b, nil, err
+	}
+	b, err := g.strategy.GetNextBackend(req)
+	if b != nil && (b.AdminDisabled || b.Draining) {
+		b, err = rehash(req, enabledBackends(g.backends))
+	}
+	if err != nil {
+		lb.selectErrors[g.Name+": "+err.Error()]++
+	}
+	return b, g, err
+}
+
+func (lb *LB) setGroupStrategy(name, strategy string) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	for _, g := range lb.groups {
+		if g.Name == name {
+			canonical, err := canonicalStrategy(strategy)
+			if err != nil {
+				return err
+			}
+			if g.strategy, err = lb.groupStrategyFromName(g, canonical); err != nil {
+				return err
+			}
+			g.strategyName = canonical
+			log.Printf("group %s: strategy %s", g.Name, g.strategyName)
+			lb.publish(StateEvent{Kind: StateStrategyChanged, Group: g.Name, Detail: canonical})
+			return nil
+		}
+	}
+	return fmt.Errorf("no group %q", name)
+}
+
+// strategyOfLocked returns the strategy of b's pool. Callers must hold lb.mu.
+func (lb *LB) strategyOfLocked(b *Backend) BalancingStrategy {
+	for _, g := range lb.groups {
+		if slices.Contains(g.backends, b) {
+			return g.strategy
+		}
+	}
+	return lb.strategy
+}
+
+// poolOfLocked returns the pool b belongs to: its group's or the main one.
+// Callers must hold lb.mu.
+func (lb *LB) poolOfLocked(b *Backend) []*Backend {
+	for _, g := range lb.groups {
+		if slices.Contains(g.backends, b) {
+			return g.backends
+		}
+	}
+	return lb.backends
+}
+
+// allBackendsLocked is the main pool plus every group's pool, for health
+// checks. Callers must hold lb.mu.
+func (lb *LB) allBackendsLocked() []*Backend {
+	all := append([]*Backend(nil), lb.backends...)
+	for _, g := range lb.groups {
+		all = append(all, g.backends...)
+	}
+	return all
+}
+
+// reinitStrategiesLocked re-reads weights into every strategy. Callers must
+// hold lb.mu.
+func (lb *LB) reinitStrategiesLocked() {
+	lb.strategy.Init(lb.backends)
+	for _, g := range lb.groups {
+		g.strategy.Init(g.backends)
+	}
+}
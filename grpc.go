@@ -0,0 +1,234 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ---------------------- gRPC Mode ----------------------
+// gRPC multiplexes every RPC of a client over one long-lived HTTP/2
+// connection, so balancing connections pins all RPCs to one backend. In gRPC
+// mode the LB terminates HTTP/2 itself, h2c or h2 negotiated by ALPN on TLS
+// listeners, and balances each stream on its own; the streams are relayed
+// over pooled h2c connections to the backends, trailers (grpc-status)
+// included. An RPC's result for passive health, circuit breakers and outlier
+// detection is its grpc-status: the codes in grpcFailureCodes, which say the
+// backend couldn't serve it, count as failures, the rest, application errors
+// included, as successes. A 5xx or a failed relay is a failure too. Client
+// connections come through the same accept loop as in the other modes, so
+// -max-conns and -max-conns-per-ip hold, and on exit they are sent GOAWAY and
+// drained within -shutdown-grace.
+//
+// Limitations: no backend TLS, no server push.
+
+// grpcFailureCodes are the grpc-status codes that count against a backend:
+// UNKNOWN, DEADLINE_EXCEEDED, INTERNAL, UNAVAILABLE and DATA_LOSS, the ones
+// gRPC maps to HTTP 5xx other than UNIMPLEMENTED.
+var grpcFailureCodes = map[string]bool{"2": true, "4": true, "13": true, "14": true, "15": true}
+
+// grpcServer is the HTTP/2 server every gRPC listener hands its admitted
+// connections to.
+func (lb *LB) grpcServer() *http.Server {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	serverProtocols := new(http.Protocols)
+	serverProtocols.SetUnencryptedHTTP2(true)
+	serverProtocols.SetHTTP2(true)
+
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			b := pr.In.Context().Value(backendKey{}).(*Backend)
+			pr.SetURL(&url.URL{Scheme: "http", Host: b.urlHost()})
+			pr.Out.Host = pr.In.Host
+		},
+		Transport:     &http.Transport{Protocols: protocols, DialContext: lb.dialContext},
+		FlushInterval: -1, // streaming RPCs: forward every DATA frame at once
+		ModifyResponse: func(resp *http.Response) error {
+			b := resp.Request.Context().Value(backendKey{}).(*Backend)
+			switch {
+			case resp.StatusCode >= 500:
+				lb.recordFailure(b, resp.Status)
+			case resp.Header.Get("Grpc-Status") != "":
+				// trailers-only response
+				lb.recordGRPCStatus(b, resp.Header)
+			default:
+				resp.Body = &grpcStatusBody{ReadCloser: resp.Body, lb: lb, b: b, resp: resp}
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			b := r.Context().Value(backendKey{}).(*Backend)
+			if !errors.Is(err, context.Canceled) {
+				log.Printf("grpc: %s %s: %s", b.Label(), r.URL.Path, err)
+				lb.recordFailure(b, err.Error())
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+
+	return &http.Server{
+		Protocols: serverProtocols,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lb.proxyStream(rp, w, r)
+		}),
+		ConnState: func(c net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				lb.releaseGRPCConn(c)
+			}
+		},
+	}
+}
+
+// releaseGRPCConn gives back the slots serveGRPC reserved for c, once.
+func (lb *LB) releaseGRPCConn(c net.Conn) {
+	if release, ok := lb.grpcConns.LoadAndDelete(c); ok {
+		release.(func())()
+	}
+}
+
+// serveGRPC accepts on l like any other listener, under the same connection
+// limits and tracked for the drain, and serves what it admits with srv.
+func (lb *LB) serveGRPC(srv *http.Server, l net.Listener) {
+	hl := &handoffListener{addr: l.Addr(), conns: make(chan net.Conn), closed: make(chan struct{})}
+	var accepting sync.WaitGroup
+	accepting.Go(func() {
+		lb.acceptLoop(l, func(c net.Conn) {
+			release := lb.reserve(IncomingReq{srcConn: c, reqId: uuid.NewString()})
+			if release == nil {
+				return
+			}
+			lb.grpcConns.Store(c, release)
+			if !hl.handoff(c) {
+				lb.releaseGRPCConn(c)
+			}
+		})
+	})
+	if err := srv.Serve(hl); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("grpc listener %s: %s", l.Addr(), err)
+	}
+	_ = hl.Close()
+	accepting.Wait()
+}
+
+// stopGRPC sends srv's clients GOAWAY and gives their RPCs up to
+// -shutdown-grace to finish, then closes what is left.
+func (lb *LB) stopGRPC(srv *http.Server) {
+	if lb.cfg.ShutdownGrace > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), lb.cfg.ShutdownGrace)
+		_ = srv.Shutdown(ctx)
+		cancel()
+	}
+	_ = srv.Close()
+}
+
+// handoffListener is the listener an http.Server sees: it yields the
+// connections the accept loop admitted.
+type handoffListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *handoffListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *handoffListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *handoffListener) Addr() net.Addr { return l.addr }
+
+// handoff passes c to the server, or closes it and reports false once the
+// server is gone.
+func (l *handoffListener) handoff(c net.Conn) bool {
+	select {
+	case l.conns <- c:
+		return true
+	case <-l.closed:
+		_ = c.Close()
+		return false
+	}
+}
+
+// recordGRPCStatus feeds the grpc-status in h into b's passive health.
+func (lb *LB) recordGRPCStatus(b *Backend, h http.Header) {
+	if code := h.Get("Grpc-Status"); grpcFailureCodes[code] {
+		lb.recordFailure(b, "grpc-status "+code+" "+h.Get("Grpc-Message"))
+	} else {
+		lb.recordSuccess(b)
+	}
+}
+
+// grpcStatusBody records the RPC's grpc-status once its response body, and
+// with it the trailers, has been read to the end.
+type grpcStatusBody struct {
+	io.ReadCloser
+	lb   *LB
+	b    *Backend
+	resp *http.Response
+	done bool
+}
+
+func (gb *grpcStatusBody) Read(p []byte) (int, error) {
+	n, err := gb.ReadCloser.Read(p)
+	if err == io.EOF && !gb.done {
+		gb.done = true
+		gb.lb.recordGRPCStatus(gb.b, gb.resp.Trailer)
+	}
+	return n, err
+}
+
+// dispatchStream picks req's backend and counts the stream on it.
+func (lb *LB) dispatchStream(req IncomingReq) (*Backend, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	backend, err := lb.pickBackend(req)
+	if err == nil {
+		backend.NumRequests++
+		backend.ActiveConns++
+		lb.breakerDispatchLocked(backend)
+	}
+	return backend, err
+}
+
+// proxyStream balances one stream (one RPC).
+func (lb *LB) proxyStream(rp *httputil.ReverseProxy, w http.ResponseWriter, r *http.Request) {
+	req := IncomingReq{reqId: uuid.NewString(), key: uuid.NewString()}
+	lb.keyHTTPRequest(&req, r)
+
+	backend, err := lb.dispatchStream(req)
+	if err != nil {
+		log.Printf("in-req: %s client=%s %s rejected: %s", req.reqId, r.RemoteAddr, r.URL.Path, err)
+		http.Error(w, "no backend available: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	start := time.Now()
+	defer func() {
+		lb.mu.Lock()
+		backend.ActiveConns--
+		lb.observeLatency(backend, time.Since(start))
+		lb.observeRTT(backend, time.Since(start))
+		lb.mu.Unlock()
+	}()
+	log.Printf("in-req: %s client=%s rpc %s -> backend: %s", req.reqId, r.RemoteAddr, r.URL.Path, backend.Label())
+
+	rp.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), backendKey{}, backend)))
+}
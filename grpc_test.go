@@ -0,0 +1,132 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// grpcBackend starts an h2c server answering every stream with name and a
+// grpc-status 0 trailer, and returns its config.
+func grpcBackend(t *testing.T, name string) BackendConfig {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	srv := &http.Server{
+		Protocols: protocols,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ProtoMajor != 2 {
+				http.Error(w, "not h2", http.StatusHTTPVersionNotSupported)
+				return
+			}
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Trailer", "Grpc-Status")
+			_, _ = io.WriteString(w, name)
+			w.Header().Set("Grpc-Status", "0")
+		}),
+	}
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(func() { _ = srv.Close() })
+	return backendAt(t, l.Addr().String())
+}
+
+func TestGRPCBalancesStreamsOfOneConnection(t *testing.T) {
+	cfg := testConfig(t, grpcBackend(t, "a"), grpcBackend(t, "b"))
+	cfg.Mode = ModeGRPC
+	cfg.Strategy = "rr"
+	lb := newTestLB(t, cfg)
+	startLB(t, lb)
+
+	var dials atomic.Int32
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			dials.Add(1)
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}}
+	got := make(map[string]int)
+	for range 10 {
+		resp, err := client.Post("http://"+lb.cfg.Listeners[0].Addr+"/svc.Echo/Say", "application/grpc", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := resp.Trailer.Get("Grpc-Status"); s != "0" {
+			t.Fatalf("grpc-status trailer %q, want 0", s)
+		}
+		got[string(body)]++
+	}
+	if n := dials.Load(); n != 1 {
+		t.Fatalf("client dialed %d connections, want 1", n)
+	}
+	if got["a"] != 5 || got["b"] != 5 {
+		t.Fatalf("streams over one connection went %v, want 5 each", got)
+	}
+}
+
+func TestGRPCConnectionsLimitedAndDrained(t *testing.T) {
+	cfg := testConfig(t, grpcBackend(t, "a"))
+	cfg.Mode = ModeGRPC
+	cfg.MaxConns = 1
+	cfg.AcceptBackoff = 0 // reject instead of pausing accept
+	cfg.ShutdownGrace = 5 * time.Second
+	lb := newTestLB(t, cfg)
+	startLB(t, lb)
+
+	h2c := func() *http.Client {
+		return &http.Client{Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		}}
+	}
+	url := "http://" + lb.cfg.Listeners[0].Addr + "/svc.Echo/Say"
+	resp, err := h2c().Post(url, "application/grpc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if n := lb.liveConns(); n != 1 {
+		t.Fatalf("%d connections tracked, want the client's 1", n)
+	}
+
+	if resp, err := h2c().Post(url, "application/grpc", nil); err == nil {
+		resp.Body.Close()
+		t.Fatal("second connection served over -max-conns 1")
+	}
+	if n := lb.rejectedConns.Load(); n != 1 {
+		t.Fatalf("%d connections rejected, want 1", n)
+	}
+
+	// the idle client connection is sent GOAWAY rather than waited out
+	start := time.Now()
+	if err := lb.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > cfg.ShutdownGrace/2 {
+		t.Fatalf("shutdown took %s with only an idle connection open", took)
+	}
+	if n := lb.liveConns(); n != 0 {
+		t.Fatalf("%d connections left after shutdown", n)
+	}
+}
@@ -0,0 +1,145 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ---------------------- gRPC Health Checks ----------------------
+// -hc-mode grpc calls the standard grpc.health.v1.Health/Check RPC over h2c
+// and passes only when the backend answers SERVING for -hc-grpc-service (""
+// asks about the server as a whole), so a backend that is up but reports
+// NOT_SERVING, e.g. while it drains, is taken out like a failed HTTP check.
+// The request and response messages are small enough to encode by hand,
+// which keeps the LB free of a gRPC dependency.
+
+const grpcHealthPath = "/grpc.health.v1.Health/Check"
+
+// grpcServing is HealthCheckResponse.ServingStatus SERVING.
+const grpcServing = 1
+
+// grpcServingStatuses names the ServingStatus values for errors.
+var grpcServingStatuses = map[uint64]string{
+	0: "UNKNOWN",
+	1: "SERVING",
+	2: "NOT_SERVING",
+	3: "SERVICE_UNKNOWN",
+}
+
+// grpcHealthRequest is a length-prefixed HealthCheckRequest for service.
+func grpcHealthRequest(service string) []byte {
+	var msg []byte
+	if service != "" {
+		msg = append(msg, 1<<3|2) // field 1, length-delimited
+		msg = binary.AppendUvarint(msg, uint64(len(service)))
+		msg = append(msg, service...)
+	}
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// parseGRPCHealthResponse returns the status in a length-prefixed
+// HealthCheckResponse.
+func parseGRPCHealthResponse(body []byte) (uint64, error) {
+	if len(body) < 5 {
+		return 0, fmt.Errorf("short response (%d bytes)", len(body))
+	}
+	if body[0] != 0 {
+		return 0, fmt.Errorf("compressed response")
+	}
+	n := binary.BigEndian.Uint32(body[1:5])
+	msg := body[5:]
+	if uint64(len(msg)) < uint64(n) {
+		return 0, fmt.Errorf("truncated response")
+	}
+	msg = msg[:n]
+	var status uint64 // absent means 0, as in any proto3 message
+	for len(msg) > 0 {
+		key, k := binary.Uvarint(msg)
+		if k <= 0 {
+			return 0, fmt.Errorf("malformed response")
+		}
+		msg = msg[k:]
+		var skip uint64
+		switch key & 7 {
+		case 0: // varint
+			v, k := binary.Uvarint(msg)
+			if k <= 0 {
+				return 0, fmt.Errorf("malformed response")
+			}
+			if key>>3 == 1 {
+				status = v
+			}
+			skip = uint64(k)
+		case 1: // 64-bit
+			skip = 8
+		case 2: // length-delimited
+			l, k := binary.Uvarint(msg)
+			if k <= 0 {
+				return 0, fmt.Errorf("malformed response")
+			}
+			skip = uint64(k) + l
+		case 5: // 32-bit
+			skip = 4
+		default:
+			return 0, fmt.Errorf("malformed response")
+		}
+		if skip > uint64(len(msg)) {
+			return 0, fmt.Errorf("truncated response")
+		}
+		msg = msg[skip:]
+	}
+	return status, nil
+}
+
+// probeGRPC calls Health/Check for service on b; nil means SERVING.
+func (lb *LB) probeGRPC(client *http.Client, b *Backend, service string) error {
+	ctx := context.WithValue(context.Background(), backendKey{}, b)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+b.urlHost()+grpcHealthPath,
+		bytes.NewReader(grpcHealthRequest(service)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthBody))
+	if err != nil {
+		return fmt.Errorf("reading response: %w", err)
+	}
+	// grpc-status comes in the trailers, or in the headers of a
+	// trailers-only response
+	code, msg := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if code == "" {
+		code, msg = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if code != "0" {
+		if msg != "" {
+			return fmt.Errorf("grpc-status %s: %s", code, msg)
+		}
+		return fmt.Errorf("grpc-status %q", code)
+	}
+	status, err := parseGRPCHealthResponse(body)
+	if err != nil {
+		return err
+	}
+	if status != grpcServing {
+		if name, ok := grpcServingStatuses[status]; ok {
+			return fmt.Errorf("%s", name)
+		}
+		return fmt.Errorf("serving status %d", status)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package loadbalancer
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+)
+
+// ---------------------- Hashers ----------------------
+// the hashing strategies take a Hasher so the LB can agree on placement with
+// other systems (e.g. a client library computing the same ring).
+
+type Hasher interface {
+	Sum32(key string) uint32
+}
+
+// FNVHasher is 32-bit FNV-1a, the default for SimpleHashStrategy.
+type FNVHasher struct{}
+
+func (FNVHasher) Sum32(key string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// SHA256Hasher is the first 4 bytes (big-endian) of SHA-256, the default for
+// ConsistentHashStrategy.
+type SHA256Hasher struct{}
+
+func (SHA256Hasher) Sum32(key string) uint32 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// hash function names accepted by -hash
+const (
+	HashFNV    = "fnv"
+	HashSHA256 = "sha256"
+)
+
+// NewHasher resolves a -hash name; "" returns nil so each strategy keeps its
+// own default.
+func NewHasher(name string) (Hasher, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case HashFNV:
+		return FNVHasher{}, nil
+	case HashSHA256:
+		return SHA256Hasher{}, nil
+	default:
+		return nil, fmt.Errorf("invalid hash %q (want fnv or sha256)", name)
+	}
+}
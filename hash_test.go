@@ -0,0 +1,84 @@
+package loadbalancer
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+)
+
+func TestHasherKnownValues(t *testing.T) {
+	if got := (FNVHasher{}).Sum32("hello"); got != 0x4f9f2cab {
+		t.Errorf("fnv(hello) = %#x, want 0x4f9f2cab", got)
+	}
+	if got := (SHA256Hasher{}).Sum32("hello"); got != 0x2cf24dba {
+		t.Errorf("sha256(hello) = %#x, want 0x2cf24dba", got)
+	}
+	for _, name := range []string{"", HashFNV, HashSHA256} {
+		if _, err := NewHasher(name); err != nil {
+			t.Errorf("NewHasher(%q): %v", name, err)
+		}
+	}
+	if _, err := NewHasher("xxhash"); err == nil {
+		t.Error("NewHasher(xxhash) succeeded")
+	}
+}
+
+func TestSimpleHashPlacementFollowsHasher(t *testing.T) {
+	backends := testBackends(4)
+	for _, tc := range []struct {
+		hasher Hasher
+		want   int // fnv(hello) % 4 = 3, sha256(hello) % 4 = 2
+	}{
+		{FNVHasher{}, 3},
+		{SHA256Hasher{}, 2},
+	} {
+		s := NewSimpleHashStrategy(backends, StrategyConfig{Hasher: tc.hasher})
+		if b, _ := s.GetNextBackend(IncomingReq{key: "hello"}); b != backends[tc.want] {
+			t.Errorf("%T: hello -> %s, want %s", tc.hasher, b, backends[tc.want])
+		}
+	}
+}
+
+// fixedHasher places the keys it knows where told and everything else at 0.
+type fixedHasher map[string]uint32
+
+func (h fixedHasher) Sum32(key string) uint32 { return h[key] }
+
+func TestConsistentHashPlacementFollowsHasher(t *testing.T) {
+	backends := testBackends(3)
+	h := fixedHasher{
+		backends[0].String(): 100,
+		backends[1].String(): 200,
+		backends[2].String(): 300,
+		"k":                  150,
+		"wrap":               301,
+	}
+	s := NewConsistentHashStrategy(backends, StrategyConfig{Hasher: h, VNodes: 1})
+	for key, want := range map[string]*Backend{"k": backends[1], "wrap": backends[0]} {
+		if b, _ := s.GetNextBackend(IncomingReq{key: key}); b != want {
+			t.Errorf("%s -> %s, want %s", key, b, want)
+		}
+	}
+
+	// the default ring is truncated SHA-256 of the addresses
+	s = NewConsistentHashStrategy(backends, StrategyConfig{VNodes: 1})
+	for i, b := range s.backends {
+		sum := sha256.Sum256([]byte(b.String()))
+		if want := binary.BigEndian.Uint32(sum[:4]); s.keys[i] != want {
+			t.Errorf("%s at %d, want %d", b, s.keys[i], want)
+		}
+	}
+}
+
+func TestConfigHashReachesStrategy(t *testing.T) {
+	cfg := testConfig(t, BackendConfig{Host: "10.0.0.1", Port: 80, Weight: 1})
+	cfg.Hash = HashFNV
+	lb := newTestLB(t, cfg)
+	ch, ok := lb.strategy.(*ConsistentHashStrategy)
+	if !ok {
+		t.Fatalf("default strategy is %T", lb.strategy)
+	}
+	if _, ok := ch.hasher.(FNVHasher); !ok {
+		t.Fatalf("-hash fnv built a ring hashing with %T", ch.hasher)
+	}
+}
@@ -0,0 +1,88 @@
+package loadbalancer
+
+import (
+	"log"
+	"time"
+)
+
+// ---------------------- Passive Health ----------------------
+// failures observed on live traffic count against a backend: dials that fail
+// in any mode, and 5xx responses in HTTP and gRPC modes. Crossing the
+// threshold inside the window marks it unhealthy; a good response (in TCP
+// mode, a dial that connects) resets it. An ejected backend gets no traffic
+// to prove itself on, so unless active checks are on to bring it back, it
+// returns after -fail-probation on probation: its first failure ejects it
+// again at once, its first success clears the probation. The same results
+// feed the circuit breakers (breaker.go) and outlier detection (outlier.go).
+
+func (lb *LB) recordFailure(b *Backend, reason string) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	lb.breakerResultLocked(b, false, reason)
+	lb.outlierResultLocked(b, false)
+	if lb.cfg.PassiveFailThreshold <= 0 {
+		return
+	}
+	now := lb.clock.Now()
+	if b.failSince.IsZero() || now.Sub(b.failSince) > lb.cfg.PassiveFailWindow {
+		b.failSince = now
+		b.failures = 0
+	}
+	b.failures++
+	if !b.IsHealthy {
+		return
+	}
+	if b.probation {
+		log.Printf("backend %s failed on probation (%s)", b.Label(), reason)
+	} else if b.failures < lb.cfg.PassiveFailThreshold {
+		return
+	} else {
+		log.Printf("backend %s marked unhealthy: %d failures in %s (last: %s)",
+			b.Label(), b.failures, lb.cfg.PassiveFailWindow, reason)
+	}
+	b.IsHealthy, b.probation = false, false
+	lb.publishBackend(StateBackendDown, b, reason)
+	lb.scheduleProbationLocked(b)
+}
+
+func (lb *LB) recordSuccess(b *Backend) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	lb.breakerResultLocked(b, true, "")
+	lb.outlierResultLocked(b, true)
+	b.failures = 0
+	b.failSince = time.Time{}
+	if b.probation {
+		b.probation = false
+		log.Printf("backend %s passed probation", b.Label())
+	}
+	if !b.IsHealthy && lb.cfg.PassiveFailThreshold > 0 {
+		b.IsHealthy = true
+		log.Printf("backend %s marked healthy again", b.Label())
+		lb.publishBackend(StateBackendUp, b, "")
+	}
+}
+
+// scheduleProbationLocked puts b, just ejected, back on probation after
+// -fail-probation, unless active checks decide when it's up or it came back
+// or left the pool meanwhile. Callers must hold lb.mu.
+func (lb *LB) scheduleProbationLocked(b *Backend) {
+	if lb.cfg.PassiveProbation <= 0 || lb.cfg.HealthCheck.Mode != HealthCheckOff {
+		return
+	}
+	b.ejections++
+	n := b.ejections
+	time.AfterFunc(lb.cfg.PassiveProbation, func() {
+		lb.mu.Lock()
+		defer lb.mu.Unlock()
+		if b.IsHealthy || b.ejections != n || !containsBackend(lb.allBackendsLocked(), b) {
+			return
+		}
+		b.IsHealthy, b.probation = true, true
+		b.failures, b.failSince = 0, time.Time{}
+		log.Printf("backend %s back on probation after %s", b.Label(), lb.cfg.PassiveProbation)
+		lb.publishBackend(StateBackendUp, b, "probation")
+	})
+}
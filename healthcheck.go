@@ -0,0 +1,367 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------------- Active Health ----------------------
+// every HealthCheck.Interval each backend is probed, by a plain TCP connect,
+// by an HTTP request whose status must be in Expect and, with Body set, whose
+// body must contain it, or by the gRPC health RPC (grpchealth.go). A
+// backend's config may override the path, statuses, body and gRPC service for
+// itself (health_check in the config file). A
+// backend flips state only after Healthy consecutive passes / Unhealthy
+// consecutive failures, so one slow probe doesn't flap it.
+
+// health check modes
+const (
+	HealthCheckOff  = "off"
+	HealthCheckTCP  = "tcp"
+	HealthCheckHTTP = "http"
+	HealthCheckGRPC = "grpc"
+)
+
+type HealthCheckConfig struct {
+	Mode      string
+	Path      string
+	Method    string
+	Expect    string // status list, e.g. "200,204" or "200-399"
+	Body      string // substring the response body must contain; "" = any
+	Timeout   time.Duration
+	Interval  time.Duration
+	Healthy   int // consecutive passes to mark up
+	Unhealthy int // consecutive failures to mark down
+
+	// WeightHeader, when set, is read from http check responses and becomes
+	// the backend's Weight, clamped to [0, maxWeight].
+	WeightHeader string
+
+	// GRPCService is the service grpc checks ask about; "" is the server.
+	GRPCService string
+
+	expect []statusRange
+}
+
+// BackendHealthCheck overrides the http or grpc check for one backend; empty
+// fields follow -hc-path, -hc-expect, -hc-body and -hc-grpc-service.
+type BackendHealthCheck struct {
+	Path        string `yaml:"path,omitempty"`
+	Expect      string `yaml:"expect,omitempty"`
+	Body        string `yaml:"body,omitempty"`
+	GRPCService string `yaml:"grpc_service,omitempty"`
+
+	expect []statusRange
+}
+
+// check validates the override and parses its statuses.
+func (bh *BackendHealthCheck) check() error {
+	if bh.Path != "" && !strings.HasPrefix(bh.Path, "/") {
+		return fmt.Errorf("health_check path must start with /")
+	}
+	if bh.Expect != "" {
+		expect, err := parseStatusRanges(bh.Expect)
+		if err != nil {
+			return fmt.Errorf("health_check expect: %w", err)
+		}
+		bh.expect = expect
+	}
+	return nil
+}
+
+// sameHealthCheck reports whether two overrides check the same thing.
+func sameHealthCheck(a, b *BackendHealthCheck) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Path == b.Path && a.Expect == b.Expect && a.Body == b.Body && a.GRPCService == b.GRPCService
+}
+
+// maxHealthBody is how much of a check response is searched for Body.
+const maxHealthBody = 64 << 10
+
+func DefaultHealthCheckConfig() HealthCheckConfig {
+	return HealthCheckConfig{
+		Mode:      HealthCheckOff,
+		Path:      "/healthz",
+		Method:    http.MethodGet,
+		Expect:    "200-399",
+		Timeout:   2 * time.Second,
+		Interval:  5 * time.Second,
+		Healthy:   2,
+		Unhealthy: 3,
+	}
+}
+
+func (hc *HealthCheckConfig) Validate() error {
+	switch hc.Mode {
+	case HealthCheckOff, HealthCheckTCP, HealthCheckGRPC:
+	case HealthCheckHTTP:
+		if !strings.HasPrefix(hc.Path, "/") {
+			return fmt.Errorf("-hc-path must start with /")
+		}
+		if hc.Method == "" {
+			return fmt.Errorf("-hc-method must not be empty")
+		}
+		hc.Method = strings.ToUpper(hc.Method)
+		expect, err := parseStatusRanges(hc.Expect)
+		if err != nil {
+			return fmt.Errorf("-hc-expect: %w", err)
+		}
+		hc.expect = expect
+	default:
+		return fmt.Errorf("invalid -hc-mode %q (want off, tcp, http or grpc)", hc.Mode)
+	}
+	if hc.Mode == HealthCheckOff {
+		return nil
+	}
+	if hc.Timeout <= 0 || hc.Interval <= 0 {
+		return fmt.Errorf("-hc-timeout and -hc-interval must be > 0")
+	}
+	if hc.Healthy < 1 || hc.Unhealthy < 1 {
+		return fmt.Errorf("-hc-healthy and -hc-unhealthy must be >= 1")
+	}
+	return nil
+}
+
+func (hc HealthCheckConfig) String() string {
+	switch hc.Mode {
+	case HealthCheckOff:
+		return "off"
+	case HealthCheckTCP:
+		return fmt.Sprintf("tcp every %s, timeout %s, up after %d, down after %d",
+			hc.Interval, hc.Timeout, hc.Healthy, hc.Unhealthy)
+	case HealthCheckGRPC:
+		return fmt.Sprintf("grpc health of service %q every %s, timeout %s, up after %d, down after %d",
+			hc.GRPCService, hc.Interval, hc.Timeout, hc.Healthy, hc.Unhealthy)
+	}
+	desc := fmt.Sprintf("http %s %s expect %s every %s, timeout %s, up after %d, down after %d",
+		hc.Method, hc.Path, hc.Expect, hc.Interval, hc.Timeout, hc.Healthy, hc.Unhealthy)
+	if hc.Body != "" {
+		desc += fmt.Sprintf(", body containing %q", hc.Body)
+	}
+	if hc.WeightHeader != "" {
+		desc += ", weight from " + hc.WeightHeader
+	}
+	return desc
+}
+
+// probeResult is one check of one backend; weight is -1 when the backend
+// didn't report a usable one.
+type probeResult struct {
+	err    error
+	weight int
+	took   time.Duration
+}
+
+type statusRange struct{ lo, hi int }
+
+// parseStatusRanges reads a comma separated list of codes and lo-hi ranges.
+func parseStatusRanges(s string) ([]statusRange, error) {
+	var out []statusRange
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(part, "-")
+		if !isRange {
+			hi = lo
+		}
+		l, err1 := strconv.Atoi(lo)
+		h, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || l < 100 || h > 599 || l > h {
+			return nil, fmt.Errorf("invalid status %q", part)
+		}
+		out = append(out, statusRange{l, h})
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no status codes given")
+	}
+	return out, nil
+}
+
+func (hc HealthCheckConfig) expects(code int) bool {
+	return inStatusRanges(hc.expect, code)
+}
+
+func inStatusRanges(ranges []statusRange, code int) bool {
+	for _, r := range ranges {
+		if code >= r.lo && code <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// runHealthChecks probes the pool until shutdown; started by Start when
+// enabled.
+func (lb *LB) runHealthChecks() {
+	hc := lb.cfg.HealthCheck
+	transport := &http.Transport{DialContext: lb.dialContext}
+	if hc.Mode == HealthCheckGRPC {
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+	client := &http.Client{
+		Timeout:   hc.Timeout,
+		Transport: transport,
+		// a redirect is an answer, judge it by its own status
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+	for {
+		lb.mu.Lock()
+		backends := lb.allBackendsLocked()
+		overrides := make([]*BackendHealthCheck, len(backends))
+		for i, b := range backends {
+			overrides[i] = b.healthCheck
+		}
+		lb.mu.Unlock()
+
+		results := make([]probeResult, len(backends))
+		var wg sync.WaitGroup
+		for i, b := range backends {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				start := time.Now()
+				results[i] = lb.probe(client, b, overrides[i])
+				results[i].took = time.Since(start)
+			}()
+		}
+		wg.Wait()
+
+		for i, b := range backends {
+			lb.applyProbe(b, results[i])
+		}
+		select {
+		case <-lb.stopping:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe checks b once, with its override bh if any; a nil err means it
+// passed.
+func (lb *LB) probe(client *http.Client, b *Backend, bh *BackendHealthCheck) probeResult {
+	hc := lb.cfg.HealthCheck
+	res := probeResult{weight: -1}
+	if hc.Mode == HealthCheckTCP {
+		network, address := b.network()
+		d := lb.dialerFor(b)
+		d.Timeout = hc.Timeout
+		conn, err := d.Dial(network, address)
+		if err != nil {
+			res.err = err
+			return res
+		}
+		res.err = conn.Close()
+		return res
+	}
+	if hc.Mode == HealthCheckGRPC {
+		service := hc.GRPCService
+		if bh != nil && bh.GRPCService != "" {
+			service = bh.GRPCService
+		}
+		res.err = lb.probeGRPC(client, b, service)
+		return res
+	}
+
+	path, expect, body := hc.Path, hc.expect, hc.Body
+	if bh != nil {
+		if bh.Path != "" {
+			path = bh.Path
+		}
+		if bh.expect != nil {
+			expect = bh.expect
+		}
+		if bh.Body != "" {
+			body = bh.Body
+		}
+	}
+	ctx := context.WithValue(context.Background(), backendKey{}, b)
+	req, err := http.NewRequestWithContext(ctx, hc.Method, "http://"+b.urlHost()+path, nil)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	defer resp.Body.Close()
+	if !inStatusRanges(expect, resp.StatusCode) {
+		res.err = fmt.Errorf("status %s", resp.Status)
+		return res
+	}
+	if body != "" {
+		got, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthBody))
+		if err != nil {
+			res.err = fmt.Errorf("reading body: %w", err)
+			return res
+		}
+		if !strings.Contains(string(got), body) {
+			res.err = fmt.Errorf("body lacks %q", body)
+			return res
+		}
+	}
+	if hc.WeightHeader != "" {
+		res.weight = parseReportedWeight(resp.Header.Get(hc.WeightHeader))
+	}
+	return res
+}
+
+// parseReportedWeight returns the clamped weight, or -1 when v is missing or
+// malformed.
+func parseReportedWeight(v string) int {
+	if v == "" {
+		return -1
+	}
+	w, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil {
+		return -1
+	}
+	return min(max(w, 0), maxWeight)
+}
+
+func (lb *LB) applyProbe(b *Backend, res probeResult) {
+	hc := lb.cfg.HealthCheck
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	b.lastProbe = probeRecord{at: lb.clock.Now(), took: res.took, err: res.err}
+	if res.weight >= 0 && res.weight != b.Weight {
+		log.Printf("health: %s reports weight %d (was %d)", b.Label(), res.weight, b.Weight)
+		b.Weight = res.weight
+		// weighted strategies precompute from weights
+		lb.reinitStrategiesLocked()
+	}
+	err := res.err
+	if err == nil {
+		b.hcFails = 0
+		b.hcPasses++
+		if !b.IsHealthy && b.hcPasses >= hc.Healthy {
+			b.IsHealthy = true
+			log.Printf("health: %s is up after %d passed checks", b.Label(), b.hcPasses)
+			lb.publishBackend(StateBackendUp, b, "")
+		}
+		return
+	}
+	b.hcPasses = 0
+	b.hcFails++
+	if b.IsHealthy && b.hcFails >= hc.Unhealthy {
+		b.IsHealthy = false
+		log.Printf("health: %s is down after %d failed checks (last: %s)", b.Label(), b.hcFails, err)
+		lb.publishBackend(StateBackendDown, b, err.Error())
+	}
+}
@@ -0,0 +1,106 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ---------------------- Health Report ----------------------
+// the `health` command answers "why isn't this backend getting traffic?":
+// per backend, its health, the last active check (when, how long it took,
+// and its error), how far it is towards being marked down by checks and by
+// passive health, and everything that currently keeps it out of rotation.
+
+// probeRecord is a backend's last active check.
+type probeRecord struct {
+	at   time.Time // zero before the first check
+	took time.Duration
+	err  error
+}
+
+func (lb *LB) writeHealth(w io.Writer) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	now := lb.clock.Now()
+	fmt.Fprintf(w, "=== HEALTH (checks: %s) ===\n", lb.cfg.HealthCheck)
+	lb.writeHealthRows(w, lb.backends, now)
+	for _, g := range lb.groups {
+		fmt.Fprintf(w, "--- group %s ---\n", g.Name)
+		lb.writeHealthRows(w, g.backends, now)
+	}
+}
+
+// writeHealthRows writes one row per backend, and its last check error
+// under it. Callers must hold lb.mu.
+func (lb *LB) writeHealthRows(w io.Writer, backends []*Backend, now time.Time) {
+	for _, b := range backends {
+		health := "up"
+		if !b.IsHealthy {
+			health = "DOWN"
+		}
+		probe := "not checked"
+		if p := b.lastProbe; !p.at.IsZero() {
+			result := "ok"
+			if p.err != nil {
+				result = "failed"
+			}
+			probe = fmt.Sprintf("checked %s ago in %s, %s", now.Sub(p.at).Round(time.Millisecond), p.took.Round(10*time.Microsecond), result)
+		}
+		// failures so far / the count that marks it down (or opens its circuit)
+		counts := ""
+		if lb.cfg.HealthCheck.Mode != HealthCheckOff {
+			counts += fmt.Sprintf(" check-fails=%d", b.hcFails)
+			if b.IsHealthy {
+				counts += fmt.Sprintf("/%d", lb.cfg.HealthCheck.Unhealthy)
+			}
+		}
+		if lb.cfg.PassiveFailThreshold > 0 {
+			fails := b.failures
+			if b.failSince.IsZero() || now.Sub(b.failSince) > lb.cfg.PassiveFailWindow {
+				fails = 0
+			}
+			counts += fmt.Sprintf(" passive-fails=%d/%d", fails, lb.cfg.PassiveFailThreshold)
+		}
+		if lb.cfg.Breaker.Failures > 0 {
+			counts += fmt.Sprintf(" cb-fails=%d/%d", b.breaker.consecutive, lb.cfg.Breaker.Failures)
+		}
+		out := lb.outOfRotationLocked(b, now)
+		notes := ""
+		if len(out) > 0 {
+			notes = " OUT: " + strings.Join(out, ", ")
+		} else if b.probation {
+			notes = " on probation"
+		}
+		fmt.Fprintf(w, "%-28s %-4s %-36s%s%s\n", b.Label(), health, probe, counts, notes)
+		if err := b.lastProbe.err; err != nil {
+			fmt.Fprintf(w, "%28s last check: %s\n", "", err)
+		}
+	}
+}
+
+// outOfRotationLocked lists why b gets no new traffic; none when it is
+// Available. Callers must hold lb.mu.
+func (lb *LB) outOfRotationLocked(b *Backend, now time.Time) []string {
+	var out []string
+	if !b.IsHealthy {
+		out = append(out, "down")
+	}
+	if b.AdminDisabled {
+		out = append(out, "disabled")
+	}
+	if b.Draining {
+		out = append(out, "draining")
+	}
+	if o := b.outlier; o.ejected {
+		out = append(out, fmt.Sprintf("ejected as an outlier, %s left", max(o.ejectedUntil.Sub(now), 0).Round(time.Second)))
+	}
+	switch br := b.breaker; {
+	case br.state == circuitOpen:
+		out = append(out, "circuit open")
+	case br.state == circuitHalfOpen && br.probesLeft == 0:
+		out = append(out, "circuit half-open, waiting on probes")
+	}
+	return out
+}
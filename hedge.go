@@ -0,0 +1,118 @@
+package loadbalancer
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ---------------------- Hedged Requests ----------------------
+// with -hedge-delay, a GET/HEAD that has no response head after the delay is
+// sent a second time to another backend; the first response wins and the
+// other connection is closed, which aborts it. Only bodiless safe methods are
+// hedged, so a request is never applied twice.
+
+func (lb *LB) hedgeable(hreq *http.Request) bool {
+	if lb.cfg.HedgeDelay <= 0 {
+		return false
+	}
+	if hreq.Method != http.MethodGet && hreq.Method != http.MethodHead {
+		return false
+	}
+	return hreq.ContentLength == 0 && len(hreq.TransferEncoding) == 0 && !isUpgrade(hreq)
+}
+
+type attempt struct {
+	up   *upstream
+	resp *http.Response
+	err  error
+}
+
+func (lb *LB) hedgedRoundTrip(req IncomingReq, hreq *http.Request, primary *upstream) (*http.Response, *upstream, error) {
+	results := make(chan attempt, 2)
+	start := func(up *upstream, r *http.Request) {
+		go func() {
+			resp, err := send(up, r)
+			results <- attempt{up, resp, err}
+		}()
+	}
+	start(primary, hreq)
+
+	timer := time.NewTimer(lb.cfg.HedgeDelay)
+	defer timer.Stop()
+
+	inFlight := 1
+	var hedge *upstream
+	var lastErr error
+	for inFlight > 0 {
+		select {
+		case <-timer.C:
+			if hedge = lb.openHedge(req.srcConn, primary.backend); hedge == nil {
+				continue
+			}
+			lb.hedgesFired.Add(1)
+			log.Printf("req %s: no response from %s after %s, hedging to %s",
+				req.reqId, primary.backend.Label(), lb.cfg.HedgeDelay, hedge.backend.Label())
+			start(hedge, hreq.Clone(hreq.Context()))
+			inFlight++
+
+		case a := <-results:
+			inFlight--
+			if a.err != nil {
+				lb.closeUpstream(a.up)
+				lastErr = a.err
+				continue
+			}
+			// winner: abort the other attempt, if any is still running
+			if inFlight > 0 {
+				loser := primary
+				if a.up == primary {
+					loser = hedge
+				}
+				lb.closeUpstream(loser)
+				go drainLoser(results)
+			}
+			if a.up == hedge {
+				lb.hedgeWins.Add(1)
+			}
+			return a.resp, a.up, nil
+		}
+	}
+	return nil, primary, lastErr
+}
+
+// drainLoser reaps the aborted attempt so its goroutine can exit.
+func drainLoser(results <-chan attempt) {
+	if a := <-results; a.resp != nil {
+		a.resp.Body.Close()
+	}
+}
+
+// openHedge dials a healthy backend other than primary from primary's pool
+// for client, nil if there is none or it can't be reached.
+func (lb *LB) openHedge(client net.Conn, primary *Backend) *upstream {
+	lb.mu.Lock()
+	var target *Backend
+	for _, b := range lb.poolOfLocked(primary) {
+		if b != primary && b.Available() {
+			target = b
+			break
+		}
+	}
+	if target != nil {
+		target.NumRequests++
+		lb.breakerDispatchLocked(target)
+	}
+	lb.mu.Unlock()
+	if target == nil {
+		return nil
+	}
+	up, err := lb.openUpstream(client, target)
+	if err != nil {
+		log.Printf("hedge to %s: %s", target.Label(), err)
+		return nil
+	}
+	up.oneShot = true
+	return up
+}
@@ -0,0 +1,246 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a loopback address nothing listens on right now.
+func freeAddr(t testing.TB) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+	return addr
+}
+
+// testConfig is DefaultConfig listening on a free loopback port, without the
+// admin server, balancing backends.
+func testConfig(t testing.TB, backends ...BackendConfig) Config {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Listeners = []ListenerConfig{{Addr: freeAddr(t)}}
+	cfg.AdminAddr = ""
+	cfg.ShutdownGrace = time.Second
+	cfg.Backends = backends
+	return cfg
+}
+
+// newTestLB builds an LB from cfg, failing t if it can't.
+func newTestLB(t testing.TB, cfg Config) *LB {
+	t.Helper()
+	lb, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lb
+}
+
+// startLB starts lb and shuts it down when t ends.
+func startLB(t testing.TB, lb *LB) {
+	t.Helper()
+	if err := lb.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = lb.Shutdown(context.Background()) })
+}
+
+// backendAt is the config for a backend at host:port addr.
+func backendAt(t testing.TB, addr string) BackendConfig {
+	t.Helper()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return BackendConfig{Host: host, Port: p, Weight: 1}
+}
+
+// httpBackend starts an HTTP server answering every request with name and
+// returns its config.
+func httpBackend(t testing.TB, name string) BackendConfig {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveHTTPBackend(t, l, name)
+}
+
+// serveHTTPBackend is httpBackend on l.
+func serveHTTPBackend(t testing.TB, l net.Listener, name string) BackendConfig {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, name)
+	}))
+	_ = srv.Listener.Close()
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(srv.Close)
+	if l.Addr().Network() == "unix" {
+		return BackendConfig{Path: l.Addr().String(), Weight: 1}
+	}
+	return backendAt(t, l.Addr().String())
+}
+
+// get fetches path through the LB's first listener on a fresh connection
+// and returns the body.
+func get(lb *LB, path string) (string, error) {
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+	resp, err := client.Get("http://" + lb.cfg.Listeners[0].Addr + path)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("status %s", resp.Status)
+	}
+	return string(body), err
+}
+
+// eventually fails t unless cond holds within a few seconds.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testBackends returns n available backends 10.0.0.1:80, 10.0.0.2:80, ...
+// of weight 1.
+func testBackends(n int) []*Backend {
+	bs := make([]*Backend, n)
+	for i := range bs {
+		bs[i], _ = NewBackend(BackendConfig{Host: fmt.Sprintf("10.0.0.%d", i+1), Port: 80, Weight: 1})
+	}
+	return bs
+}
+
+// echoBackend starts a TCP server echoing whatever its clients send and
+// returns its config.
+func echoBackend(t *testing.T) BackendConfig {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	return backendAt(t, l.Addr().String())
+}
+
+// dialLB connects to the LB's first listener.
+func dialLB(t *testing.T, lb *LB) net.Conn {
+	t.Helper()
+	c, err := net.DialTimeout("tcp", lb.cfg.Listeners[0].Addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	return c
+}
+
+// echoes reports whether c sends msg straight back.
+func echoes(c net.Conn, msg string) bool {
+	if _, err := io.WriteString(c, msg); err != nil {
+		return false
+	}
+	buf := make([]byte, len(msg))
+	_, err := io.ReadFull(c, buf)
+	return err == nil && string(buf) == msg
+}
+
+// testCert writes a self-signed certificate for localhost and 127.0.0.1,
+// which is its own CA, and its key to t's temp dir.
+func testCert(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// certPool is a pool trusting the certificate in certFile.
+func certPool(t *testing.T, certFile string) *x509.CertPool {
+	t.Helper()
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		t.Fatalf("%s: no certificate", certFile)
+	}
+	return pool
+}
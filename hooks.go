@@ -0,0 +1,101 @@
+package loadbalancer
+
+import (
+	"errors"
+	"log"
+)
+
+// ---------------------- Selection Hooks ----------------------
+// hooks run around backend selection without touching the strategies:
+// SelectionHooks narrow or reorder the candidate pool before the pick,
+// SelectedHooks observe the result. Register them before Start; the slices are
+// read without locking afterwards.
+
+// SelectionHook returns the candidates req may be sent to. It gets its own
+// copy of the pool and may filter or reorder it freely.
+type SelectionHook func(req *IncomingReq, candidates []*Backend) []*Backend
+
+// SelectedHook is told which backend req went to (nil if none).
+type SelectedHook func(req *IncomingReq, b *Backend)
+
+func (lb *LB) UseSelectionHook(h SelectionHook) { lb.selectionHooks = append(lb.selectionHooks, h) }
+func (lb *LB) OnSelected(h SelectedHook)        { lb.selectedHooks = append(lb.selectedHooks, h) }
+
+// selectBackend runs the hook chain around the strategy. Admin-disabled and
+// draining backends are never candidates, nor are slow-starting ones not yet
+// taking req's key. When the hooks narrowed the pool and the strategy's pick
+// fell outside it, the key is hashed onto the remaining candidates so sticky
+// keys stay sticky. Callers must hold lb.mu.
+func (lb *LB) selectBackend(req IncomingReq) (*Backend, error) {
+	b, err := lb.strategy.GetNextBackend(req)
+	ramping := b != nil && !lb.slowStartAdmits(req, b)
+	if len(lb.selectionHooks) > 0 || ramping || (b != nil && (b.AdminDisabled || b.Draining)) {
+		candidates := enabledBackends(lb.backends)
+		for _, h := range lb.selectionHooks {
+			candidates = h(&req, candidates)
+		}
+		if ramping {
+			candidates = lb.slowStartFilter(req, candidates)
+		}
+		if !containsBackend(candidates, b) {
+			b, err = rehash(req, candidates)
+			if errors.Is(err, ErrNoBackends) && len(lb.backends) > 0 {
+				// the pool isn't empty, nothing in it may take req
+				err = ErrAllUnhealthy
+			}
+		}
+	}
+	for _, h := range lb.selectedHooks {
+		h(&req, b)
+	}
+	return b, err
+}
+
+// rehash places req's key on candidates, ErrNoBackends if there are none.
+func rehash(req IncomingReq, candidates []*Backend) (*Backend, error) {
+	if len(candidates) == 0 {
+		return nil, ErrNoBackends
+	}
+	return candidates[FNVHasher{}.Sum32(req.key)%uint32(len(candidates))], nil
+}
+
+// enabledBackends is a fresh copy of pool without admin-disabled or draining
+// backends.
+func enabledBackends(pool []*Backend) []*Backend {
+	out := make([]*Backend, 0, len(pool))
+	for _, b := range pool {
+		if !b.AdminDisabled && !b.Draining {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+func containsBackend(list []*Backend, b *Backend) bool {
+	for _, c := range list {
+		if c == b {
+			return true
+		}
+	}
+	return false
+}
+
+// HealthyOnlyHook drops unhealthy backends from the candidates.
+func HealthyOnlyHook(_ *IncomingReq, candidates []*Backend) []*Backend {
+	out := candidates[:0]
+	for _, b := range candidates {
+		if b.IsHealthy {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// LogSelectedHook logs every selection, including misses.
+func LogSelectedHook(req *IncomingReq, b *Backend) {
+	if b == nil {
+		log.Printf("select: key=%s -> <nil>", req.key)
+		return
+	}
+	log.Printf("select: key=%s -> %s", req.key, b.Label())
+}
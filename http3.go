@@ -0,0 +1,222 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// ---------------------- HTTP/3 ----------------------
+// in HTTP mode a TLS listener with the h3 option
+// (-listen :443,cert=FILE,key=FILE,h3) also takes HTTP/3 over QUIC on the
+// same port, UDP, and the responses it sends over TCP advertise that with
+// Alt-Svc, so browsers move over on their next request. Each HTTP/3 request
+// is balanced on its own like an HTTP mode one: keys (ip and ipport from the
+// client's UDP address, sni from the handshake), groups, overrides, request
+// IDs, the backend header and passive health all apply, and -request-timeout
+// caps it. Requests go to the backends over pooled connections, HTTP/1.1, or
+// h2 where backend TLS is on and the backend offers it by ALPN. Upgrades,
+// hedging, mirroring and -proxy-protocol are HTTP/1.1 side features and don't
+// apply; -max-conns, -max-conns-per-ip and the drain don't count QUIC
+// connections, which get -shutdown-grace to finish their requests instead.
+
+// altSvcMaxAge is how long, in seconds, clients may remember an Alt-Svc.
+const altSvcMaxAge = 24 * 60 * 60
+
+// listenHTTP3 opens the UDP side of the h3 listener lc.
+func (lb *LB) listenHTTP3(lc ListenerConfig) (*http3.Server, net.PacketConn, error) {
+	cert, err := tls.LoadX509KeyPair(lc.CertFile, lc.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("listener %s: %w", lc.Addr, err)
+	}
+	pc, err := net.ListenPacket("udp", lc.Addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	rp := lb.http3Proxy()
+	srv := &http3.Server{
+		TLSConfig:  http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+		QUICConfig: &quic.Config{MaxIdleTimeout: lb.cfg.ReadTimeout}, // 0 = quic-go's default
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lb.proxyHTTP3(rp, w, r)
+		}),
+	}
+	return srv, pc, nil
+}
+
+// altSvc is the Alt-Svc header value advertising the HTTP/3 ports pcs.
+func altSvc(pcs []net.PacketConn) string {
+	alts := make([]string, len(pcs))
+	for i, pc := range pcs {
+		alts[i] = fmt.Sprintf(`h3=":%d"; ma=%d`, pc.LocalAddr().(*net.UDPAddr).Port, altSvcMaxAge)
+	}
+	return strings.Join(alts, ", ")
+}
+
+// stopHTTP3 gives srv's requests up to -shutdown-grace to finish, then closes
+// what is left.
+func (lb *LB) stopHTTP3(srv *http3.Server) {
+	if lb.cfg.ShutdownGrace > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), lb.cfg.ShutdownGrace)
+		_ = srv.Shutdown(ctx)
+		cancel()
+	}
+	_ = srv.Close()
+}
+
+// http3Proxy forwards HTTP/3 requests to the backend in their context.
+func (lb *LB) http3Proxy() *httputil.ReverseProxy {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			b := pr.In.Context().Value(backendKey{}).(*Backend)
+			lb.mu.Lock()
+			scheme := "http"
+			if b.tls != nil {
+				scheme = "https"
+			}
+			lb.mu.Unlock()
+			pr.SetURL(&url.URL{Scheme: scheme, Host: b.urlHost()})
+			pr.Out.Host = pr.In.Host
+			pr.SetXForwarded()
+		},
+		Transport: &http.Transport{
+			Protocols:      protocols,
+			DialContext:    lb.dialContext,
+			DialTLSContext: lb.dialTLSContext,
+		},
+		FlushInterval: -1,
+		ModifyResponse: func(resp *http.Response) error {
+			b := resp.Request.Context().Value(backendKey{}).(*Backend)
+			if resp.StatusCode >= 500 {
+				lb.recordFailure(b, resp.Status)
+			} else {
+				lb.recordSuccess(b)
+			}
+			if h := lb.cfg.RequestIDHeader; h != "" {
+				resp.Header.Set(h, resp.Request.Header.Get(h)) // as tagRequestID left it
+			}
+			if h := lb.cfg.BackendHeader; h != "" {
+				if lb.cfg.BackendHeaderID {
+					resp.Header.Set(h, b.ID)
+				} else {
+					resp.Header.Set(h, b.String())
+				}
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			b := r.Context().Value(backendKey{}).(*Backend)
+			if !errors.Is(err, context.Canceled) {
+				log.Printf("h3: %s %s: %s", b.Label(), r.URL.Path, err)
+				lb.recordFailure(b, err.Error())
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+}
+
+// dialTLSContext dials a backend with backend TLS for the HTTP/3 proxy,
+// offering h2 by ALPN so the transport can use it.
+func (lb *LB) dialTLSContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	b, ok := ctx.Value(backendKey{}).(*Backend)
+	if !ok {
+		return nil, fmt.Errorf("no backend to dial for %s", addr)
+	}
+	lb.mu.Lock()
+	cfg := b.tls
+	lb.mu.Unlock()
+	conn, err := lb.dialBackendRaw(b)
+	if err != nil || cfg == nil {
+		return conn, err
+	}
+	cfg = cfg.Clone()
+	cfg.NextProtos = []string{"h2", "http/1.1"}
+	return handshakeBackend(conn, b, cfg)
+}
+
+// proxyHTTP3 balances one HTTP/3 request.
+func (lb *LB) proxyHTTP3(rp *httputil.ReverseProxy, w http.ResponseWriter, r *http.Request) {
+	req := IncomingReq{reqId: uuid.NewString(), key: uuid.NewString()}
+	req.reqId = lb.tagRequestID(r, req.reqId)
+	lb.keyHTTP3Request(&req, r)
+
+	backend, group, overridden, err := lb.dispatchHTTP3(req, r)
+	via := ""
+	if group != nil {
+		via = " group=" + group.Name
+	}
+	if overridden {
+		via += " override"
+	}
+	if err != nil {
+		log.Printf("in-req: %s client=%s key=%s h3%s rejected: %s", req.reqId, r.RemoteAddr, req.key, via, err)
+		http.Error(w, "no backend available: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("in-req: %s client=%s key=%s h3 %s %s%s -> backend: %s", req.reqId, r.RemoteAddr, req.key, r.Method, r.URL.RequestURI(), via, backend.Label())
+
+	start := time.Now()
+	defer func() {
+		lb.mu.Lock()
+		backend.ActiveConns--
+		lb.observeLatency(backend, time.Since(start))
+		lb.observeRTT(backend, time.Since(start))
+		lb.mu.Unlock()
+	}()
+	ctx := context.WithValue(r.Context(), backendKey{}, backend)
+	if lb.cfg.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, lb.cfg.RequestTimeout)
+		defer cancel()
+	}
+	rp.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// dispatchHTTP3 is pickHTTP counting the request on its backend in the same
+// critical section.
+func (lb *LB) dispatchHTTP3(req IncomingReq, r *http.Request) (backend *Backend, group *BackendGroup, overridden bool, err error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	backend, group, overridden, err = lb.pickHTTPLocked(req, r)
+	if err == nil {
+		backend.NumRequests++
+		backend.ActiveConns++
+		lb.breakerDispatchLocked(backend)
+	}
+	return backend, group, overridden, err
+}
+
+// keyHTTP3Request keys r as keyRequest and keyHTTPRequest would its
+// connection and request; extractors that read from the connection have
+// nothing to read here and leave the random key.
+func (lb *LB) keyHTTP3Request(req *IncomingReq, r *http.Request) {
+	lb.mu.Lock()
+	kx := lb.keyExtractor
+	lb.mu.Unlock()
+	switch kx.(type) {
+	case ClientIPKey:
+		req.key = clientIP(r.RemoteAddr)
+	case ClientAddrKey:
+		req.key = clientAddr(r.RemoteAddr)
+	case SNIKey:
+		if r.TLS != nil && r.TLS.ServerName != "" {
+			req.key = r.TLS.ServerName
+		}
+	}
+	lb.keyHTTPRequest(req, r)
+}
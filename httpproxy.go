@@ -0,0 +1,343 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ---------------------- HTTP Mode ----------------------
+// in HTTP mode the LB parses the client's requests instead of splicing bytes,
+// so every request on a keep-alive connection is balanced on its own. Backend
+// connections are kept per client connection and reused while the backend
+// allows it. Response status feeds passive health: 5xx counts as a failure,
+// anything else resets the counter. A reused backend connection the backend
+// has meanwhile closed fails before any of the response arrives; a request
+// that can safely be sent again, bodiless and idempotent as http.Transport
+// judges it, then goes once more over a fresh connection.
+
+// upstream is a backend connection owned by one client connection.
+type upstream struct {
+	backend *Backend
+	conn    net.Conn // raw, for Close
+	rw      net.Conn // with idle deadlines
+	br      *bufio.Reader
+
+	// oneShot upstreams (hedges) are closed after their response instead
+	// of being kept for the client's next request
+	oneShot bool
+
+	// protocol is what the backend switched to with a 101 (see upgrade.go)
+	protocol string
+
+	// reused is set once the upstream has carried a request
+	reused bool
+}
+
+// pickHTTP selects hreq's backend, the one it is pinned to when overridden
+// is true, and the group its path routes to, taking lb.mu itself.
+func (lb *LB) pickHTTP(req IncomingReq, hreq *http.Request) (backend *Backend, group *BackendGroup, overridden bool, err error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.pickHTTPLocked(req, hreq)
+}
+
+// pickHTTPLocked is pickHTTP for callers that hold lb.mu.
+func (lb *LB) pickHTTPLocked(req IncomingReq, hreq *http.Request) (backend *Backend, group *BackendGroup, overridden bool, err error) {
+	if backend = lb.overrideForLocked(req, hreq); backend != nil {
+		return backend, lb.routeLocked(hreq.URL.Path), true, nil
+	}
+	backend, group, err = lb.pickFor(req, hreq.URL.Path)
+	return backend, group, false, err
+}
+
+func (lb *LB) proxyHTTP(req IncomingReq) {
+	client := lb.withIdleTimeouts(req.srcConn)
+	br := bufio.NewReader(client)
+	ups := make(map[*Backend]*upstream)
+	served := 0
+
+	defer func() {
+		_ = req.srcConn.Close()
+		for _, up := range ups {
+			lb.closeUpstream(up)
+		}
+	}()
+
+	for {
+		hreq, err := http.ReadRequest(br)
+		if err != nil {
+			switch {
+			case isTimeout(err):
+				log.Printf("conn %s: client idle/read timeout, closing", req.reqId)
+			case !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed):
+				log.Printf("conn %s: reading request: %s", req.reqId, err)
+			}
+			return
+		}
+
+		// the connection's id names its first request, later ones get their
+		// own; an id the client already sent may be adopted
+		r := req
+		if served > 0 {
+			r.reqId = uuid.NewString()
+		}
+		served++
+		r.reqId = lb.tagRequestID(hreq, r.reqId)
+		lb.keyHTTPRequest(&r, hreq)
+
+		backend, group, overridden, err := lb.pickHTTP(r, hreq)
+		via := ""
+		if group != nil {
+			via = " group=" + group.Name
+		}
+		if overridden {
+			via += " override"
+		}
+		if err != nil {
+			log.Printf("in-req: %s client=%s key=%s%s rejected: %s", r.reqId, r.srcConn.RemoteAddr(), r.key, via, err)
+			lb.rejectRequest(r, "no backend available: "+err.Error())
+			return
+		}
+		log.Printf("in-req: %s client=%s key=%s %s %s%s -> backend: %s", r.reqId, r.srcConn.RemoteAddr(), r.key, hreq.Method, hreq.URL, via, backend.Label())
+
+		lb.retryBudget.deposit()
+		up := ups[backend]
+		if up == nil {
+			var conn net.Conn
+			if backend, conn, err = lb.dialWithRetries(r, backend); err != nil {
+				log.Printf("Error connecting to backend: %s", err.Error())
+				lb.rejectRequest(r, "backend not available")
+				return
+			}
+			if old := ups[backend]; old != nil {
+				// a retry landed on a backend we already hold a connection to
+				lb.closeUpstream(old)
+			}
+			up = lb.newUpstream(backend, conn)
+			ups[backend] = up
+		}
+		lb.mu.Lock()
+		backend.NumRequests++
+		lb.breakerDispatchLocked(backend)
+		lb.mu.Unlock()
+
+		lb.mirrorRequest(r, hreq)
+		clientClose := hreq.Close
+		if err := lb.exchange(r, hreq, up, client); err != nil {
+			if isTimeout(err) {
+				log.Printf("req %s: timeout talking to %s, closing", r.reqId, backend.Label())
+			} else if !errors.Is(err, net.ErrClosed) {
+				log.Printf("req %s: %s: %s", r.reqId, backend.Label(), err)
+			}
+			return
+		}
+		if up.protocol != "" {
+			if up.conn != nil {
+				lb.tunnel(r, br, up)
+			}
+			return
+		}
+		if up.conn == nil {
+			// backend asked to close; the next request dials again
+			delete(ups, backend)
+		}
+		if clientClose {
+			return
+		}
+	}
+}
+
+// exchange forwards one request to up and relays its response to the client,
+// all under -request-timeout when set. On return up.conn is nil if the backend
+// connection can't be reused.
+func (lb *LB) exchange(req IncomingReq, hreq *http.Request, up *upstream, client net.Conn) error {
+	start := time.Now()
+	if lb.cfg.RequestTimeout > 0 {
+		conn := up.conn
+		watchdog := time.AfterFunc(lb.cfg.RequestTimeout, func() {
+			log.Printf("req %s: exceeded request timeout %s on %s, closing", req.reqId, lb.cfg.RequestTimeout, up.backend.Label())
+			_ = conn.Close()
+			_ = req.srcConn.Close()
+		})
+		defer watchdog.Stop()
+	}
+
+	resp, up, err := lb.roundTrip(req, hreq, up)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		if !isUpgrade(hreq) {
+			lb.closeUpstream(up)
+			return fmt.Errorf("101 Switching Protocols to a request that didn't ask for it")
+		}
+		if up.protocol = resp.Header.Get("Upgrade"); up.protocol == "" {
+			up.protocol = hreq.Header.Get("Upgrade")
+		}
+	}
+
+	if resp.StatusCode >= 500 {
+		lb.recordFailure(up.backend, resp.Status)
+	} else {
+		lb.recordSuccess(up.backend)
+	}
+
+	if h := lb.cfg.RequestIDHeader; h != "" {
+		resp.Header.Set(h, req.reqId)
+	}
+	if _, ok := req.srcConn.(*tls.Conn); ok && lb.altSvc != "" {
+		resp.Header.Set("Alt-Svc", lb.altSvc)
+	}
+	if h := lb.cfg.BackendHeader; h != "" {
+		if lb.cfg.BackendHeaderID {
+			resp.Header.Set(h, up.backend.ID)
+		} else {
+			resp.Header.Set(h, up.backend.String())
+		}
+	}
+
+	// the backend closing its side doesn't mean the client's keep-alive ends
+	backendClose := resp.Close
+	resp.Close = hreq.Close
+	if !hreq.ProtoAtLeast(1, 1) && len(resp.TransferEncoding) > 0 {
+		// an HTTP/1.0 client can't read chunks: send the body raw and let
+		// the close mark its end
+		resp.TransferEncoding = nil
+		resp.Close = true
+	}
+	err = resp.Write(client)
+	if err == nil {
+		lb.mu.Lock()
+		lb.observeLatency(up.backend, time.Since(start))
+		lb.observeRTT(up.backend, time.Since(start))
+		lb.mu.Unlock()
+	}
+	if backendClose || up.oneShot || err != nil {
+		lb.closeUpstream(up)
+	}
+	up.reused = true
+	return err
+}
+
+// roundTrip sends hreq on up and reads the response head, hedging it when
+// allowed. It returns the upstream the response came from; an upstream that
+// failed is closed.
+func (lb *LB) roundTrip(req IncomingReq, hreq *http.Request, up *upstream) (*http.Response, *upstream, error) {
+	if lb.hedgeable(hreq) {
+		return lb.hedgedRoundTrip(req, hreq, up)
+	}
+	resp, err := send(up, hreq)
+	if err != nil && up.reused && replayable(hreq) && errors.As(err, new(noResponseError)) {
+		// most likely the backend closed the idle connection as we used it
+		log.Printf("req %s: reused connection to %s failed (%s), redialing", req.reqId, up.backend.Label(), err)
+		if err = lb.redial(req, up); err == nil {
+			resp, err = send(up, hreq)
+		}
+	}
+	if err != nil {
+		lb.closeUpstream(up)
+		return nil, up, err
+	}
+	return resp, up, nil
+}
+
+// noResponseError is a send that failed before any byte of the response
+// arrived.
+type noResponseError struct{ err error }
+
+func (e noResponseError) Error() string { return e.err.Error() }
+func (e noResponseError) Unwrap() error { return e.err }
+
+// send writes hreq to up and reads the response head. It leaves closing to
+// the caller so it can run concurrently with another send.
+func send(up *upstream, hreq *http.Request) (*http.Response, error) {
+	if err := hreq.Write(up.rw); err != nil {
+		return nil, noResponseError{err}
+	}
+	if _, err := up.br.Peek(1); err != nil && !isTimeout(err) {
+		// a timeout may be a slow backend still working on the request
+		return nil, noResponseError{err}
+	}
+	return http.ReadResponse(up.br, hreq)
+}
+
+// replayable reports whether hreq may be sent again after a failed attempt:
+// it has no body, which is gone once written, and is idempotent by method or
+// by an Idempotency-Key header, the rule http.Transport applies.
+func replayable(hreq *http.Request) bool {
+	if hreq.ContentLength != 0 || len(hreq.TransferEncoding) > 0 || isUpgrade(hreq) {
+		return false
+	}
+	switch hreq.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return hreq.Header.Get("Idempotency-Key") != "" || hreq.Header.Get("X-Idempotency-Key") != ""
+}
+
+// redial swaps up's connection for a fresh one to the same backend.
+func (lb *LB) redial(req IncomingReq, up *upstream) error {
+	lb.closeUpstream(up)
+	fresh, err := lb.openUpstream(req.srcConn, up.backend)
+	if err != nil {
+		lb.recordFailure(up.backend, err.Error())
+		return err
+	}
+	*up = *fresh
+	return nil
+}
+
+// tagRequestID puts id into the -request-id-header of hreq and returns the id
+// the request now carries: a value the client sent wins unless
+// -request-id-overwrite is set. Header edits don't affect body framing, which
+// hreq.Write derives from ContentLength/TransferEncoding.
+func (lb *LB) tagRequestID(hreq *http.Request, id string) string {
+	h := lb.cfg.RequestIDHeader
+	if h == "" {
+		return id
+	}
+	if have := hreq.Header.Get(h); have != "" && !lb.cfg.RequestIDOverwrite {
+		return have
+	}
+	hreq.Header.Set(h, id)
+	return id
+}
+
+func (lb *LB) openUpstream(client net.Conn, b *Backend) (*upstream, error) {
+	conn, err := lb.dialBackendFor(client, b)
+	if err != nil {
+		return nil, err
+	}
+	return lb.newUpstream(b, conn), nil
+}
+
+// newUpstream wraps a freshly dialed connection to b.
+func (lb *LB) newUpstream(b *Backend, conn net.Conn) *upstream {
+	lb.mu.Lock()
+	b.ActiveConns++
+	lb.mu.Unlock()
+	rw := lb.withIdleTimeouts(conn)
+	return &upstream{backend: b, conn: conn, rw: rw, br: bufio.NewReader(rw)}
+}
+
+// closeUpstream is idempotent; it marks up unusable by clearing up.conn.
+func (lb *LB) closeUpstream(up *upstream) {
+	if up.conn == nil {
+		return
+	}
+	_ = up.conn.Close()
+	up.conn = nil
+	lb.mu.Lock()
+	up.backend.ActiveConns--
+	lb.mu.Unlock()
+}
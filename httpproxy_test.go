@@ -0,0 +1,89 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// closingBackend starts a server that answers one request per connection
+// without announcing the close, as a backend whose keep-alive timeout has
+// just run out does, and returns its config. served counts the requests it
+// read.
+func closingBackend(t *testing.T, served *atomic.Int32) BackendConfig {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				r, err := http.ReadRequest(bufio.NewReader(c))
+				if err != nil {
+					return
+				}
+				_, _ = io.Copy(io.Discard, r.Body)
+				served.Add(1)
+				fmt.Fprint(c, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+			}()
+		}
+	}()
+	return backendAt(t, l.Addr().String())
+}
+
+func TestStaleUpstreamRedialedForReplayableRequests(t *testing.T) {
+	var served atomic.Int32
+	cfg := testConfig(t, closingBackend(t, &served))
+	cfg.Mode = ModeHTTP
+	lb := newTestLB(t, cfg)
+	startLB(t, lb)
+
+	c := dialLB(t, lb)
+	br := bufio.NewReader(c)
+	roundTrip := func(req string) error {
+		if _, err := io.WriteString(c, req); err != nil {
+			return err
+		}
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			return err
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "ok" {
+			return fmt.Errorf("body %q", body)
+		}
+		return nil
+	}
+	for i, req := range []string{
+		"GET / HTTP/1.1\r\nHost: lb\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: lb\r\n\r\n",
+		"DELETE /x HTTP/1.1\r\nHost: lb\r\n\r\n",
+		"POST /x HTTP/1.1\r\nHost: lb\r\nIdempotency-Key: k1\r\n\r\n",
+	} {
+		if err := roundTrip(req); err != nil {
+			t.Fatalf("request %d (%s) over a kept-alive client connection: %v", i, strings.Fields(req)[0], err)
+		}
+	}
+
+	// a POST isn't sent twice: the client sees the failure instead
+	served.Store(0)
+	if err := roundTrip("POST /x HTTP/1.1\r\nHost: lb\r\nContent-Length: 1\r\n\r\nx"); err == nil {
+		t.Fatal("POST over a closed upstream answered")
+	}
+	if n := served.Load(); n != 0 {
+		t.Fatalf("POST reached the backend %d times, want 0", n)
+	}
+}
@@ -0,0 +1,41 @@
+package loadbalancer
+
+import "sync"
+
+// ---------------------- Per-IP Connection Limit ----------------------
+// -max-conns-per-ip caps the live connections of any one client IP, so a
+// single client can't take every -max-conns slot. Counts are kept per
+// clientIP and an entry is deleted when it drops back to zero, so the map
+// only ever holds IPs with open connections. Clients on a Unix socket
+// listener have no IP (see connIP) and are not limited.
+
+type ipConns struct {
+	mu sync.Mutex
+	n  map[string]int
+}
+
+// acquireIP counts a new connection from ip; false means ip is at its cap.
+// Always succeeds when there is no cap.
+func (lb *LB) acquireIP(ip string) bool {
+	if lb.cfg.MaxConnsPerIP <= 0 || ip == "" {
+		return true
+	}
+	lb.ipConns.mu.Lock()
+	defer lb.ipConns.mu.Unlock()
+	if lb.ipConns.n[ip] >= lb.cfg.MaxConnsPerIP {
+		return false
+	}
+	lb.ipConns.n[ip]++
+	return true
+}
+
+func (lb *LB) releaseIP(ip string) {
+	if lb.cfg.MaxConnsPerIP <= 0 || ip == "" {
+		return
+	}
+	lb.ipConns.mu.Lock()
+	defer lb.ipConns.mu.Unlock()
+	if lb.ipConns.n[ip]--; lb.ipConns.n[ip] <= 0 {
+		delete(lb.ipConns.n, ip)
+	}
+}
@@ -0,0 +1,83 @@
+package loadbalancer
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// dialLBFrom connects to the LB's first listener from the loopback address
+// src.
+func dialLBFrom(t *testing.T, lb *LB, src string) net.Conn {
+	t.Helper()
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(src)}, Timeout: 5 * time.Second}
+	c, err := d.Dial("tcp", lb.cfg.Listeners[0].Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	return c
+}
+
+func TestMaxConnsPerIPThrottlesOnlyThatIP(t *testing.T) {
+	if err := checkDialSource("127.0.0.3"); err != nil {
+		t.Skipf("127.0.0.x not bindable: %v", err)
+	}
+	cfg := testConfig(t, echoBackend(t))
+	cfg.MaxConnsPerIP = 2
+	lb := newTestLB(t, cfg)
+	startLB(t, lb)
+
+	var busy []net.Conn
+	for i := range 5 {
+		c := dialLBFrom(t, lb, "127.0.0.2")
+		if i < 2 {
+			if !echoes(c, "ping") {
+				t.Fatalf("connection %d under the cap not proxied", i)
+			}
+			busy = append(busy, c)
+			continue
+		}
+		if msg, _ := io.ReadAll(c); string(msg) != "too many connections from your address" {
+			t.Fatalf("connection %d over the cap got %q", i, msg)
+		}
+	}
+	for i := range 2 {
+		if !echoes(dialLBFrom(t, lb, "127.0.0.3"), "pong") {
+			t.Fatalf("connection %d from another IP not proxied", i)
+		}
+	}
+	if per, global := lb.rejectedPerIP.Load(), lb.rejectedConns.Load(); per != 3 || global != 0 {
+		t.Fatalf("%d per-IP and %d global rejections, want 3 and 0", per, global)
+	}
+
+	// closing a connection frees one of the IP's slots
+	_ = busy[0].Close()
+	eventually(t, "a free slot for 127.0.0.2", func() bool {
+		lb.ipConns.mu.Lock()
+		defer lb.ipConns.mu.Unlock()
+		return lb.ipConns.n["127.0.0.2"] < 2
+	})
+	if !echoes(dialLBFrom(t, lb, "127.0.0.2"), "again") {
+		t.Fatal("connection after one closed not proxied")
+	}
+}
+
+func TestIPConnsDropsIdleEntries(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MaxConnsPerIP = 1
+	lb := newTestLB(t, cfg)
+	if !lb.acquireIP("192.0.2.1") || lb.acquireIP("192.0.2.1") {
+		t.Fatal("second connection from one IP allowed at a cap of 1")
+	}
+	if !lb.acquireIP("") {
+		t.Fatal("connection without an IP (unix socket) limited")
+	}
+	lb.releaseIP("192.0.2.1")
+	lb.releaseIP("")
+	if len(lb.ipConns.n) != 0 {
+		t.Fatalf("entries left with no open connections: %v", lb.ipConns.n)
+	}
+}
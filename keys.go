@@ -0,0 +1,247 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---------------------- Request Keys ----------------------
+// hashing strategies route by the request's key, and the key extractor
+// (-key, or the `key` command at runtime) decides what that is for each new
+// connection: a random UUID (the default, which shows the spread but no
+// stickiness), the client IP, the client IP and port, the first -key-bytes
+// bytes the client sends, or the TLS server name it asks for. The payload and
+// SNI extractors read ahead on the connection and replay what they read, so
+// the backend still sees every byte; they wait at most -read-timeout
+// (autoSniffTimeout when unset) for it. A connection that offers no key (a
+// client that sends nothing, a plain-TCP client under sni) gets a random one.
+// In HTTP and gRPC modes an extractor may key each request instead
+// (RequestKeyExtractor): header:<Name> keys by a request header, and a
+// request without it keeps its connection's key.
+
+// DefaultKeyBytes is the -key-bytes default.
+const DefaultKeyBytes = 16
+
+// KeyExtractor derives the routing key of a new connection. It returns the
+// connection to proxy from then on, which must replay anything Key read, and
+// ok false when conn has no key to offer.
+type KeyExtractor interface {
+	Key(conn net.Conn) (key string, c net.Conn, ok bool)
+}
+
+// RequestKeyExtractor is a KeyExtractor that, in HTTP and gRPC modes, also
+// keys every request on its own; ok false leaves the connection's key.
+type RequestKeyExtractor interface {
+	KeyExtractor
+	RequestKey(r *http.Request) (key string, ok bool)
+}
+
+// KeyExtractorNames are the names NewKeyExtractor accepts.
+var KeyExtractorNames = []string{"random", "ip", "ipport", "payload", "sni", "header:<name>"}
+
+// NewKeyExtractor builds the extractor called name. payload reads up to
+// payloadBytes; payload and sni wait at most timeout for the client.
+func NewKeyExtractor(name string, payloadBytes int, timeout time.Duration) (KeyExtractor, error) {
+	switch name {
+	case "random":
+		return RandomKey{}, nil
+	case "ip":
+		return ClientIPKey{}, nil
+	case "ipport":
+		return ClientAddrKey{}, nil
+	case "payload":
+		if payloadBytes <= 0 {
+			return nil, fmt.Errorf("payload key needs a positive byte count")
+		}
+		return PayloadKey{N: payloadBytes, Timeout: timeout}, nil
+	case "sni":
+		return SNIKey{Timeout: timeout}, nil
+	}
+	if h, ok := strings.CutPrefix(name, "header:"); ok {
+		if h == "" || strings.ContainsAny(h, " \t:") {
+			return nil, fmt.Errorf("header key needs a header name, e.g. header:X-User-ID")
+		}
+		return HeaderKey{Name: http.CanonicalHeaderKey(h)}, nil
+	}
+	return nil, fmt.Errorf("unknown key extractor %q (want random|ip|ipport|payload|sni|header:<name>)", name)
+}
+
+// RandomKey offers no key, so every connection gets a random one.
+type RandomKey struct{}
+
+func (RandomKey) Key(conn net.Conn) (string, net.Conn, bool) { return "", conn, false }
+
+// ClientIPKey keys by the client's IP: one client, one backend.
+type ClientIPKey struct{}
+
+func (ClientIPKey) Key(conn net.Conn) (string, net.Conn, bool) {
+	ip := connIP(conn)
+	return ip, conn, ip != ""
+}
+
+// ClientAddrKey keys by the client's IP and port, one key per connection
+// that a reconnecting client doesn't keep.
+type ClientAddrKey struct{}
+
+func (ClientAddrKey) Key(conn net.Conn) (string, net.Conn, bool) {
+	if connIP(conn) == "" {
+		return "", conn, false
+	}
+	addr := clientAddr(conn.RemoteAddr().String())
+	return addr, conn, addr != ""
+}
+
+// PayloadKey keys by the first N bytes the client sends, or fewer if that's
+// all that arrives within Timeout. The key is the Go-quoted bytes, so binary
+// protocols log readably.
+type PayloadKey struct {
+	N       int
+	Timeout time.Duration
+}
+
+func (k PayloadKey) Key(conn net.Conn) (string, net.Conn, bool) {
+	br := bufio.NewReaderSize(conn, max(k.N, 16))
+	_ = conn.SetReadDeadline(time.Now().Add(k.Timeout))
+	head, _ := br.Peek(k.N)
+	_ = conn.SetReadDeadline(time.Time{})
+	return strconv.Quote(string(head)), &sniffedConn{Conn: conn, r: br}, len(head) > 0
+}
+
+// HeaderKey keys each HTTP request or RPC by its Name header, so requests of
+// one user, tenant or session stick to one backend whatever connection they
+// arrive on. Connections themselves get no key from it, so in TCP mode it
+// is as good as random.
+type HeaderKey struct {
+	Name string
+}
+
+func (HeaderKey) Key(conn net.Conn) (string, net.Conn, bool) { return "", conn, false }
+
+// RequestKey is the header's value; one that is a bare IP address (as in
+// X-Real-IP) is canonicalized like clientIP, so every spelling of a client's
+// address keys alike.
+func (k HeaderKey) RequestKey(r *http.Request) (string, bool) {
+	v := strings.TrimSpace(r.Header.Get(k.Name))
+	if ip, err := netip.ParseAddr(v); err == nil {
+		v = ip.Unmap().String()
+	}
+	return v, v != ""
+}
+
+// SNIKey keys by the server name in the client's TLS ClientHello. On a
+// listener that terminates TLS it is read from the handshake; otherwise the
+// ClientHello is parsed from a peek and passed through untouched.
+type SNIKey struct {
+	Timeout time.Duration
+}
+
+// errHelloRead stops the peeking handshake once the ClientHello is parsed.
+var errHelloRead = errors.New("client hello read")
+
+func (k SNIKey) Key(conn net.Conn) (string, net.Conn, bool) {
+	name, conn := peekServerName(conn, k.Timeout)
+	return name, conn, name != ""
+}
+
+// peekServerName returns the server name conn's client asks for, "" when it
+// names none or isn't TLS, and the connection to use from then on, which
+// replays what was read. It waits at most timeout for the ClientHello.
+func peekServerName(conn net.Conn, timeout time.Duration) (string, net.Conn) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := tc.HandshakeContext(ctx); err != nil {
+			return "", conn
+		}
+		return tc.ConnectionState().ServerName, conn
+	}
+
+	var seen bytes.Buffer
+	var name string
+	peek := tls.Server(readOnlyConn{Conn: conn, r: io.TeeReader(conn, &seen)}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = h.ServerName
+			return nil, errHelloRead
+		},
+	})
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	_ = peek.Handshake()
+	_ = conn.SetReadDeadline(time.Time{})
+	return name, &sniffedConn{Conn: conn, r: bufio.NewReader(io.MultiReader(&seen, conn))}
+}
+
+// readOnlyConn lets the peeking handshake read the client without answering
+// it.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// keyTimeout is how long payload and SNI extraction wait for the client.
+func (lb *LB) keyTimeout() time.Duration {
+	if lb.cfg.ReadTimeout > 0 {
+		return lb.cfg.ReadTimeout
+	}
+	return autoSniffTimeout
+}
+
+// setKeyExtractorLocked switches to the extractor called name. Callers must
+// hold lb.mu.
+func (lb *LB) setKeyExtractorLocked(name string) error {
+	kx, err := NewKeyExtractor(name, lb.cfg.KeyBytes, lb.keyTimeout())
+	if err != nil {
+		return err
+	}
+	lb.keyExtractor, lb.keyName = kx, name
+	return nil
+}
+
+// UseKeyExtractor replaces the key extractor with kx, reported as name, for
+// embedders with a key of their own. Call it before Start.
+func (lb *LB) UseKeyExtractor(name string, kx KeyExtractor) {
+	lb.keyExtractor, lb.keyName = kx, name
+}
+
+// keyHTTPRequest re-keys req by hreq when the current extractor keys
+// requests.
+func (lb *LB) keyHTTPRequest(req *IncomingReq, hreq *http.Request) {
+	lb.mu.Lock()
+	kx := lb.keyExtractor
+	lb.mu.Unlock()
+	if rk, ok := kx.(RequestKeyExtractor); ok {
+		if key, ok := rk.RequestKey(hreq); ok {
+			req.key = key
+		}
+	}
+}
+
+// keyRequest fills in req's key from the current extractor, keeping the
+// random one when it offers none.
+func (lb *LB) keyRequest(req *IncomingReq) {
+	lb.mu.Lock()
+	kx := lb.keyExtractor
+	lb.mu.Unlock()
+	key, conn, ok := kx.Key(req.srcConn)
+	req.srcConn = conn
+	if ok {
+		req.key = key
+	}
+	if _, isSNI := kx.(SNIKey); isSNI {
+		// SNI routing needn't read the ClientHello again
+		req.sni, req.sniRead = key, true
+	}
+}
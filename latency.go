@@ -0,0 +1,96 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---------------------- Latency Histograms ----------------------
+// every backend carries a histogram of how long it served, exported as
+// lb_backend_duration_seconds{backend,id}. What one observation means
+// depends on the mode: in TCP mode it is a whole connection, from backend
+// connect to close, so long-lived clients land in the top buckets whatever
+// the backend's speed; in HTTP mode it is one request, from forwarding it to
+// the last response byte relayed; in gRPC mode it is one RPC. The histogram
+// lives on the Backend, so its series leave /metrics with it when the backend
+// is removed, even though the counts are cumulative: a scraper sees the series
+// end, and one re-added on the same address starts again from zero under its
+// new id. Connections still open on a removed backend are no longer counted.
+
+// defaultLatencyBuckets are the -latency-buckets default, in seconds.
+const defaultLatencyBuckets = "0.005,0.01,0.025,0.05,0.1,0.25,0.5,1,2.5,5,10"
+
+type latencyHist struct {
+	counts []int64 // per bucket, not cumulative; allocated on first use
+	count  int64
+	sum    float64
+}
+
+// observeLatency records d on b. Callers must hold lb.mu.
+func (lb *LB) observeLatency(b *Backend, d time.Duration) {
+	bounds := lb.cfg.latencyBounds
+	h := &b.latency
+	if h.counts == nil {
+		h.counts = make([]int64, len(bounds))
+	}
+	s := d.Seconds()
+	if i := sort.SearchFloat64s(bounds, s); i < len(bounds) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += s
+}
+
+// writeLatency writes every backend's histogram in the Prometheus text
+// format.
+func (lb *LB) writeLatency(w io.Writer) {
+	const name = "lb_backend_duration_seconds"
+	bounds := lb.cfg.latencyBounds
+	fmt.Fprintf(w, "# HELP %s Time a backend spent on a connection (tcp), request (http) or RPC (grpc).\n", name)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	for _, b := range lb.allBackendsLocked() {
+		h := b.latency
+		labels := fmt.Sprintf("backend=%q,id=%q", b.String(), b.ID)
+		var cum int64
+		for i, ub := range bounds {
+			if h.counts != nil {
+				cum += h.counts[i]
+			}
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, ub, cum)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+	}
+}
+
+// parseBuckets parses a comma-separated list of strictly increasing,
+// positive bucket bounds.
+func parseBuckets(s string) ([]float64, error) {
+	var out []float64
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("invalid bucket %q", part)
+		}
+		if len(out) > 0 && v <= out[len(out)-1] {
+			return nil, fmt.Errorf("buckets must increase, %g after %g", v, out[len(out)-1])
+		}
+		out = append(out, v)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no buckets given")
+	}
+	return out, nil
+}
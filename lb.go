@@ -1,13 +1,28 @@
-package main
+package loadbalancer
 
 import (
+	"container/list"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/quic-go/quic-go/http3"
 )
 
 // ----- event names -----
@@ -17,74 +32,666 @@ const (
 	CMD_BackendRemove  = "backend:remove"
 	CMD_StrategyChange = "strategy:change"
 	CMD_ShowMapping    = "mapping:show"
+	CMD_KeysSet        = "keys:set"
+	CMD_Simulate       = "simulate"
+	CMD_Bench          = "bench"
+	CMD_ListBackends   = "backend:list"
+	CMD_ShowTopology   = "topology:show"
+	CMD_GroupStrategy  = "group:strategy"
+	CMD_BackendAdmin   = "backend:admin"
+	CMD_ShowRing       = "ring:show"
+	CMD_Reload         = "config:reload"
+	CMD_VNodes         = "ring:vnodes"
+	CMD_DRRQuantum     = "drr:quantum"
+	CMD_BackendTier    = "backend:priority"
+	CMD_BackendZone    = "backend:zone"
+	CMD_KeyExtractor   = "key:extractor"
+	CMD_ShowSessions   = "sessions:show"
+	CMD_FlushSessions  = "sessions:flush"
+	CMD_ShowHealth     = "health:show"
 )
 
+// MaxSimulateRequests caps a single simulate run so a typo can't wedge the
+// control loop.
+const MaxSimulateRequests = 1_000_000
+
+// ErrStopped is returned by Request once the LB has shut down.
+var ErrStopped = errors.New("load balancer stopped")
+
+// rejectWriteTimeout bounds how long an error reply may block on a client
+// that stopped reading.
+const rejectWriteTimeout = 2 * time.Second
+
 // ---------------------- Structs ----------------------
 
 type Backend struct {
-	Host        string
-	Port        int
+	// ID names this instance of the backend: it never changes, and a backend
+	// removed and added again on the same address gets a new one.
+	ID string
+
+	Host string
+	Port int
+	// Path, when set, makes this a Unix socket backend; Host and Port are
+	// then unused.
+	Path string
+
+	// Name is the hostname b was resolved from under -dns-refresh, Host then
+	// being one of its addresses; empty for a backend given by address.
+	Name string
+
 	IsHealthy   bool
 	NumRequests int
+	ActiveConns int
+
+	// Weight is the relative share of traffic for weighted strategies;
+	// 0 takes the backend out of weighted rotation.
+	Weight int
+
+	// Priority is the backend's tier for the priority strategy: 0 takes
+	// traffic first, higher tiers only while every lower one is down.
+	Priority int
+
+	// Zone is the backend's locality label for the zone strategy; empty
+	// means unknown, which counts as remote.
+	Zone string
+
+	// slowStartAt is when b's -slow-start ramp began; zero once it has full
+	// weight. Guarded by lb.mu.
+	slowStartAt time.Time
+
+	// AdminDisabled is set by the operator (`disable`) and keeps the backend
+	// out of rotation whatever its health checks say, until `enable`.
+	AdminDisabled bool
+
+	// Draining is set from the config file (drain: true, applied on SIGHUP):
+	// no new traffic, open connections finish. Unlike removal the backend
+	// keeps its ring positions, so resuming it moves no other key.
+	Draining bool
+
+	// passive health bookkeeping, guarded by lb.mu
+	failures  int
+	failSince time.Time
+	probation bool // back after an ejection, until its first result
+	ejections int  // passive ejections so far, to match probation timers
+
+	// consecutive active check results and the last one, guarded by lb.mu
+	hcPasses  int
+	hcFails   int
+	lastProbe probeRecord
+
+	// healthCheck overrides the http or grpc check for b; nil follows -hc-*. It is
+	// replaced, never modified, under lb.mu.
+	healthCheck *BackendHealthCheck
+
+	// time spent serving, see latency.go; guarded by lb.mu
+	latency latencyHist
+
+	// latency average for p2c, see peakewma.go; guarded by lb.mu
+	rtt peakEWMA
+
+	// circuit breaker, see breaker.go; guarded by lb.mu
+	breaker breaker
+
+	// outlier detection, see outlier.go; guarded by lb.mu
+	outlier outlierStats
+
+	// tls is its pool's backend TLS config, or its own from tlsConfig (the
+	// config file's tls block, nil without one); nil dials in plaintext.
+	// Guarded by lb.mu, as a reload may replace both.
+	tls       *tls.Config
+	tlsConfig *BackendTLSConfig
+}
+
+// Available reports whether b may be picked: healthy, not disabled, not
+// draining, not ejected as an outlier and with a circuit that admits
+// requests.
+func (b *Backend) Available() bool {
+	return b.IsHealthy && !b.AdminDisabled && !b.Draining && !b.outlier.ejected && b.breaker.admits()
+}
+
+// String is the address; IPv6 literals are bracketed ("[::1]:8081") and Unix
+// sockets prefixed ("unix:/run/app.sock"). It doubles as the backend's ring
+// key and identity in commands, so it must stay stable.
+func (b *Backend) String() string {
+	if b.Path != "" {
+		return "unix:" + b.Path
+	}
+	return net.JoinHostPort(b.Host, strconv.Itoa(b.Port))
+}
+
+// network returns the net.Dial arguments for b.
+func (b *Backend) network() (network, address string) {
+	if b.Path != "" {
+		return "unix", b.Path
+	}
+	return "tcp", b.String()
+}
+
+// Label is how logs name a backend: address plus ID ("localhost:8081#1f0c9a2e").
+func (b *Backend) Label() string { return b.String() + "#" + b.ID }
+
+// ParseBackendAddr accepts a bare port (localhost implied), host:port with
+// IPv6 literals bracketed ("[::1]:8085"), or unix:/path for a Unix socket. IP
+// literals are normalized so the same address always yields the same
+// Backend.String().
+func ParseBackendAddr(s string) (Backend, error) {
+	if path, ok := strings.CutPrefix(s, "unix:"); ok {
+		if path == "" {
+			return Backend{}, fmt.Errorf("invalid address %q: empty socket path", s)
+		}
+		return Backend{Path: path}, nil
+	}
+	host, portStr := "localhost", s
+	if strings.Contains(s, ":") {
+		h, ps, err := net.SplitHostPort(s)
+		if err != nil {
+			return Backend{}, fmt.Errorf("invalid address %q: %v", s, err)
+		}
+		host, portStr = h, ps
+	}
+	p, err := strconv.Atoi(portStr)
+	if err != nil {
+		return Backend{}, fmt.Errorf("invalid port %q", portStr)
+	}
+	if err := checkPort(p); err != nil {
+		return Backend{}, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	return Backend{Host: host, Port: p}, nil
+}
+
+// newBackendID returns a short random backend ID.
+func newBackendID() string { return uuid.NewString()[:8] }
+
+// lowPort is the first port outside the privileged range; see -warn-low-ports.
+const lowPort = 1024
+
+// checkPort rejects ports a backend can't listen on.
+func checkPort(p int) error {
+	if p < 1 || p > 65535 {
+		return fmt.Errorf("invalid port %d (want 1-65535)", p)
+	}
+	return nil
+}
+
+// NewBackend builds the backend bc describes, healthy and with a fresh ID
+// unless bc names one. Every pool member is created here, so a bad port or
+// weight is refused before anything dials it.
+func NewBackend(bc BackendConfig) (*Backend, error) {
+	if err := bc.check(); err != nil {
+		return nil, fmt.Errorf("backend %s: %w", bc.addr(), err)
+	}
+	id := bc.ID
+	if id == "" {
+		id = newBackendID()
+	}
+	return &Backend{
+		ID: id, Host: bc.Host, Port: bc.Port, Path: bc.Path, Weight: bc.Weight, Priority: bc.Priority, Zone: bc.Zone,
+		IsHealthy: true, AdminDisabled: bc.Disabled, Draining: bc.Drain, healthCheck: bc.HealthCheck,
+		tlsConfig: bc.TLS,
+	}, nil
+}
+
+// newBackend is NewBackend plus the -warn-low-ports warning.
+func (lb *LB) newBackend(bc BackendConfig) (*Backend, error) {
+	b, err := NewBackend(bc)
+	if err == nil {
+		lb.warnLowPort(b)
+	}
+	return b, err
 }
 
-func (b *Backend) String() string { return fmt.Sprintf("%s:%d", b.Host, b.Port) }
+// warnLowPort logs b if -warn-low-ports is set and b is on a privileged port.
+func (lb *LB) warnLowPort(b *Backend) {
+	if lb.cfg.WarnLowPorts && b.Path == "" && b.Port < lowPort {
+		log.Printf("warning: backend %s is on privileged port %d", b, b.Port)
+	}
+}
 
 type Event struct {
 	EventName string
-	Data      interface{} // Backend (add), int (port) for remove, string for strategy, or nil
+	Data      interface{} // Backend for add/remove, string for strategy, []string for keys, Simulation, int for bench, or nil
+
+	// Ack, if set, receives the outcome once the event was handled (nil on
+	// success). It must be buffered so the control loop never blocks on it.
+	Ack chan error
+}
+
+// reject logs and acks an event whose Data has the wrong type; the control
+// loop carries on with the next one.
+func (e Event) reject() {
+	err := fmt.Errorf("%s: invalid data %T", e.EventName, e.Data)
+	log.Println(err)
+	e.ack(err)
+}
+
+// Send hands ev to the control loop without waiting for its outcome. It
+// needs a started LB and does nothing once it has shut down.
+func (lb *LB) Send(ev Event) {
+	select {
+	case lb.events <- ev:
+	case <-lb.done:
+	}
+}
+
+// Request sends ev to the control loop and waits for its outcome.
+func (lb *LB) Request(ev Event) error {
+	ev.Ack = make(chan error, 1)
+	select {
+	case lb.events <- ev:
+	case <-lb.done:
+		return ErrStopped
+	}
+	select {
+	case err := <-ev.Ack:
+		return err
+	case <-lb.done:
+		return ErrStopped
+	}
+}
+
+// ack reports err to the sender of e, if it asked.
+func (e Event) ack(err error) {
+	if e.Ack != nil {
+		e.Ack <- err
+	}
+}
+
+// Simulation describes a synthetic traffic run: N requests keyed by Keys in
+// rotation, or by random keys when Keys is empty.
+type Simulation struct {
+	N    int
+	Keys []string
 }
 
 type LB struct {
+	// mu guards backends, strategy and demoKeys; the control loop holds it
+	// while mutating, readers hold it to get a consistent view. strategy is
+	// never modified in place by a swap, only replaced whole by
+	// setStrategyLocked, so a selection sees either the old or the new one.
+	mu sync.Mutex
+
+	cfg      Config
+	hasher   Hasher // nil = per-strategy default
+	rng      *Rand
+	clock    clock
 	backends []*Backend
 	events   chan Event
 	strategy BalancingStrategy
 
+	// strategyName is the canonical name of strategy, as persisted
+	strategyName string
+
+	// keyExtractor keys new connections, named keyName; guarded by mu
+	keyExtractor KeyExtractor
+	keyName      string
+
+	// vnodes is the ring positions per unit of weight for ch: -vnodes until
+	// the vnodes command changes it
+	vnodes int
+
+	// strategyState is what the main pool's strategies accumulate, kept
+	// across rebuilds; guarded by mu
+	strategyState *StrategyState
+
+	// drrQuantum is drr's quantum: -drr-quantum until the quantum command
+	// changes it; guarded by mu
+	drrQuantum int
+
 	// demo keys to visualize stickiness & churn
 	demoKeys []string
+
+	// sampleKeys are the -remap-sample keys, fixed for the LB's lifetime
+	sampleKeys []string
+
+	// groups route HTTP requests by path prefix to their own pool and
+	// strategy, longest prefix first; guarded by mu
+	groups []*BackendGroup
+
+	// affinity table keyed by request key and its entries by recency, most
+	// recent first, both guarded by mu; sessionEvictions counts entries
+	// dropped for -affinity-max
+	sessions         map[string]*session
+	sessionLRU       *list.List
+	sessionEvictions atomic.Int64
+
+	// selectErrors counts failed data-plane selections by reason, guarded by mu
+	selectErrors map[string]int64
+
+	// connSlots is the -max-conns semaphore (nil = unlimited);
+	// rejectedConns counts connections turned away because it was full.
+	connSlots     chan struct{}
+	rejectedConns atomic.Int64
+
+	// ipConns counts live connections per client IP for -max-conns-per-ip;
+	// rejectedPerIP counts connections turned away by it.
+	ipConns       ipConns
+	rejectedPerIP atomic.Int64
+
+	// slotFreed wakes a paused accept loop when a connection ends; stopping
+	// is closed when shutdown begins; backpressureNanos totals the pauses
+	slotFreed         chan struct{}
+	stopping          chan struct{}
+	backpressureNanos atomic.Int64
+
+	// hedged requests sent and how many of them answered first
+	hedgesFired atomic.Int64
+	hedgeWins   atomic.Int64
+
+	// spills counts keys consistent hashing sent past a busy owner (-spill-at)
+	spills atomic.Int64
+
+	// retryBudget gates -retries; retries counts those made, retriesDenied
+	// those the budget refused
+	retryBudget   *retryBudget
+	retries       atomic.Int64
+	retriesDenied atomic.Int64
+
+	// breakerTrips counts circuits opened
+	breakerTrips atomic.Int64
+
+	// outlierEjections counts backends ejected by outlier detection
+	outlierEjections atomic.Int64
+
+	remaps *RemapMetrics
+
+	// conns are the client connections being proxied, for the shutdown
+	// drain; done is closed once it has finished
+	connsMu sync.Mutex
+	conns   map[net.Conn]struct{}
+	done    chan struct{}
+	// grpcConns maps the connections handed to the gRPC server to the func
+	// that gives back their slots when it closes them
+	grpcConns sync.Map
+
+	// hooks around backend selection, see hooks.go
+	selectionHooks []SelectionHook
+	selectedHooks  []SelectedHook
+
+	// dnsNames are the main pool's hostname backends under -dns-refresh,
+	// whose addresses are in backends (see dns.go); guarded by mu
+	dnsNames []*dnsName
+
+	// resolver caches backend name lookups for happy-eyeballs dialing; nil
+	// when it's off.
+	resolver *resolveCache
+
+	// altSvc advertises the h3 listeners on HTTP responses, "" without any;
+	// set by Start before accepting
+	altSvc string
+
+	// dialer dials TCP backends, bound to -dial-source when set
+	dialer net.Dialer
+
+	// backendTLS is the main pool's -backend-tls config, nil when off
+	backendTLS *tls.Config
+
+	// mirror shadows HTTP requests (-mirror), nil when off; mirrorSent
+	// counts copies sent, mirrorFailed those that errored or got a 5xx and
+	// mirrorSkipped sampled requests not copied (body too big, too many in
+	// flight)
+	mirror        *mirror
+	mirrorSent    atomic.Int64
+	mirrorFailed  atomic.Int64
+	mirrorSkipped atomic.Int64
+
+	// subscribers receive StateEvents, see stateevents.go
+	subscribers stateSubscribers
 }
 
 type IncomingReq struct {
 	srcConn net.Conn
 	reqId   string
 	key     string
+
+	// http is set when -mode auto found an HTTP request on srcConn
+	http bool
+
+	// sni is the TLS server name the client asked for, once sniRead
+	sni     string
+	sniRead bool
+
+	// lookup marks a what-if selection (remap snapshots, simulate) that
+	// sends no traffic; strategies leave it out of their counters
+	lookup bool
 }
 
-var lb *LB
+// lookupReq is the request for a what-if selection of key.
+func lookupReq(key string) IncomingReq { return IncomingReq{key: key, lookup: true} }
+
+// ID is the request's log ID; Key is what hashing strategies route it by.
+func (r *IncomingReq) ID() string  { return r.reqId }
+func (r *IncomingReq) Key() string { return r.key }
 
 // ---------------------- Initialization ----------------------
 
-func InitLB() {
-	backends := []*Backend{
-		{Host: "localhost", Port: 8081, IsHealthy: true},
-		{Host: "localhost", Port: 8082, IsHealthy: true},
-		{Host: "localhost", Port: 8083, IsHealthy: true},
-		{Host: "localhost", Port: 8084, IsHealthy: true},
+// New builds an LB from cfg, which should already hold its pool (see
+// LoadFile, LoadEnv and CheckPool). Nothing listens until Start.
+func New(cfg Config) (*LB, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	hasher, _ := NewHasher(cfg.Hash) // checked by Validate
+	backendTLS, err := cfg.BackendTLS.build()
+	if err != nil {
+		return nil, fmt.Errorf("-backend-tls: %w", err)
 	}
 
-	lb = &LB{
-		events:   make(chan Event),
-		backends: backends,
-		// default to proper consistent hashing (ring)
-		strategy: NewConsistentHashStrategy(backends),
+	lb := &LB{
+		cfg:          cfg,
+		backendTLS:   backendTLS,
+		hasher:       hasher,
+		vnodes:       cfg.VNodes,
+		drrQuantum:   cfg.DRRQuantum,
+		rng:          NewRand(cfg.Seed),
+		clock:        cfg.clock,
+		events:       make(chan Event),
+		sessions:     make(map[string]*session),
+		sessionLRU:   list.New(),
+		selectErrors: make(map[string]int64),
+		ipConns:      ipConns{n: make(map[string]int)},
+		remaps:       NewRemapMetrics(),
+		sampleKeys:   sampleKeys(cfg.RemapSample),
+		retryBudget:  newRetryBudget(cfg.RetryBudget),
+		conns:        make(map[net.Conn]struct{}),
+		done:         make(chan struct{}),
+		slotFreed:    make(chan struct{}, 1),
+		stopping:     make(chan struct{}),
 		demoKeys: []string{
 			"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4",
 			"10.0.0.5", "10.0.0.6", "10.0.0.7", "10.0.0.8",
 			"10.0.0.9", "10.0.0.10", "10.0.0.11", "10.0.0.12",
 		},
 	}
+	if lb.clock == nil {
+		lb.clock = realClock{}
+	}
+	lb.strategyState = NewStrategyState()
+	for _, bc := range cfg.Backends {
+		b, _ := lb.newBackend(bc) // checked by Validate
+		if b.tls, err = backendTLSFor(bc, lb.backendTLS); err != nil {
+			return nil, err
+		}
+		if lb.discovering() && isDNSName(bc) {
+			// its addresses join the pool when Start resolves it
+			bc.ID = ""
+			lb.dnsNames = append(lb.dnsNames, &dnsName{bc: bc, tls: b.tls})
+			continue
+		}
+		lb.backends = append(lb.backends, b)
+	}
+	// default to proper consistent hashing (ring)
+	if err := lb.setStrategyLocked(cfg.Strategy); err != nil {
+		return nil, err
+	}
+	if err := lb.setKeyExtractorLocked(cfg.Key); err != nil {
+		return nil, err
+	}
+	for _, gc := range cfg.Groups {
+		if err := lb.addGroup(gc); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Mirror != "" {
+		b, _ := ParseBackendAddr(cfg.Mirror) // checked by Validate
+		lb.mirror = lb.newMirror(b)
+	}
+	if cfg.DialSource != "" {
+		lb.dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(cfg.DialSource)}
+	}
+	if cfg.HappyEyeballs {
+		lb.resolver = newResolveCache(cfg.ResolveTTL, lb.clock)
+	}
+	if cfg.MaxConns > 0 {
+		lb.connSlots = make(chan struct{}, cfg.MaxConns)
+	}
+	return lb, nil
 }
 
 // ---------------------- Run ----------------------
 
-func (lb *LB) Run() {
-	listener, err := net.Listen("tcp", ":9090")
-	if err != nil {
-		panic(err)
+// Start opens the listeners and serves in the background until Shutdown, an
+// exit command or the end of ctx. It fails without serving anything if a
+// listener can't be opened; an LB is started at most once.
+func (lb *LB) Start(ctx context.Context) error {
+	listeners := make([]net.Listener, 0, len(lb.cfg.Listeners))
+	var udp net.PacketConn
+	var h3 []*http3.Server
+	var h3Conns []net.PacketConn
+	unlisten := func() {
+		for _, l := range listeners {
+			_ = l.Close()
+		}
+		for _, pc := range h3Conns {
+			_ = pc.Close()
+		}
+		if udp != nil {
+			_ = udp.Close()
+		}
+	}
+	for _, lc := range lb.cfg.Listeners {
+		if lb.cfg.Mode == ModeGRPC {
+			// gRPC clients over TLS insist on h2 by ALPN
+			lc.nextProtos = []string{"h2"}
+		}
+		ls, err := lc.ListenN(lb.cfg.Acceptors)
+		if err != nil {
+			unlisten()
+			return err
+		}
+		listeners = append(listeners, ls...)
+		if len(ls) > 1 {
+			log.Printf("LB listening on %s with %d acceptors ...", lc, len(ls))
+		} else {
+			log.Printf("LB listening on %s ...", lc)
+		}
+	}
+	if lb.cfg.UDPListen != "" {
+		var err error
+		if udp, err = net.ListenPacket("udp", lb.cfg.UDPListen); err != nil {
+			unlisten()
+			return err
+		}
+		log.Printf("LB listening on %s (udp, sessions by %s) ...", lb.cfg.UDPListen, lb.cfg.UDPKey)
+	}
+	for _, lc := range lb.cfg.Listeners {
+		if !lc.HTTP3 {
+			continue
+		}
+		srv, pc, err := lb.listenHTTP3(lc)
+		if err != nil {
+			unlisten()
+			return err
+		}
+		h3, h3Conns = append(h3, srv), append(h3Conns, pc)
+		log.Printf("LB listening on %s (udp, HTTP/3) ...", pc.LocalAddr())
+	}
+	if len(h3) > 0 {
+		lb.altSvc = altSvc(h3Conns)
+	}
+	var admin *http.Server
+	var adminListener net.Listener
+	if lb.cfg.AdminAddr != "" {
+		var err error
+		if adminListener, err = net.Listen("tcp", lb.cfg.AdminAddr); err != nil {
+			unlisten()
+			return err
+		}
+		admin = lb.adminServer()
+	}
+
+	if lb.discovering() {
+		lb.refreshNames()
+		go lb.runDNSRefresh()
+	}
+	var adminDone sync.WaitGroup
+	if admin != nil {
+		adminDone.Go(func() { lb.serveAdmin(admin, adminListener) })
+	}
+	if lb.cfg.Affinity && lb.cfg.AffinityTTL > 0 {
+		go lb.sweepSessions()
+	}
+	go lb.decayRTT()
+	log.Printf("health checks: %s", lb.cfg.HealthCheck)
+	log.Printf("circuit breakers: %s", lb.cfg.Breaker)
+	log.Printf("outlier detection: %s", lb.cfg.Outlier)
+	if lb.cfg.ProxyProtocol != "" {
+		log.Printf("sending PROXY protocol %s headers to backends", lb.cfg.ProxyProtocol)
+	}
+	if len(lb.backends) == 0 && len(lb.groups) == 0 {
+		log.Println("starting with an empty pool (-allow-empty): requests fail until backends are added")
+	}
+	if lb.cfg.HealthWebhook != "" {
+		go lb.runHealthWebhook(lb.Subscribe())
+	}
+	if lb.cfg.HealthCheck.Mode != HealthCheckOff {
+		go lb.runHealthChecks()
+	}
+	if lb.cfg.Outlier.enabled() {
+		go lb.detectOutliers()
 	}
-	defer listener.Close()
 
-	log.Println("LB listening on port 9090 ...")
+	// data-plane: one accept loop per listener, all sharing the pool
+	var accepting sync.WaitGroup
+	if udp != nil {
+		accepting.Add(1)
+		go func() {
+			defer accepting.Done()
+			lb.serveUDP(udp)
+		}()
+	}
+	for i, srv := range h3 {
+		accepting.Go(func() {
+			if err := srv.Serve(h3Conns[i]); err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("h3 listener %s: %s", h3Conns[i].LocalAddr(), err)
+			}
+		})
+	}
+	var grpcSrv *http.Server
+	if lb.cfg.Mode == ModeGRPC {
+		grpcSrv = lb.grpcServer()
+	}
+	for _, l := range listeners {
+		accepting.Add(1)
+		go func() {
+			defer accepting.Done()
+			if grpcSrv != nil {
+				lb.serveGRPC(grpcSrv, l)
+			} else {
+				lb.acceptLoop(l, lb.admit)
+			}
+		}()
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = lb.Shutdown(context.Background())
+		case <-lb.done:
+		}
+	}()
 
 	// control-plane event loop
 	go func() {
@@ -95,110 +702,709 @@ func (lb *LB) Run() {
 
 				case CMD_Exit:
 					log.Println("Gracefully terminating ...")
+					close(lb.stopping)
+					for _, l := range listeners {
+						_ = l.Close()
+					}
+					if udp != nil {
+						_ = udp.Close()
+					}
+					var stopped sync.WaitGroup
+					for _, srv := range h3 {
+						stopped.Go(func() { lb.stopHTTP3(srv) })
+					}
+					if grpcSrv != nil {
+						stopped.Go(func() { lb.stopGRPC(grpcSrv) })
+					}
+					lb.drain(lb.cfg.ShutdownGrace)
+					stopped.Wait()
+					accepting.Wait()
+					if admin != nil {
+						_ = admin.Close()
+						adminDone.Wait()
+					}
+					close(lb.done)
 					return
 
 				case CMD_BackendAdd:
-					before := lb.snapshot()
 					backend, ok := event.Data.(Backend)
 					if !ok {
-						panic("invalid backend data")
+						event.reject()
+						continue
 					}
+					// held to the rules NewBackend and the config file apply
+					bc := BackendConfig{Host: backend.Host, Port: backend.Port, Path: backend.Path, Weight: backend.Weight, Priority: backend.Priority, Zone: backend.Zone}
+					if err := bc.check(); err != nil {
+						event.ack(fmt.Errorf("backend %s: %w", bc.addr(), err))
+						continue
+					}
+					backend.Host = bc.Host
+					if backend.ID == "" {
+						backend.ID = newBackendID()
+					}
+					lb.mu.Lock()
+					if lb.findBackendLocked(backend.String()) != nil || lb.findNameLocked(backend.String()) != nil {
+						lb.mu.Unlock()
+						event.ack(fmt.Errorf("backend %s already in pool", backend.String()))
+						continue
+					}
+					if lb.discovering() && isDNSName(bc) {
+						n := &dnsName{bc: bc, tls: lb.backendTLS}
+						lb.dnsNames = append(lb.dnsNames, n)
+						lb.mu.Unlock()
+						log.Printf("dns: resolving %s every %s", bc.addr(), lb.cfg.DNSRefresh)
+						lb.persist()
+						event.ack(nil)
+						go lb.refreshName(n)
+						continue
+					}
+					lb.warnLowPort(&backend)
+					backend.tls = lb.backendTLS
+					lb.beginSlowStartLocked(&backend)
+					before := lb.remapSnapLocked()
 					lb.backends = append(lb.backends, &backend)
 					lb.strategy.Init(lb.backends)
-					lb.printRemap("ADD", before, lb.snapshot())
+					after := lb.remapSnapLocked()
+					lb.mu.Unlock()
+					lb.reportRemap("ADD", before, after)
+					lb.publishBackend(StateBackendAdded, &backend, "")
+					lb.persist()
+					event.ack(nil)
 
 				case CMD_BackendRemove:
-					before := lb.snapshot()
-					port, ok := event.Data.(int)
+					target, ok := event.Data.(Backend)
 					if !ok {
-						panic("invalid remove data")
+						event.reject()
+						continue
+					}
+					lb.mu.Lock()
+					before := lb.remapSnapLocked()
+					var removed []*Backend
+					found := false
+					if b := lb.removeBackend(target.String()); b != nil {
+						removed, found = []*Backend{b}, true
+					} else {
+						removed, found = lb.removeNameLocked(target.String())
 					}
-					if lb.removeBackend("localhost", port) {
+					if found {
 						lb.strategy.Init(lb.backends)
-						lb.printRemap("REMOVE", before, lb.snapshot())
+					}
+					after := lb.remapSnapLocked()
+					lb.mu.Unlock()
+					if found {
+						lb.reportRemap("REMOVE", before, after)
+						for _, b := range removed {
+							lb.publishBackend(StateBackendRemoved, b, "")
+						}
+						lb.persist()
+						event.ack(nil)
 					} else {
-						log.Printf("no backend found on port %d", port)
+						event.ack(fmt.Errorf("no backend found at %s", target.String()))
 					}
 
 				case CMD_StrategyChange:
-					before := lb.snapshot()
 					name, ok := event.Data.(string)
 					if !ok {
-						panic("invalid strategy name")
-					}
-					switch name {
-					case "round-robin", "rr":
-						lb.strategy = NewRRBalancingStrategy(lb.backends)
-					case "static":
-						lb.strategy = NewStaticBalancingStrategy(lb.backends)
-					case "simple", "simple-hash":
-						lb.strategy = NewSimpleHashStrategy(lb.backends)
-					case "ch", "hash", "consistent-hash":
-						lb.strategy = NewConsistentHashStrategy(lb.backends)
-					default:
-						lb.strategy = NewConsistentHashStrategy(lb.backends)
-					}
-					lb.printRemap("STRATEGY:"+name, before, lb.snapshot())
+						event.reject()
+						continue
+					}
+					lb.mu.Lock()
+					before := lb.remapSnapLocked()
+					err := lb.setStrategyLocked(name)
+					name = lb.strategyName
+					after := lb.remapSnapLocked()
+					lb.mu.Unlock()
+					event.ack(err)
+					if err != nil {
+						continue
+					}
+					lb.reportRemap("STRATEGY:"+name, before, after)
+					lb.publish(StateEvent{Kind: StateStrategyChanged, Detail: name})
+					lb.persist()
+
+				case CMD_VNodes:
+					n, ok := event.Data.(int)
+					if !ok {
+						event.reject()
+						continue
+					}
+					lb.mu.Lock()
+					before := lb.remapSnapLocked()
+					err := lb.setVNodesLocked(n)
+					after := lb.remapSnapLocked()
+					lb.mu.Unlock()
+					event.ack(err)
+					if err == nil {
+						lb.reportRemap(fmt.Sprintf("VNODES:%d", n), before, after)
+					}
+
+				case CMD_DRRQuantum:
+					q, ok := event.Data.(int)
+					if !ok {
+						event.reject()
+						continue
+					}
+					lb.mu.Lock()
+					err := lb.setDRRQuantumLocked(q)
+					lb.mu.Unlock()
+					event.ack(err)
 
 				case CMD_ShowMapping:
 					cur := lb.snapshot()
 					lb.printRemap("SHOW", nil, cur)
+
+				case CMD_BackendAdmin:
+					st, ok := event.Data.(AdminState)
+					if !ok {
+						event.reject()
+						continue
+					}
+					err := lb.setAdminState(st)
+					event.ack(err)
+					if err == nil {
+						lb.persist()
+					}
+
+				case CMD_BackendTier:
+					bp, ok := event.Data.(BackendPriority)
+					if !ok {
+						event.reject()
+						continue
+					}
+					lb.mu.Lock()
+					before := lb.remapSnapLocked()
+					err := lb.setPriorityLocked(bp)
+					after := lb.remapSnapLocked()
+					lb.mu.Unlock()
+					event.ack(err)
+					if err == nil {
+						lb.reportRemap("PRIORITY", before, after)
+						lb.persist()
+					}
+
+				case CMD_BackendZone:
+					bz, ok := event.Data.(BackendZone)
+					if !ok {
+						event.reject()
+						continue
+					}
+					lb.mu.Lock()
+					before := lb.remapSnapLocked()
+					err := lb.setZoneLocked(bz)
+					after := lb.remapSnapLocked()
+					lb.mu.Unlock()
+					event.ack(err)
+					if err == nil {
+						lb.reportRemap("ZONE", before, after)
+						lb.persist()
+					}
+
+				case CMD_GroupStrategy:
+					gs, ok := event.Data.(GroupStrategy)
+					if !ok {
+						event.reject()
+						continue
+					}
+					event.ack(lb.setGroupStrategy(gs.Group, gs.Strategy))
+					lb.persist()
+
+				case CMD_ShowTopology:
+					verbose, _ := event.Data.(bool)
+					lb.mu.Lock()
+					fmt.Printf("=== TOPOLOGY %s ===\n", lb.strategyName)
+					lb.strategy.PrintTopology()
+					if ch, ok := lb.strategy.(*ConsistentHashStrategy); ok && verbose {
+						ch.PrintPositions()
+					}
+					lb.mu.Unlock()
+
+				case CMD_Reload:
+					err := lb.reload()
+					if err != nil {
+						log.Println(err)
+					}
+					event.ack(err)
+
+				case CMD_ShowRing:
+					probe, _ := event.Data.(string)
+					if err := lb.writeRing(os.Stdout, probe); err != nil {
+						fmt.Println(err)
+					}
+
+				case CMD_KeyExtractor:
+					name, ok := event.Data.(string)
+					if !ok {
+						event.reject()
+						continue
+					}
+					lb.mu.Lock()
+					err := lb.setKeyExtractorLocked(name)
+					lb.mu.Unlock()
+					if err == nil {
+						log.Printf("routing key: %s", name)
+					}
+					event.ack(err)
+
+				case CMD_ShowSessions:
+					lb.writeSessions(os.Stdout)
+
+				case CMD_FlushSessions:
+					key, _ := event.Data.(string)
+					n := lb.flushSessions(key)
+					log.Printf("affinity: flushed %d sessions", n)
+					event.ack(nil)
+
+				case CMD_ListBackends:
+					lb.printStats(lb.stats())
+
+				case CMD_ShowHealth:
+					lb.writeHealth(os.Stdout)
+
+				case CMD_KeysSet:
+					keys, ok := event.Data.([]string)
+					if !ok || len(keys) == 0 {
+						err := errors.New("invalid keys data")
+						log.Println(err)
+						event.ack(err)
+						continue
+					}
+					lb.mu.Lock()
+					lb.demoKeys = keys
+					cur := lb.snapshotLocked()
+					lb.mu.Unlock()
+					lb.printRemap("KEYS", nil, cur)
+					event.ack(nil)
+
+				case CMD_Simulate:
+					sim, ok := event.Data.(Simulation)
+					if !ok || sim.N <= 0 {
+						err := errors.New("invalid simulate data")
+						log.Println(err)
+						event.ack(err)
+						continue
+					}
+					n, counts, err := lb.simulate(sim)
+					if err != nil {
+						log.Printf("simulate: %s", err)
+						event.ack(err)
+						continue
+					}
+					lb.printDistribution(n, counts)
+					event.ack(nil)
+
+				case CMD_Bench:
+					n, ok := event.Data.(int)
+					if !ok || n <= 0 {
+						err := errors.New("invalid bench data")
+						log.Println(err)
+						event.ack(err)
+						continue
+					}
+					pool, results := lb.bench(n)
+					lb.printBench(n, pool, results)
+					event.ack(nil)
 				}
 			}
 		}
 	}()
+	return nil
+}
+
+// Shutdown stops accepting, gives open connections up to -shutdown-grace to
+// finish and returns once they are gone, or with ctx's error when ctx ends
+// first (the drain then carries on). Calling it more than once is safe.
+func (lb *LB) Shutdown(ctx context.Context) error {
+	select {
+	case lb.events <- Event{EventName: CMD_Exit}:
+	case <-lb.stopping:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-lb.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-	// data-plane: accept and proxy
+// Done is closed once the LB has shut down and drained.
+func (lb *LB) Done() <-chan struct{} { return lb.done }
+
+// acceptLoop accepts on listener until it closes and passes each connection,
+// once any PROXY header is in, to admit.
+func (lb *LB) acceptLoop(listener net.Listener, admit func(net.Conn)) {
+	var errDelay time.Duration
 	for {
+		if !lb.awaitCapacity() {
+			return
+		}
 		connection, err := listener.Accept()
 		if err != nil {
-			log.Printf("Unable to accept connection: %s", err.Error())
+			switch {
+			case errors.Is(err, net.ErrClosed):
+				// closed by shutdown
+				return
+			case temporaryAcceptError(err):
+				errDelay = min(max(2*errDelay, acceptBackoffStart), maxAcceptErrorDelay)
+				log.Printf("accept on %s: %s; retrying in %s", listener.Addr(), err, errDelay)
+				t := time.NewTimer(errDelay)
+				select {
+				case <-t.C:
+				case <-lb.stopping:
+					t.Stop()
+					return
+				}
+				continue
+			default:
+				log.Printf("accept on %s: %s; shutting down", listener.Addr(), err)
+				select {
+				case lb.events <- Event{EventName: CMD_Exit}:
+				case <-lb.stopping:
+				}
+				return
+			}
+		}
+		errDelay = 0
+
+		if pc := proxyConnOf(connection); pc != nil {
+			// the client, which the per-IP limit and the key go by, is
+			// only known once its PROXY header is in; read it without
+			// holding up the accept loop, tracked so a shutdown closes it
+			go func() {
+				lb.trackConn(connection)
+				err := pc.readHeader()
+				lb.untrackConn(connection)
+				if err != nil {
+					log.Printf("%s; closing", err)
+					_ = connection.Close()
+					return
+				}
+				admit(connection)
+			}()
 			continue
 		}
+		admit(connection)
+	}
+}
+
+// admit applies -max-conns-per-ip and -max-conns to a freshly accepted
+// connection and hands it to its own goroutine, or rejects it.
+func (lb *LB) admit(connection net.Conn) {
+	req := IncomingReq{
+		srcConn: connection,
+		reqId:   uuid.NewString(),
+		// random until proxy asks the key extractor, which may need
+		// to read from the client
+		key: uuid.NewString(),
+	}
+	release := lb.reserve(req)
+	if release == nil {
+		return
+	}
+
+	// Spawn goroutine per connection
+	go func() {
+		defer lb.recoverConn(req)
+		defer release()
+		lb.proxy(req)
+	}()
+}
+
+// reserve takes req's connection slots under -max-conns-per-ip and
+// -max-conns and tracks it for the drain, returning the func that gives
+// them back. Over either limit it rejects the connection and returns nil.
+func (lb *LB) reserve(req IncomingReq) (release func()) {
+	connection := req.srcConn
+	ip := connIP(connection)
+	if !lb.acquireIP(ip) {
+		n := lb.rejectedPerIP.Add(1)
+		log.Printf("max-conns-per-ip %d reached for %s, rejecting (rejected so far: %d)",
+			lb.cfg.MaxConnsPerIP, ip, n)
+		go lb.rejectRequest(req, "too many connections from your address")
+		return nil
+	}
+	if !lb.acquireConn() {
+		lb.releaseIP(ip)
+		n := lb.rejectedConns.Add(1)
+		log.Printf("max-conns %d reached, rejecting %s (rejected so far: %d)",
+			lb.cfg.MaxConns, connection.RemoteAddr(), n)
+		go lb.rejectRequest(req, "too many connections")
+		return nil
+	}
+	lb.trackConn(connection)
+	return func() {
+		lb.untrackConn(connection)
+		lb.releaseConn()
+		lb.releaseIP(ip)
+	}
+}
+
+// maxAcceptErrorDelay caps the pause after repeated temporary accept errors.
+const maxAcceptErrorDelay = time.Second
+
+// temporaryAcceptError reports whether an Accept failure is worth retrying:
+// a timeout, running out of file descriptors or memory, or a client that
+// vanished before its connection was accepted.
+func temporaryAcceptError(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	for _, errno := range []syscall.Errno{
+		syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM,
+		syscall.ECONNABORTED, syscall.ECONNRESET, syscall.EINTR, syscall.EAGAIN,
+		syscall.EPERM, // Linux: refused by a firewall rule
+	} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
 
-		// Spawn goroutine per connection
-		go lb.proxy(IncomingReq{
-			srcConn: connection,
-			reqId:   uuid.NewString(),
-			// NOTE: when testing locally, using client IP will stick to one backend (always ::1).
-			// To visualize distribution, we use a random UUID as the key for now.
-			// key:     clientIP(connection.RemoteAddr().String()),
-			key: uuid.NewString(),
-		})
+// recoverConn keeps a panic in one connection's handler from taking down the
+// LB. The handlers decrement their gauges in defers, which have run by the
+// time this one does, so only the client connection is left to close. For
+// the same reason everything that picks a backend (pickTCP, pickHTTP,
+// dispatchStream, udpProxy.pick) releases lb.mu by a defer: a strategy or
+// selection hook that panics must not leave it held.
+func (lb *LB) recoverConn(req IncomingReq) {
+	if r := recover(); r != nil {
+		log.Printf("req %s: panic: %v\n%s", req.reqId, r, debug.Stack())
+		_ = req.srcConn.Close()
+	}
+}
+
+// acquireConn takes a slot from the -max-conns semaphore without blocking;
+// false means the LB is full. Always succeeds when there is no cap.
+func (lb *LB) acquireConn() bool {
+	if lb.connSlots == nil {
+		return true
+	}
+	select {
+	case lb.connSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (lb *LB) releaseConn() {
+	if lb.connSlots != nil {
+		<-lb.connSlots
+		select {
+		case lb.slotFreed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// writeRing dumps the consistent-hash ring (see WriteRing), or explains that
+// the active strategy has none.
+func (lb *LB) writeRing(w io.Writer, probe string) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	ch, ok := lb.strategy.(*ConsistentHashStrategy)
+	if !ok {
+		return fmt.Errorf("strategy %s has no hash ring; `strat ch` switches to consistent hashing", lb.strategyName)
+	}
+	fmt.Fprintf(w, "=== RING (%d positions) ===\n", len(ch.keys))
+	ch.WriteRing(w, probe)
+	return nil
+}
+
+// setStrategyLocked builds the new strategy completely before publishing it,
+// together with its canonical name. Callers must hold lb.mu (or own lb
+// exclusively).
+func (lb *LB) setStrategyLocked(name string) error {
+	canonical, err := canonicalStrategy(name)
+	if err != nil {
+		return err
+	}
+	s, err := lb.StrategyFromName(canonical, lb.backends)
+	if err != nil {
+		return err
+	}
+	lb.strategy, lb.strategyName = s, canonical
+	return nil
+}
+
+// setVNodesLocked sets the ring positions per unit of weight and rebuilds
+// every consistent-hash ring, the main pool's and the groups'. Callers must
+// hold lb.mu.
+func (lb *LB) setVNodesLocked(n int) error {
+	if err := checkVNodes(n); err != nil {
+		return err
+	}
+	lb.vnodes = n
+	if err := lb.rebuildStrategiesLocked("ch"); err != nil {
+		return err
+	}
+	log.Printf("consistent hashing: %d positions per unit of weight", n)
+	return nil
+}
+
+// rebuildStrategiesLocked rebuilds every strategy that uses the strategy
+// called name, alone or in a chain, from the current configuration. Callers
+// must hold lb.mu.
+func (lb *LB) rebuildStrategiesLocked(name string) error {
+	if usesStrategy(lb.strategyName, name) {
+		if err := lb.setStrategyLocked(lb.strategyName); err != nil {
+			return err
+		}
+	}
+	for _, g := range lb.groups {
+		if !usesStrategy(g.strategyName, name) {
+			continue
+		}
+		s, err := lb.groupStrategyFromName(g, g.strategyName)
+		if err != nil {
+			return err
+		}
+		g.strategy = s
 	}
+	return nil
 }
 
 // ---------------------- Proxy Logic ----------------------
 
 func (lb *LB) proxy(req IncomingReq) {
-	backend := lb.strategy.GetNextBackend(req)
-	if backend == nil {
-		_, _ = req.srcConn.Write([]byte("no backend available"))
-		_ = req.srcConn.Close()
+	lb.keyRequest(&req)
+	switch lb.cfg.Mode {
+	case ModeHTTP:
+		lb.proxyHTTP(req)
+	case ModeAuto:
+		lb.proxyAuto(req)
+	default:
+		lb.proxyTCP(req)
+	}
+}
+
+// pickTCP is pickForSNI taking lb.mu itself.
+func (lb *LB) pickTCP(req IncomingReq) (*Backend, *BackendGroup, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.pickForSNI(req)
+}
+
+// proxyTCP splices the client connection to one backend.
+func (lb *LB) proxyTCP(req IncomingReq) {
+	if !req.sniRead && lb.sniRouting() {
+		req.sni, req.srcConn = peekServerName(req.srcConn, lb.keyTimeout())
+		req.sniRead = true
+	}
+	backend, group, err := lb.pickTCP(req)
+	via := ""
+	if group != nil {
+		via = " group=" + group.Name
+	}
+	if err != nil {
+		log.Printf("in-req: %s client=%s key=%s%s rejected: %s", req.reqId, req.srcConn.RemoteAddr(), req.key, via, err)
+		lb.rejectRequest(req, "no backend available: "+err.Error())
 		return
 	}
-	log.Printf("in-req: %s key=%s -> backend: %s", req.reqId, req.key, backend.String())
+	log.Printf("in-req: %s client=%s key=%s%s -> backend: %s", req.reqId, req.srcConn.RemoteAddr(), req.key, via, backend.Label())
 
-	backendConn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", backend.Host, backend.Port))
+	lb.retryBudget.deposit()
+	backend, backendConn, err := lb.dialWithRetries(req, backend)
 	if err != nil {
 		log.Printf("Error connecting to backend: %s", err.Error())
-		_, _ = req.srcConn.Write([]byte("backend not available"))
-		_ = req.srcConn.Close()
+		lb.rejectRequest(req, "backend not available")
 		return
 	}
+	lb.recordSuccess(backend) // all TCP mode knows of a backend's health
+	lb.mu.Lock()
 	backend.NumRequests++
+	backend.ActiveConns++
+	lb.breakerDispatchLocked(backend)
+	lb.mu.Unlock()
+
+	start := time.Now()
+	defer func() {
+		_ = backendConn.Close()
+		_ = req.srcConn.Close()
+		lb.mu.Lock()
+		backend.ActiveConns--
+		lb.observeLatency(backend, time.Since(start))
+		lb.mu.Unlock()
+	}()
+
+	// hard ceiling on the connection: the watchdog closes both sides, which
+	// unblocks both copy loops
+	if lb.cfg.RequestTimeout > 0 {
+		watchdog := time.AfterFunc(lb.cfg.RequestTimeout, func() {
+			log.Printf("req %s: exceeded request timeout %s on %s, closing", req.reqId, lb.cfg.RequestTimeout, backend.Label())
+			_ = backendConn.Close()
+			_ = req.srcConn.Close()
+		})
+		defer watchdog.Stop()
+	}
 
-	go io.Copy(backendConn, req.srcConn)
-	go io.Copy(req.srcConn, backendConn)
+	client := lb.withIdleTimeouts(req.srcConn)
+	upstream := lb.withIdleTimeouts(backendConn)
+
+	go func() {
+		_, err := io.Copy(upstream, client)
+		if isTimeout(err) {
+			log.Printf("req %s: timeout client -> %s, closing", req.reqId, backend.Label())
+			_ = backendConn.Close()
+			_ = req.srcConn.Close()
+			return
+		}
+		// pass the client's half-close on so the backend can finish up
+		// (TCP and Unix connections both support it)
+		if hc, ok := backendConn.(interface{ CloseWrite() error }); ok {
+			_ = hc.CloseWrite()
+		}
+	}()
+
+	_, err = io.Copy(client, upstream)
+	if isTimeout(err) {
+		log.Printf("req %s: timeout %s -> client, closing", req.reqId, backend.Label())
+	}
+}
+
+// rejectRequest tells the client why it isn't being served and closes the
+// connection: a 503 to HTTP clients, the bare message to TCP ones. A client that
+// already hung up is simply closed.
+func (lb *LB) rejectRequest(req IncomingReq, msg string) {
+	defer req.srcConn.Close()
+	_ = req.srcConn.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+
+	if lb.cfg.Mode != ModeHTTP && !req.http {
+		_, _ = req.srcConn.Write([]byte(msg))
+		return
+	}
+	body := msg + "\n"
+	resp := &http.Response{
+		StatusCode:    http.StatusServiceUnavailable,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+	}
+	_ = resp.Write(req.srcConn)
 }
 
 // ---------------------- Helpers: mapping & diffs ----------------------
 
+// snapshot maps every demo key to the backend the active strategy picks for
+// it, taken under lb.mu so it never observes a half-applied mutation.
 func (lb *LB) snapshot() map[string]string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.snapshotLocked()
+}
+
+// snapshotLocked is snapshot for callers that already hold lb.mu.
+func (lb *LB) snapshotLocked() map[string]string {
 	m := make(map[string]string, len(lb.demoKeys))
 	for _, k := range lb.demoKeys {
-		b := lb.strategy.GetNextBackend(IncomingReq{key: k})
-		if b != nil {
+		b, err := lb.strategy.GetNextBackend(lookupReq(k))
+		if err == nil {
 			m[k] = b.String()
 		} else {
 			m[k] = "<nil>"
@@ -229,26 +1435,216 @@ func (lb *LB) printRemap(what string, before, after map[string]string) {
 	}
 }
 
-func (lb *LB) removeBackend(host string, port int) bool {
+// simulate routes sim.N synthetic requests, capped at MaxSimulateRequests,
+// through the active strategy and tallies picks per backend, returning how
+// many it ran. Like bench it runs on a fresh instance over copies of the
+// pool, seeded from -seed, so the live strategy, the data plane and lb.rng
+// are left alone. No sockets are opened.
+func (lb *LB) simulate(sim Simulation) (int, map[string]int, error) {
+	n := min(sim.N, MaxSimulateRequests)
+	counts := make(map[string]int)
+
+	lb.mu.Lock()
+	pool := make([]*Backend, len(lb.backends))
+	for i, b := range lb.backends {
+		c := *b
+		pool[i] = &c
+	}
+	name := lb.strategyName
+	cfg := lb.strategyConfig()
+	lb.mu.Unlock()
+
+	rng := NewRand(lb.cfg.Seed)
+	cfg.Rand, cfg.Spills, cfg.State = rng, nil, nil
+	s, err := NewStrategy(name, pool, cfg)
+	if err != nil {
+		return 0, nil, err
+	}
+	for i := 0; i < n; i++ {
+		key := ""
+		if len(sim.Keys) > 0 {
+			key = sim.Keys[i%len(sim.Keys)]
+		} else {
+			key = fmt.Sprintf("sim-%016x", rng.Uint64())
+		}
+		b, err := s.GetNextBackend(lookupReq(key))
+		if err == nil {
+			counts[b.String()]++
+		} else {
+			counts["<"+err.Error()+">"]++
+		}
+	}
+	return n, counts, nil
+}
+
+func (lb *LB) printDistribution(n int, counts map[string]int) {
+	log.Printf("=== SIMULATE n=%d ===", n)
+	lb.mu.Lock()
+	names := make([]string, 0, len(lb.backends)+1)
+	for _, b := range lb.backends {
+		names = append(names, b.String())
+	}
+	lb.mu.Unlock()
+	// failed selections, one row per reason
+	var failed []string
+	for name := range counts {
+		if strings.HasPrefix(name, "<") {
+			failed = append(failed, name)
+		}
+	}
+	slices.Sort(failed)
+	names = append(names, failed...)
+	for _, name := range names {
+		c := counts[name]
+		log.Printf("%-24s %8d  %6.2f%%", name, c, 100*float64(c)/float64(n))
+	}
+}
+
+// findBackendLocked returns the pool entry at host:port, or nil. Callers must
+// hold lb.mu.
+func (lb *LB) findBackendLocked(addr string) *Backend {
+	for _, b := range lb.backends {
+		if b.String() == addr {
+			return b
+		}
+	}
+	return nil
+}
+
+// AdminState is the CMD_BackendAdmin payload: disable or enable the backend
+// whose String() is Addr.
+type AdminState struct {
+	Addr     string
+	Disabled bool
+}
+
+// setAdminState applies st to the matching backend in any pool. Health
+// checks keep running on a disabled backend, so `list` still shows whether
+// it would be up once enabled.
+func (lb *LB) setAdminState(st AdminState) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	for _, b := range lb.allBackendsLocked() {
+		if b.String() == st.Addr {
+			b.AdminDisabled = st.Disabled
+			if st.Disabled {
+				log.Printf("backend %s: disabled by admin", b.Label())
+				lb.publishBackend(StateBackendDisabled, b, "")
+			} else {
+				log.Printf("backend %s: enabled by admin", b.Label())
+				lb.publishBackend(StateBackendEnabled, b, "")
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("no backend found at %s", st.Addr)
+}
+
+// BackendPriority moves the backend at Addr to tier Priority.
+type BackendPriority struct {
+	Addr     string
+	Priority int
+}
+
+// setPriorityLocked applies bp to the matching backend in any pool and
+// regroups the strategies' tiers. Callers must hold lb.mu.
+func (lb *LB) setPriorityLocked(bp BackendPriority) error {
+	if bp.Priority < 0 {
+		return fmt.Errorf("negative priority %d", bp.Priority)
+	}
+	for _, b := range lb.allBackendsLocked() {
+		if b.String() == bp.Addr {
+			log.Printf("backend %s: priority %d -> %d", b.Label(), b.Priority, bp.Priority)
+			b.Priority = bp.Priority
+			lb.reinitStrategiesLocked()
+			return nil
+		}
+	}
+	return fmt.Errorf("no backend found at %s", bp.Addr)
+}
+
+// BackendZone labels the backend at Addr with Zone ("" clears it).
+type BackendZone struct {
+	Addr string
+	Zone string
+}
+
+// setZoneLocked applies bz to the matching backend in any pool and regroups
+// the strategies. Callers must hold lb.mu.
+func (lb *LB) setZoneLocked(bz BackendZone) error {
+	for _, b := range lb.allBackendsLocked() {
+		if b.String() == bz.Addr {
+			log.Printf("backend %s: zone %q -> %q", b.Label(), b.Zone, bz.Zone)
+			b.Zone = bz.Zone
+			lb.reinitStrategiesLocked()
+			return nil
+		}
+	}
+	return fmt.Errorf("no backend found at %s", bz.Addr)
+}
+
+// removeBackend takes the backend at addr out of the main pool and returns
+// it, or nil if there is none. Callers must hold lb.mu.
+func (lb *LB) removeBackend(addr string) *Backend {
 	idx := -1
 	for i, b := range lb.backends {
-		if b.Host == host && b.Port == port {
+		if b.String() == addr {
 			idx = i
 			break
 		}
 	}
 	if idx == -1 {
-		return false
+		return nil
 	}
+	b := lb.backends[idx]
+	lb.forgetBackendLocked(b)
 	lb.backends = append(lb.backends[:idx], lb.backends[idx+1:]...)
-	return true
+	return b
+}
+
+// forgetBackendLocked drops what the LB holds about b outside b itself once b
+// has left the pool, so pools churned by autoscaling don't grow the LB: b's
+// sessions and its cached addresses. Its metrics (latency histogram, request
+// counters) live on b and leave /metrics and /stats with it, history
+// included. Callers must hold lb.mu.
+func (lb *LB) forgetBackendLocked(b *Backend) {
+	lb.dropSessionsLocked(b)
+	if lb.resolver != nil && b.Path == "" {
+		lb.resolver.forget(b.Host)
+	}
 }
 
-// clientIP extracts the IP from "ip:port" or "[v6]:port"
+// connIP is the IP of c's client, or "" when it came in on a Unix socket,
+// whose peers are all unnamed ("@") and can't be told apart.
+func connIP(c net.Conn) string {
+	if _, ok := c.RemoteAddr().(*net.UnixAddr); ok {
+		return ""
+	}
+	return clientIP(c.RemoteAddr().String())
+}
+
+// clientIP extracts the IP from "ip:port", "[v6]:port" or a bare IP, in
+// canonical form: IPv6 compressed and lowercased, and IPv4-mapped addresses
+// (::ffff:10.0.0.1) as plain IPv4, so a client gets the same key, per-IP
+// count and log entry whether it reached a v4 or a dual-stack listener, or
+// was named by a PROXY header either way. Anything that isn't an IP is
+// returned as is.
 func clientIP(remote string) string {
-	if i := strings.LastIndex(remote, ":"); i != -1 {
-		ip := remote[:i]
-		return strings.Trim(ip, "[]")
+	host := remote
+	if h, _, err := net.SplitHostPort(remote); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return ip.Unmap().String()
+	}
+	return host
+}
+
+// clientAddr is remote ("ip:port") with its IP canonical as for clientIP.
+func clientAddr(remote string) string {
+	if _, port, err := net.SplitHostPort(remote); err == nil {
+		return net.JoinHostPort(clientIP(remote), port)
 	}
 	return remote
 }
@@ -0,0 +1,404 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// churn adds and removes a backend and switches strategies through the
+// control loop, rounds times.
+func churn(t *testing.T, lb *LB, rounds int) {
+	strategies := []string{"ch", "rr", "lc", "wrr", "maglev", "hrw"}
+	for i := range rounds {
+		b, _ := NewBackend(BackendConfig{Host: "10.0.1.1", Port: 1000 + i%5, Weight: 1})
+		if err := lb.Request(Event{EventName: CMD_BackendAdd, Data: *b}); err != nil {
+			t.Fatalf("add %s: %v", b, err)
+		}
+		if err := lb.Request(Event{EventName: CMD_StrategyChange, Data: strategies[i%len(strategies)]}); err != nil {
+			t.Fatalf("strat: %v", err)
+		}
+		if err := lb.Request(Event{EventName: CMD_BackendRemove, Data: *b}); err != nil {
+			t.Fatalf("rm %s: %v", b, err)
+		}
+	}
+}
+
+// churnConfig is a test config over a few backends whose topology changes
+// stay cheap to report.
+func churnConfig(t *testing.T) Config {
+	cfg := testConfig(t)
+	for i := range 3 {
+		cfg.Backends = append(cfg.Backends, BackendConfig{Host: "10.0.0.1", Port: 1000 + i, Weight: 1})
+	}
+	cfg.RemapSample = 0
+	return cfg
+}
+
+// whileChurning runs f in a few goroutines, over and over, while churn
+// changes lb.
+func whileChurning(t *testing.T, lb *LB, f func(worker, i int) bool) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Go(func() {
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if !f(w, i) {
+					return
+				}
+			}
+		})
+	}
+	churn(t, lb, 30)
+	close(done)
+	wg.Wait()
+}
+
+func TestSnapshotDuringChurn(t *testing.T) {
+	lb := newTestLB(t, churnConfig(t))
+	startLB(t, lb)
+	whileChurning(t, lb, func(_, _ int) bool {
+		for k, addr := range lb.snapshot() {
+			if addr == "<nil>" {
+				t.Errorf("key %s mapped to no backend with a non-empty pool", k)
+				return false
+			}
+		}
+		lb.stats()
+		return true
+	})
+}
+
+func TestStrategySwapDuringPicks(t *testing.T) {
+	lb := newTestLB(t, churnConfig(t))
+	startLB(t, lb)
+	whileChurning(t, lb, func(w, i int) bool {
+		b, _, err := lb.pickTCP(IncomingReq{key: fmt.Sprintf("%d-%d", w, i)})
+		if err != nil || (b.Host != "10.0.0.1" && b.Host != "10.0.1.1") {
+			t.Errorf("pick during a strategy swap: %v, %v", b, err)
+			return false
+		}
+		return true
+	})
+}
+
+func TestPanickingHookReleasesLock(t *testing.T) {
+	cfg := testConfig(t, echoBackend(t))
+	cfg.MaxConns = 1
+	lb := newTestLB(t, cfg)
+	var panicked atomic.Bool
+	lb.UseSelectionHook(func(_ *IncomingReq, candidates []*Backend) []*Backend {
+		if panicked.CompareAndSwap(false, true) {
+			panic("hook failure")
+		}
+		return candidates
+	})
+	startLB(t, lb)
+
+	if echoes(dialLB(t, lb), "ping") {
+		t.Fatal("connection whose hook panicked proxied")
+	}
+	// a deadlocked lb.mu or a leaked -max-conns slot fails this one
+	if !echoes(dialLB(t, lb), "ping") {
+		t.Fatal("connection after the panic not proxied")
+	}
+}
+
+func TestPanickingHookReleasesGauges(t *testing.T) {
+	cfg := testConfig(t, httpBackend(t, "a"))
+	cfg.Mode = ModeHTTP
+	cfg.MaxConns = 1
+	lb := newTestLB(t, cfg)
+	var picks atomic.Int32
+	heldAtPanic := -1
+	lb.UseSelectionHook(func(_ *IncomingReq, candidates []*Backend) []*Backend {
+		// the second request on the connection, while its upstream from
+		// the first is counted on the backend
+		if picks.Add(1) == 2 {
+			heldAtPanic = lb.backends[0].ActiveConns
+			panic("hook failure")
+		}
+		return candidates
+	})
+	startLB(t, lb)
+
+	c := dialLB(t, lb)
+	fmt.Fprint(c, "GET / HTTP/1.1\r\nHost: lb\r\n\r\nGET / HTTP/1.1\r\nHost: lb\r\n\r\n")
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "a" {
+		t.Fatalf("first request: %q", body)
+	}
+	if _, err := http.ReadResponse(br, nil); err == nil {
+		t.Fatal("request whose hook panicked answered")
+	}
+	lb.mu.Lock()
+	held := heldAtPanic
+	lb.mu.Unlock()
+	if held != 1 {
+		t.Fatalf("%d upstreams counted when the hook panicked, want 1", held)
+	}
+
+	eventually(t, "gauges to drop back", func() bool {
+		lb.mu.Lock()
+		defer lb.mu.Unlock()
+		return lb.liveConns() == 0 && lb.backends[0].ActiveConns == 0
+	})
+	if body, err := get(lb, "/"); err != nil || body != "a" {
+		t.Fatalf("request after the panic: %q, %v", body, err)
+	}
+}
+
+func TestBackendAddValidates(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.AllowEmpty = true
+	lb := newTestLB(t, cfg)
+	startLB(t, lb)
+
+	for name, b := range map[string]Backend{
+		"port 0":            {Host: "10.0.0.1", Port: 0, Weight: 1},
+		"port out of range": {Host: "10.0.0.1", Port: 65536, Weight: 1},
+		"negative weight":   {Host: "10.0.0.1", Port: 80, Weight: -1},
+		"weight over max":   {Host: "10.0.0.1", Port: 80, Weight: maxWeight + 1},
+		"negative priority": {Host: "10.0.0.1", Port: 80, Weight: 1, Priority: -1},
+		"path and port":     {Path: "/tmp/lb.sock", Port: 80, Weight: 1},
+	} {
+		if err := lb.Request(Event{EventName: CMD_BackendAdd, Data: b}); err == nil {
+			t.Errorf("%s: added %s", name, b.String())
+		}
+	}
+	lb.mu.Lock()
+	n := len(lb.backends)
+	lb.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("%d invalid backends in the pool", n)
+	}
+
+	if err := lb.Request(Event{EventName: CMD_BackendAdd, Data: Backend{Port: 8080, Weight: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if len(lb.backends) != 1 || lb.backends[0].Host != "localhost" {
+		t.Fatalf("backend without a host added as %v, want localhost:8080", lb.backends)
+	}
+}
+
+func TestIPv6Backend(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	bc := serveHTTPBackend(t, l, "v6")
+	b, err := ParseBackendAddr(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Host != "::1" || b.String() != l.Addr().String() {
+		t.Fatalf("parsed %s as host %q, address %s", l.Addr(), b.Host, b.String())
+	}
+
+	for _, mode := range []string{ModeTCP, ModeHTTP} {
+		t.Run(mode, func(t *testing.T) {
+			cfg := testConfig(t, bc)
+			cfg.Mode = mode
+			cfg.HealthCheck.Mode = HealthCheckHTTP
+			cfg.HealthCheck.Interval = 20 * time.Millisecond
+			lb := newTestLB(t, cfg)
+			startLB(t, lb)
+			if body, err := get(lb, "/"); err != nil || body != "v6" {
+				t.Fatalf("through the LB: %q, %v", body, err)
+			}
+			eventually(t, "a passed health check", func() bool {
+				lb.mu.Lock()
+				defer lb.mu.Unlock()
+				p := lb.backends[0].lastProbe
+				return !p.at.IsZero() && p.err == nil
+			})
+		})
+	}
+}
+
+func TestMaxConnsRejectsOverCap(t *testing.T) {
+	cfg := testConfig(t, echoBackend(t))
+	cfg.MaxConns = 2
+	cfg.AcceptBackoff = 0 // reject instead of pausing accept
+	lb := newTestLB(t, cfg)
+	startLB(t, lb)
+
+	held := []net.Conn{dialLB(t, lb), dialLB(t, lb)}
+	for _, c := range held {
+		if !echoes(c, "ping") {
+			t.Fatal("connection under the cap not proxied")
+		}
+	}
+	for range 3 {
+		c := dialLB(t, lb)
+		msg, _ := io.ReadAll(c)
+		if string(msg) != "too many connections" {
+			t.Fatalf("connection over the cap got %q", msg)
+		}
+	}
+	if n := lb.rejectedConns.Load(); n != 3 {
+		t.Fatalf("%d rejections counted, want 3", n)
+	}
+
+	// a closed connection frees its slot
+	_ = held[0].Close()
+	eventually(t, "a free slot", func() bool { return len(lb.connSlots) < 2 })
+	if !echoes(dialLB(t, lb), "ping") {
+		t.Fatal("connection after one closed not proxied")
+	}
+}
+
+func TestMaxConnsPausesAccept(t *testing.T) {
+	cfg := testConfig(t, echoBackend(t))
+	cfg.MaxConns = 1
+	lb := newTestLB(t, cfg)
+	startLB(t, lb)
+
+	first := dialLB(t, lb)
+	if !echoes(first, "ping") {
+		t.Fatal("first connection not proxied")
+	}
+	second := dialLB(t, lb) // waits in the listen backlog
+	served := make(chan bool, 1)
+	go func() { served <- echoes(second, "pong") }()
+	select {
+	case <-served:
+		t.Fatal("second connection served while the cap was reached")
+	case <-time.After(100 * time.Millisecond):
+	}
+	_ = first.Close()
+	if !<-served {
+		t.Fatal("queued connection not proxied once a slot freed")
+	}
+	if n := lb.rejectedConns.Load(); n != 0 {
+		t.Fatalf("%d rejections while pausing accept", n)
+	}
+}
+
+func TestDuplicateAddRejected(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Strategy = "ch"
+	lb := newTestLB(t, cfg)
+	startLB(t, lb)
+
+	b, _ := NewBackend(BackendConfig{Host: "10.0.0.1", Port: 8081, Weight: 1})
+	if err := lb.Request(Event{EventName: CMD_BackendAdd, Data: *b}); err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.Request(Event{EventName: CMD_BackendAdd, Data: *b}); err == nil {
+		t.Fatal("second add of the same backend accepted")
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if len(lb.backends) != 1 {
+		t.Fatalf("pool of %d after a duplicate add, want 1", len(lb.backends))
+	}
+	ch := lb.strategy.(*ConsistentHashStrategy)
+	if len(ch.keys) != ch.vnodes {
+		t.Fatalf("%d ring positions, want %d", len(ch.keys), ch.vnodes)
+	}
+	for i, k := range ch.keys {
+		if i > 0 && k < ch.keys[i-1] {
+			t.Fatalf("ring out of order at %d", i)
+		}
+		if ch.backends[i] != lb.backends[0] {
+			t.Fatalf("ring position %d owned by %s", i, ch.backends[i])
+		}
+	}
+}
+
+func TestEmptyPoolServesOnceAdded(t *testing.T) {
+	for _, name := range StrategyNames() {
+		s, _ := NewStrategy(name, nil, StrategyConfig{})
+		b := testBackends(1)[0]
+		s.RegisterBackend(b)
+		if got, err := s.GetNextBackend(IncomingReq{key: "k"}); got != b || err != nil {
+			t.Errorf("%s, empty then one registered: %v, %v", name, got, err)
+		}
+	}
+
+	cfg := testConfig(t)
+	cfg.Mode = ModeHTTP
+	cfg.AllowEmpty = true
+	lb := newTestLB(t, cfg)
+	startLB(t, lb)
+	if body, err := get(lb, "/"); err == nil {
+		t.Fatalf("request to an empty pool succeeded: %q", body)
+	}
+	b, err := NewBackend(httpBackend(t, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.Request(Event{EventName: CMD_BackendAdd, Data: *b}); err != nil {
+		t.Fatal(err)
+	}
+	if body, err := get(lb, "/"); err != nil || body != "a" {
+		t.Fatalf("request after add: %q, %v", body, err)
+	}
+}
+
+func TestPortBoundaries(t *testing.T) {
+	for port, valid := range map[int]bool{-1: false, 0: false, 1: true, 1023: true, 1024: true, 65535: true, 65536: false} {
+		if err := checkPort(port); (err == nil) != valid {
+			t.Errorf("checkPort(%d) = %v, want valid %v", port, err, valid)
+		}
+		b, err := NewBackend(BackendConfig{Host: "app", Port: port, Weight: 1})
+		if (err == nil) != valid || (err != nil && b != nil) {
+			t.Errorf("NewBackend on port %d = %v, %v, want valid %v", port, b, err, valid)
+		}
+		addr := fmt.Sprintf("app:%d", port)
+		if _, err := ParseBackendAddr(addr); (err == nil) != valid {
+			t.Errorf("ParseBackendAddr(%q) = %v, want valid %v", addr, err, valid)
+		}
+		if _, err := parseEnvBackends(addr + ":2"); (err == nil) != valid {
+			t.Errorf("parseEnvBackends(%q) = %v, want valid %v", addr+":2", err, valid)
+		}
+		if err := checkBackends([]BackendConfig{{Host: "app", Port: port}}); (err == nil) != valid {
+			t.Errorf("config file backend on port %d: %v, want valid %v", port, err, valid)
+		}
+	}
+	// a bare port means localhost
+	if b, err := ParseBackendAddr("65535"); err != nil || b.Host != "localhost" || b.Port != 65535 {
+		t.Errorf("ParseBackendAddr(\"65535\") = %+v, %v", b, err)
+	}
+	for _, s := range []string{"99999", "-5", "app:0x50", "app:80.0"} {
+		if _, err := ParseBackendAddr(s); err == nil {
+			t.Errorf("ParseBackendAddr(%q) accepted", s)
+		}
+	}
+}
+
+func TestWarnLowPorts(t *testing.T) {
+	logged := captureLog(t)
+	cfg := testConfig(t)
+	cfg.WarnLowPorts = true
+	lb := newTestLB(t, cfg)
+	for _, port := range []int{1023, 1024} {
+		if _, err := lb.newBackend(BackendConfig{Host: "app", Port: port, Weight: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := logged.lines(); n != 1 {
+		t.Fatalf("%d warnings for ports 1023 and 1024, want one", n)
+	}
+}
@@ -0,0 +1,208 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ---------------------- Listeners ----------------------
+
+// ListenerConfig is one address the LB accepts on: host:port, or unix:/path
+// for a Unix socket. With CertFile and KeyFile set, TLS is terminated on it;
+// with AcceptProxy every connection must start with a PROXY protocol header
+// (see proxyproto.go). Mode, when set, is applied to a Unix socket's file so
+// clients running as other users can connect. HTTP3 also serves HTTP/3 on the
+// same port over UDP (see http3.go).
+type ListenerConfig struct {
+	Addr        string
+	CertFile    string
+	KeyFile     string
+	AcceptProxy bool
+	Mode        os.FileMode
+	HTTP3       bool
+
+	// nextProtos are the ALPN protocols a TLS listener offers; Start sets
+	// them for the mode
+	nextProtos []string
+}
+
+func (lc ListenerConfig) TLS() bool { return lc.CertFile != "" }
+
+func (lc ListenerConfig) String() string {
+	var opts []string
+	if lc.AcceptProxy {
+		opts = append(opts, "proxy")
+	}
+	if lc.Mode != 0 {
+		opts = append(opts, fmt.Sprintf("mode=%04o", lc.Mode))
+	}
+	if lc.TLS() {
+		opts = append(opts, "tls")
+	}
+	if lc.HTTP3 {
+		opts = append(opts, "h3")
+	}
+	if len(opts) == 0 {
+		return lc.Addr
+	}
+	return lc.Addr + " (" + strings.Join(opts, ", ") + ")"
+}
+
+func (lc ListenerConfig) Listen() (net.Listener, error) {
+	network, address := "tcp", lc.Addr
+	if path, ok := strings.CutPrefix(lc.Addr, "unix:"); ok {
+		network, address = "unix", path
+		// a socket file left by an earlier run would make Listen fail
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(path)
+		}
+	}
+	l, err := lc.listen(net.ListenConfig{}, network, address)
+	if err != nil || lc.Mode == 0 || network != "unix" {
+		return l, err
+	}
+	if err := os.Chmod(address, lc.Mode); err != nil {
+		_ = l.Close()
+		return nil, fmt.Errorf("listener %s: %w", lc.Addr, err)
+	}
+	return l, nil
+}
+
+// ListenN opens n listeners on lc's address that share its port through
+// SO_REUSEPORT, so the kernel spreads new connections over n accept loops.
+// Unix sockets, n <= 1 and platforms without SO_REUSEPORT balancing get a
+// single listener.
+func (lc ListenerConfig) ListenN(n int) ([]net.Listener, error) {
+	if n <= 1 || strings.HasPrefix(lc.Addr, "unix:") || !reusePortSupported {
+		l, err := lc.Listen()
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+	cfg := net.ListenConfig{Control: reusePortControl}
+	address := lc.Addr
+	ls := make([]net.Listener, 0, n)
+	for range n {
+		l, err := lc.listen(cfg, "tcp", address)
+		if err != nil {
+			for _, l := range ls {
+				_ = l.Close()
+			}
+			return nil, err
+		}
+		// with port 0 the rest must join the port the first one got
+		address = l.Addr().String()
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+func (lc ListenerConfig) listen(cfg net.ListenConfig, network, address string) (net.Listener, error) {
+	l, err := cfg.Listen(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	if lc.AcceptProxy {
+		// the header comes first, before any TLS
+		l = proxyListener{l}
+	}
+	if !lc.TLS() {
+		return l, nil
+	}
+	cert, err := tls.LoadX509KeyPair(lc.CertFile, lc.KeyFile)
+	if err != nil {
+		_ = l.Close()
+		return nil, fmt.Errorf("listener %s: %w", lc.Addr, err)
+	}
+	return tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: lc.nextProtos}), nil
+}
+
+func reusePortControl(_, _ string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) { err = setReusePort(fd) }); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// parseListener reads "addr[,cert=FILE,key=FILE][,proxy][,mode=OCTAL][,h3]".
+func parseListener(s string) (ListenerConfig, error) {
+	parts := strings.Split(s, ",")
+	lc := ListenerConfig{Addr: strings.TrimSpace(parts[0])}
+	if path, ok := strings.CutPrefix(lc.Addr, "unix:"); ok {
+		if path == "" {
+			return lc, fmt.Errorf("invalid listen address %q: empty socket path", lc.Addr)
+		}
+	} else if _, _, err := net.SplitHostPort(lc.Addr); err != nil {
+		return lc, fmt.Errorf("invalid listen address %q: %v", lc.Addr, err)
+	}
+	for _, opt := range parts[1:] {
+		k, v, ok := strings.Cut(strings.TrimSpace(opt), "=")
+		switch {
+		case ok && k == "cert":
+			lc.CertFile = v
+		case ok && k == "key":
+			lc.KeyFile = v
+		case !ok && k == "proxy":
+			lc.AcceptProxy = true
+		case !ok && k == "h3":
+			lc.HTTP3 = true
+		case ok && k == "mode":
+			m, err := strconv.ParseUint(v, 8, 32)
+			if err != nil || m == 0 || m&^0o777 != 0 {
+				return lc, fmt.Errorf("listener %s: invalid mode %q (want permission bits in octal, e.g. 0660)", lc.Addr, v)
+			}
+			lc.Mode = os.FileMode(m)
+		default:
+			return lc, fmt.Errorf("invalid listener option %q (want cert=FILE, key=FILE, proxy, mode=OCTAL or h3)", opt)
+		}
+	}
+	if lc.Mode != 0 && !strings.HasPrefix(lc.Addr, "unix:") {
+		return lc, fmt.Errorf("listener %s: mode only applies to unix: sockets", lc.Addr)
+	}
+	if (lc.CertFile == "") != (lc.KeyFile == "") {
+		return lc, fmt.Errorf("listener %s: cert and key must be given together", lc.Addr)
+	}
+	if lc.HTTP3 && (!lc.TLS() || strings.HasPrefix(lc.Addr, "unix:")) {
+		return lc, fmt.Errorf("listener %s: h3 needs a host:port listener with cert and key", lc.Addr)
+	}
+	return lc, nil
+}
+
+// listenFlag is the repeatable -listen flag; the first use replaces the
+// default listener instead of adding to it.
+type listenFlag struct {
+	l   *[]ListenerConfig
+	set bool
+}
+
+func (f *listenFlag) String() string {
+	if f.l == nil {
+		return ""
+	}
+	addrs := make([]string, len(*f.l))
+	for i, lc := range *f.l {
+		addrs[i] = lc.String()
+	}
+	return strings.Join(addrs, " ")
+}
+
+func (f *listenFlag) Set(s string) error {
+	lc, err := parseListener(s)
+	if err != nil {
+		return err
+	}
+	if !f.set {
+		*f.l = nil
+		f.set = true
+	}
+	*f.l = append(*f.l, lc)
+	return nil
+}
@@ -0,0 +1,298 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestListenNSharesPort(t *testing.T) {
+	if !reusePortSupported {
+		t.Skip("no SO_REUSEPORT balancing on this platform")
+	}
+	ls, err := ListenerConfig{Addr: "127.0.0.1:0"}.ListenN(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, l := range ls {
+			_ = l.Close()
+		}
+	}()
+	if len(ls) != 4 {
+		t.Fatalf("%d listeners, want 4", len(ls))
+	}
+	for _, l := range ls[1:] {
+		if l.Addr().String() != ls[0].Addr().String() {
+			t.Fatalf("acceptor on %s, want %s", l.Addr(), ls[0].Addr())
+		}
+	}
+}
+
+func TestListenersShareThePool(t *testing.T) {
+	certFile, keyFile := testCert(t)
+	cfg := testConfig(t, httpBackend(t, "a"))
+	cfg.Mode = ModeHTTP
+	cfg.Listeners = append(cfg.Listeners, ListenerConfig{Addr: freeAddr(t), CertFile: certFile, KeyFile: keyFile})
+	lb := newTestLB(t, cfg)
+	startLB(t, lb)
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: certPool(t, certFile)},
+			DisableKeepAlives: true,
+		},
+	}
+	for _, url := range []string{
+		"http://" + cfg.Listeners[0].Addr + "/",
+		"https://" + cfg.Listeners[1].Addr + "/",
+	} {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if string(body) != "a" {
+			t.Fatalf("%s: %q", url, body)
+		}
+	}
+
+	_ = lb.Shutdown(context.Background())
+	for _, lc := range cfg.Listeners {
+		if c, err := net.Dial("tcp", lc.Addr); err == nil {
+			_ = c.Close()
+			t.Fatalf("%s still accepting after shutdown", lc.Addr)
+		}
+	}
+}
+
+func TestUnixSocketListenerAndBackend(t *testing.T) {
+	dir, err := os.MkdirTemp("", "lb") // t.TempDir can exceed the socket path limit
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	backendSock, lbSock := filepath.Join(dir, "b.sock"), filepath.Join(dir, "lb.sock")
+
+	l, err := net.Listen("unix", backendSock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc := serveHTTPBackend(t, l, "sock")
+
+	for _, mode := range []string{ModeTCP, ModeHTTP} {
+		t.Run(mode, func(t *testing.T) {
+			cfg := testConfig(t, bc)
+			cfg.Listeners = []ListenerConfig{{Addr: "unix:" + lbSock}}
+			cfg.Mode = mode
+			cfg.HealthCheck.Mode = HealthCheckHTTP
+			cfg.HealthCheck.Interval = 20 * time.Millisecond
+			lb := newTestLB(t, cfg)
+			startLB(t, lb)
+
+			client := &http.Client{
+				Timeout: 5 * time.Second,
+				Transport: &http.Transport{
+					DisableKeepAlives: true,
+					DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+						var d net.Dialer
+						return d.DialContext(ctx, "unix", lbSock)
+					},
+				},
+			}
+			resp, err := client.Get("http://lb/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "sock" {
+				t.Fatalf("through the unix listener: %q", body)
+			}
+			eventually(t, "a passed health check", func() bool {
+				lb.mu.Lock()
+				defer lb.mu.Unlock()
+				p := lb.backends[0].lastProbe
+				return !p.at.IsZero() && p.err == nil
+			})
+			if s := lb.backends[0].String(); s != "unix:"+backendSock {
+				t.Fatalf("socket backend named %q", s)
+			}
+		})
+	}
+}
+
+// failingListener returns errs from Accept in turn, then net.ErrClosed.
+type failingListener struct {
+	mu      sync.Mutex
+	errs    []error
+	accepts int
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.accepts++
+	if len(l.errs) == 0 {
+		return nil, net.ErrClosed
+	}
+	err := l.errs[0]
+	l.errs = l.errs[1:]
+	return nil, err
+}
+
+func (l *failingListener) Close() error   { return nil }
+func (l *failingListener) Addr() net.Addr { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+
+// captureLog sends the log to the returned buffer until t ends.
+func captureLog(t *testing.T) *syncBuffer {
+	buf := new(syncBuffer)
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return buf
+}
+
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) lines() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.Count(b.b.Bytes(), []byte("\n"))
+}
+
+// runAcceptLoop runs lb's accept loop on l and fails t unless it returns
+// within a few seconds.
+func runAcceptLoop(t *testing.T, lb *LB, l net.Listener) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		lb.acceptLoop(l, lb.admit)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("accept loop still running")
+	}
+}
+
+func TestAcceptLoopExitsOnClose(t *testing.T) {
+	logged := captureLog(t)
+	lb := newTestLB(t, testConfig(t))
+	l := &failingListener{}
+	runAcceptLoop(t, lb, l)
+	if l.accepts != 1 || logged.lines() != 0 {
+		t.Fatalf("closed listener: %d accepts, %d log lines", l.accepts, logged.lines())
+	}
+
+	// a real listener closed under the loop
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(20*time.Millisecond, func() { _ = tl.Close() })
+	runAcceptLoop(t, lb, tl)
+	if n := logged.lines(); n != 0 {
+		t.Fatalf("%d log lines for a closed listener", n)
+	}
+}
+
+func TestAcceptLoopBacksOffTemporaryErrors(t *testing.T) {
+	logged := captureLog(t)
+	lb := newTestLB(t, testConfig(t))
+	l := &failingListener{errs: []error{syscall.EMFILE, syscall.EMFILE, syscall.ECONNABORTED}}
+	start := time.Now()
+	runAcceptLoop(t, lb, l)
+	// 5ms, 10ms, 20ms: backing off, not spinning
+	if d := time.Since(start); d < 35*time.Millisecond {
+		t.Fatalf("three temporary errors passed in %s", d)
+	}
+	if l.accepts != 4 || logged.lines() != 3 {
+		t.Fatalf("%d accepts, %d log lines, want 4 and one line per error", l.accepts, logged.lines())
+	}
+
+	// a shutdown ends the backoff
+	l = &failingListener{errs: []error{syscall.EMFILE}}
+	close(lb.stopping)
+	runAcceptLoop(t, lb, l)
+	if l.accepts != 1 {
+		t.Fatalf("%d accepts after shutdown began", l.accepts)
+	}
+}
+
+func TestAcceptLoopFatalErrorShutsDown(t *testing.T) {
+	captureLog(t)
+	lb := newTestLB(t, testConfig(t))
+	l := &failingListener{errs: []error{errors.New("listener broken")}}
+	go lb.acceptLoop(l, lb.admit)
+	select {
+	case e := <-lb.events:
+		if e.EventName != CMD_Exit {
+			t.Fatalf("fatal accept error sent %s, want %s", e.EventName, CMD_Exit)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fatal accept error didn't start a shutdown")
+	}
+}
+
+// BenchmarkAcceptors opens a connection, makes one HTTP/1.0 request on it
+// and closes it, from parallel clients, against 1 and 4 acceptors. See the
+// Readme's Multiple Acceptors section.
+func BenchmarkAcceptors(b *testing.B) {
+	for _, n := range []int{1, 4} {
+		b.Run(fmt.Sprintf("acceptors=%d", n), func(b *testing.B) {
+			if n > 1 && !reusePortSupported {
+				b.Skip("no SO_REUSEPORT balancing on this platform")
+			}
+			// a log line per connection would be most of what is measured
+			log.SetOutput(io.Discard)
+			b.Cleanup(func() { log.SetOutput(os.Stderr) })
+			cfg := testConfig(b, httpBackend(b, "a"))
+			cfg.Acceptors = n
+			lb := newTestLB(b, cfg)
+			startLB(b, lb)
+
+			addr := lb.cfg.Listeners[0].Addr
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					c, err := net.Dial("tcp", addr)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					_, _ = io.WriteString(c, "GET / HTTP/1.0\r\n\r\n")
+					resp, err := io.ReadAll(c)
+					_ = c.Close()
+					if err != nil || !bytes.HasSuffix(resp, []byte("a")) {
+						b.Errorf("response %q, %v", resp, err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ---------------------- Maglev Hashing ----------------------
+// Google's Maglev: every backend walks its own permutation of a lookup table
+// of prime size M (start offset and step both hashed from its address), and
+// the backends take turns claiming the next free entry of their permutation
+// until the table is full. A key goes to table[hash(key) % M]. Every backend
+// ends up with M/N entries give or take one, so the spread is near perfect,
+// and a pool change only reassigns about the changed backend's share plus a
+// little. Bigger tables spread more evenly at the cost of memory and rebuild
+// time. Weights are ignored. A key whose entry is unavailable goes to the next
+// available entry, so a down backend's keys spread over the rest.
+
+// DefaultMaglevTableSize is the -maglev-table default, the paper's choice.
+const DefaultMaglevTableSize = 65537
+
+type MaglevStrategy struct {
+	Backends []*Backend // sorted by address, so pool order doesn't matter
+	table    []int32    // indexes into Backends
+	hasher   Hasher
+}
+
+// NewMaglevStrategy builds a table of cfg.MaglevTableSize entries (prime;
+// DefaultMaglevTableSize when 0), hashing with cfg.Hasher or truncated
+// SHA-256 when unset.
+func NewMaglevStrategy(backends []*Backend, cfg StrategyConfig) *MaglevStrategy {
+	h := cfg.Hasher
+	if h == nil {
+		h = SHA256Hasher{}
+	}
+	size := cfg.MaglevTableSize
+	if size <= 0 {
+		size = DefaultMaglevTableSize
+	}
+	s := &MaglevStrategy{hasher: h, table: make([]int32, size)}
+	s.Init(backends)
+	return s
+}
+
+func (s *MaglevStrategy) Init(backends []*Backend) {
+	s.Backends = slices.Clone(backends)
+	slices.SortFunc(s.Backends, func(a, b *Backend) int { return strings.Compare(a.String(), b.String()) })
+	s.populate()
+}
+
+func (s *MaglevStrategy) RegisterBackend(backend *Backend) {
+	s.Init(append(s.Backends, backend))
+}
+
+// populate fills the lookup table, the paper's Algorithm 1.
+func (s *MaglevStrategy) populate() {
+	m := uint64(len(s.table))
+	for i := range s.table {
+		s.table[i] = -1
+	}
+	n := len(s.Backends)
+	if n == 0 {
+		return
+	}
+	offset := make([]uint64, n)
+	skip := make([]uint64, n)
+	next := make([]uint64, n)
+	for i, b := range s.Backends {
+		offset[i] = uint64(s.hasher.Sum32(b.String())) % m
+		skip[i] = uint64(s.hasher.Sum32(b.String()+"#skip"))%(m-1) + 1
+	}
+	for filled := uint64(0); ; {
+		for i := range n {
+			c := (offset[i] + next[i]*skip[i]) % m
+			for s.table[c] >= 0 {
+				next[i]++
+				c = (offset[i] + next[i]*skip[i]) % m
+			}
+			s.table[c] = int32(i)
+			next[i]++
+			if filled++; filled == m {
+				return
+			}
+		}
+	}
+}
+
+func (s *MaglevStrategy) GetNextBackend(req IncomingReq) (*Backend, error) {
+	if len(s.Backends) == 0 {
+		return nil, ErrNoBackends
+	}
+	if !slices.ContainsFunc(s.Backends, (*Backend).Available) {
+		return nil, ErrAllUnhealthy
+	}
+	m := len(s.table)
+	slot := int(s.hasher.Sum32(req.key) % uint32(m))
+	for n := 0; ; n++ {
+		if b := s.Backends[s.table[(slot+n)%m]]; b.Available() {
+			return b, nil
+		}
+	}
+}
+
+// PrintTopology reports each backend's share of the lookup table.
+func (s *MaglevStrategy) PrintTopology() {
+	entries := make([]int, len(s.Backends))
+	for _, i := range s.table {
+		if i >= 0 {
+			entries[i]++
+		}
+	}
+	fmt.Printf("table size %d\n", len(s.table))
+	for i, b := range s.Backends {
+		fmt.Printf("[%d] %-20s entries=%-6d owns=%6.2f%%\n", i, b, entries[i], 100*float64(entries[i])/float64(len(s.table)))
+	}
+}
+
+// isPrime reports whether n is prime, for -maglev-table.
+func isPrime(n int) bool {
+	if n < 2 {
+		return false
+	}
+	for d := 2; d*d <= n; d++ {
+		if n%d == 0 {
+			return false
+		}
+	}
+	return true
+}
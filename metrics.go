@@ -0,0 +1,138 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ---------------------- Remap Metrics ----------------------
+// every topology change (add/remove/strategy) records which fraction of the
+// demo keyspace changed backend, so churn can be alerted on.
+
+// remapBuckets are the upper bounds of the moved-fraction histogram.
+var remapBuckets = []float64{0, 0.05, 0.1, 0.25, 0.5, 0.75, 1}
+
+type RemapMetrics struct {
+	mu           sync.Mutex
+	count        int
+	sum          float64 // sum of moved fractions
+	buckets      []int   // cumulative, parallel to remapBuckets
+	lastFraction float64
+	lastEvent    string
+}
+
+func NewRemapMetrics() *RemapMetrics {
+	return &RemapMetrics{buckets: make([]int, len(remapBuckets))}
+}
+
+func (m *RemapMetrics) Observe(event string, fraction float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.count++
+	m.sum += fraction
+	for i, ub := range remapBuckets {
+		if fraction <= ub {
+			m.buckets[i]++
+		}
+	}
+	m.lastFraction = fraction
+	m.lastEvent = event
+}
+
+// RemapStats is the /stats view of RemapMetrics.
+type RemapStats struct {
+	Rebalances        int     `json:"rebalances"`
+	LastEvent         string  `json:"last_event,omitempty"`
+	LastMovedFraction float64 `json:"last_moved_fraction"`
+	AvgMovedFraction  float64 `json:"avg_moved_fraction"`
+}
+
+func (m *RemapMetrics) Stats() RemapStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := RemapStats{
+		Rebalances:        m.count,
+		LastEvent:         m.lastEvent,
+		LastMovedFraction: m.lastFraction,
+	}
+	if m.count > 0 {
+		st.AvgMovedFraction = m.sum / float64(m.count)
+	}
+	return st
+}
+
+// WritePrometheus writes the histogram in the Prometheus text format.
+func (m *RemapMetrics) WritePrometheus(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	const name = "lb_rebalance_moved_fraction"
+	fmt.Fprintf(w, "# HELP %s Fraction of sampled keys that changed backend on a topology change.\n", name)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	for i, ub := range remapBuckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, ub, m.buckets[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, m.count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, m.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, m.count)
+}
+
+// recordRemap feeds a before/after demo snapshot pair into lb.remaps; see
+// reportRemap for the -remap-sample path.
+func (lb *LB) recordRemap(event string, before, after map[string]string) {
+	if len(after) == 0 {
+		return
+	}
+	moved := 0
+	for k, a := range after {
+		if before[k] != a {
+			moved++
+		}
+	}
+	lb.remaps.Observe(event, float64(moved)/float64(len(after)))
+}
+
+func (lb *LB) serveMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	lb.remaps.WritePrometheus(w)
+	lb.writeLatency(w)
+	lb.writePeakEWMA(w)
+	fmt.Fprintf(w, "# HELP lb_hedges_fired_total Hedged requests sent to a second backend.\n")
+	fmt.Fprintf(w, "# TYPE lb_hedges_fired_total counter\n")
+	fmt.Fprintf(w, "lb_hedges_fired_total %d\n", lb.hedgesFired.Load())
+	fmt.Fprintf(w, "# HELP lb_hedge_wins_total Hedged requests that answered before the original.\n")
+	fmt.Fprintf(w, "# TYPE lb_hedge_wins_total counter\n")
+	fmt.Fprintf(w, "lb_hedge_wins_total %d\n", lb.hedgeWins.Load())
+	fmt.Fprintf(w, "# HELP lb_rejected_conns_total Client connections turned away, by the limit that refused them.\n")
+	fmt.Fprintf(w, "# TYPE lb_rejected_conns_total counter\n")
+	fmt.Fprintf(w, "lb_rejected_conns_total{limit=\"max-conns\"} %d\n", lb.rejectedConns.Load())
+	fmt.Fprintf(w, "lb_rejected_conns_total{limit=\"max-conns-per-ip\"} %d\n", lb.rejectedPerIP.Load())
+	fmt.Fprintf(w, "# HELP lb_mirror_requests_total Request copies for -mirror, by outcome (failed is a subset of sent).\n")
+	fmt.Fprintf(w, "# TYPE lb_mirror_requests_total counter\n")
+	fmt.Fprintf(w, "lb_mirror_requests_total{result=\"sent\"} %d\n", lb.mirrorSent.Load())
+	fmt.Fprintf(w, "lb_mirror_requests_total{result=\"failed\"} %d\n", lb.mirrorFailed.Load())
+	fmt.Fprintf(w, "lb_mirror_requests_total{result=\"skipped\"} %d\n", lb.mirrorSkipped.Load())
+	fmt.Fprintf(w, "# HELP lb_spills_total Requests sent past their busy consistent-hash owner or local zone (-spill-at).\n")
+	fmt.Fprintf(w, "# TYPE lb_spills_total counter\n")
+	fmt.Fprintf(w, "lb_spills_total %d\n", lb.spills.Load())
+	fmt.Fprintf(w, "# HELP lb_affinity_evictions_total Affinity sessions evicted to stay within -affinity-max.\n")
+	fmt.Fprintf(w, "# TYPE lb_affinity_evictions_total counter\n")
+	fmt.Fprintf(w, "lb_affinity_evictions_total %d\n", lb.sessionEvictions.Load())
+	fmt.Fprintf(w, "# HELP lb_retries_total Dials retried on another backend after a connection failure.\n")
+	fmt.Fprintf(w, "# TYPE lb_retries_total counter\n")
+	fmt.Fprintf(w, "lb_retries_total %d\n", lb.retries.Load())
+	fmt.Fprintf(w, "# HELP lb_retries_denied_total Retries not made because the retry budget was exhausted.\n")
+	fmt.Fprintf(w, "# TYPE lb_retries_denied_total counter\n")
+	fmt.Fprintf(w, "lb_retries_denied_total %d\n", lb.retriesDenied.Load())
+	fmt.Fprintf(w, "# HELP lb_circuit_trips_total Backend circuit breakers opened.\n")
+	fmt.Fprintf(w, "# TYPE lb_circuit_trips_total counter\n")
+	fmt.Fprintf(w, "lb_circuit_trips_total %d\n", lb.breakerTrips.Load())
+	fmt.Fprintf(w, "# HELP lb_outlier_ejections_total Backends ejected by outlier detection.\n")
+	fmt.Fprintf(w, "# TYPE lb_outlier_ejections_total counter\n")
+	fmt.Fprintf(w, "lb_outlier_ejections_total %d\n", lb.outlierEjections.Load())
+	fmt.Fprintf(w, "# HELP lb_backpressure_seconds_total Time accept loops spent paused because -max-conns was reached.\n")
+	fmt.Fprintf(w, "# TYPE lb_backpressure_seconds_total counter\n")
+	fmt.Fprintf(w, "lb_backpressure_seconds_total %g\n", time.Duration(lb.backpressureNanos.Load()).Seconds())
+}
@@ -0,0 +1,64 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrape returns lb's /metrics output.
+func scrape(lb *LB) string {
+	rec := httptest.NewRecorder()
+	lb.serveMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	return rec.Body.String()
+}
+
+func TestRemovedBackendsLeaveNoSeries(t *testing.T) {
+	cfg := testConfig(t, BackendConfig{Host: "10.0.0.1", Port: 80, Weight: 1})
+	cfg.RemapSample = 0
+	cfg.Strategy = "rr"
+	lb := newTestLB(t, cfg)
+	startLB(t, lb)
+
+	var added []Backend
+	for i := range 100 {
+		b, _ := NewBackend(BackendConfig{Host: "10.0.1.1", Port: 2000 + i, Weight: 1})
+		if err := lb.Request(Event{EventName: CMD_BackendAdd, Data: *b}); err != nil {
+			t.Fatal(err)
+		}
+		added = append(added, *b)
+	}
+	lb.mu.Lock()
+	for _, b := range lb.backends {
+		lb.observeLatency(b, 10*time.Millisecond)
+		lb.observeRTT(b, 10*time.Millisecond)
+	}
+	lb.mu.Unlock()
+	series := func() int {
+		n := 0
+		for _, line := range strings.Split(scrape(lb), "\n") {
+			if strings.Contains(line, `"10.0.1.1:`) {
+				n++
+			}
+		}
+		return n
+	}
+	if series() < 100 {
+		t.Fatalf("%d series for 100 added backends", series())
+	}
+
+	for _, b := range added {
+		if err := lb.Request(Event{EventName: CMD_BackendRemove, Data: b}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := series(); n != 0 {
+		t.Fatalf("%d series left for removed backends", n)
+	}
+	if out := scrape(lb); !strings.Contains(out, fmt.Sprintf("backend=%q", "10.0.0.1:80")) {
+		t.Fatal("series of the remaining backend gone too")
+	}
+}
@@ -0,0 +1,93 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ---------------------- Request Mirroring ----------------------
+// with -mirror, HTTP mode copies a -mirror-percent sample of requests to a
+// shadow backend, e.g. a new version under test. The client is only ever
+// served by the pool: the copy is sent from its own goroutine after the body
+// has been buffered, its response is read and thrown away, and its failures
+// are only counted. A body over mirrorMaxBody isn't buffered, so that request
+// isn't mirrored; neither is one arriving while mirrorMaxInFlight copies are
+// still outstanding.
+
+const (
+	mirrorMaxBody     = 1 << 20
+	mirrorMaxInFlight = 64
+	mirrorTimeout     = 10 * time.Second
+)
+
+type mirror struct {
+	backend *Backend
+	client  *http.Client
+	slots   chan struct{}
+}
+
+func (lb *LB) newMirror(b Backend) *mirror {
+	return &mirror{
+		backend: &b,
+		client: &http.Client{
+			Timeout:       mirrorTimeout,
+			Transport:     &http.Transport{DialContext: lb.dialContext},
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		slots: make(chan struct{}, mirrorMaxInFlight),
+	}
+}
+
+// mirrorRequest sends a copy of hreq to the mirror when it is sampled. hreq's
+// body is buffered (and replaced by the buffer) so both sends see it whole.
+func (lb *LB) mirrorRequest(req IncomingReq, hreq *http.Request) {
+	m := lb.mirror
+	if m == nil || isUpgrade(hreq) || lb.rng.Float64()*100 >= lb.cfg.MirrorPercent {
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(hreq.Body, mirrorMaxBody+1))
+	if err != nil || len(body) > mirrorMaxBody {
+		// put back what was read; the primary still gets the whole body
+		hreq.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), hreq.Body), hreq.Body}
+		lb.mirrorSkipped.Add(1)
+		return
+	}
+	hreq.Body = io.NopCloser(bytes.NewReader(body))
+
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		lb.mirrorSkipped.Add(1)
+		return
+	}
+
+	ctx := context.WithValue(context.Background(), backendKey{}, m.backend)
+	mreq := hreq.Clone(ctx)
+	mreq.RequestURI = ""
+	mreq.URL.Scheme, mreq.URL.Host = "http", m.backend.urlHost()
+	mreq.Body = io.NopCloser(bytes.NewReader(body))
+	mreq.ContentLength, mreq.TransferEncoding = int64(len(body)), nil
+	lb.mirrorSent.Add(1)
+	go func() {
+		defer func() { <-m.slots }()
+		resp, err := m.client.Do(mreq)
+		if err != nil {
+			lb.mirrorFailed.Add(1)
+			log.Printf("req %s: mirror %s: %s", req.reqId, m.backend, err)
+			return
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			lb.mirrorFailed.Add(1)
+		}
+	}()
+}
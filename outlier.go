@@ -0,0 +1,239 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"time"
+)
+
+// ---------------------- Outlier Detection ----------------------
+// every Interval each pool's backends are compared with each other, as
+// Envoy's outlier detection does. A backend that had at least MinRequests
+// results in the interval is a candidate; when a pool has MinHosts
+// candidates, one whose success rate lies more than StdevFactor standard
+// deviations below the pool mean is ejected, and so is one whose p99 connect
+// time lies that far above the pool mean. Results are what passive health
+// sees (failed dials, 5xx responses, successes); connect times are every
+// successful backend dial, so in HTTP mode, where connections are reused,
+// latency needs a busy pool to find its MinRequests. An ejected backend sits
+// out BaseEjection times the number of times it has been ejected, up to
+// MaxEjection, and is let back at the first interval after that; every
+// interval it spends in the pool takes one off its count. No more than
+// MaxEjectionPercent of a pool is ejected at once, always at least one
+// backend in a pool of two or more and never the whole pool.
+
+type OutlierConfig struct {
+	Interval           time.Duration // between comparisons; 0 = off
+	BaseEjection       time.Duration // first ejection's length
+	MaxEjection        time.Duration // cap on an ejection's length
+	MaxEjectionPercent int           // of a pool ejected at once
+	MinRequests        int           // results (and connects) an interval needs to count
+	MinHosts           int           // candidates a pool needs for a comparison
+	StdevFactor        float64       // deviations from the mean that make an outlier
+}
+
+func DefaultOutlierConfig() OutlierConfig {
+	return OutlierConfig{
+		BaseEjection:       30 * time.Second,
+		MaxEjection:        300 * time.Second,
+		MaxEjectionPercent: 10,
+		MinRequests:        20,
+		MinHosts:           5,
+		StdevFactor:        1.9,
+	}
+}
+
+func (oc OutlierConfig) enabled() bool { return oc.Interval > 0 }
+
+func (oc OutlierConfig) Validate() error {
+	if oc.Interval < 0 {
+		return fmt.Errorf("-outlier-interval must be >= 0")
+	}
+	if !oc.enabled() {
+		return nil
+	}
+	if oc.BaseEjection <= 0 || oc.MaxEjection < oc.BaseEjection {
+		return fmt.Errorf("-outlier-ejection must be > 0 and at most -outlier-max-ejection")
+	}
+	if oc.MaxEjectionPercent < 0 || oc.MaxEjectionPercent > 100 {
+		return fmt.Errorf("-outlier-max-percent must be between 0 and 100")
+	}
+	if oc.MinRequests < 1 {
+		return fmt.Errorf("-outlier-min-requests must be >= 1")
+	}
+	if oc.MinHosts < 2 {
+		return fmt.Errorf("-outlier-min-hosts must be >= 2")
+	}
+	if oc.StdevFactor <= 0 {
+		return fmt.Errorf("-outlier-stdev-factor must be > 0")
+	}
+	return nil
+}
+
+func (oc OutlierConfig) String() string {
+	if !oc.enabled() {
+		return "off"
+	}
+	return fmt.Sprintf("every %s, %.1f stdev off the mean of %d+ backends with %d+ results, eject %s-%s, max %d%%",
+		oc.Interval, oc.StdevFactor, oc.MinHosts, oc.MinRequests, oc.BaseEjection, oc.MaxEjection, oc.MaxEjectionPercent)
+}
+
+// maxOutlierSamples bounds the connect times kept per backend and interval;
+// past it the newest overwrite the oldest.
+const maxOutlierSamples = 1024
+
+// outlierStats is one backend's detection state, guarded by lb.mu.
+type outlierStats struct {
+	results   int             // this interval
+	failures  int             // this interval
+	connects  []time.Duration // this interval, a ring of maxOutlierSamples
+	nconnects int             // this interval, including overwritten ones
+
+	ejected      bool
+	ejectedUntil time.Time
+	ejections    int // multiplier for the next ejection's length
+}
+
+// p99 is the 99th percentile of the interval's connect times.
+func (o *outlierStats) p99() time.Duration {
+	s := slices.Clone(o.connects)
+	slices.Sort(s)
+	return s[(len(s)*99+99)/100-1] // nearest rank
+}
+
+// outlierResultLocked counts a result for b. Callers must hold lb.mu.
+func (lb *LB) outlierResultLocked(b *Backend, ok bool) {
+	if !lb.cfg.Outlier.enabled() {
+		return
+	}
+	b.outlier.results++
+	if !ok {
+		b.outlier.failures++
+	}
+}
+
+// outlierConnectLocked records a connect time for b. Callers must hold lb.mu.
+func (lb *LB) outlierConnectLocked(b *Backend, d time.Duration) {
+	if !lb.cfg.Outlier.enabled() {
+		return
+	}
+	o := &b.outlier
+	if len(o.connects) < maxOutlierSamples {
+		o.connects = append(o.connects, d)
+	} else {
+		o.connects[o.nconnects%maxOutlierSamples] = d
+	}
+	o.nconnects++
+}
+
+// detectOutliers runs until shutdown with -outlier-interval set.
+func (lb *LB) detectOutliers() {
+	ticker := time.NewTicker(lb.cfg.Outlier.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lb.stopping:
+			return
+		case <-ticker.C:
+		}
+		lb.mu.Lock()
+		lb.detectOutliersLocked(lb.backends)
+		for _, g := range lb.groups {
+			lb.detectOutliersLocked(g.backends)
+		}
+		lb.mu.Unlock()
+	}
+}
+
+// detectOutliersLocked ends an interval for one pool: it lets back the
+// backends whose ejection is over, ejects the new outliers and starts the
+// next interval. Callers must hold lb.mu.
+func (lb *LB) detectOutliersLocked(pool []*Backend) {
+	oc := lb.cfg.Outlier
+	now := lb.clock.Now()
+	ejected := 0
+	for _, b := range pool {
+		o := &b.outlier
+		if o.ejected && !now.Before(o.ejectedUntil) {
+			o.ejected = false
+			log.Printf("outlier %s: back in the pool", b.Label())
+			lb.publishBackend(StateOutlierReturned, b, "")
+		}
+		if o.ejected {
+			ejected++
+		} else if o.ejections > 0 {
+			o.ejections--
+		}
+	}
+	allowed := len(pool) * oc.MaxEjectionPercent / 100
+	if allowed < 1 && len(pool) > 1 {
+		allowed = 1
+	}
+	allowed = min(allowed, len(pool)-1)
+
+	var byRate, byLatency []*Backend
+	for _, b := range pool {
+		if b.outlier.ejected || !b.Available() {
+			continue
+		}
+		if b.outlier.results >= oc.MinRequests {
+			byRate = append(byRate, b)
+		}
+		if b.outlier.nconnects >= oc.MinRequests {
+			byLatency = append(byLatency, b)
+		}
+	}
+	eject := func(b *Backend, reason string) {
+		if b.outlier.ejected || ejected >= allowed {
+			return
+		}
+		o := &b.outlier
+		o.ejections++
+		d := min(time.Duration(o.ejections)*oc.BaseEjection, oc.MaxEjection)
+		o.ejected, o.ejectedUntil = true, now.Add(d)
+		ejected++
+		lb.outlierEjections.Add(1)
+		log.Printf("outlier %s: ejected for %s: %s", b.Label(), d, reason)
+		lb.publishBackend(StateOutlierEjected, b, reason)
+	}
+	if len(byRate) >= oc.MinHosts {
+		rate := func(b *Backend) float64 {
+			return 1 - float64(b.outlier.failures)/float64(b.outlier.results)
+		}
+		mean, stdev := meanStdev(byRate, rate)
+		for _, b := range byRate {
+			if r := rate(b); r < mean-oc.StdevFactor*stdev {
+				eject(b, fmt.Sprintf("success rate %.1f%%, pool mean %.1f%%", 100*r, 100*mean))
+			}
+		}
+	}
+	if len(byLatency) >= oc.MinHosts {
+		p99 := func(b *Backend) float64 { return b.outlier.p99().Seconds() }
+		mean, stdev := meanStdev(byLatency, p99)
+		for _, b := range byLatency {
+			if l := p99(b); l > mean+oc.StdevFactor*stdev {
+				eject(b, fmt.Sprintf("p99 connect %s, pool mean %s", fmtSeconds(l), fmtSeconds(mean)))
+			}
+		}
+	}
+
+	for _, b := range pool {
+		o := &b.outlier
+		o.results, o.failures, o.connects, o.nconnects = 0, 0, o.connects[:0], 0
+	}
+}
+
+// meanStdev is the mean and population standard deviation of f over bs.
+func meanStdev(bs []*Backend, f func(*Backend) float64) (mean, stdev float64) {
+	for _, b := range bs {
+		mean += f(b)
+	}
+	mean /= float64(len(bs))
+	for _, b := range bs {
+		d := f(b) - mean
+		stdev += d * d
+	}
+	return mean, math.Sqrt(stdev / float64(len(bs)))
+}
@@ -0,0 +1,59 @@
+package loadbalancer
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+)
+
+// ---------------------- Backend Override ----------------------
+// with -allow-backend-override, an HTTP request carrying -backend-override-
+// header (X-LB-Backend: localhost:8082, or a backend ID) goes to that backend
+// instead of the one its strategy would pick, for debugging one instance or
+// pinning a canary test. The backend has to be in the pool the request routes
+// to and available; otherwise the header is ignored and normal selection
+// applies. With -backend-override-secret the request must also carry it in
+// X-LB-Override-Secret. Neither header is forwarded to the backend.
+
+// overrideSecretHeader carries -backend-override-secret.
+const overrideSecretHeader = "X-LB-Override-Secret"
+
+// overrideForLocked returns the backend hreq asks to be pinned to, or nil. It
+// strips the override headers either way. Callers must hold lb.mu.
+func (lb *LB) overrideForLocked(req IncomingReq, hreq *http.Request) *Backend {
+	if !lb.cfg.AllowBackendOverride {
+		return nil
+	}
+	want := hreq.Header.Get(lb.cfg.BackendOverrideHeader)
+	secret := hreq.Header.Get(overrideSecretHeader)
+	hreq.Header.Del(lb.cfg.BackendOverrideHeader)
+	hreq.Header.Del(overrideSecretHeader)
+	if want == "" {
+		return nil
+	}
+	if s := lb.cfg.BackendOverrideSecret; s != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(s)) != 1 {
+		log.Printf("in-req: %s override to %s ignored: bad or missing %s", req.reqId, want, overrideSecretHeader)
+		return nil
+	}
+
+	pool := lb.backends
+	if g := lb.routeLocked(hreq.URL.Path); g != nil {
+		pool = g.backends
+	}
+	addr := want
+	if b, err := ParseBackendAddr(want); err == nil {
+		addr = b.String()
+	}
+	for _, b := range pool {
+		if b.String() != addr && b.ID != want {
+			continue
+		}
+		if !b.Available() {
+			log.Printf("in-req: %s override to %s ignored: backend unavailable", req.reqId, b.Label())
+			return nil
+		}
+		return b
+	}
+	log.Printf("in-req: %s override to %s ignored: no such backend in the pool", req.reqId, want)
+	return nil
+}
@@ -0,0 +1,180 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ---------------------- Peak-EWMA ----------------------
+// every backend keeps a peak-sensitive moving average of how long it takes
+// to answer, the cost the p2c strategy compares. A sample above the average
+// replaces it outright, so a latency spike shows at once; lower samples only
+// pull it down gradually, weighted by the time since the previous one against
+// -ewma-decay. What a sample is depends on the mode: every backend dial
+// contributes its connect time (and TLS handshake, with backend TLS), and in
+// HTTP and gRPC modes every request or RPC contributes its duration as well.
+// A backend that gets no traffic, typically because its cost is high, gets no
+// samples either; the decay loop brings its average down towards zero so it
+// is tried again and can prove it recovered.
+
+// DefaultEWMADecay is the -ewma-decay default, Finagle's.
+const DefaultEWMADecay = 10 * time.Second
+
+// unmeasuredPenalty is the cost, in seconds, of a busy backend that has no
+// samples yet: it has connections in flight but no known latency, so it
+// shouldn't win against a measured one.
+const unmeasuredPenalty = 1e6
+
+type peakEWMA struct {
+	value float64   // seconds
+	stamp time.Time // of the last sample or decay
+}
+
+// observe folds a sample of d taken at now into the average.
+func (e *peakEWMA) observe(d time.Duration, now time.Time, decay time.Duration) {
+	rtt := d.Seconds()
+	if e.stamp.IsZero() || rtt > e.value {
+		e.value = rtt
+	} else {
+		w := math.Exp(-float64(max(now.Sub(e.stamp), 0)) / float64(decay))
+		e.value = e.value*w + rtt*(1-w)
+	}
+	e.stamp = now
+}
+
+// decay moves the average towards zero for the time since the last sample.
+func (e *peakEWMA) decay(now time.Time, decay time.Duration) {
+	if e.stamp.IsZero() {
+		return
+	}
+	e.value *= math.Exp(-float64(max(now.Sub(e.stamp), 0)) / float64(decay))
+	e.stamp = now
+}
+
+// peakEWMACost is b's load as p2c sees it: its latency average scaled by the
+// connections it already has in flight.
+func peakEWMACost(b *Backend) float64 {
+	if b.rtt.value == 0 && b.ActiveConns > 0 {
+		return unmeasuredPenalty + float64(b.ActiveConns)
+	}
+	return b.rtt.value * float64(b.ActiveConns+1)
+}
+
+// observeRTT feeds a latency sample for b into its average. Callers must
+// hold lb.mu.
+func (lb *LB) observeRTT(b *Backend, d time.Duration) {
+	b.rtt.observe(d, lb.clock.Now(), lb.cfg.EWMADecay)
+}
+
+// decayRTT runs until shutdown, decaying the average of every backend that
+// went a whole tick without a sample.
+func (lb *LB) decayRTT() {
+	interval := max(lb.cfg.EWMADecay/10, 100*time.Millisecond)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lb.stopping:
+			return
+		case <-ticker.C:
+		}
+		now := lb.clock.Now()
+		lb.mu.Lock()
+		for _, b := range lb.allBackendsLocked() {
+			if now.Sub(b.rtt.stamp) >= interval {
+				b.rtt.decay(now, lb.cfg.EWMADecay)
+			}
+		}
+		lb.mu.Unlock()
+	}
+}
+
+// writePeakEWMA writes every backend's average in the Prometheus text format.
+func (lb *LB) writePeakEWMA(w io.Writer) {
+	const name = "lb_backend_peak_ewma_seconds"
+	fmt.Fprintf(w, "# HELP %s Peak-EWMA latency of a backend, the cost p2c compares.\n", name)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	for _, b := range lb.allBackendsLocked() {
+		fmt.Fprintf(w, "%s{backend=%q,id=%q} %g\n", name, b.String(), b.ID, b.rtt.value)
+	}
+}
+
+// ---------------------- Peak-EWMA P2C Strategy ----------------------
+// power of two choices: draw two available backends at random and take the
+// cheaper by peakEWMACost, so a backend that is slow or already busy loses
+// most draws without the whole pool herding onto whichever one looks best
+// right now, as a strict minimum would. Weights are ignored, like lc. A
+// backend with no samples and nothing in flight costs nothing, so new
+// backends are tried straight away.
+
+type P2CStrategy struct {
+	Backends []*Backend // sorted by address, so a -seed run doesn't depend on pool order
+	rng      *Rand
+}
+
+// NewP2CStrategy draws from cfg.Rand, or a clock-seeded Rand when unset.
+func NewP2CStrategy(backends []*Backend, cfg StrategyConfig) *P2CStrategy {
+	rng := cfg.Rand
+	if rng == nil {
+		rng = NewRand(0)
+	}
+	s := &P2CStrategy{rng: rng}
+	s.Init(backends)
+	return s
+}
+
+func (s *P2CStrategy) Init(backends []*Backend) {
+	s.Backends = slices.Clone(backends)
+	slices.SortFunc(s.Backends, func(a, b *Backend) int { return strings.Compare(a.String(), b.String()) })
+}
+
+func (s *P2CStrategy) RegisterBackend(backend *Backend) {
+	s.Init(append(s.Backends, backend))
+}
+
+func (s *P2CStrategy) GetNextBackend(_ IncomingReq) (*Backend, error) {
+	if len(s.Backends) == 0 {
+		return nil, ErrNoBackends
+	}
+	var up []*Backend
+	for _, b := range s.Backends {
+		if b.Available() {
+			up = append(up, b)
+		}
+	}
+	switch len(up) {
+	case 0:
+		return nil, ErrAllUnhealthy
+	case 1:
+		return up[0], nil
+	}
+	i := s.rng.Intn(len(up))
+	j := s.rng.Intn(len(up) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := up[i], up[j]
+	ca, cb := peakEWMACost(a), peakEWMACost(b)
+	if cb < ca || (cb == ca && tieBefore(b, a)) {
+		return b, nil
+	}
+	return a, nil
+}
+
+func (s *P2CStrategy) PrintTopology() {
+	for i, b := range s.Backends {
+		fmt.Printf("[%d] %-20s ewma=%-9s conns=%-4d cost=%.4g\n", i, b, fmtSeconds(b.rtt.value), b.ActiveConns, peakEWMACost(b))
+	}
+}
+
+// fmtSeconds renders a peak-EWMA value for humans.
+func fmtSeconds(s float64) string {
+	return time.Duration(s * float64(time.Second)).Round(10 * time.Microsecond).String()
+}
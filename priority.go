@@ -0,0 +1,89 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"slices"
+)
+
+// ---------------------- Priority Tiers ----------------------
+// backends carry a priority (0, the default, is the highest) and every
+// request goes to the highest tier that still has an available backend, spread
+// inside the tier by smooth weighted round robin. When every tier-0 backend is
+// down, disabled or weighted 0, traffic fails over to tier 1, and it fails
+// back as soon as one of them recovers. Each tier keeps its own rotation, so a
+// failover and back doesn't restart it.
+
+type PriorityStrategy struct {
+	Backends []*Backend
+	tiers    []priorityTier // by priority, highest (lowest number) first
+}
+
+type priorityTier struct {
+	priority int
+	wrr      *SmoothWRRStrategy
+}
+
+func NewPriorityStrategy(backends []*Backend, _ StrategyConfig) *PriorityStrategy {
+	s := &PriorityStrategy{}
+	s.Init(backends)
+	return s
+}
+
+// Init regroups the pool by priority, keeping the rotation of tiers that
+// survive.
+func (s *PriorityStrategy) Init(backends []*Backend) {
+	s.Backends = backends
+	byPrio := make(map[int][]*Backend)
+	for _, b := range backends {
+		byPrio[b.Priority] = append(byPrio[b.Priority], b)
+	}
+	old := s.tiers
+	s.tiers = s.tiers[:0:0]
+	for p, members := range byPrio {
+		t := priorityTier{priority: p}
+		if i := slices.IndexFunc(old, func(t priorityTier) bool { return t.priority == p }); i >= 0 {
+			t.wrr = old[i].wrr
+			t.wrr.Init(members)
+		} else {
+			t.wrr = NewSmoothWRRStrategy(members, StrategyConfig{})
+		}
+		s.tiers = append(s.tiers, t)
+	}
+	slices.SortFunc(s.tiers, func(a, b priorityTier) int { return a.priority - b.priority })
+}
+
+func (s *PriorityStrategy) RegisterBackend(backend *Backend) {
+	s.Init(append(s.Backends, backend))
+}
+
+func (s *PriorityStrategy) GetNextBackend(req IncomingReq) (*Backend, error) {
+	if len(s.Backends) == 0 {
+		return nil, ErrNoBackends
+	}
+	for _, t := range s.tiers {
+		if b, err := t.wrr.GetNextBackend(req); err == nil {
+			return b, nil
+		}
+	}
+	return nil, ErrAllUnhealthy
+}
+
+// PrintTopology lists the tiers in order and marks the one taking traffic.
+func (s *PriorityStrategy) PrintTopology() {
+	active := true
+	for _, t := range s.tiers {
+		up := slices.ContainsFunc(t.wrr.Backends, func(b *Backend) bool { return b.Available() && b.Weight > 0 })
+		mark := ""
+		switch {
+		case up && active:
+			mark = " <- active"
+			active = false
+		case !up:
+			mark = " (down)"
+		}
+		fmt.Printf("tier %d%s\n", t.priority, mark)
+		for _, b := range t.wrr.Backends {
+			fmt.Printf("  %-20s w=%-3d\n", b, b.Weight)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------------- PROXY Protocol ----------------------
+// a spliced connection reaches the backend from the LB's address, so the
+// backend never sees who the client is. With -proxy-protocol v1 (text) or v2
+// (binary) every backend connection opened for a client starts with a PROXY
+// protocol header, as specified by HAProxy, naming the client's address and
+// the LB address it connected to; nginx, HAProxy, Envoy and many other servers
+// can be set up to read it. The header goes out before the TLS handshake when
+// backend TLS is on. A client on a Unix socket listener gets v1's UNKNOWN or
+// v2's UNSPEC header, which tells the backend to use the connection's own
+// addresses. Health checks send no header, so a backend that insists on one
+// needs -hc-mode tcp or a separate check port. In grpc mode backend
+// connections are shared by many clients, so there the option is rejected.
+
+// -proxy-protocol versions
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+// proxyV2Signature opens every v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// v2 header fields
+const (
+	proxyV2Proxy  = 0x21 // version 2, command PROXY
+	proxyV2Unspec = 0x00
+	proxyV2TCP4   = 0x11
+	proxyV2TCP6   = 0x21
+)
+
+// proxyHeader builds the version header describing client, whose peer is
+// the source and whose local address the destination.
+func proxyHeader(version string, client net.Conn) []byte {
+	src, sok := client.RemoteAddr().(*net.TCPAddr)
+	dst, dok := client.LocalAddr().(*net.TCPAddr)
+	known := sok && dok
+	srcIP, dstIP := net.IP(nil), net.IP(nil)
+	v4 := false
+	if known {
+		srcIP, dstIP = src.IP.To4(), dst.IP.To4()
+		v4 = srcIP != nil && dstIP != nil
+		if !v4 {
+			// a dual-stack listener may report one side mapped, the other not
+			srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+			known = srcIP != nil && dstIP != nil
+		}
+	}
+
+	if version == ProxyProtocolV1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP6"
+		if v4 {
+			family = "TCP4"
+		}
+		return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, src.Port, dst.Port)
+	}
+
+	h := append([]byte(nil), proxyV2Signature...)
+	if !known {
+		return append(h, proxyV2Proxy, proxyV2Unspec, 0, 0)
+	}
+	family := byte(proxyV2TCP6)
+	if v4 {
+		family = proxyV2TCP4
+	}
+	h = append(h, proxyV2Proxy, family)
+	h = binary.BigEndian.AppendUint16(h, uint16(2*len(srcIP)+4))
+	h = append(h, srcIP...)
+	h = append(h, dstIP...)
+	h = binary.BigEndian.AppendUint16(h, uint16(src.Port))
+	return binary.BigEndian.AppendUint16(h, uint16(dst.Port))
+}
+
+// ---------------------- Accepting PROXY Protocol ----------------------
+// behind another proxy every connection comes from that proxy's address. A
+// listener with the proxy option (-listen :9090,proxy) expects each
+// connection to start with a PROXY protocol header, v1 or v2, and from then
+// on reports the client the header names as the connection's peer, so -key
+// ip and ipport hash the real client, -max-conns-per-ip counts it, the
+// request log shows it and -proxy-protocol passes it on. The header is read
+// before TLS, and a connection without a valid one within proxyHeaderTimeout
+// is closed. Only put the option on listeners that nothing but the trusted
+// proxy can reach: anyone else could claim any address.
+
+// proxyHeaderTimeout bounds the wait for a connection's PROXY header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV1MaxLen is the longest v1 header line the spec allows, CRLF included.
+const proxyV1MaxLen = 107
+
+// proxyListener wraps the accepted connections of a proxy listener.
+type proxyListener struct{ net.Listener }
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c, br: bufio.NewReader(c)}, nil
+}
+
+// proxyConn reads its PROXY header the first time it is read from or asked
+// for an address; until then it has no client to report.
+type proxyConn struct {
+	net.Conn
+	br       *bufio.Reader
+	once     sync.Once
+	err      error
+	src, dst net.Addr // from the header; nil = the connection's own
+}
+
+// readHeader consumes the header, once; the error stays with the connection.
+func (c *proxyConn) readHeader() error {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.src, c.dst, c.err = parseProxyHeader(c.br)
+		_ = c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.err = fmt.Errorf("proxy protocol header from %s: %w", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+	return c.err
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+	return c.br.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.readHeader() == nil && c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.readHeader() == nil && c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
+
+// proxyConnOf is c's proxyConn, under TLS if need be; nil when c wasn't
+// accepted by a proxy listener.
+func proxyConnOf(c net.Conn) *proxyConn {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	pc, _ := c.(*proxyConn)
+	return pc
+}
+
+// parseProxyHeader reads a v1 or v2 header from br and returns the addresses
+// it names; both are nil for UNKNOWN, LOCAL and non-TCP headers, which leave
+// the connection's own.
+func parseProxyHeader(br *bufio.Reader) (src, dst net.Addr, err error) {
+	sig, err := br.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case bytes.Equal(sig, proxyV2Signature):
+		return parseProxyV2(br)
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		return parseProxyV1(br)
+	}
+	return nil, nil, fmt.Errorf("missing")
+}
+
+func parseProxyV1(br *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyV1MaxLen {
+			return nil, nil, fmt.Errorf("v1 line too long")
+		}
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, c)
+	}
+	f := strings.Fields(string(line))
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed v1 line %q", strings.TrimSpace(string(line)))
+	}
+	addr := func(ip, port string) (*net.TCPAddr, bool) {
+		a := net.ParseIP(ip)
+		p, err := strconv.ParseUint(port, 10, 16)
+		// TCP4 takes dotted quads only; TCP6 any IPv6 form, IPv4-mapped
+		// included, as dual-stack proxies send
+		family := a != nil && strings.Contains(ip, ":") == (f[1] == "TCP6")
+		return &net.TCPAddr{IP: a, Port: int(p)}, family && err == nil
+	}
+	s, sok := addr(f[2], f[4])
+	d, dok := addr(f[3], f[5])
+	if !sok || !dok {
+		return nil, nil, fmt.Errorf("malformed v1 line %q", strings.TrimSpace(string(line)))
+	}
+	return s, d, nil
+}
+
+func parseProxyV2(br *bufio.Reader) (src, dst net.Addr, err error) {
+	var head [16]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		return nil, nil, err
+	}
+	verCmd, family := head[12], head[13]
+	body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case verCmd>>4 != 2:
+		return nil, nil, fmt.Errorf("unsupported version %d", verCmd>>4)
+	case verCmd == 0x20: // LOCAL: the proxy's own connection, e.g. a health check
+		return nil, nil, nil
+	case verCmd != proxyV2Proxy:
+		return nil, nil, fmt.Errorf("unsupported command %d", verCmd&0xf)
+	}
+	n := 0
+	switch family {
+	case proxyV2TCP4:
+		n = net.IPv4len
+	case proxyV2TCP6:
+		n = net.IPv6len
+	default:
+		return nil, nil, nil // UDP, Unix or unspecified: nothing to report
+	}
+	if len(body) < 2*n+4 {
+		return nil, nil, fmt.Errorf("short v2 address block")
+	}
+	s := &net.TCPAddr{IP: net.IP(body[:n]), Port: int(binary.BigEndian.Uint16(body[2*n:]))}
+	d := &net.TCPAddr{IP: net.IP(body[n : 2*n]), Port: int(binary.BigEndian.Uint16(body[2*n+2:]))}
+	return s, d, nil
+}
@@ -0,0 +1,43 @@
+package loadbalancer
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ---------------------- Seedable RNG ----------------------
+// every random choice (random strategies, simulate keys) draws from the LB's
+// single Rand so a fixed -seed reproduces a run exactly. *rand.Rand isn't safe
+// for concurrent use, hence the mutex.
+
+type Rand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+// NewRand seeds from the clock when seed is 0.
+func NewRand(seed int64) *Rand {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &Rand{r: rand.New(rand.NewSource(seed))}
+}
+
+func (r *Rand) Intn(n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.r.Intn(n)
+}
+
+func (r *Rand) Float64() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.r.Float64()
+}
+
+func (r *Rand) Uint64() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.r.Uint64()
+}
@@ -0,0 +1,154 @@
+package loadbalancer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"slices"
+)
+
+// ---------------------- Config Reload ----------------------
+// SIGHUP re-reads -config and applies the difference to the main pool without
+// a restart: backends that appeared are added, vanished ones removed, and
+// weight, TLS, disabled and drain flags updated in place, so unchanged backends
+// keep their IDs, counters and ring positions. Draining a backend this way
+// (drain: true) stops new traffic to it while its open connections finish;
+// dropping the flag resumes it. Under -dns-refresh hostname entries are
+// matched as names (see dns.go). Groups are only read at startup.
+
+// reload applies the config file to the running LB and reports the remap.
+func (lb *LB) reload() error {
+	if lb.cfg.ConfigFile == "" {
+		return fmt.Errorf("reload: no -config file")
+	}
+	fc, err := LoadFileConfig(lb.cfg.ConfigFile)
+	if err != nil {
+		return fmt.Errorf("reload: %w", err)
+	}
+	if len(fc.Backends) == 0 && len(fc.Groups) == 0 && !lb.cfg.AllowEmpty {
+		return fmt.Errorf("reload: %s: no backends configured; keeping the current pool", lb.cfg.ConfigFile)
+	}
+
+	// load the backends' own TLS files before touching the pool
+	ownTLS := make(map[string]*tls.Config)
+	for _, bc := range fc.Backends {
+		if bc.TLS == nil {
+			continue
+		}
+		if lb.cfg.Mode == ModeGRPC && bc.TLS.Enabled {
+			return fmt.Errorf("reload: backend %s: backend TLS is not supported in grpc mode", bc.addr())
+		}
+		if ownTLS[bc.addr()], err = backendTLSFor(bc, lb.backendTLS); err != nil {
+			return fmt.Errorf("reload: %w", err)
+		}
+	}
+
+	literal, names := fc.Backends, []BackendConfig(nil)
+	if lb.discovering() {
+		literal = nil
+		for _, bc := range fc.Backends {
+			if isDNSName(bc) {
+				names = append(names, bc)
+			} else {
+				literal = append(literal, bc)
+			}
+		}
+	}
+
+	lb.mu.Lock()
+	before := lb.remapSnapLocked()
+	changes := lb.applyPoolLocked(literal, ownTLS)
+	nameChanges, added := lb.setNamesLocked(names, ownTLS)
+	changes = append(changes, nameChanges...)
+	name, _ := canonicalStrategy(fc.Strategy)
+	if name != lb.strategyName {
+		_ = lb.setStrategyLocked(name) // LoadFileConfig checked the name
+		changes = append(changes, "strategy "+name)
+		lb.publish(StateEvent{Kind: StateStrategyChanged, Detail: name})
+	} else {
+		lb.strategy.Init(lb.backends)
+	}
+	after := lb.remapSnapLocked()
+	lb.mu.Unlock()
+
+	if len(changes) == 0 {
+		log.Printf("reload: %s unchanged", lb.cfg.ConfigFile)
+		return nil
+	}
+	for _, c := range changes {
+		log.Printf("reload: %s", c)
+	}
+	lb.reportRemap("RELOAD", before, after)
+	for _, n := range added {
+		go lb.refreshName(n)
+	}
+	return nil
+}
+
+// applyPoolLocked makes lb.backends match bcs and describes each change;
+// ownTLS has the loaded TLS config of every backend with a tls block.
+// Callers must hold lb.mu.
+func (lb *LB) applyPoolLocked(bcs []BackendConfig, ownTLS map[string]*tls.Config) []string {
+	var changes []string
+	keep := make([]*Backend, 0, len(bcs))
+	for _, bc := range bcs {
+		b := lb.findBackendLocked(bc.addr())
+		if b == nil {
+			b, _ = lb.newBackend(BackendConfig{ID: bc.ID, Host: bc.Host, Port: bc.Port, Path: bc.Path, Weight: bc.Weight, Priority: bc.Priority, Zone: bc.Zone, HealthCheck: bc.HealthCheck, TLS: bc.TLS}) // checked by LoadFileConfig
+			b.tls = lb.backendTLS
+			if bc.TLS != nil {
+				b.tls = ownTLS[bc.addr()]
+			}
+			lb.beginSlowStartLocked(b)
+			changes = append(changes, "added "+b.Label())
+			lb.publishBackend(StateBackendAdded, b, "")
+		} else if b.Weight != bc.Weight {
+			changes = append(changes, fmt.Sprintf("%s weight %d -> %d", b.Label(), b.Weight, bc.Weight))
+			b.Weight = bc.Weight
+		}
+		if b.Priority != bc.Priority {
+			changes = append(changes, fmt.Sprintf("%s priority %d -> %d", b.Label(), b.Priority, bc.Priority))
+			b.Priority = bc.Priority
+		}
+		if b.Zone != bc.Zone {
+			changes = append(changes, fmt.Sprintf("%s zone %q -> %q", b.Label(), b.Zone, bc.Zone))
+			b.Zone = bc.Zone
+		}
+		if !sameHealthCheck(b.healthCheck, bc.HealthCheck) {
+			changes = append(changes, b.Label()+" health check")
+			b.healthCheck = bc.HealthCheck
+		}
+		if !sameBackendTLS(b.tlsConfig, bc.TLS) {
+			changes = append(changes, b.Label()+" tls")
+			b.tlsConfig, b.tls = bc.TLS, lb.backendTLS
+			if bc.TLS != nil {
+				b.tls = ownTLS[bc.addr()]
+			}
+		}
+		if b.Draining != bc.Drain {
+			b.Draining = bc.Drain
+			changes = append(changes, fmt.Sprintf("%s draining=%t", b.Label(), b.Draining))
+		}
+		if b.AdminDisabled != bc.Disabled {
+			b.AdminDisabled = bc.Disabled
+			changes = append(changes, fmt.Sprintf("%s disabled=%t", b.Label(), b.AdminDisabled))
+			if b.AdminDisabled {
+				lb.publishBackend(StateBackendDisabled, b, "")
+			} else {
+				lb.publishBackend(StateBackendEnabled, b, "")
+			}
+		}
+		keep = append(keep, b)
+	}
+	for _, b := range lb.backends {
+		if b.Name != "" && !slices.Contains(keep, b) {
+			keep = append(keep, b) // its name's, see setNamesLocked
+		} else if !slices.Contains(keep, b) {
+			lb.forgetBackendLocked(b)
+			changes = append(changes, "removed "+b.Label())
+			lb.publishBackend(StateBackendRemoved, b, "")
+		}
+	}
+	lb.backends = keep
+	return changes
+}
@@ -0,0 +1,89 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"log"
+	"sort"
+)
+
+// ---------------------- Remap Sampling ----------------------
+// the twelve demo keys make a readable per-key log of a topology change but a
+// poor estimate of real churn. With -remap-sample N the control loop also maps
+// N fixed synthetic keys before and after every add/remove/strategy change
+// and reports only aggregates for them: the moved fraction (which then feeds
+// lb_rebalance_moved_fraction instead of the demo keys) and the backends that
+// gained and lost the most keys.
+
+// remapSnap is the key->backend picture on one side of a topology change.
+type remapSnap struct {
+	demo   map[string]string
+	sample []string // backend address per lb.sampleKeys[i]
+}
+
+// sampleKeys returns the n fixed keys of -remap-sample; they must not change
+// between the before and after snapshots, so they are generated once.
+func sampleKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("remap-%d", i)
+	}
+	return keys
+}
+
+// remapSnapLocked maps the demo keys and the sample. Callers must hold lb.mu.
+func (lb *LB) remapSnapLocked() remapSnap {
+	snap := remapSnap{demo: lb.snapshotLocked()}
+	if len(lb.sampleKeys) > 0 {
+		snap.sample = make([]string, len(lb.sampleKeys))
+		for i, k := range lb.sampleKeys {
+			snap.sample[i] = "<nil>"
+			if b, err := lb.strategy.GetNextBackend(lookupReq(k)); err == nil {
+				snap.sample[i] = b.String()
+			}
+		}
+	}
+	return snap
+}
+
+// reportRemap logs a topology change per demo key and, with a sample, in
+// aggregate, and records its moved fraction.
+func (lb *LB) reportRemap(what string, before, after remapSnap) {
+	lb.printRemap(what, before.demo, after.demo)
+	if len(after.sample) == 0 {
+		lb.recordRemap(what, before.demo, after.demo)
+		return
+	}
+
+	moved := 0
+	delta := make(map[string]int) // keys gained (+) or lost (-) per backend
+	for i, a := range after.sample {
+		if b := before.sample[i]; b != a {
+			moved++
+			delta[b]--
+			delta[a]++
+		}
+	}
+	n := len(after.sample)
+	lb.remaps.Observe(what, float64(moved)/float64(n))
+	log.Printf("sample: moved=%d/%d keys (%.2f%%)", moved, n, 100*float64(moved)/float64(n))
+	if moved == 0 {
+		return
+	}
+
+	// sorted so ties resolve the same way on every run
+	addrs := make([]string, 0, len(delta))
+	for a := range delta {
+		addrs = append(addrs, a)
+	}
+	sort.Strings(addrs)
+	gainer, loser := addrs[0], addrs[0]
+	for _, a := range addrs {
+		if delta[a] > delta[gainer] {
+			gainer = a
+		}
+		if delta[a] < delta[loser] {
+			loser = a
+		}
+	}
+	log.Printf("sample: most gained %s (%+d), most lost %s (%+d)", gainer, delta[gainer], loser, delta[loser])
+}
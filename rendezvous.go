@@ -0,0 +1,95 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"math"
+)
+
+// ---------------------- Rendezvous (HRW) Hashing ----------------------
+// highest random weight: every backend scores the key with a hash of the key
+// and its address, and the highest score wins. Nothing is precomputed, so a
+// pool change moves exactly the keys won or lost by the changed backend, and
+// a down backend's keys each go to their runner-up, spread over the rest.
+// Weights use the logarithmic method: score = -weight / ln(u), u being the
+// hash mapped into (0, 1), which gives every backend a share of keys
+// proportional to its weight. Weight 0 backends get no keys unless every
+// weight is 0. Each pick costs one hash per backend.
+
+type RendezvousStrategy struct {
+	Backends []*Backend
+	hasher   Hasher
+}
+
+// NewRendezvousStrategy scores with cfg.Hasher, or truncated SHA-256 when
+// unset.
+func NewRendezvousStrategy(backends []*Backend, cfg StrategyConfig) *RendezvousStrategy {
+	h := cfg.Hasher
+	if h == nil {
+		h = SHA256Hasher{}
+	}
+	s := &RendezvousStrategy{hasher: h}
+	s.Init(backends)
+	return s
+}
+
+func (s *RendezvousStrategy) Init(backends []*Backend) {
+	s.Backends = backends
+}
+
+func (s *RendezvousStrategy) RegisterBackend(backend *Backend) {
+	s.Backends = append(s.Backends, backend)
+}
+
+func (s *RendezvousStrategy) GetNextBackend(req IncomingReq) (*Backend, error) {
+	if len(s.Backends) == 0 {
+		return nil, ErrNoBackends
+	}
+	b := s.pick(req.key, func(b *Backend) int { return max(b.Weight, 0) })
+	if b == nil {
+		// every available backend has weight 0: score them equally
+		b = s.pick(req.key, func(*Backend) int { return 1 })
+	}
+	if b == nil {
+		return nil, ErrAllUnhealthy
+	}
+	return b, nil
+}
+
+// pick returns the available backend scoring key highest, nil if none has a
+// positive weight.
+func (s *RendezvousStrategy) pick(key string, weight func(*Backend) int) *Backend {
+	var best *Backend
+	bestScore := 0.0
+	for _, b := range s.Backends {
+		w := weight(b)
+		if !b.Available() || w == 0 {
+			continue
+		}
+		score := s.score(key, b, w)
+		if best == nil || score > bestScore || (score == bestScore && tieBefore(b, best)) {
+			best, bestScore = b, score
+		}
+	}
+	return best
+}
+
+func (s *RendezvousStrategy) score(key string, b *Backend, weight int) float64 {
+	u := (float64(s.hasher.Sum32(key+"|"+b.String())) + 0.5) / (1 << 32)
+	return -float64(weight) / math.Log(u)
+}
+
+// PrintTopology lists the backends with the share of keys their weight
+// entitles them to.
+func (s *RendezvousStrategy) PrintTopology() {
+	total := 0
+	for _, b := range s.Backends {
+		total += max(b.Weight, 0)
+	}
+	for i, b := range s.Backends {
+		share := 0.0
+		if total > 0 {
+			share = 100 * float64(max(b.Weight, 0)) / float64(total)
+		}
+		fmt.Printf("[%d] %-20s w=%-3d (%.1f%%)\n", i, b, b.Weight, share)
+	}
+}
@@ -0,0 +1,123 @@
+package loadbalancer
+
+import (
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ---------------------- Retries ----------------------
+// a backend that refuses the connection has seen nothing of the request yet,
+// so with -retries N the LB dials up to N other available backends of the same
+// pool before giving up. Retries draw from one budget shared by all requests:
+// every request adds -retry-budget tokens (0.1 = retries may add at most ~10%
+// load), every retry spends one, and the bucket never holds more than
+// retryBudgetBurst. When a whole pool is failing the budget runs dry and
+// requests fail fast instead of multiplying the load on it. Under a strategy
+// that ranks replicas (ReplicaStrategy: consistent hashing walks the ring)
+// the retries go down that list, so a key fails over to the backend it would
+// move to anyway; otherwise the key is rehashed over the untried backends.
+
+// retryBudgetBurst caps the saved-up tokens, and is also the starting balance
+// so a fresh LB can retry at all.
+const retryBudgetBurst = 10
+
+type retryBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	tokens float64
+}
+
+func newRetryBudget(ratio float64) *retryBudget {
+	return &retryBudget{ratio: ratio, tokens: retryBudgetBurst}
+}
+
+// deposit credits one request.
+func (rb *retryBudget) deposit() {
+	rb.mu.Lock()
+	rb.tokens = min(rb.tokens+rb.ratio, retryBudgetBurst)
+	rb.mu.Unlock()
+}
+
+// withdraw spends a token for one retry; false means the budget is exhausted.
+func (rb *retryBudget) withdraw() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if rb.tokens < 1 {
+		return false
+	}
+	rb.tokens--
+	return true
+}
+
+// dialWithRetries dials b and, while that fails and both -retries and the
+// budget allow, other backends. It returns the backend it ended up on.
+func (lb *LB) dialWithRetries(req IncomingReq, b *Backend) (*Backend, net.Conn, error) {
+	conn, err := lb.timedDial(req.srcConn, b)
+	tried := []*Backend{b}
+	for attempt := 0; err != nil && attempt < lb.cfg.Retries; attempt++ {
+		lb.mu.Lock()
+		next, perr := lb.nextReplicaLocked(req, tried)
+		lb.mu.Unlock()
+		if perr != nil {
+			break
+		}
+		if !lb.retryBudget.withdraw() {
+			lb.retriesDenied.Add(1)
+			log.Printf("req %s: %s: %s; retry budget exhausted, giving up", req.reqId, b.Label(), err)
+			break
+		}
+		lb.retries.Add(1)
+		log.Printf("req %s: %s: %s; retrying on %s", req.reqId, b.Label(), err, next.Label())
+		b = next
+		tried = append(tried, b)
+		conn, err = lb.timedDial(req.srcConn, b)
+	}
+	return b, conn, err
+}
+
+// timedDial dials b for client, feeding the connect time into its peak-EWMA and outlier
+// detection when it succeeds and the failure into passive health when it
+// doesn't.
+func (lb *LB) timedDial(client net.Conn, b *Backend) (net.Conn, error) {
+	start := time.Now()
+	conn, err := lb.dialBackendFor(client, b)
+	if err != nil {
+		lb.recordFailure(b, err.Error())
+		return nil, err
+	}
+	lb.mu.Lock()
+	d := time.Since(start)
+	lb.observeRTT(b, d)
+	lb.outlierConnectLocked(b, d)
+	lb.mu.Unlock()
+	return conn, nil
+}
+
+// nextReplicaLocked picks the backend to retry req on after tried failed.
+// Callers must hold lb.mu.
+func (lb *LB) nextReplicaLocked(req IncomingReq, tried []*Backend) (*Backend, error) {
+	first := tried[0]
+	if rs, ok := lb.strategyOfLocked(first).(ReplicaStrategy); ok {
+		for _, c := range rs.GetBackends(req, len(tried)+1) {
+			if !slices.Contains(tried, c) {
+				return c, nil
+			}
+		}
+	}
+	return rehash(req, lb.retryCandidatesLocked(first, tried))
+}
+
+// retryCandidatesLocked are the available backends of b's pool not yet tried.
+// Callers must hold lb.mu.
+func (lb *LB) retryCandidatesLocked(b *Backend, tried []*Backend) []*Backend {
+	var out []*Backend
+	for _, c := range lb.poolOfLocked(b) {
+		if c.Available() && !slices.Contains(tried, c) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
@@ -0,0 +1,60 @@
+package loadbalancer
+
+import (
+	"io"
+	"testing"
+)
+
+func TestRetryBudgetRefillsByRatio(t *testing.T) {
+	rb := newRetryBudget(0.1)
+	spent := 0
+	for range 1000 {
+		rb.deposit()
+		for rb.withdraw() {
+			spent++
+		}
+	}
+	// the starting burst plus a tenth of a token per request
+	if want := retryBudgetBurst + 100; spent > want || spent < want-1 {
+		t.Fatalf("%d retries allowed over 1000 requests, want about %d", spent, want)
+	}
+
+	rb = newRetryBudget(0.1)
+	for range 1000 {
+		rb.deposit()
+	}
+	if rb.tokens != retryBudgetBurst {
+		t.Fatalf("%.1f tokens saved up, want at most %d", rb.tokens, retryBudgetBurst)
+	}
+}
+
+func TestRetryBudgetCapsRetriesUnderFlood(t *testing.T) {
+	var backends []BackendConfig
+	for range 5 {
+		backends = append(backends, backendAt(t, freeAddr(t))) // refuses connections
+	}
+	cfg := testConfig(t, backends...)
+	cfg.Strategy = "rr"
+	cfg.Retries = 3
+	cfg.RetryBudget = 0.1
+	cfg.PassiveFailThreshold = 0 // keep the failing backends in rotation
+	lb := newTestLB(t, cfg)
+	startLB(t, lb)
+
+	const requests = 100
+	for range requests {
+		c := dialLB(t, lb)
+		_, _ = io.ReadAll(c)
+		_ = c.Close()
+	}
+	eventually(t, "every request to be counted", func() bool {
+		return lb.retries.Load()+lb.retriesDenied.Load() >= requests
+	})
+	// without the budget each request would retry 3 times
+	if n, limit := lb.retries.Load(), int64(retryBudgetBurst+requests/10); n > limit {
+		t.Fatalf("%d retries for %d failing requests, want at most %d", n, requests, limit)
+	}
+	if lb.retriesDenied.Load() == 0 {
+		t.Fatal("no retry denied by the budget")
+	}
+}
@@ -0,0 +1,11 @@
+package loadbalancer
+
+import "golang.org/x/sys/unix"
+
+// reusePortSupported: Linux spreads new connections across every socket
+// bound with SO_REUSEPORT on the same address.
+const reusePortSupported = true
+
+func setReusePort(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package loadbalancer
+
+import "errors"
+
+// reusePortSupported is false where SO_REUSEPORT is missing or, as on the
+// BSDs and macOS, doesn't balance connections across the sockets sharing a
+// port; -acceptors then falls back to one listener.
+const reusePortSupported = false
+
+func setReusePort(uintptr) error {
+	return errors.New("SO_REUSEPORT load balancing is not supported on this platform")
+}
@@ -0,0 +1,57 @@
+package loadbalancer
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// ---------------------- Graceful Shutdown ----------------------
+// on exit (command or SIGTERM/SIGINT) the listeners close first, then the
+// connections already in flight get up to -shutdown-grace to finish before
+// they are closed forcibly. Shutdown (and Done) wait for that.
+
+// drainPoll is how often drain re-checks the live connection set.
+const drainPoll = 100 * time.Millisecond
+
+func (lb *LB) trackConn(c net.Conn) {
+	lb.connsMu.Lock()
+	lb.conns[c] = struct{}{}
+	lb.connsMu.Unlock()
+}
+
+func (lb *LB) untrackConn(c net.Conn) {
+	lb.connsMu.Lock()
+	delete(lb.conns, c)
+	lb.connsMu.Unlock()
+}
+
+func (lb *LB) liveConns() int {
+	lb.connsMu.Lock()
+	defer lb.connsMu.Unlock()
+	return len(lb.conns)
+}
+
+// drain waits up to grace for tracked client connections to finish, then
+// closes whatever is left.
+func (lb *LB) drain(grace time.Duration) {
+	start := lb.liveConns()
+	if start == 0 {
+		log.Println("drain: no connections in flight")
+		return
+	}
+	log.Printf("drain: waiting up to %s for %d connections", grace, start)
+
+	deadline := time.Now().Add(grace)
+	for lb.liveConns() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPoll)
+	}
+
+	lb.connsMu.Lock()
+	forced := len(lb.conns)
+	for c := range lb.conns {
+		_ = c.Close()
+	}
+	lb.connsMu.Unlock()
+	log.Printf("drain: %d drained, %d force-closed", start-forced, forced)
+}
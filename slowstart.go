@@ -0,0 +1,60 @@
+package loadbalancer
+
+import "time"
+
+// ---------------------- Slow Start ----------------------
+// with -slow-start, a backend added at runtime (`add`, or a reload that adds
+// it) doesn't take its full share at once: its share ramps linearly from 0 to
+// full over the window, so a cold cache or JIT isn't hit by a wall of
+// traffic. It works on the strategy's pick, whatever the strategy: a
+// ramping backend accepts a key only while hash(key, backend) falls under the
+// elapsed fraction of the window, and other keys are hashed onto the rest of
+// the pool as if it were disabled. So a key, once moved over, stays moved
+// for the rest of the ramp. Backends present at startup start at full
+// weight. Groups have no runtime adds and never ramp.
+
+// beginSlowStartLocked starts b's ramp, if -slow-start is on. Callers must
+// hold lb.mu.
+func (lb *LB) beginSlowStartLocked(b *Backend) {
+	if lb.cfg.SlowStart > 0 {
+		b.slowStartAt = lb.clock.Now()
+	}
+}
+
+// slowStartShare is the fraction of its share b takes at now, 1 once its ramp
+// is over.
+func (lb *LB) slowStartShare(b *Backend, now time.Time) float64 {
+	if lb.cfg.SlowStart <= 0 || b.slowStartAt.IsZero() {
+		return 1
+	}
+	share := float64(now.Sub(b.slowStartAt)) / float64(lb.cfg.SlowStart)
+	if share >= 1 {
+		b.slowStartAt = time.Time{} // done; skip the arithmetic from now on
+		return 1
+	}
+	return max(share, 0)
+}
+
+// slowStartAdmits reports whether b, maybe ramping, takes req.
+func (lb *LB) slowStartAdmits(req IncomingReq, b *Backend) bool {
+	share := lb.slowStartShare(b, lb.clock.Now())
+	if share >= 1 {
+		return true
+	}
+	return float64(FNVHasher{}.Sum32(req.key+"|"+b.String())) < share*(1<<32)
+}
+
+// slowStartFilter keeps the available candidates that take req, or all of
+// candidates when none does: a ramping backend beats none.
+func (lb *LB) slowStartFilter(req IncomingReq, candidates []*Backend) []*Backend {
+	out := make([]*Backend, 0, len(candidates))
+	for _, b := range candidates {
+		if b.Available() && lb.slowStartAdmits(req, b) {
+			out = append(out, b)
+		}
+	}
+	if len(out) == 0 {
+		return candidates
+	}
+	return out
+}
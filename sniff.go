@@ -0,0 +1,90 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// ---------------------- Protocol Sniffing ----------------------
+// -mode auto serves HTTP/1.x and raw TCP on the same port: the first bytes of
+// each connection are buffered and, if they start an HTTP request line
+// ("GET ", "POST " ...), the connection goes through the HTTP proxy, otherwise
+// it is spliced as TCP. The buffered bytes are replayed either way. A client
+// that sends nothing within -read-timeout (autoSniffTimeout when unset) is
+// treated as TCP, since server-speaks-first protocols wait for a greeting.
+
+// autoSniffTimeout bounds the wait for a client's first bytes without
+// -read-timeout.
+const autoSniffTimeout = time.Second
+
+// httpMethods are the request-line prefixes that mark a connection as HTTP.
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("HEAD "), []byte("POST "), []byte("PUT "),
+	[]byte("DELETE "), []byte("OPTIONS "), []byte("PATCH "), []byte("TRACE "),
+	[]byte("CONNECT "),
+}
+
+// sniffedConn replays the bytes buffered while sniffing before reading on.
+type sniffedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *sniffedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// proxyAuto sniffs req's connection and hands it to the HTTP or TCP proxy.
+func (lb *LB) proxyAuto(req IncomingReq) {
+	timeout := autoSniffTimeout
+	if lb.cfg.ReadTimeout > 0 {
+		timeout = lb.cfg.ReadTimeout
+	}
+	br := bufio.NewReader(req.srcConn)
+	_ = req.srcConn.SetReadDeadline(time.Now().Add(timeout))
+	isHTTP, err := sniffHTTP(br)
+	_ = req.srcConn.SetReadDeadline(time.Time{})
+	if err != nil && br.Buffered() == 0 && !isTimeout(err) {
+		// gone before saying anything
+		if !errors.Is(err, io.EOF) {
+			log.Printf("conn %s: sniffing: %s", req.reqId, err)
+		}
+		_ = req.srcConn.Close()
+		return
+	}
+
+	req.srcConn = &sniffedConn{Conn: req.srcConn, r: br}
+	if isHTTP {
+		req.http = true
+		lb.proxyHTTP(req)
+		return
+	}
+	lb.proxyTCP(req)
+}
+
+// sniffHTTP reads just enough of br to tell whether it starts with an HTTP
+// request line. A read error (including the deadline) ends the wait with
+// whatever has arrived.
+func sniffHTTP(br *bufio.Reader) (bool, error) {
+	for n := 1; ; n++ {
+		p, err := br.Peek(n)
+		if err != nil {
+			return false, err
+		}
+		maybe := false
+		for _, m := range httpMethods {
+			if bytes.HasPrefix(p, m) {
+				return true, nil
+			}
+			if bytes.HasPrefix(m, p) {
+				maybe = true
+			}
+		}
+		if !maybe {
+			return false, nil
+		}
+	}
+}
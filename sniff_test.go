@@ -0,0 +1,108 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSniffHTTP(t *testing.T) {
+	for in, want := range map[string]bool{
+		"GET / HTTP/1.1\r\n":       true,
+		"POST /rpc HTTP/1.1\r\n":   true,
+		"OPTIONS * HTTP/1.1\r\n":   true,
+		"CONNECT a:443 HTTP/1.1\r": true,
+		"GETS / HTTP/1.1\r\n":      false,
+		"get / HTTP/1.1\r\n":       false,
+		"\x16\x03\x01\x02\x00":     false, // TLS ClientHello
+		"\x00\x00\x00\x01":         false,
+		"SSH-2.0-OpenSSH\r\n":      false,
+	} {
+		br := bufio.NewReader(strings.NewReader(in))
+		if got, err := sniffHTTP(br); got != want || err != nil {
+			t.Errorf("sniffHTTP(%q) = %v, %v, want %v", in, got, err, want)
+		}
+		// sniffing consumes nothing
+		if rest, _ := io.ReadAll(br); string(rest) != in {
+			t.Errorf("after sniffing %q, %q left to read", in, rest)
+		}
+	}
+	// a prefix of a method that ends there is not HTTP
+	if got, err := sniffHTTP(bufio.NewReader(strings.NewReader("POS"))); got || err != io.EOF {
+		t.Errorf("sniffHTTP(\"POS\") = %v, %v, want false, EOF", got, err)
+	}
+}
+
+// mixedBackend starts a server answering HTTP requests with "http" and
+// echoing any other stream, and returns its config.
+func mixedBackend(t *testing.T) BackendConfig {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				if isHTTP, _ := sniffHTTP(br); !isHTTP {
+					_, _ = io.Copy(c, br)
+					return
+				}
+				for {
+					r, err := http.ReadRequest(br)
+					if err != nil {
+						return
+					}
+					_, _ = io.Copy(io.Discard, r.Body)
+					fmt.Fprint(c, "HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\nhttp")
+				}
+			}()
+		}
+	}()
+	return backendAt(t, l.Addr().String())
+}
+
+func TestAutoModeSplitsHTTPAndTCP(t *testing.T) {
+	cfg := testConfig(t, mixedBackend(t))
+	cfg.Mode = ModeAuto
+	cfg.BackendHeader = "X-Backend" // set by the HTTP proxy only
+	cfg.ReadTimeout = 200 * time.Millisecond
+	lb := newTestLB(t, cfg)
+	startLB(t, lb)
+
+	resp, err := http.Get("http://" + lb.cfg.Listeners[0].Addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "http" || resp.Header.Get("X-Backend") == "" {
+		t.Fatalf("HTTP request: %q, X-Backend %q; want it through the HTTP proxy", body, resp.Header.Get("X-Backend"))
+	}
+
+	for _, first := range []string{"\x16\x03\x01\x00\x05hello", "GEX binary", "\x00\xffPOST "} {
+		if c := dialLB(t, lb); !echoes(c, first) {
+			t.Errorf("binary stream %q not spliced intact", first)
+		}
+	}
+
+	// a client that waits to be spoken to is TCP once -read-timeout passes,
+	// after which the same timeout starts counting it idle
+	c := dialLB(t, lb)
+	time.Sleep(cfg.ReadTimeout * 3 / 2)
+	if !echoes(c, "late hello") {
+		t.Fatal("silent client not spliced as TCP after the sniff timeout")
+	}
+}
@@ -0,0 +1,94 @@
+package loadbalancer
+
+import (
+	"sync"
+	"time"
+)
+
+// ---------------------- State Events ----------------------
+// code embedding the LB can follow its state through Subscribe instead of
+// scraping logs. Every subscriber gets its own buffered channel; publishing
+// never blocks, so a subscriber that falls more than stateEventBuffer events
+// behind loses the newest ones (counted in Dropped on the next event it does
+// receive). Events are delivered in the order they happened, channels are
+// never closed.
+
+type StateEventKind string
+
+const (
+	StateBackendAdded    StateEventKind = "backend-added"
+	StateBackendRemoved  StateEventKind = "backend-removed"
+	StateBackendUp       StateEventKind = "backend-up"
+	StateBackendDown     StateEventKind = "backend-down"
+	StateBackendDisabled StateEventKind = "backend-disabled"
+	StateBackendEnabled  StateEventKind = "backend-enabled"
+	StateStrategyChanged StateEventKind = "strategy-changed"
+	StateCircuitOpen     StateEventKind = "circuit-open"
+	StateCircuitClosed   StateEventKind = "circuit-closed"
+	StateOutlierEjected  StateEventKind = "outlier-ejected"
+	StateOutlierReturned StateEventKind = "outlier-returned"
+)
+
+// stateEventBuffer is each subscriber's channel capacity.
+const stateEventBuffer = 64
+
+type StateEvent struct {
+	Kind StateEventKind
+	Time time.Time
+
+	// Backend and BackendID name the backend concerned; empty for
+	// strategy changes.
+	Backend   string
+	BackendID string
+
+	// Group is the group whose strategy changed, empty for the main pool.
+	Group string
+
+	// Detail is the new strategy name, or why a backend went down.
+	Detail string
+
+	// Dropped is how many events this subscriber missed just before this
+	// one because its channel was full.
+	Dropped int
+}
+
+type subscriber struct {
+	ch      chan StateEvent
+	dropped int
+}
+
+type stateSubscribers struct {
+	mu   sync.Mutex
+	subs []*subscriber
+}
+
+// Subscribe returns a channel receiving every state change from now on.
+func (lb *LB) Subscribe() <-chan StateEvent {
+	s := &subscriber{ch: make(chan StateEvent, stateEventBuffer)}
+	lb.subscribers.mu.Lock()
+	lb.subscribers.subs = append(lb.subscribers.subs, s)
+	lb.subscribers.mu.Unlock()
+	return s.ch
+}
+
+// publish hands ev to every subscriber without blocking; safe with or
+// without lb.mu held.
+func (lb *LB) publish(ev StateEvent) {
+	ev.Time = lb.clock.Now()
+	lb.subscribers.mu.Lock()
+	defer lb.subscribers.mu.Unlock()
+	for _, s := range lb.subscribers.subs {
+		ev.Dropped = s.dropped
+		select {
+		case s.ch <- ev:
+			s.dropped = 0
+		default:
+			s.dropped++
+		}
+	}
+}
+
+// publishBackend publishes a kind event about b.
+func (lb *LB) publishBackend(kind StateEventKind, b *Backend, detail string) {
+	lb.publish(StateEvent{Kind: kind, Backend: b.String(), BackendID: b.ID, Detail: detail})
+}
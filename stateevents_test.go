@@ -0,0 +1,70 @@
+package loadbalancer
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// nextEvent returns the next event on ch of kind, skipping others.
+func nextEvent(t *testing.T, ch <-chan StateEvent, kind StateEventKind) StateEvent {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-ch:
+			if ev.Kind == kind {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("no %s event", kind)
+		}
+	}
+}
+
+func TestSubscriberSeesAddAndDown(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.AllowEmpty = true
+	cfg.HealthCheck.Mode = HealthCheckTCP
+	cfg.HealthCheck.Interval = 20 * time.Millisecond
+	lb := newTestLB(t, cfg)
+	events := lb.Subscribe()
+	startLB(t, lb)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewBackend(backendAt(t, l.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.Request(Event{EventName: CMD_BackendAdd, Data: *b}); err != nil {
+		t.Fatal(err)
+	}
+	added := nextEvent(t, events, StateBackendAdded)
+	if added.Backend != b.String() || added.BackendID == "" {
+		t.Fatalf("add event for %q (id %q), want %s", added.Backend, added.BackendID, b)
+	}
+
+	_ = l.Close() // health checks now fail
+	down := nextEvent(t, events, StateBackendDown)
+	if down.Backend != b.String() || down.BackendID != added.BackendID || down.Detail == "" {
+		t.Fatalf("down event %+v, want %s with a reason", down, b)
+	}
+}
+
+func TestSlowSubscriberCountsDrops(t *testing.T) {
+	lb := newTestLB(t, testConfig(t))
+	events := lb.Subscribe()
+	for range stateEventBuffer + 3 {
+		lb.publish(StateEvent{Kind: StateStrategyChanged, Detail: "rr"})
+	}
+	for range stateEventBuffer {
+		<-events
+	}
+	lb.publish(StateEvent{Kind: StateStrategyChanged, Detail: "lc"})
+	if ev := <-events; ev.Detail != "lc" || ev.Dropped != 3 {
+		t.Fatalf("first event after a full channel: %+v, want lc with 3 dropped", ev)
+	}
+}
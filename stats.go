@@ -0,0 +1,252 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"strings"
+	"time"
+)
+
+// ---------------------- Stats ----------------------
+// one read path for the `list` command and GET /stats, taken under lb.mu so
+// the totals always add up to the per-backend rows.
+
+type BackendStats struct {
+	ID          string `json:"id"`
+	Host        string `json:"host"`
+	Port        int    `json:"port"`
+	Path        string `json:"path,omitempty"`
+	Healthy     bool   `json:"healthy"`
+	Disabled    bool   `json:"disabled,omitempty"`
+	Draining    bool   `json:"draining,omitempty"`
+	Weight      int    `json:"weight"`
+	Priority    int    `json:"priority,omitempty"`
+	Zone        string `json:"zone,omitempty"`
+	ActiveConns int    `json:"active_conns"`
+	NumRequests int    `json:"total_requests"`
+
+	// Name is the hostname the backend was resolved from (-dns-refresh).
+	Name string `json:"name,omitempty"`
+
+	// SlowStart is the share a ramping backend takes so far, 0 to 1; absent
+	// once it takes its full share.
+	SlowStart float64 `json:"slow_start,omitempty"`
+
+	// PeakEWMA is the backend's latency average in seconds, what p2c
+	// compares; absent before its first sample.
+	PeakEWMA float64 `json:"peak_ewma_seconds,omitempty"`
+
+	// Circuit is the backend's circuit breaker, "open" or "half-open";
+	// absent while closed.
+	Circuit string `json:"circuit,omitempty"`
+
+	// Ejected is set while outlier detection keeps the backend out.
+	Ejected bool `json:"ejected,omitempty"`
+}
+
+type StatsSummary struct {
+	Backends    int `json:"backends"`
+	Healthy     int `json:"healthy"`
+	ActiveConns int `json:"active_conns"`
+	NumRequests int `json:"total_requests"`
+
+	// RejectedConns were turned away by -max-conns.
+	RejectedConns int64 `json:"rejected_conns"`
+
+	// RejectedPerIP were turned away by -max-conns-per-ip.
+	RejectedPerIP int64 `json:"rejected_per_ip"`
+
+	// HedgesFired / HedgeWins count hedged requests and those that
+	// answered before the original.
+	HedgesFired int64 `json:"hedges_fired"`
+	HedgeWins   int64 `json:"hedge_wins"`
+
+	// MirrorSent copies went to -mirror, MirrorFailed of them errored or
+	// got a 5xx, MirrorSkipped sampled requests weren't copied.
+	MirrorSent    int64 `json:"mirror_sent"`
+	MirrorFailed  int64 `json:"mirror_failed"`
+	MirrorSkipped int64 `json:"mirror_skipped"`
+
+	// Spills were sent past their busy consistent-hash owner.
+	Spills int64 `json:"spills"`
+
+	// Retries were made after a failed dial; RetriesDenied were refused by
+	// the retry budget.
+	Retries       int64 `json:"retries"`
+	RetriesDenied int64 `json:"retries_denied"`
+
+	// CircuitTrips counts backend circuits opened.
+	CircuitTrips int64 `json:"circuit_trips"`
+
+	// OutlierEjections counts backends ejected by outlier detection.
+	OutlierEjections int64 `json:"outlier_ejections"`
+
+	// BackpressureSeconds is the time accept loops spent paused at -max-conns.
+	BackpressureSeconds float64 `json:"backpressure_seconds"`
+
+	// SelectErrors counts requests no backend could be selected for, by
+	// reason (ErrNoBackends, ErrAllUnhealthy, ...).
+	SelectErrors map[string]int64 `json:"select_errors,omitempty"`
+}
+
+// GroupStats is one backend group of /stats.
+type GroupStats struct {
+	Name     string         `json:"name"`
+	Prefix   string         `json:"prefix,omitempty"`
+	SNI      []string       `json:"sni,omitempty"`
+	Strategy string         `json:"strategy"`
+	Backends []BackendStats `json:"backends"`
+}
+
+type Stats struct {
+	Backends []BackendStats `json:"backends"`
+	Groups   []GroupStats   `json:"groups,omitempty"`
+	Summary  StatsSummary   `json:"summary"`
+	Remap    RemapStats     `json:"remap"`
+}
+
+func (lb *LB) stats() Stats {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	st := Stats{Backends: make([]BackendStats, 0, len(lb.backends))}
+	st.Summary.RejectedConns = lb.rejectedConns.Load()
+	st.Summary.RejectedPerIP = lb.rejectedPerIP.Load()
+	st.Summary.HedgesFired = lb.hedgesFired.Load()
+	st.Summary.HedgeWins = lb.hedgeWins.Load()
+	st.Summary.Spills = lb.spills.Load()
+	st.Summary.MirrorSent = lb.mirrorSent.Load()
+	st.Summary.MirrorFailed = lb.mirrorFailed.Load()
+	st.Summary.MirrorSkipped = lb.mirrorSkipped.Load()
+	st.Summary.Retries = lb.retries.Load()
+	st.Summary.RetriesDenied = lb.retriesDenied.Load()
+	st.Summary.CircuitTrips = lb.breakerTrips.Load()
+	st.Summary.OutlierEjections = lb.outlierEjections.Load()
+	st.Summary.BackpressureSeconds = time.Duration(lb.backpressureNanos.Load()).Seconds()
+	st.Remap = lb.remaps.Stats()
+	if len(lb.selectErrors) > 0 {
+		st.Summary.SelectErrors = maps.Clone(lb.selectErrors)
+	}
+	st.Backends = st.Summary.add(lb.backends)
+	now := lb.clock.Now()
+	for i, b := range lb.backends {
+		if share := lb.slowStartShare(b, now); share < 1 {
+			st.Backends[i].SlowStart = share
+		}
+	}
+	for _, g := range lb.groups {
+		st.Groups = append(st.Groups, GroupStats{
+			Name:     g.Name,
+			Prefix:   g.Prefix,
+			SNI:      g.SNI,
+			Strategy: g.strategyName,
+			Backends: st.Summary.add(g.backends),
+		})
+	}
+	return st
+}
+
+// add returns the rows for backends and counts them into the summary.
+func (sum *StatsSummary) add(backends []*Backend) []BackendStats {
+	rows := make([]BackendStats, 0, len(backends))
+	for _, b := range backends {
+		row := BackendStats{
+			ID:          b.ID,
+			Host:        b.Host,
+			Path:        b.Path,
+			Port:        b.Port,
+			Healthy:     b.IsHealthy,
+			Disabled:    b.AdminDisabled,
+			Draining:    b.Draining,
+			Weight:      b.Weight,
+			Priority:    b.Priority,
+			Zone:        b.Zone,
+			Name:        b.Name,
+			ActiveConns: b.ActiveConns,
+			NumRequests: b.NumRequests,
+			PeakEWMA:    b.rtt.value,
+			Ejected:     b.outlier.ejected,
+		}
+		if b.breaker.state != circuitClosed {
+			row.Circuit = b.breaker.state.String()
+		}
+		rows = append(rows, row)
+		sum.Backends++
+		if b.IsHealthy {
+			sum.Healthy++
+		}
+		sum.ActiveConns += b.ActiveConns
+		sum.NumRequests += b.NumRequests
+	}
+	return rows
+}
+
+// routes is what g is routed by, for `list`.
+func (g GroupStats) routes() string {
+	var r []string
+	if g.Prefix != "" {
+		r = append(r, g.Prefix+"*")
+	}
+	if len(g.SNI) > 0 {
+		r = append(r, "sni "+strings.Join(g.SNI, ","))
+	}
+	return strings.Join(r, " ")
+}
+
+func (lb *LB) printStats(st Stats) {
+	log.Printf("=== BACKENDS ===")
+	for _, b := range st.Backends {
+		printBackendStats(b)
+	}
+	for _, g := range st.Groups {
+		log.Printf("--- group %s (%s, %s) ---", g.Name, g.routes(), g.Strategy)
+		for _, b := range g.Backends {
+			printBackendStats(b)
+		}
+	}
+	log.Printf("total: %d backends (%d healthy), conns=%d, reqs=%d, rejected=%d, rejected-per-ip=%d",
+		st.Summary.Backends, st.Summary.Healthy, st.Summary.ActiveConns, st.Summary.NumRequests,
+		st.Summary.RejectedConns, st.Summary.RejectedPerIP)
+	for reason, n := range st.Summary.SelectErrors {
+		log.Printf("select failed (%s): %d", reason, n)
+	}
+}
+
+// printBackendStats is one `list` row; health is what the checks say, the
+// trailing DISABLED / DRAINING whether the operator took the backend out.
+func printBackendStats(b BackendStats) {
+	health := "up"
+	if !b.Healthy {
+		health = "DOWN"
+	}
+	admin := ""
+	if b.Disabled {
+		admin += " DISABLED"
+	}
+	if b.Draining {
+		admin += " DRAINING"
+	}
+	if b.Ejected {
+		admin += " EJECTED"
+	}
+	if b.Circuit != "" {
+		admin += " circuit=" + b.Circuit
+	}
+	if b.SlowStart > 0 {
+		admin += fmt.Sprintf(" slow-start %.0f%%", 100*b.SlowStart)
+	}
+	if b.PeakEWMA > 0 {
+		admin += " ewma=" + fmtSeconds(b.PeakEWMA)
+	}
+	if b.Name != "" {
+		admin += " name=" + b.Name
+	}
+	if b.Zone != "" {
+		admin += " zone=" + b.Zone
+	}
+	if b.Priority != 0 {
+		admin += fmt.Sprintf(" prio=%d", b.Priority)
+	}
+	log.Printf("%-29s %-4s w=%-3d conns=%-5d reqs=%d%s", (&Backend{ID: b.ID, Host: b.Host, Port: b.Port, Path: b.Path}).Label(), health, b.Weight, b.ActiveConns, b.NumRequests, admin)
+}
@@ -1,31 +1,272 @@
-package main
+package loadbalancer
 
 import (
-	"crypto/sha256"
-	"encoding/binary"
+	"cmp"
+	"errors"
 	"fmt"
-	"hash/fnv"
+	"io"
+	"os"
+	"slices"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 // ---------------------- Strategy Interface ----------------------
 
+// selection errors: why GetNextBackend came back empty-handed
+var (
+	ErrNoBackends   = errors.New("no backends in pool")
+	ErrAllUnhealthy = errors.New("all backends unhealthy")
+)
+
 type BalancingStrategy interface {
 	Init([]*Backend)
-	GetNextBackend(IncomingReq) *Backend
+	// GetNextBackend returns an available backend (see Backend.Available),
+	// ErrNoBackends when the pool is empty, or ErrAllUnhealthy when nothing
+	// in it is available.
+	GetNextBackend(IncomingReq) (*Backend, error)
 	RegisterBackend(*Backend)
 	PrintTopology()
 }
 
+// ReplicaStrategy is implemented by strategies that can rank several
+// backends for one request, the first being the one GetNextBackend picks.
+// Retries then follow that order instead of rehashing the key.
+type ReplicaStrategy interface {
+	// GetBackends returns up to n distinct available backends for req, best
+	// first.
+	GetBackends(req IncomingReq, n int) []*Backend
+}
+
+// tieBefore is the tie-break strategies apply when two backends are otherwise
+// equal: the lower address (String()) wins, so the outcome doesn't depend on
+// pool order, which add, remove and reload reshuffle. Least connections is the
+// exception: on an idle pool every backend ties at zero, and a fixed winner
+// would take every short connection, so lc rotates through the tied backends
+// in address order instead. That is just as independent of pool order.
+func tieBefore(a, b *Backend) bool { return a.String() < b.String() }
+
+// nextAvailable returns the index of the first available backend at or after
+// start, wrapping around, and false when there is none.
+func nextAvailable(backends []*Backend, start int) (int, bool) {
+	for n := range len(backends) {
+		if i := (start + n) % len(backends); backends[i].Available() {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// ---------------------- Strategy Registry ----------------------
+// strategies are looked up by name in a registry, so the strat command,
+// LB_STRATEGY, the config file and the admin API accept whatever is
+// registered, and an embedding program can add its own with RegisterStrategy
+// (from an init function, or at least before New) without touching this
+// package. Names are case-insensitive; aliases resolve to the canonical name,
+// which is what gets persisted and reported.
+
+// StrategyFactory builds a strategy over backends, reading from cfg whatever
+// tunables it understands.
+type StrategyFactory func(backends []*Backend, cfg StrategyConfig) BalancingStrategy
+
+var strategyRegistry = struct {
+	sync.RWMutex
+	factories map[string]StrategyFactory // by canonical name
+	aliases   map[string]string          // every accepted name -> canonical
+	names     []string                   // canonical, in registration order
+}{factories: make(map[string]StrategyFactory), aliases: make(map[string]string)}
+
+// RegisterStrategy makes factory available as name and aliases. It panics if
+// the factory is nil or a name is empty or already taken, which is a
+// programming error like registering an HTTP pattern twice.
+func RegisterStrategy(name string, factory StrategyFactory, aliases ...string) {
+	if factory == nil {
+		panic("loadbalancer: RegisterStrategy with a nil factory")
+	}
+	r := &strategyRegistry
+	r.Lock()
+	defer r.Unlock()
+	name = strings.ToLower(strings.TrimSpace(name))
+	all := append([]string{name}, aliases...)
+	for i, n := range all {
+		n = strings.ToLower(strings.TrimSpace(n))
+		if n == "" {
+			panic("loadbalancer: RegisterStrategy with an empty name")
+		}
+		if _, dup := r.aliases[n]; dup || slices.Contains(all[:i], n) {
+			panic(fmt.Sprintf("loadbalancer: strategy name %q registered twice", n))
+		}
+		all[i] = n
+	}
+	for _, n := range all {
+		r.aliases[n] = name
+	}
+	r.factories[name] = factory
+	r.names = append(r.names, name)
+}
+
+// StrategyNames lists the canonical names of the registered strategies in
+// registration order, the built-in ones first.
+func StrategyNames() []string {
+	strategyRegistry.RLock()
+	defer strategyRegistry.RUnlock()
+	return slices.Clone(strategyRegistry.names)
+}
+
+func init() {
+	RegisterStrategy("ch", func(b []*Backend, c StrategyConfig) BalancingStrategy { return NewConsistentHashStrategy(b, c) }, "consistent", "consistent-hash")
+	RegisterStrategy("maglev", func(b []*Backend, c StrategyConfig) BalancingStrategy { return NewMaglevStrategy(b, c) })
+	RegisterStrategy("hrw", func(b []*Backend, c StrategyConfig) BalancingStrategy { return NewRendezvousStrategy(b, c) }, "rendezvous")
+	RegisterStrategy("simple", func(b []*Backend, c StrategyConfig) BalancingStrategy { return NewSimpleHashStrategy(b, c) }, "simple-hash")
+	RegisterStrategy("rr", func(b []*Backend, c StrategyConfig) BalancingStrategy { return NewRRBalancingStrategy(b, c) }, "round-robin")
+	RegisterStrategy("wrr", func(b []*Backend, c StrategyConfig) BalancingStrategy { return NewSmoothWRRStrategy(b, c) }, "weighted-rr", "smooth-wrr")
+	RegisterStrategy("drr", func(b []*Backend, c StrategyConfig) BalancingStrategy { return NewDRRStrategy(b, c) }, "deficit-rr")
+	RegisterStrategy("wrand", func(b []*Backend, c StrategyConfig) BalancingStrategy { return NewWeightedRandomStrategy(b, c) }, "weighted-random")
+	RegisterStrategy("lc", func(b []*Backend, c StrategyConfig) BalancingStrategy { return NewLeastConnectionsStrategy(b, c) }, "least-conn", "least-conns")
+	RegisterStrategy("p2c", func(b []*Backend, c StrategyConfig) BalancingStrategy { return NewP2CStrategy(b, c) }, "peak-ewma", "p2c-ewma")
+	RegisterStrategy("zone", func(b []*Backend, c StrategyConfig) BalancingStrategy { return NewZoneStrategy(b, c) }, "locality", "zone-aware")
+	RegisterStrategy("priority", func(b []*Backend, c StrategyConfig) BalancingStrategy { return NewPriorityStrategy(b, c) }, "prio", "failover")
+	RegisterStrategy("static", func(b []*Backend, c StrategyConfig) BalancingStrategy { return NewStaticBalancingStrategy(b, c) })
+}
+
+// canonicalStrategy normalizes name (case, surrounding space, aliases, chain
+// syntax). An empty name means the default, consistent hashing.
+func canonicalStrategy(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return "ch", nil
+	}
+	if chain, ok, err := canonicalChain(name); ok {
+		return chain, err
+	}
+	strategyRegistry.RLock()
+	canonical, ok := strategyRegistry.aliases[name]
+	strategyRegistry.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("unknown strategy %q (want %s, or chain <a>,<b>...)", name, strings.Join(StrategyNames(), "|"))
+	}
+	return canonical, nil
+}
+
+// StrategyConfig carries the tunables a strategy may read. Each strategy
+// takes the fields it understands and ignores the rest; the zero value gives
+// every strategy its default behavior.
+type StrategyConfig struct {
+	// Hasher places keys (simple, ch); nil means each strategy's default.
+	Hasher Hasher
+
+	// Rand draws random picks (wrand, p2c); nil seeds one from the clock.
+	Rand *Rand
+
+	// SpillAt > 0 lets ch send a key on to the next ring node while its home
+	// backend has SpillAt or more active connections, and zone send traffic
+	// to other zones while every local backend has; Spills, if set, counts
+	// those that carry traffic (not lookups).
+	SpillAt int
+	Spills  *atomic.Int64
+
+	// MaglevTableSize is maglev's lookup table size, a prime; 0 means
+	// DefaultMaglevTableSize.
+	MaglevTableSize int
+
+	// VNodes is how many ring positions ch gives each backend; 0 means
+	// DefaultVNodes.
+	VNodes int
+
+	// Quantum is drr's credit per visit; 0 means DefaultDRRQuantum.
+	Quantum int
+
+	// Zone is the LB's own zone, which zone prefers; empty makes every
+	// backend local.
+	Zone string
+
+	// State keeps what wrr and drr accumulate across rebuilds; nil gives the
+	// strategy state of its own.
+	State *StrategyState
+}
+
+// ---------------------- Shared Strategy State ----------------------
+// replacing a strategy (strat, a reload, a vnodes or quantum change) must
+// not reset what the LB knows about load. Most of it is kept on the Backend,
+// which the LB owns and every strategy reads: active connections, request
+// counts, the peak-EWMA latency, health. What strategies accumulate
+// themselves, smooth wrr's current weights and drr's credit, is kept in a
+// StrategyState the LB owns, one per pool, and hands to every strategy it
+// builds. So `strat lc` then `strat wrr` continues the old rotation instead
+// of restarting it. It is guarded by lb.mu, like the strategies.
+
+// StrategyState holds per-backend counters by strategy name.
+type StrategyState struct {
+	counters map[string]map[*Backend]int
+}
+
+func NewStrategyState() *StrategyState {
+	return &StrategyState{counters: make(map[string]map[*Backend]int)}
+}
+
+// Counters returns the counters kept under name, created empty on first use.
+// On a nil StrategyState it returns a fresh map, unshared.
+func (s *StrategyState) Counters(name string) map[*Backend]int {
+	if s == nil {
+		return make(map[*Backend]int)
+	}
+	c, ok := s.counters[name]
+	if !ok {
+		c = make(map[*Backend]int)
+		s.counters[name] = c
+	}
+	return c
+}
+
+// NewStrategy builds the strategy called name (any alias) over backends.
+func NewStrategy(name string, backends []*Backend, cfg StrategyConfig) (BalancingStrategy, error) {
+	canonical, err := canonicalStrategy(name)
+	if err != nil {
+		return nil, err
+	}
+	if links := chainLinks(canonical); links != nil {
+		return NewChainStrategy(links, backends, cfg)
+	}
+	strategyRegistry.RLock()
+	factory := strategyRegistry.factories[canonical]
+	strategyRegistry.RUnlock()
+	return factory(backends, cfg), nil
+}
+
+// StrategyFromName is NewStrategy configured from the LB: its hash function,
+// random source and -spill-at, and the main pool's StrategyState.
+func (lb *LB) StrategyFromName(name string, backends []*Backend) (BalancingStrategy, error) {
+	return NewStrategy(name, backends, lb.strategyConfig())
+}
+
+// groupStrategyFromName is StrategyFromName for g, with g's StrategyState.
+func (lb *LB) groupStrategyFromName(g *BackendGroup, name string) (BalancingStrategy, error) {
+	cfg := lb.strategyConfig()
+	cfg.State = g.state
+	return NewStrategy(name, g.backends, cfg)
+}
+
+func (lb *LB) strategyConfig() StrategyConfig {
+	return StrategyConfig{Hasher: lb.hasher, Rand: lb.rng, SpillAt: lb.cfg.SpillAt, Spills: &lb.spills, MaglevTableSize: lb.cfg.MaglevTableSize, VNodes: lb.vnodes, Quantum: lb.drrQuantum, Zone: lb.cfg.Zone, State: lb.strategyState}
+}
+
 // ---------------------- Simple Hash Strategy ----------------------
 // hash the key and use the hash value to determine the backend
 
 type SimpleHashStrategy struct {
 	Backends []*Backend
+	hasher   Hasher
 }
 
-func NewSimpleHashStrategy(backends []*Backend) *SimpleHashStrategy {
-	s := new(SimpleHashStrategy)
+// NewSimpleHashStrategy hashes keys with cfg.Hasher, or FNV-1a when unset.
+func NewSimpleHashStrategy(backends []*Backend, cfg StrategyConfig) *SimpleHashStrategy {
+	h := cfg.Hasher
+	if h == nil {
+		h = FNVHasher{}
+	}
+	s := &SimpleHashStrategy{hasher: h}
 	s.Init(backends)
 	return s
 }
@@ -34,15 +275,19 @@ func (s *SimpleHashStrategy) Init(backends []*Backend) {
 	s.Backends = backends
 }
 
-func (s *SimpleHashStrategy) GetNextBackend(req IncomingReq) *Backend {
+func (s *SimpleHashStrategy) GetNextBackend(req IncomingReq) (*Backend, error) {
 	n := len(s.Backends)
 	if n == 0 {
-		return nil
+		return nil, ErrNoBackends
+	}
+	idx := int(s.hasher.Sum32(req.key) % uint32(n)) // stable key (e.g., client IP)
+	// a down backend's keys go to the next available slot, so the keys of
+	// the others stay put
+	idx, ok := nextAvailable(s.Backends, idx)
+	if !ok {
+		return nil, ErrAllUnhealthy
 	}
-	h := fnv.New32a()
-	_, _ = h.Write([]byte(req.key)) // stable key (e.g., client IP)
-	idx := int(h.Sum32() % uint32(n))
-	return s.Backends[idx]
+	return s.Backends[idx], nil
 }
 
 func (s *SimpleHashStrategy) RegisterBackend(backend *Backend) {
@@ -63,7 +308,7 @@ type RRBalancingStrategy struct {
 	Backends []*Backend
 }
 
-func NewRRBalancingStrategy(backends []*Backend) *RRBalancingStrategy {
+func NewRRBalancingStrategy(backends []*Backend, _ StrategyConfig) *RRBalancingStrategy {
 	strategy := new(RRBalancingStrategy)
 	strategy.Init(backends)
 	return strategy
@@ -74,12 +319,17 @@ func (s *RRBalancingStrategy) Init(backends []*Backend) {
 	s.Backends = backends
 }
 
-func (s *RRBalancingStrategy) GetNextBackend(_ IncomingReq) *Backend {
+func (s *RRBalancingStrategy) GetNextBackend(_ IncomingReq) (*Backend, error) {
 	if len(s.Backends) == 0 {
-		return nil
+		return nil, ErrNoBackends
 	}
-	s.Index = (s.Index + 1) % len(s.Backends)
-	return s.Backends[s.Index]
+	// step past down backends; the next request continues after the pick
+	i, ok := nextAvailable(s.Backends, s.Index+1)
+	if !ok {
+		return nil, ErrAllUnhealthy
+	}
+	s.Index = i
+	return s.Backends[i], nil
 }
 
 func (s *RRBalancingStrategy) RegisterBackend(backend *Backend) {
@@ -93,14 +343,16 @@ func (s *RRBalancingStrategy) PrintTopology() {
 }
 
 // ---------------------- Static Strategy ----------------------
-// Used to pin all request to the same backend
+// Used to pin all request to the same backend. While the pinned backend is
+// down, requests go to the next available one; the pin itself stays, so they
+// come back once it is up again.
 
 type StaticBalancingStrategy struct {
 	Index    int
 	Backends []*Backend
 }
 
-func NewStaticBalancingStrategy(backends []*Backend) *StaticBalancingStrategy {
+func NewStaticBalancingStrategy(backends []*Backend, _ StrategyConfig) *StaticBalancingStrategy {
 	strategy := new(StaticBalancingStrategy)
 	strategy.Init(backends)
 	return strategy
@@ -111,11 +363,15 @@ func (s *StaticBalancingStrategy) Init(backends []*Backend) {
 	s.Backends = backends
 }
 
-func (s *StaticBalancingStrategy) GetNextBackend(_ IncomingReq) *Backend {
+func (s *StaticBalancingStrategy) GetNextBackend(_ IncomingReq) (*Backend, error) {
 	if len(s.Backends) == 0 {
-		return nil
+		return nil, ErrNoBackends
+	}
+	i, ok := nextAvailable(s.Backends, s.Index)
+	if !ok {
+		return nil, ErrAllUnhealthy
 	}
-	return s.Backends[s.Index]
+	return s.Backends[i], nil
 }
 
 func (s *StaticBalancingStrategy) RegisterBackend(backend *Backend) {
@@ -133,15 +389,58 @@ func (s *StaticBalancingStrategy) PrintTopology() {
 }
 
 // ---------------------- Consistent Hashing (real ring) ----------------------
+// every backend is placed on the ring VNodes times per unit of weight, at the
+// hashes of its address and of "<address>#1", "#2" and so on, so its share of
+// the keyspace is the sum of many small arcs rather than one big one: with a
+// single position four backends can end up owning 7% and 44%, with 100 they
+// stay within a few percent of an even split. A weight 2 backend gets twice
+// the positions and so about twice the keys; raising a weight only adds
+// positions, so only keys moving to that backend move. Weight 0 keeps a
+// backend off the ring, unless no backend has any weight, when all count as
+// 1. A down backend's keys likewise spread over all the others instead of
+// landing on one neighbour. More positions cost memory and a slower rebuild,
+// not a slower lookup.
+
+// DefaultVNodes is the -vnodes default; maxVNodes bounds it and the vnodes
+// command.
+const (
+	DefaultVNodes = 100
+	maxVNodes     = 10000
+)
+
+func checkVNodes(n int) error {
+	if n < 1 || n > maxVNodes {
+		return fmt.Errorf("vnodes must be between 1 and %d, got %d", maxVNodes, n)
+	}
+	return nil
+}
 
 type ConsistentHashStrategy struct {
 	keys       []uint32   // sorted ring positions
 	backends   []*Backend // parallel to keys
 	totalSlots uint64     // fixed hash space (independent of #nodes)
+	hasher     Hasher
+	vnodes     int        // positions per unit of weight
+	pool       []*Backend // as given to Init and RegisterBackend
+	unweighted bool       // no backend in pool has a weight; all count as 1
+
+	spillAt int           // see StrategyConfig.SpillAt
+	spills  *atomic.Int64 // may be nil
 }
 
-func NewConsistentHashStrategy(backends []*Backend) *ConsistentHashStrategy {
-	s := &ConsistentHashStrategy{totalSlots: 1 << 32}
+// NewConsistentHashStrategy places cfg.VNodes positions per unit of weight
+// (DefaultVNodes when 0), hashing nodes and keys with cfg.Hasher or truncated
+// SHA-256 when unset.
+func NewConsistentHashStrategy(backends []*Backend, cfg StrategyConfig) *ConsistentHashStrategy {
+	h := cfg.Hasher
+	if h == nil {
+		h = SHA256Hasher{}
+	}
+	vnodes := cfg.VNodes
+	if vnodes <= 0 {
+		vnodes = DefaultVNodes
+	}
+	s := &ConsistentHashStrategy{totalSlots: 1 << 32, hasher: h, vnodes: vnodes, spillAt: cfg.SpillAt, spills: cfg.Spills}
 	s.Init(backends)
 	return s
 }
@@ -149,51 +448,458 @@ func NewConsistentHashStrategy(backends []*Backend) *ConsistentHashStrategy {
 func (s *ConsistentHashStrategy) Init(backends []*Backend) {
 	s.keys = s.keys[:0]
 	s.backends = s.backends[:0]
+	s.pool = slices.Clone(backends)
+	s.unweighted = !slices.ContainsFunc(backends, func(b *Backend) bool { return b.Weight > 0 })
+	var points []ringPoint
 	for _, b := range backends {
-		k := chPos(b.String(), s.totalSlots)
-		s.insert(k, b)
+		points = s.points(points, b)
 	}
+	s.build(points)
 }
 
 func (s *ConsistentHashStrategy) RegisterBackend(b *Backend) {
-	k := chPos(b.String(), s.totalSlots)
-	s.insert(k, b)
+	if s.unweighted && b.Weight > 0 {
+		// the first weight in the pool: everyone else's positions change
+		s.Init(append(s.pool, b))
+		return
+	}
+	s.pool = append(s.pool, b)
+	points := make([]ringPoint, len(s.keys), len(s.keys)+s.replicas(b))
+	for i, k := range s.keys {
+		points[i] = ringPoint{k, s.backends[i]}
+	}
+	s.build(s.points(points, b))
+}
+
+// ringPoint is one position on the ring and the backend placed there.
+type ringPoint struct {
+	key uint32
+	b   *Backend
+}
+
+// points appends b's positions to dst. The first is the bare address, so
+// -vnodes 1 at weight 1 is the old one-point ring.
+func (s *ConsistentHashStrategy) points(dst []ringPoint, b *Backend) []ringPoint {
+	n := s.replicas(b)
+	if n == 0 {
+		return dst
+	}
+	dst = append(dst, ringPoint{s.pos(b.String()), b})
+	for i := 1; i < n; i++ {
+		dst = append(dst, ringPoint{s.pos(fmt.Sprintf("%s#%d", b, i)), b})
+	}
+	return dst
+}
+
+// build makes the ring from points with one sort, O(P log P) in the number
+// of positions.
+func (s *ConsistentHashStrategy) build(points []ringPoint) {
+	// backends sharing a position are kept in tieBefore order, so the first
+	// of them owns it whichever was placed first
+	slices.SortStableFunc(points, func(a, b ringPoint) int {
+		switch {
+		case a.key != b.key:
+			return cmp.Compare(a.key, b.key)
+		case tieBefore(a.b, b.b):
+			return -1
+		case tieBefore(b.b, a.b):
+			return 1
+		}
+		return 0
+	})
+	// the same backend twice on one position would only skew ownership
+	points = slices.Compact(points)
+	s.keys = s.keys[:0]
+	s.backends = s.backends[:0]
+	for _, p := range points {
+		s.keys = append(s.keys, p.key)
+		s.backends = append(s.backends, p.b)
+	}
+}
+
+// replicas is how many ring positions b gets.
+func (s *ConsistentHashStrategy) replicas(b *Backend) int {
+	if s.unweighted {
+		return s.vnodes
+	}
+	return s.vnodes * max(b.Weight, 0)
 }
 
+// PrintTopology reports, per backend, its ring positions and the share of
+// the keyspace it owns next to the share its weight asks for.
 func (s *ConsistentHashStrategy) PrintTopology() {
+	owned := s.Ownership()
+	replicas := make(map[*Backend]int)
+	for _, b := range s.backends {
+		replicas[b]++
+	}
+	totalWeight := 0
+	for _, b := range s.pool {
+		totalWeight += max(b.Weight, 0)
+	}
+	for _, b := range s.pool {
+		want := 100 / float64(len(s.pool)) // unweighted: all count as 1
+		if totalWeight > 0 {
+			want = 100 * float64(max(b.Weight, 0)) / float64(totalWeight)
+		}
+		fmt.Printf("%-20s replicas=%-4d owns=%6.2f%%  w=%d (%.2f%%)\n",
+			b, replicas[b], 100*owned[b], b.Weight, want)
+	}
+}
+
+// PrintPositions lists every ring position in order, the verbose topology.
+func (s *ConsistentHashStrategy) PrintPositions() {
+	s.WriteRing(os.Stdout, "")
+}
+
+// WriteRing writes every ring position in order with its owner and, for a
+// non-empty probe key, the key's slot and the clockwise walk GetNextBackend
+// takes from it. Backends are named by address, not ID, so dumps of the same
+// pool diff cleanly across restarts.
+func (s *ConsistentHashStrategy) WriteRing(w io.Writer, probe string) {
 	for i := range s.backends {
-		fmt.Printf("[%10d] %s\n", s.keys[i], s.backends[i])
+		fmt.Fprintf(w, "[%10d] %s\n", s.keys[i], s.backends[i])
+	}
+	if probe == "" {
+		return
+	}
+	slot := s.pos(probe)
+	fmt.Fprintf(w, "key %q -> slot %d\n", probe, slot)
+	if len(s.backends) == 0 {
+		fmt.Fprintln(w, "  ring is empty")
+		return
 	}
+	i := s.successor(slot)
+	for n := 0; n < len(s.backends); n++ {
+		j := (i + n) % len(s.backends)
+		b := s.backends[j]
+		if b.Available() {
+			fmt.Fprintf(w, "  [%10d] %s <- lands here\n", s.keys[j], b)
+			return
+		}
+		fmt.Fprintf(w, "  [%10d] %s unavailable, walking on\n", s.keys[j], b)
+	}
+	fmt.Fprintln(w, "  no available backend on the ring")
+}
+
+// Ownership returns the fraction of the hash space each backend owns: a node
+// gets the arc from its predecessor (exclusive) up to its own position
+// (exclusive), since lookup picks the first node strictly above the slot.
+func (s *ConsistentHashStrategy) Ownership() map[*Backend]float64 {
+	owned := make(map[*Backend]float64)
+	n := len(s.keys)
+	if n == 0 {
+		return owned
+	}
+	space := float64(s.totalSlots)
+	if s.totalSlots == 0 {
+		space = 1 << 32
+	}
+	for i := range s.keys {
+		var arc uint64
+		if i == 0 {
+			// wraps: from the last position round to this one
+			arc = uint64(s.keys[0]) + uint64(space) - uint64(s.keys[n-1])
+		} else {
+			arc = uint64(s.keys[i]) - uint64(s.keys[i-1])
+		}
+		owned[s.backends[i]] += float64(arc) / space
+	}
+	return owned
 }
 
-func (s *ConsistentHashStrategy) GetNextBackend(req IncomingReq) *Backend {
+func (s *ConsistentHashStrategy) GetNextBackend(req IncomingReq) (*Backend, error) {
 	if len(s.backends) == 0 {
-		return nil
+		return nil, ErrNoBackends
+	}
+	i := s.successor(s.pos(req.key))
+	// if the owner is down keep walking clockwise, so every key it owned lands
+	// on the same successor; one full lap without a healthy node means none.
+	// With spillAt, a busy owner is walked past the same way, but when every
+	// node is busy the key stays home.
+	var home *Backend
+	for n := 0; n < len(s.backends); n++ {
+		b := s.backends[(i+n)%len(s.backends)]
+		if !b.Available() {
+			continue
+		}
+		if home == nil {
+			home = b
+		}
+		if s.spillAt <= 0 || b.ActiveConns < s.spillAt {
+			if b != home && s.spills != nil && !req.lookup {
+				s.spills.Add(1)
+			}
+			return b, nil
+		}
 	}
-	slot := chPos(req.key, s.totalSlots)
-	// first node strictly to the right of slot; wrap
-	i := sort.Search(len(s.keys), func(i int) bool { return s.keys[i] > slot })
-	return s.backends[i%len(s.backends)]
+	if home == nil {
+		return nil, ErrAllUnhealthy
+	}
+	return home, nil
 }
 
-func (s *ConsistentHashStrategy) insert(k uint32, b *Backend) {
-	i := sort.Search(len(s.keys), func(i int) bool { return s.keys[i] >= k })
-	if i == len(s.keys) {
-		s.keys = append(s.keys, k)
-		s.backends = append(s.backends, b)
-		return
+// GetBackends walks the ring clockwise from req's key and returns the first n
+// distinct available backends: the owner GetNextBackend would pick (ignoring
+// -spill-at) and then its successors, which is where the key lands if the
+// ones before it fail.
+func (s *ConsistentHashStrategy) GetBackends(req IncomingReq, n int) []*Backend {
+	if len(s.backends) == 0 || n <= 0 {
+		return nil
+	}
+	i := s.successor(s.pos(req.key))
+	var out []*Backend
+	for k := 0; k < len(s.backends) && len(out) < n; k++ {
+		b := s.backends[(i+k)%len(s.backends)]
+		if b.Available() && !slices.Contains(out, b) {
+			out = append(out, b)
+		}
 	}
-	s.keys = append(s.keys[:i+1], s.keys[i:]...)
-	s.keys[i] = k
-	s.backends = append(s.backends[:i+1], s.backends[i:]...)
-	s.backends[i] = b
+	return out
 }
 
-func chPos(key string, totalSlots uint64) uint32 {
-	sum := sha256.Sum256([]byte(key))
-	v := binary.BigEndian.Uint32(sum[:4])
-	if totalSlots == 0 {
+// successor is the index of the first node strictly to the right of slot,
+// possibly len(s.keys); callers wrap it modulo the ring size.
+func (s *ConsistentHashStrategy) successor(slot uint32) int {
+	return sort.Search(len(s.keys), func(i int) bool { return s.keys[i] > slot })
+}
+
+func (s *ConsistentHashStrategy) pos(key string) uint32 {
+	v := s.hasher.Sum32(key)
+	if s.totalSlots == 0 {
 		return v
 	}
-	return uint32(uint64(v) % totalSlots)
+	return uint32(uint64(v) % s.totalSlots)
+}
+
+// ---------------------- Smooth Weighted Round Robin ----------------------
+// nginx's smooth WRR: every pick adds each backend's weight to its current
+// weight, takes the largest and subtracts the total from it, which spreads a
+// 5:1:1 pool as a a b a c a a rather than a a a a a b c. Pool changes keep
+// the current weights of the backends that stay, so churn elsewhere doesn't
+// restart the rotation; newcomers join at the pool's mean so they neither
+// burst nor starve. The current weights live in cfg.State, so a rebuilt wrr
+// continues the rotation too.
+
+type SmoothWRRStrategy struct {
+	Backends []*Backend
+	current  map[*Backend]int
+}
+
+func NewSmoothWRRStrategy(backends []*Backend, cfg StrategyConfig) *SmoothWRRStrategy {
+	s := &SmoothWRRStrategy{current: cfg.State.Counters("wrr")}
+	s.Init(backends)
+	return s
+}
+
+// Init adopts the new pool incrementally: state for removed backends is
+// dropped and the rest shifted so the current weights sum to zero again,
+// which is the invariant the algorithm keeps between picks.
+func (s *SmoothWRRStrategy) Init(backends []*Backend) {
+	s.Backends = backends
+	in := make(map[*Backend]bool, len(backends))
+	for _, b := range backends {
+		in[b] = true
+	}
+	// in place: the map may be shared through StrategyState
+	sum := 0
+	for b, c := range s.current {
+		if !in[b] {
+			delete(s.current, b)
+			continue
+		}
+		sum += c // newcomers have no entry yet, which counts as 0
+	}
+	if n := len(in); n > 0 {
+		mean := sum / n
+		for b := range in {
+			s.current[b] -= mean
+		}
+	}
+}
+
+func (s *SmoothWRRStrategy) RegisterBackend(backend *Backend) {
+	s.Init(append(s.Backends, backend))
+}
+
+func (s *SmoothWRRStrategy) GetNextBackend(_ IncomingReq) (*Backend, error) {
+	if len(s.Backends) == 0 {
+		return nil, ErrNoBackends
+	}
+	var best *Backend
+	total := 0
+	for _, b := range s.Backends {
+		w := max(b.Weight, 0)
+		if !b.Available() || w == 0 {
+			continue
+		}
+		s.current[b] += w
+		total += w
+		if best == nil || s.current[b] > s.current[best] ||
+			(s.current[b] == s.current[best] && tieBefore(b, best)) {
+			best = b
+		}
+	}
+	if best == nil {
+		return nil, ErrAllUnhealthy
+	}
+	s.current[best] -= total
+	return best, nil
+}
+
+func (s *SmoothWRRStrategy) PrintTopology() {
+	for i, b := range s.Backends {
+		fmt.Printf("[%d] %-20s w=%-3d current=%d\n", i, b, b.Weight, s.current[b])
+	}
+}
+
+// ---------------------- Weighted Random Strategy ----------------------
+// pick a backend with probability proportional to its Weight: draw a point in
+// [0, total) and binary search the cumulative weights. Weight 0 never gets
+// traffic, unless every weight is 0, then the pick is uniform.
+
+type WeightedRandomStrategy struct {
+	Backends   []*Backend
+	cumulative []int // cumulative[i] = sum of weights of Backends[:i+1]
+	rng        *Rand
+}
+
+// NewWeightedRandomStrategy draws from cfg.Rand, or a clock-seeded Rand when
+// unset.
+func NewWeightedRandomStrategy(backends []*Backend, cfg StrategyConfig) *WeightedRandomStrategy {
+	rng := cfg.Rand
+	if rng == nil {
+		rng = NewRand(0)
+	}
+	s := &WeightedRandomStrategy{rng: rng}
+	s.Init(backends)
+	return s
+}
+
+func (s *WeightedRandomStrategy) Init(backends []*Backend) {
+	s.Backends = backends
+	s.rebuild()
+}
+
+func (s *WeightedRandomStrategy) RegisterBackend(backend *Backend) {
+	s.Backends = append(s.Backends, backend)
+	s.rebuild()
+}
+
+func (s *WeightedRandomStrategy) rebuild() {
+	s.cumulative = make([]int, len(s.Backends))
+	total := 0
+	for i, b := range s.Backends {
+		total += max(b.Weight, 0)
+		s.cumulative[i] = total
+	}
+}
+
+func (s *WeightedRandomStrategy) GetNextBackend(_ IncomingReq) (*Backend, error) {
+	n := len(s.Backends)
+	if n == 0 {
+		return nil, ErrNoBackends
+	}
+	total := s.cumulative[n-1]
+	if total == 0 {
+		return s.pickHealthy(func(*Backend) int { return 1 })
+	}
+	r := s.rng.Intn(total)
+	i := sort.Search(n, func(i int) bool { return s.cumulative[i] > r })
+	if b := s.Backends[i]; b.Available() {
+		return b, nil
+	}
+	// the cumulative array covers the whole pool; with part of it down, draw
+	// again among the healthy ones only
+	return s.pickHealthy(func(b *Backend) int { return max(b.Weight, 0) })
+}
+
+// pickHealthy is the slow path: a weighted draw over healthy backends only.
+func (s *WeightedRandomStrategy) pickHealthy(weight func(*Backend) int) (*Backend, error) {
+	total := 0
+	for _, b := range s.Backends {
+		if b.Available() {
+			total += weight(b)
+		}
+	}
+	if total == 0 {
+		return nil, ErrAllUnhealthy
+	}
+	r := s.rng.Intn(total)
+	for _, b := range s.Backends {
+		if !b.Available() {
+			continue
+		}
+		if r -= weight(b); r < 0 {
+			return b, nil
+		}
+	}
+	return nil, ErrAllUnhealthy
+}
+
+func (s *WeightedRandomStrategy) PrintTopology() {
+	total := 0
+	if len(s.cumulative) > 0 {
+		total = s.cumulative[len(s.cumulative)-1]
+	}
+	for i, b := range s.Backends {
+		share := 0.0
+		if total > 0 {
+			share = 100 * float64(max(b.Weight, 0)) / float64(total)
+		}
+		fmt.Printf("[%d] %s w=%d (%.1f%%)\n", i, b, b.Weight, share)
+	}
+}
+
+// ---------------------- Least Connections Strategy ----------------------
+// send each connection to the available backend with the fewest open ones
+// (ActiveConns), which adapts to slow backends and long-lived clients that
+// rr would keep piling onto. Weights are ignored. Ties rotate through the
+// tied backends in address order, so an idle pool is walked like rr instead
+// of sending everything to one backend, and pool order doesn't matter.
+
+type LeastConnectionsStrategy struct {
+	Backends []*Backend // sorted by address
+	next     int        // where the scan for a tie starts
+}
+
+func NewLeastConnectionsStrategy(backends []*Backend, _ StrategyConfig) *LeastConnectionsStrategy {
+	s := new(LeastConnectionsStrategy)
+	s.Init(backends)
+	return s
+}
+
+func (s *LeastConnectionsStrategy) Init(backends []*Backend) {
+	s.Backends = slices.Clone(backends)
+	slices.SortFunc(s.Backends, func(a, b *Backend) int { return strings.Compare(a.String(), b.String()) })
+}
+
+func (s *LeastConnectionsStrategy) RegisterBackend(backend *Backend) {
+	s.Init(append(s.Backends, backend))
+}
+
+func (s *LeastConnectionsStrategy) GetNextBackend(_ IncomingReq) (*Backend, error) {
+	n := len(s.Backends)
+	if n == 0 {
+		return nil, ErrNoBackends
+	}
+	best := -1
+	for i := range n {
+		j := (s.next + i) % n
+		b := s.Backends[j]
+		if b.Available() && (best < 0 || b.ActiveConns < s.Backends[best].ActiveConns) {
+			best = j
+		}
+	}
+	if best < 0 {
+		return nil, ErrAllUnhealthy
+	}
+	s.next = best + 1
+	return s.Backends[best], nil
+}
+
+func (s *LeastConnectionsStrategy) PrintTopology() {
+	for i, b := range s.Backends {
+		fmt.Printf("[%d] %-20s conns=%d\n", i, b, b.ActiveConns)
+	}
 }
@@ -0,0 +1,664 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSpillsCountOnlyTraffic(t *testing.T) {
+	for _, name := range []string{"ch", "chain:ch,lc", "zone"} {
+		t.Run(name, func(t *testing.T) {
+			backends := testBackends(4)
+			for i, b := range backends {
+				b.Zone = "near"
+				if i >= 2 {
+					b.Zone = "far"
+				}
+				if i < 3 {
+					b.ActiveConns = 1 // at -spill-at
+				}
+			}
+			var spills atomic.Int64
+			s, err := NewStrategy(name, backends, StrategyConfig{SpillAt: 1, Spills: &spills, Zone: "near"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range 50 {
+				if _, err := s.GetNextBackend(lookupReq(fmt.Sprintf("k%d", i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if n := spills.Load(); n != 0 {
+				t.Fatalf("lookups counted %d spills", n)
+			}
+			for i := range 50 {
+				if _, err := s.GetNextBackend(IncomingReq{key: fmt.Sprintf("k%d", i)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if spills.Load() == 0 {
+				t.Fatal("requests past busy backends counted no spill")
+			}
+		})
+	}
+}
+
+func TestRemapSnapshotCountsNoSpills(t *testing.T) {
+	cfg := testConfig(t,
+		BackendConfig{Host: "10.0.0.1", Port: 80, Weight: 1},
+		BackendConfig{Host: "10.0.0.2", Port: 80, Weight: 1},
+	)
+	cfg.SpillAt = 1
+	lb := newTestLB(t, cfg)
+	lb.mu.Lock()
+	lb.backends[0].ActiveConns = 1
+	lb.remapSnapLocked()
+	lb.mu.Unlock()
+	if n := lb.spills.Load(); n != 0 {
+		t.Fatalf("remap snapshot counted %d spills", n)
+	}
+}
+
+func TestConsistentHashOwnershipFollowsWeights(t *testing.T) {
+	backends := testBackends(5)
+	for i, b := range backends {
+		b.Weight = i // 0, 1, 2, 3, 4
+	}
+	s := NewConsistentHashStrategy(backends, StrategyConfig{})
+	owned := s.Ownership()
+	for _, b := range backends {
+		want := float64(b.Weight) / 10
+		if d := owned[b] - want; d < -0.03 || d > 0.03 {
+			t.Errorf("%s weight %d owns %.3f of the ring, want %.3f±0.03", b, b.Weight, owned[b], want)
+		}
+	}
+}
+
+func TestConsistentHashWeightRaiseMovesKeysOnlyToIt(t *testing.T) {
+	backends := testBackends(4)
+	s := NewConsistentHashStrategy(backends, StrategyConfig{})
+	before := make(map[string]*Backend)
+	for i := range 2000 {
+		k := fmt.Sprintf("k%d", i)
+		before[k], _ = s.GetNextBackend(IncomingReq{key: k})
+	}
+	backends[2].Weight = 2
+	s.Init(backends)
+	moved := 0
+	for k, was := range before {
+		b, _ := s.GetNextBackend(IncomingReq{key: k})
+		if b != was {
+			moved++
+			if b != backends[2] {
+				t.Fatalf("key %s moved from %s to %s, not to the reweighted backend", k, was, b)
+			}
+		}
+	}
+	if moved == 0 {
+		t.Fatal("doubling a weight moved no key")
+	}
+}
+
+func TestConsistentHashAllZeroWeightsCountAsOne(t *testing.T) {
+	backends := testBackends(3)
+	for _, b := range backends {
+		b.Weight = 0
+	}
+	s := NewConsistentHashStrategy(backends, StrategyConfig{})
+	for _, b := range backends {
+		if s.Ownership()[b] == 0 {
+			t.Fatalf("%s owns nothing with every weight 0", b)
+		}
+	}
+}
+
+func TestLeastConnectionsRotatesTiesInAddressOrder(t *testing.T) {
+	backends := testBackends(3)
+	for _, pool := range [][]*Backend{
+		backends,
+		{backends[2], backends[0], backends[1]},
+	} {
+		s := NewLeastConnectionsStrategy(pool, StrategyConfig{})
+		for i := range 6 {
+			b, err := s.GetNextBackend(IncomingReq{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := backends[i%3]; b != want {
+				t.Fatalf("pick %d from %v: %s, want %s", i, pool, b, want)
+			}
+		}
+	}
+
+	backends[0].ActiveConns = 1
+	s := NewLeastConnectionsStrategy(backends, StrategyConfig{})
+	for i := range 4 {
+		b, _ := s.GetNextBackend(IncomingReq{})
+		if want := backends[1+i%2]; b != want {
+			t.Fatalf("pick %d with %s busy: %s, want %s", i, backends[0], b, want)
+		}
+	}
+}
+
+func TestIPv6RingPositionIsBracketedAddress(t *testing.T) {
+	b, _ := NewBackend(BackendConfig{Host: "2001:db8::1", Port: 8080, Weight: 1})
+	s := NewConsistentHashStrategy([]*Backend{b}, StrategyConfig{VNodes: 1})
+	if want := s.pos("[2001:db8::1]:8080"); s.keys[0] != want {
+		t.Fatalf("ring position %d, want %d (the hash of the bracketed address)", s.keys[0], want)
+	}
+}
+
+func TestConsistentHashSkipsDownOwnerToSuccessor(t *testing.T) {
+	backends := testBackends(3)
+	h := fixedHasher{
+		backends[0].String(): 100,
+		backends[1].String(): 200,
+		backends[2].String(): 300,
+		"a":                  150, // owned by backends[1]
+		"b":                  160,
+	}
+	s := NewConsistentHashStrategy(backends, StrategyConfig{Hasher: h, VNodes: 1})
+	pick := func(key string) *Backend {
+		b, err := s.GetNextBackend(IncomingReq{key: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	if b := pick("a"); b != backends[1] {
+		t.Fatalf("a -> %s, want its owner %s", b, backends[1])
+	}
+
+	backends[1].IsHealthy = false
+	for _, key := range []string{"a", "b"} {
+		if b := pick(key); b != backends[2] {
+			t.Fatalf("owner down: %s -> %s, want the successor %s", key, b, backends[2])
+		}
+	}
+	backends[2].IsHealthy = false
+	if b := pick("a"); b != backends[0] {
+		t.Fatalf("two down: a -> %s, want %s past the wrap", b, backends[0])
+	}
+	backends[0].IsHealthy = false
+	if b, err := s.GetNextBackend(IncomingReq{key: "a"}); err != ErrAllUnhealthy {
+		t.Fatalf("all down: %v, %v, want ErrAllUnhealthy", b, err)
+	}
+
+	for _, b := range backends {
+		b.IsHealthy = true
+	}
+	if b := pick("a"); b != backends[1] {
+		t.Fatalf("owner back: a -> %s, want %s", b, backends[1])
+	}
+}
+
+// shares picks n times from s and returns each backend's fraction of them.
+func shares(t *testing.T, s BalancingStrategy, n int) map[*Backend]float64 {
+	t.Helper()
+	counts := make(map[*Backend]int)
+	for range n {
+		b, err := s.GetNextBackend(IncomingReq{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[b]++
+	}
+	got := make(map[*Backend]float64)
+	for b, c := range counts {
+		got[b] = float64(c) / float64(n)
+	}
+	return got
+}
+
+func TestWeightedRandomTracksWeights(t *testing.T) {
+	backends := testBackends(4)
+	for i, w := range []int{1, 2, 3, 0} {
+		backends[i].Weight = w
+	}
+	s := NewWeightedRandomStrategy(backends, StrategyConfig{Rand: NewRand(1)})
+	got := shares(t, s, 60000)
+	for i, want := range []float64{1.0 / 6, 2.0 / 6, 3.0 / 6, 0} {
+		if d := got[backends[i]] - want; d > 0.01 || d < -0.01 {
+			t.Errorf("%s (weight %d) got %.3f of picks, want %.3f", backends[i], backends[i].Weight, got[backends[i]], want)
+		}
+	}
+	if got[backends[3]] != 0 {
+		t.Errorf("weight 0 backend %s picked", backends[3])
+	}
+
+	// with the heaviest down, the rest keep their ratio
+	backends[2].IsHealthy = false
+	got = shares(t, s, 60000)
+	for i, want := range []float64{1.0 / 3, 2.0 / 3} {
+		if d := got[backends[i]] - want; d > 0.01 || d < -0.01 {
+			t.Errorf("%s with %s down got %.3f of picks, want %.3f", backends[i], backends[2], got[backends[i]], want)
+		}
+	}
+}
+
+func TestWeightedRandomAllZeroWeightsIsUniform(t *testing.T) {
+	backends := testBackends(3)
+	for _, b := range backends {
+		b.Weight = 0
+	}
+	s := NewWeightedRandomStrategy(backends, StrategyConfig{Rand: NewRand(1)})
+	got := shares(t, s, 30000)
+	for _, b := range backends {
+		if d := got[b] - 1.0/3; d > 0.01 || d < -0.01 {
+			t.Errorf("%s got %.3f of picks, want 1/3", b, got[b])
+		}
+	}
+
+	// a weighted backend joining takes everything
+	b, _ := NewBackend(BackendConfig{Host: "10.0.0.9", Port: 80, Weight: 1})
+	s.RegisterBackend(b)
+	if got := shares(t, s, 100); got[b] != 1 {
+		t.Errorf("only weighted backend %s got %.2f of picks", b, got[b])
+	}
+}
+
+func TestSelectionErrors(t *testing.T) {
+	unavailable := map[string]func(*Backend){
+		"down":     func(b *Backend) { b.IsHealthy = false },
+		"disabled": func(b *Backend) { b.AdminDisabled = true },
+		"draining": func(b *Backend) { b.Draining = true },
+	}
+	for _, name := range append(StrategyNames(), "chain:ch,rr") {
+		t.Run(name, func(t *testing.T) {
+			s, err := NewStrategy(name, nil, StrategyConfig{Rand: NewRand(1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.GetNextBackend(IncomingReq{key: "k"}); !errors.Is(err, ErrNoBackends) {
+				t.Errorf("empty pool: %v, want ErrNoBackends", err)
+			}
+			for how, mark := range unavailable {
+				backends := testBackends(3)
+				for _, b := range backends {
+					mark(b)
+				}
+				s, _ := NewStrategy(name, backends, StrategyConfig{Rand: NewRand(1)})
+				if b, err := s.GetNextBackend(IncomingReq{key: "k"}); !errors.Is(err, ErrAllUnhealthy) {
+					t.Errorf("all %s: %v, %v, want ErrAllUnhealthy", how, b, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSelectionErrorsCountedByReason(t *testing.T) {
+	lb := newTestLB(t, testConfig(t))
+	startLB(t, lb)
+	pick := func() error {
+		lb.mu.Lock()
+		defer lb.mu.Unlock()
+		_, err := lb.pickBackend(IncomingReq{key: "k"})
+		return err
+	}
+	if err := pick(); !errors.Is(err, ErrNoBackends) {
+		t.Fatalf("empty pool: %v, want ErrNoBackends", err)
+	}
+
+	b, _ := NewBackend(BackendConfig{Host: "10.0.0.1", Port: 80, Weight: 1})
+	if err := lb.Request(Event{EventName: CMD_BackendAdd, Data: *b}); err != nil {
+		t.Fatal(err)
+	}
+	lb.mu.Lock()
+	lb.backends[0].AdminDisabled = true
+	lb.mu.Unlock()
+	for range 2 {
+		if err := pick(); !errors.Is(err, ErrAllUnhealthy) {
+			t.Fatalf("only backend disabled: %v, want ErrAllUnhealthy", err)
+		}
+	}
+
+	got := lb.stats().Summary.SelectErrors
+	want := map[string]int64{ErrNoBackends.Error(): 1, ErrAllUnhealthy.Error(): 2}
+	if !maps.Equal(got, want) {
+		t.Fatalf("select errors %v, want %v", got, want)
+	}
+}
+
+func TestConsistentHashBuildIgnoresSamePosition(t *testing.T) {
+	backends := testBackends(2)
+	s := NewConsistentHashStrategy(nil, StrategyConfig{})
+	s.build([]ringPoint{{7, backends[1]}, {7, backends[0]}, {7, backends[0]}})
+	if len(s.keys) != 2 || s.backends[0] != backends[0] || s.backends[1] != backends[1] {
+		t.Fatalf("ring with a position placed twice: %v -> %v", s.keys, s.backends)
+	}
+}
+
+func TestConsistentHashBuildsFastAtMaxVNodes(t *testing.T) {
+	backends := testBackends(20)
+	start := time.Now()
+	s := NewConsistentHashStrategy(backends[:19], StrategyConfig{VNodes: maxVNodes})
+	s.RegisterBackend(backends[19])
+	// an insert per position took minutes here; one sort takes well under a
+	// second, even under -race
+	if took := time.Since(start); took > 5*time.Second {
+		t.Fatalf("ring of %d positions took %s to build", len(s.keys), took)
+	}
+	if !slices.IsSorted(s.keys) {
+		t.Fatal("ring positions out of order")
+	}
+}
+
+func TestStrategyAliases(t *testing.T) {
+	aliases := map[string][]string{
+		"ch":          {"consistent", "consistent-hash", "CH", " Consistent-Hash "},
+		"maglev":      {"MAGLEV"},
+		"hrw":         {"rendezvous"},
+		"simple":      {"simple-hash"},
+		"rr":          {"round-robin"},
+		"wrr":         {"weighted-rr", "smooth-wrr"},
+		"drr":         {"deficit-rr"},
+		"wrand":       {"weighted-random"},
+		"lc":          {"least-conn", "least-conns"},
+		"p2c":         {"peak-ewma", "p2c-ewma"},
+		"zone":        {"locality", "zone-aware"},
+		"priority":    {"prio", "failover"},
+		"static":      {"Static"},
+		"chain:ch,rr": {"chain: consistent , round-robin"},
+	}
+	if len(aliases)-1 != len(StrategyNames()) {
+		t.Fatalf("table covers %d strategies, %d registered", len(aliases)-1, len(StrategyNames()))
+	}
+	for canonical, names := range aliases {
+		want, err := NewStrategy(canonical, testBackends(2), StrategyConfig{})
+		if err != nil {
+			t.Fatalf("%s: %v", canonical, err)
+		}
+		for _, name := range append(names, canonical) {
+			if got, err := canonicalStrategy(name); err != nil || got != canonical {
+				t.Errorf("canonicalStrategy(%q) = %q, %v, want %q", name, got, err, canonical)
+			}
+			s, err := NewStrategy(name, testBackends(2), StrategyConfig{})
+			if err != nil || fmt.Sprintf("%T", s) != fmt.Sprintf("%T", want) {
+				t.Errorf("NewStrategy(%q) = %T, %v, want %T", name, s, err, want)
+			}
+		}
+	}
+	if got, err := canonicalStrategy(""); err != nil || got != "ch" {
+		t.Errorf("empty name: %q, %v, want the default ch", got, err)
+	}
+	for _, name := range []string{"bogus", "c h", "chain:ch,bogus", "chain:ch", "chain:ch,chain:rr"} {
+		if s, err := NewStrategy(name, testBackends(2), StrategyConfig{}); err == nil {
+			t.Errorf("NewStrategy(%q) = %T, want an error", name, s)
+		}
+	}
+}
+
+func TestUnknownStrategyChangeRejected(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Strategy = "rr"
+	lb := newTestLB(t, cfg)
+	startLB(t, lb)
+	if err := lb.Request(Event{EventName: CMD_StrategyChange, Data: "bogus"}); err == nil {
+		t.Fatal("change to an unknown strategy acked without error")
+	}
+	lb.mu.Lock()
+	name := lb.strategyName
+	lb.mu.Unlock()
+	if name != "rr" {
+		t.Fatalf("strategy %s after a rejected change, want rr kept", name)
+	}
+	if err := lb.Request(Event{EventName: CMD_StrategyChange, Data: "Least-Conn"}); err != nil {
+		t.Fatal(err)
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if _, ok := lb.strategy.(*LeastConnectionsStrategy); !ok || lb.strategyName != "lc" {
+		t.Fatalf("strategy %s (%T) after Least-Conn, want lc", lb.strategyName, lb.strategy)
+	}
+}
+
+func TestSmoothWRRFairUnderChurn(t *testing.T) {
+	stable := testBackends(3)
+	stable[0].Weight = 5
+	churner, _ := NewBackend(BackendConfig{Host: "10.0.1.1", Port: 80, Weight: 1})
+	s := NewSmoothWRRStrategy(stable, StrategyConfig{})
+
+	got := make(map[*Backend]int)
+	picks := 0
+	for round := range 500 {
+		// the churner joins for 10 picks out of every 24
+		s.RegisterBackend(churner)
+		joined := 0
+		for range 10 {
+			b, _ := s.GetNextBackend(IncomingReq{})
+			if b == churner {
+				joined++
+			}
+		}
+		// its fair share of 10 picks at weight 1 of 8 is 1.25
+		if joined > 2 {
+			t.Fatalf("round %d: newcomer took %d of 10 picks", round, joined)
+		}
+		s.Init(stable)
+		for range 14 {
+			b, _ := s.GetNextBackend(IncomingReq{})
+			got[b]++
+			picks++
+		}
+	}
+	for _, b := range stable {
+		want := float64(b.Weight) / 7
+		if share := float64(got[b]) / float64(picks); share-want > 0.01 || want-share > 0.01 {
+			t.Errorf("%s (weight %d) got %.3f of picks between churn, want %.3f", b, b.Weight, share, want)
+		}
+	}
+}
+
+func TestSmoothWRRRebuildContinuesRotation(t *testing.T) {
+	backends := testBackends(3)
+	backends[0].Weight = 5
+	sequence := func(rebuildEvery int) []*Backend {
+		cfg := StrategyConfig{State: NewStrategyState()}
+		s := NewSmoothWRRStrategy(backends, cfg)
+		var seq []*Backend
+		for i := range 21 {
+			if rebuildEvery > 0 && i%rebuildEvery == 0 {
+				s = NewSmoothWRRStrategy(backends, cfg)
+			}
+			b, _ := s.GetNextBackend(IncomingReq{})
+			seq = append(seq, b)
+		}
+		return seq
+	}
+	want := sequence(0)
+	if got := sequence(4); !slices.Equal(got, want) {
+		t.Fatalf("rotation with rebuilds %v, want %v", got, want)
+	}
+}
+
+func TestStrategyConfigZeroValueDefaults(t *testing.T) {
+	for _, name := range StrategyNames() {
+		s, err := NewStrategy(name, testBackends(3), StrategyConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := s.GetNextBackend(IncomingReq{key: "k"}); b == nil || err != nil {
+			t.Errorf("%s with an empty config: %v, %v", name, b, err)
+		}
+	}
+	ch := NewConsistentHashStrategy(testBackends(3), StrategyConfig{})
+	maglev := NewMaglevStrategy(testBackends(3), StrategyConfig{})
+	drr := NewDRRStrategy(testBackends(3), StrategyConfig{})
+	simple := NewSimpleHashStrategy(testBackends(3), StrategyConfig{})
+	if len(ch.keys) != 3*DefaultVNodes || len(maglev.table) != DefaultMaglevTableSize ||
+		drr.quantum != DefaultDRRQuantum || simple.hasher != Hasher(FNVHasher{}) {
+		t.Fatalf("zero config: %d ring positions, maglev table %d, drr quantum %d, simple hasher %T",
+			len(ch.keys), len(maglev.table), drr.quantum, simple.hasher)
+	}
+}
+
+func TestSimulateLeavesLiveStrategyAlone(t *testing.T) {
+	for _, name := range []string{"rr", "wrand"} {
+		t.Run(name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.Strategy = name
+			cfg.Seed = 42
+			for _, b := range testBackends(3) {
+				cfg.Backends = append(cfg.Backends, BackendConfig{Host: b.Host, Port: b.Port, Weight: 1})
+			}
+			lb := newTestLB(t, cfg)
+			pick := func() string {
+				lb.mu.Lock()
+				defer lb.mu.Unlock()
+				b, err := lb.strategy.GetNextBackend(lookupReq("k"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return b.String()
+			}
+			// what the live strategy picks next, from a twin LB left untouched
+			twin := newTestLB(t, cfg)
+			want := make([]string, 4)
+			for i := range want {
+				twin.mu.Lock()
+				b, _ := twin.strategy.GetNextBackend(lookupReq("k"))
+				twin.mu.Unlock()
+				want[i] = b.String()
+			}
+
+			got := []string{pick(), pick()}
+			n, first, err := lb.simulate(Simulation{N: 1000})
+			if err != nil || n != 1000 {
+				t.Fatalf("simulate: %d picks, %v", n, err)
+			}
+			_, again, _ := lb.simulate(Simulation{N: 1000})
+			if !maps.Equal(first, again) {
+				t.Fatalf("simulate under -seed not reproducible: %v then %v", first, again)
+			}
+			got = append(got, pick(), pick())
+			if !slices.Equal(got, want) {
+				t.Fatalf("live picks around a simulate: %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestSimulateReportsCappedCount(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Strategy = "rr"
+	for _, b := range testBackends(2) {
+		cfg.Backends = append(cfg.Backends, BackendConfig{Host: b.Host, Port: b.Port, Weight: 1})
+	}
+	lb := newTestLB(t, cfg)
+	n, counts, err := lb.simulate(Simulation{N: MaxSimulateRequests + 1, Keys: []string{"k"}})
+	if err != nil || n != MaxSimulateRequests {
+		t.Fatalf("simulate over the cap: %d picks, %v; want %d", n, err, MaxSimulateRequests)
+	}
+	total := 0
+	for _, c := range counts {
+		total += c
+	}
+	if total != n {
+		t.Fatalf("%d picks tallied, want %d", total, n)
+	}
+}
+
+func TestStrategyConfigExplicit(t *testing.T) {
+	backends := testBackends(3)
+	if s := NewConsistentHashStrategy(backends, StrategyConfig{VNodes: 4}); len(s.keys) != 12 {
+		t.Errorf("ch with VNodes 4: %d ring positions, want 12", len(s.keys))
+	}
+	if s := NewMaglevStrategy(backends, StrategyConfig{MaglevTableSize: 13}); len(s.table) != 13 {
+		t.Errorf("maglev with MaglevTableSize 13: table of %d", len(s.table))
+	}
+	if s := NewDRRStrategy(backends, StrategyConfig{Quantum: 4}); s.quantum != 4 {
+		t.Errorf("drr with Quantum 4: quantum %d", s.quantum)
+	}
+	h := fixedHasher{"k": 2}
+	if b, _ := NewSimpleHashStrategy(backends, StrategyConfig{Hasher: h}).GetNextBackend(IncomingReq{key: "k"}); b != backends[2] {
+		t.Errorf("simple with a hasher placing k at 2: %s", b)
+	}
+
+	// a seeded Rand makes the random strategies reproducible
+	for _, name := range []string{"wrand", "p2c"} {
+		seq := func() []*Backend {
+			s, _ := NewStrategy(name, backends, StrategyConfig{Rand: NewRand(7)})
+			var out []*Backend
+			for range 20 {
+				b, _ := s.GetNextBackend(IncomingReq{})
+				out = append(out, b)
+			}
+			return out
+		}
+		if a, b := seq(), seq(); !slices.Equal(a, b) {
+			t.Errorf("%s with the same seed: %v then %v", name, a, b)
+		}
+	}
+
+	zoned := testBackends(3)
+	zoned[1].Zone = "b"
+	s := NewZoneStrategy(zoned, StrategyConfig{Zone: "b"})
+	for range 5 {
+		if b, _ := s.GetNextBackend(IncomingReq{}); b != zoned[1] {
+			t.Fatalf("zone with Zone b: %s, want the zone's only backend %s", b, zoned[1])
+		}
+	}
+}
+
+func TestTiesGoToLowerAddress(t *testing.T) {
+	all := testBackends(4) // 10.0.0.1:80 sorts first
+	lowest, extra := all[0], all[3]
+	pool := all[:3]
+	for name, tc := range map[string]struct {
+		cfg    StrategyConfig
+		pool   []*Backend
+		rotate bool // the tie rotates after the first pick
+	}{
+		"hrw":  {cfg: StrategyConfig{Hasher: fixedHasher{}}, pool: pool},            // every score equal
+		"ch":   {cfg: StrategyConfig{Hasher: fixedHasher{}, VNodes: 1}, pool: pool}, // one shared ring position
+		"p2c":  {cfg: StrategyConfig{Rand: NewRand(1)}, pool: pool[:2]},             // equal cost; two, so both are drawn
+		"wrr":  {pool: pool, rotate: true},                                          // equal weights
+		"lc":   {pool: pool, rotate: true},
+		"zone": {pool: pool, rotate: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rev := slices.Clone(tc.pool)
+			slices.Reverse(rev)
+			shrunk := must(NewStrategy(name, append([]*Backend{extra}, rev...), tc.cfg))
+			shrunk.Init(rev) // extra removed, the rest in another order
+			for i, s := range []BalancingStrategy{
+				must(NewStrategy(name, tc.pool, tc.cfg)),
+				must(NewStrategy(name, rev, tc.cfg)),
+				shrunk,
+			} {
+				for range 3 {
+					if b, err := s.GetNextBackend(IncomingReq{key: "k"}); b != lowest || err != nil {
+						t.Fatalf("pool %d: tie went to %v (%v), want %s", i, b, err, lowest)
+					}
+					if tc.rotate {
+						break
+					}
+				}
+			}
+		})
+	}
+
+	// maglev sorts its pool, so any order builds the same table
+	rev := slices.Clone(pool)
+	slices.Reverse(rev)
+	a := NewMaglevStrategy(pool, StrategyConfig{MaglevTableSize: 13})
+	b := NewMaglevStrategy(rev, StrategyConfig{MaglevTableSize: 13})
+	for i := range a.table {
+		if a.Backends[a.table[i]] != b.Backends[b.table[i]] {
+			t.Fatalf("maglev slot %d: %s from one pool order, %s from another", i, a.Backends[a.table[i]], b.Backends[b.table[i]])
+		}
+	}
+}
+
+// must returns s, panicking on err.
+func must(s BalancingStrategy, err error) BalancingStrategy {
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
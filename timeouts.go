@@ -0,0 +1,47 @@
+package loadbalancer
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// ---------------------- Idle Deadlines ----------------------
+// -read-timeout / -write-timeout are inactivity limits: the deadline is pushed
+// forward before every Read/Write, so a stream that keeps moving bytes lives
+// forever while one that stalls (or dribbles slower than one read per timeout)
+// is cut off. They are not a cap on total connection lifetime.
+
+type idleConn struct {
+	net.Conn
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	if c.readTimeout > 0 {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		_ = c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	return c.Conn.Write(p)
+}
+
+// withIdleTimeouts wraps c with the configured deadlines, or returns it as is
+// when none are set.
+func (lb *LB) withIdleTimeouts(c net.Conn) net.Conn {
+	if lb.cfg.ReadTimeout <= 0 && lb.cfg.WriteTimeout <= 0 {
+		return c
+	}
+	return &idleConn{Conn: c, readTimeout: lb.cfg.ReadTimeout, writeTimeout: lb.cfg.WriteTimeout}
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
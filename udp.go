@@ -0,0 +1,300 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ---------------------- UDP ----------------------
+// with -udp-listen the LB also balances UDP datagrams over the main pool,
+// sending them to each backend's host and port. There are no connections to
+// go by, so it keeps NAT-style sessions: the first datagram of a key picks a
+// backend the way a new TCP connection would and opens a socket to it, whose
+// replies are relayed back to the client; the key's later datagrams reuse the
+// session until it has been idle for -udp-idle-timeout, or its backend
+// leaves rotation. -udp-key src keys by the client's address and port, ip by
+// its address alone; payload keys every datagram by its first -key-bytes
+// bytes, so one client can have sessions with several backends. A session
+// counts as one request and one active connection on its backend, and a
+// backend that refuses datagrams (ICMP port unreachable) counts as a failed
+// dial for passive health. Unix socket backends can't take datagrams and are
+// skipped. Sessions are closed at once on shutdown; UDP has nothing to drain.
+
+// udp session keys
+const (
+	UDPKeySrc     = "src"
+	UDPKeyIP      = "ip"
+	UDPKeyPayload = "payload"
+)
+
+// maxUDPDatagram is the largest datagram relayed either way.
+const maxUDPDatagram = 64 << 10
+
+// maxUDPSessions caps the session table; datagrams that would open more are
+// dropped.
+const maxUDPSessions = 1 << 16
+
+type udpSession struct {
+	id       string // table key
+	client   net.Addr
+	backend  *Backend
+	conn     net.Conn // connected to backend
+	answered bool     // replied at least once; relay goroutine only
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+func (s *udpSession) touch(now time.Time) {
+	s.mu.Lock()
+	s.last = now
+	s.mu.Unlock()
+}
+
+func (s *udpSession) idleSince() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// udpProxy is the session table of one UDP listener.
+type udpProxy struct {
+	lb       *LB
+	pc       net.PacketConn
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+}
+
+// serveUDP relays datagrams on pc until it is closed.
+func (lb *LB) serveUDP(pc net.PacketConn) {
+	u := &udpProxy{lb: lb, pc: pc, sessions: make(map[string]*udpSession)}
+	stop := make(chan struct{})
+	go u.expire(stop)
+	defer func() {
+		close(stop)
+		u.endAll()
+	}()
+
+	buf := make([]byte, maxUDPDatagram)
+	for {
+		n, client, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("udp: read on %s: %s", pc.LocalAddr(), err)
+			continue
+		}
+		u.forward(client, buf[:n])
+	}
+}
+
+// forward sends one datagram from client on through its session, opening one
+// when there is none yet.
+func (u *udpProxy) forward(client net.Addr, payload []byte) {
+	lb := u.lb
+	defer func() {
+		// as recoverConn does for connections: a panicking strategy or
+		// hook costs this datagram, not the read loop and the process
+		if r := recover(); r != nil {
+			log.Printf("udp: %s: panic: %v\n%s", client, r, debug.Stack())
+		}
+	}()
+	key := u.key(client, payload)
+	now := lb.clock.Now()
+
+	var s *udpSession
+	if lb.cfg.UDPKey != UDPKeyPayload {
+		u.mu.Lock()
+		s = u.sessions[key]
+		u.mu.Unlock()
+		if s != nil && !u.usable(s) {
+			u.end(s)
+			s = nil
+		}
+	}
+	if s == nil {
+		var err error
+		if s, err = u.open(client, key); err != nil {
+			log.Printf("udp: %s key=%s dropped: %s", client, key, err)
+			return
+		}
+	}
+	s.touch(now)
+	if _, err := s.conn.Write(payload); err != nil {
+		lb.recordFailure(s.backend, err.Error())
+		u.end(s)
+	}
+}
+
+// key is the session key of a datagram from client.
+func (u *udpProxy) key(client net.Addr, payload []byte) string {
+	switch u.lb.cfg.UDPKey {
+	case UDPKeyIP:
+		return clientIP(client.String())
+	case UDPKeyPayload:
+		head := payload[:min(len(payload), u.lb.cfg.KeyBytes)]
+		return strconv.Quote(string(head))
+	}
+	return clientAddr(client.String())
+}
+
+// usable reports whether s's backend may still take its datagrams.
+func (u *udpProxy) usable(s *udpSession) bool {
+	u.lb.mu.Lock()
+	defer u.lb.mu.Unlock()
+	return s.backend.Available() && containsBackend(u.lb.backends, s.backend)
+}
+
+// pick selects req's backend under lb.mu.
+func (u *udpProxy) pick(req IncomingReq) (*Backend, error) {
+	u.lb.mu.Lock()
+	defer u.lb.mu.Unlock()
+	return u.lb.pickBackend(req)
+}
+
+// open picks a backend for key and opens a session from client to it; under
+// -udp-key payload an existing session with that backend is reused.
+func (u *udpProxy) open(client net.Addr, key string) (*udpSession, error) {
+	lb := u.lb
+	req := IncomingReq{reqId: uuid.NewString(), key: key}
+	b, err := u.pick(req)
+	if err != nil {
+		return nil, err
+	}
+	if b.Path != "" {
+		return nil, fmt.Errorf("backend %s is a Unix socket", b.Label())
+	}
+
+	id := key
+	if lb.cfg.UDPKey == UDPKeyPayload {
+		id = client.String() + " " + b.ID
+		u.mu.Lock()
+		s := u.sessions[id]
+		u.mu.Unlock()
+		if s != nil {
+			return s, nil
+		}
+	}
+	u.mu.Lock()
+	full := len(u.sessions) >= maxUDPSessions
+	u.mu.Unlock()
+	if full {
+		return nil, fmt.Errorf("%d sessions open", maxUDPSessions)
+	}
+
+	conn, err := lb.dialUDP(b)
+	if err != nil {
+		lb.recordFailure(b, err.Error())
+		return nil, err
+	}
+	// idle from now, not from the zero time, or an expire tick between
+	// here and forward's touch would end it at once
+	s := &udpSession{id: id, client: client, backend: b, conn: conn, last: lb.clock.Now()}
+	u.mu.Lock()
+	u.sessions[id] = s
+	u.mu.Unlock()
+	lb.mu.Lock()
+	b.NumRequests++
+	b.ActiveConns++
+	lb.breakerDispatchLocked(b)
+	lb.mu.Unlock()
+	log.Printf("in-req: %s client=%s key=%s udp -> backend: %s", req.reqId, client, key, b.Label())
+	go u.relay(s)
+	return s, nil
+}
+
+// dialUDP opens a socket connected to b, from -dial-source when set.
+func (lb *LB) dialUDP(b *Backend) (net.Conn, error) {
+	var d net.Dialer
+	if src, ok := lb.dialer.LocalAddr.(*net.TCPAddr); ok {
+		d.LocalAddr = &net.UDPAddr{IP: src.IP}
+	}
+	return d.Dial("udp", b.String())
+}
+
+// relay copies s's backend replies to its client until the session ends.
+func (u *udpProxy) relay(s *udpSession) {
+	buf := make([]byte, maxUDPDatagram)
+	for {
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				u.lb.recordFailure(s.backend, err.Error())
+			}
+			u.end(s)
+			return
+		}
+		if !s.answered {
+			s.answered = true
+			u.lb.recordSuccess(s.backend)
+		}
+		s.touch(u.lb.clock.Now())
+		if _, err := u.pc.WriteTo(buf[:n], s.client); err != nil && errors.Is(err, net.ErrClosed) {
+			u.end(s)
+			return
+		}
+	}
+}
+
+// end closes s and takes it out of the table, once.
+func (u *udpProxy) end(s *udpSession) {
+	u.mu.Lock()
+	if u.sessions[s.id] != s {
+		u.mu.Unlock()
+		return
+	}
+	delete(u.sessions, s.id)
+	u.mu.Unlock()
+	_ = s.conn.Close()
+	u.lb.mu.Lock()
+	s.backend.ActiveConns--
+	u.lb.mu.Unlock()
+}
+
+func (u *udpProxy) endAll() {
+	u.mu.Lock()
+	all := make([]*udpSession, 0, len(u.sessions))
+	for _, s := range u.sessions {
+		all = append(all, s)
+	}
+	u.mu.Unlock()
+	for _, s := range all {
+		u.end(s)
+	}
+}
+
+// expire ends the sessions idle for -udp-idle-timeout until stop is closed.
+func (u *udpProxy) expire(stop <-chan struct{}) {
+	timeout := u.lb.cfg.UDPIdleTimeout
+	ticker := time.NewTicker(max(timeout/4, 100*time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		now := u.lb.clock.Now()
+		var idle []*udpSession
+		u.mu.Lock()
+		for _, s := range u.sessions {
+			if now.Sub(s.idleSince()) >= timeout {
+				idle = append(idle, s)
+			}
+		}
+		u.mu.Unlock()
+		for _, s := range idle {
+			u.end(s)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// udpEchoBackend starts a UDP server answering every datagram with name,
+// ":" and the datagram, and returns its config.
+func udpEchoBackend(t *testing.T, name string) BackendConfig {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	go func() {
+		buf := make([]byte, maxUDPDatagram)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(append([]byte(name+":"), buf[:n]...), from)
+		}
+	}()
+	return backendAt(t, pc.LocalAddr().String())
+}
+
+// freeUDPAddr returns a loopback UDP address nothing is bound to.
+func freeUDPAddr(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	return pc.LocalAddr().String()
+}
+
+// dialUDPLB opens a client socket to the LB's UDP listener.
+func dialUDPLB(t *testing.T, lb *LB) net.Conn {
+	t.Helper()
+	c, err := net.Dial("udp", lb.cfg.UDPListen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+// udpExchange sends msg on c and returns the reply, "" when none comes
+// within wait.
+func udpExchange(t *testing.T, c net.Conn, msg string, wait time.Duration) string {
+	t.Helper()
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(wait))
+	buf := make([]byte, maxUDPDatagram)
+	n, err := c.Read(buf)
+	if err != nil {
+		return ""
+	}
+	return string(buf[:n])
+}
+
+func TestUDPPanickingHookKeepsServing(t *testing.T) {
+	cfg := testConfig(t, udpEchoBackend(t, "a"))
+	cfg.UDPListen = freeUDPAddr(t)
+	lb := newTestLB(t, cfg)
+	var panicked atomic.Bool
+	lb.UseSelectionHook(func(_ *IncomingReq, candidates []*Backend) []*Backend {
+		if panicked.CompareAndSwap(false, true) {
+			panic("hook failure")
+		}
+		return candidates
+	})
+	startLB(t, lb)
+
+	c := dialUDPLB(t, lb)
+	if got := udpExchange(t, c, "first", 200*time.Millisecond); got != "" {
+		t.Fatalf("datagram whose hook panicked answered with %q", got)
+	}
+	if got := udpExchange(t, c, "second", 5*time.Second); got != "a:second" {
+		t.Fatalf("datagram after the panic: %q, want a:second", got)
+	}
+}
+
+func TestUDPRoutesRepliesPerSession(t *testing.T) {
+	cfg := testConfig(t, udpEchoBackend(t, "a"), udpEchoBackend(t, "b"))
+	cfg.Strategy = "rr"
+	cfg.UDPListen = freeUDPAddr(t)
+	lb := newTestLB(t, cfg)
+	startLB(t, lb)
+
+	// each client keeps its backend, and gets only its own replies
+	c1, c2 := dialUDPLB(t, lb), dialUDPLB(t, lb)
+	first1 := udpExchange(t, c1, "one", 5*time.Second)
+	first2 := udpExchange(t, c2, "two", 5*time.Second)
+	if first1 == "" || first2 == "" || first1[:1] == first2[:1] {
+		t.Fatalf("first replies %q and %q, want one from each backend", first1, first2)
+	}
+	for i := range 3 {
+		if got, want := udpExchange(t, c1, fmt.Sprint("one", i), 5*time.Second), first1[:2]+fmt.Sprint("one", i); got != want {
+			t.Fatalf("client 1 datagram %d: %q, want %q", i, got, want)
+		}
+		if got, want := udpExchange(t, c2, fmt.Sprint("two", i), 5*time.Second), first2[:2]+fmt.Sprint("two", i); got != want {
+			t.Fatalf("client 2 datagram %d: %q, want %q", i, got, want)
+		}
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	for _, b := range lb.backends {
+		if b.NumRequests != 1 || b.ActiveConns != 1 {
+			t.Errorf("%s: %d requests, %d active, want one session each", b, b.NumRequests, b.ActiveConns)
+		}
+	}
+}
+
+func TestUDPSessionExpiresWhenIdle(t *testing.T) {
+	clk := newFakeClock()
+	cfg := testConfig(t, udpEchoBackend(t, "a"), udpEchoBackend(t, "b"))
+	cfg.Strategy = "rr"
+	cfg.UDPListen = freeUDPAddr(t)
+	cfg.UDPIdleTimeout = 400 * time.Millisecond
+	cfg.clock = clk
+	lb := newTestLB(t, cfg)
+	startLB(t, lb)
+	active := func() int {
+		lb.mu.Lock()
+		defer lb.mu.Unlock()
+		return lb.backends[0].ActiveConns + lb.backends[1].ActiveConns
+	}
+
+	c := dialUDPLB(t, lb)
+	first := udpExchange(t, c, "x", 5*time.Second)
+	if first == "" {
+		t.Fatal("no reply")
+	}
+	// the clock stands still, so the session outlives several expire ticks
+	time.Sleep(3 * cfg.UDPIdleTimeout / 2)
+	if n := active(); n != 1 {
+		t.Fatalf("%d sessions open before the idle timeout, want 1", n)
+	}
+
+	clk.Advance(cfg.UDPIdleTimeout)
+	eventually(t, "the idle session to end", func() bool { return active() == 0 })
+	// the next datagram opens a new session, on the other backend under rr
+	if again := udpExchange(t, c, "x", 5*time.Second); again == "" || again[:1] == first[:1] {
+		t.Fatalf("reply after expiry %q, want one from a new session (first was %q)", again, first)
+	}
+}
+
+func TestUDPSessionOpensIdleFromNow(t *testing.T) {
+	clk := newFakeClock()
+	cfg := testConfig(t, udpEchoBackend(t, "a"))
+	cfg.clock = clk
+	lb := newTestLB(t, cfg)
+	u := &udpProxy{lb: lb, sessions: make(map[string]*udpSession)}
+	s, err := u.open(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}, "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { u.end(s) })
+	if got := s.idleSince(); !got.Equal(clk.Now()) {
+		t.Fatalf("new session idle since %s, want %s", got, clk.Now())
+	}
+}
@@ -0,0 +1,62 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// ---------------------- Protocol Upgrades ----------------------
+// a request asking to switch protocols (Connection: Upgrade, as WebSocket
+// handshakes do) is forwarded like any other; when its backend answers 101
+// Switching Protocols the response is relayed and the client connection
+// stops being HTTP: from then on it is spliced to that backend connection
+// both ways, as in TCP mode, until either side closes. The socket is pinned
+// to the backend that accepted the upgrade for its whole life. Idle timeouts
+// still apply, -request-timeout does not. Upgrade requests are never hedged
+// or mirrored, since a second backend would accept a socket nobody uses.
+
+// isUpgrade reports whether hreq asks to switch protocols.
+func isUpgrade(hreq *http.Request) bool {
+	return hreq.Header.Get("Upgrade") != "" && headerHasToken(hreq.Header, "Connection", "upgrade")
+}
+
+// headerHasToken reports whether any comma separated value of h's key is
+// token, case-insensitively.
+func headerHasToken(h http.Header, key, token string) bool {
+	for _, v := range h.Values(key) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tunnel splices client, whose request up's backend switched protocols for,
+// to up until either side closes. br holds whatever the client sent after the
+// request.
+func (lb *LB) tunnel(req IncomingReq, br *bufio.Reader, up *upstream) {
+	log.Printf("req %s: switched to %s with %s", req.reqId, up.protocol, up.backend.Label())
+	client := lb.withIdleTimeouts(req.srcConn)
+	go func() {
+		_, err := io.Copy(up.rw, br)
+		if isTimeout(err) {
+			log.Printf("req %s: timeout client -> %s, closing", req.reqId, up.backend.Label())
+			_ = up.conn.Close()
+			_ = req.srcConn.Close()
+			return
+		}
+		if hc, ok := up.conn.(interface{ CloseWrite() error }); ok {
+			_ = hc.CloseWrite()
+		}
+	}()
+
+	_, err := io.Copy(client, up.br)
+	if isTimeout(err) {
+		log.Printf("req %s: timeout %s -> client, closing", req.reqId, up.backend.Label())
+	}
+}
@@ -0,0 +1,104 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ---------------------- Health Webhook ----------------------
+// with -health-webhook, every time a backend turns healthy or unhealthy (by
+// active checks, passive health or probation) the LB POSTs a JSON
+// HealthWebhookEvent to that URL, so alerts can be wired to it without
+// scraping logs. It is a state event subscriber: calls are made one at a
+// time in the order the changes happened, a failed or slow call is logged
+// and not retried, and changes that come faster than the webhook answers
+// are dropped past the subscriber buffer and reported in the next call's
+// missed count.
+
+const webhookTimeout = 5 * time.Second
+
+// backend states in HealthWebhookEvent
+const (
+	webhookHealthy   = "healthy"
+	webhookUnhealthy = "unhealthy"
+)
+
+type HealthWebhookEvent struct {
+	Backend  string    `json:"backend"`
+	ID       string    `json:"id"`
+	OldState string    `json:"old_state"`
+	NewState string    `json:"new_state"`
+	Reason   string    `json:"reason,omitempty"`
+	Time     time.Time `json:"time"`
+
+	// Missed is how many state events, health changes among them, were
+	// dropped since the previous call.
+	Missed int `json:"missed,omitempty"`
+}
+
+// checkWebhookURL validates a -health-webhook value.
+func checkWebhookURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("-health-webhook must be an http:// or https:// URL")
+	}
+	return nil
+}
+
+// runHealthWebhook calls -health-webhook for every health change on events;
+// started by Start when it is set.
+func (lb *LB) runHealthWebhook(events <-chan StateEvent) {
+	client := &http.Client{Timeout: webhookTimeout}
+	missed := 0
+	for {
+		var ev StateEvent
+		select {
+		case <-lb.stopping:
+			return
+		case ev = <-events:
+		}
+		missed += ev.Dropped
+		whe := HealthWebhookEvent{
+			Backend: ev.Backend,
+			ID:      ev.BackendID,
+			Reason:  ev.Detail,
+			Time:    ev.Time,
+			Missed:  missed,
+		}
+		switch ev.Kind {
+		case StateBackendUp:
+			whe.OldState, whe.NewState = webhookUnhealthy, webhookHealthy
+		case StateBackendDown:
+			whe.OldState, whe.NewState = webhookHealthy, webhookUnhealthy
+		default:
+			continue
+		}
+		missed = 0
+		if err := postWebhook(client, lb.cfg.HealthWebhook, whe); err != nil {
+			log.Printf("health webhook for %s (%s): %s", ev.Backend, whe.NewState, err)
+		}
+	}
+}
+
+func postWebhook(client *http.Client, target string, whe HealthWebhookEvent) error {
+	body, err := json.Marshal(whe)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"slices"
+	"sync/atomic"
+)
+
+// ---------------------- Zone-Aware Balancing ----------------------
+// backends may carry a zone label, and the LB knows its own (-zone). The zone
+// strategy keeps traffic in the LB's zone, spread by smooth weighted round
+// robin, and only sends it to other zones when the local backends can't take
+// it: all down, disabled or weighted 0, or, with -spill-at, all holding that
+// many active connections. Remote backends, unlabeled ones included, then
+// share the overflow the same way. Without -zone every backend counts as
+// local and this is plain wrr.
+
+type ZoneStrategy struct {
+	Backends []*Backend
+	zone     string
+	local    *SmoothWRRStrategy
+	remote   *SmoothWRRStrategy
+
+	spillAt int           // see StrategyConfig.SpillAt
+	spills  *atomic.Int64 // may be nil
+}
+
+// NewZoneStrategy prefers the backends in cfg.Zone.
+func NewZoneStrategy(backends []*Backend, cfg StrategyConfig) *ZoneStrategy {
+	s := &ZoneStrategy{
+		zone:    cfg.Zone,
+		local:   NewSmoothWRRStrategy(nil, StrategyConfig{}),
+		remote:  NewSmoothWRRStrategy(nil, StrategyConfig{}),
+		spillAt: cfg.SpillAt,
+		spills:  cfg.Spills,
+	}
+	s.Init(backends)
+	return s
+}
+
+func (s *ZoneStrategy) isLocal(b *Backend) bool { return s.zone == "" || b.Zone == s.zone }
+
+// Init splits the pool by locality, keeping both rotations.
+func (s *ZoneStrategy) Init(backends []*Backend) {
+	s.Backends = backends
+	var local, remote []*Backend
+	for _, b := range backends {
+		if s.isLocal(b) {
+			local = append(local, b)
+		} else {
+			remote = append(remote, b)
+		}
+	}
+	s.local.Init(local)
+	s.remote.Init(remote)
+}
+
+func (s *ZoneStrategy) RegisterBackend(backend *Backend) {
+	s.Init(append(s.Backends, backend))
+}
+
+func (s *ZoneStrategy) GetNextBackend(req IncomingReq) (*Backend, error) {
+	if len(s.Backends) == 0 {
+		return nil, ErrNoBackends
+	}
+	if !s.localFull() {
+		if b, err := s.local.GetNextBackend(req); err == nil {
+			return b, nil
+		}
+	}
+	if b, err := s.remote.GetNextBackend(req); err == nil {
+		if s.spills != nil && !req.lookup && s.localUp() {
+			s.spills.Add(1)
+		}
+		return b, nil
+	}
+	// no remote capacity either: busy local backends beat none
+	if b, err := s.local.GetNextBackend(req); err == nil {
+		return b, nil
+	}
+	return nil, ErrAllUnhealthy
+}
+
+// localUp reports whether any local backend could take traffic.
+func (s *ZoneStrategy) localUp() bool {
+	return slices.ContainsFunc(s.local.Backends, func(b *Backend) bool { return b.Available() && b.Weight > 0 })
+}
+
+// localFull reports whether -spill-at is set and every local backend that
+// could take traffic has reached it.
+func (s *ZoneStrategy) localFull() bool {
+	if s.spillAt <= 0 {
+		return false
+	}
+	return !slices.ContainsFunc(s.local.Backends, func(b *Backend) bool {
+		return b.Available() && b.Weight > 0 && b.ActiveConns < s.spillAt
+	})
+}
+
+// PrintTopology lists local and remote backends with their zones.
+func (s *ZoneStrategy) PrintTopology() {
+	zone := s.zone
+	if zone == "" {
+		zone = "(unset: every backend is local)"
+	}
+	fmt.Printf("lb zone %s\n", zone)
+	for _, part := range []struct {
+		name string
+		wrr  *SmoothWRRStrategy
+	}{{"local", s.local}, {"remote", s.remote}} {
+		fmt.Printf("%s:\n", part.name)
+		for _, b := range part.wrr.Backends {
+			fmt.Printf("  %-20s zone=%-12s w=%-3d conns=%d\n", b, b.Zone, b.Weight, b.ActiveConns)
+		}
+	}
+}